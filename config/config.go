@@ -1,11 +1,16 @@
 package config
 
 import (
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 
 	"github.com/vrischmann/envconfig"
 )
@@ -23,6 +28,15 @@ type LogConfig struct {
 
 	// Filter out all messages where errno=0
 	OnlyHTTPErrors bool `envconfig:"default=false"`
+
+	// log 1 in SampleRate requests where errno=0
+	SampleRate int `envconfig:"default=1"`
+
+	// always log requests that take longer in milliseconds, 0 disables it
+	SlowMS int `envconfig:"default=0"`
+
+	// Log metrics, ie: DB open latency
+	Metrics bool `envconfig:"default=false"`
 }
 
 // configures limits for web/SyncUserHandler
@@ -33,20 +47,216 @@ type UserHandlerConfig struct {
 	MaxPOSTBytes          int `envconfig:"default=2097152"`
 	MaxTotalRecords       int `envconfig:"default=1000"`
 	MaxTotalBytes         int `envconfig:"default=20971520"`
-	MaxBatchTTL           int `envconfig:"default=7200"`   // 2 hours
-	MaxRecordPayloadBytes int `envconfig:"default=262144"` // 256KB
+	MaxBatchTTL           int `envconfig:"default=7200"`    // 2 hours
+	MaxRecordPayloadBytes int `envconfig:"default=262144"`  // 256KB
+	MaxUserBytes          int `envconfig:"default=0"`       // quota, 0 is unlimited
+	MaxPOSTResults        int `envconfig:"default=0"`       // 0 is unlimited
+	MaxPagingRecords      int `envconfig:"default=0"`       // 0 is unlimited
+	MaxImportRecords      int `envconfig:"default=1000000"` // 0 is unlimited
+
+	// largest a gzip'd request body may decompress to,
+	// 0 uses MaxRequestBytes
+	MaxDecompressedBytes int `envconfig:"default=0"`
+
+	// limits of specific collections, ie: history.max_ttl=5184000
+	Collections CollectionLimits `envconfig:"optional"`
+}
+
+// configures sync 1.5 api behaviour of web/SyncUserHandler
+type SyncConfig struct {
+	// generate ids for POSTed BSOs that don't have one
+	AutoBSOIds bool `envconfig:"default=false"`
+
+	// allow fetching multiple collections with GET /storage?collections=a,b
+	MultiCollectionGET bool `envconfig:"default=false"`
+
+	// allow writing multiple collections with POST /storage
+	MultiCollectionPOST bool `envconfig:"default=false"`
+
+	// 404 on paths with a trailing slash instead of ignoring the slash
+	StrictSlash bool `envconfig:"default=false"`
+
+	// 400 batch POSTs whose X-Weave-Records or X-Weave-Total-Records do
+	// not match the BSOs sent
+	StrictRecordCounts bool `envconfig:"default=false"`
+
+	// 404 on GET of collections that were never written instead of []
+	CollectionNotFound bool `envconfig:"default=false"`
+
+	// sort order of GETs without a sort param: newest, oldest or index
+	DefaultSort string `envconfig:"default=newest"`
+
+	// send the modified time a BSO had before a PUT in
+	// X-Weave-Previous-Modified
+	PreviousModified bool `envconfig:"default=false"`
+
+	// response format for requests without an Accept header
+	DefaultAccept string `envconfig:"default=application/json"`
+
+	// minimum TTL in seconds for specific collections, ie: tabs:3600,forms:60
+	MinTTL CollectionTTLs `envconfig:"optional"`
+
+	// reject BSOs with a TTL below the minimum instead of raising it
+	MinTTLReject bool `envconfig:"default=false"`
+
+	// collections that can be read but not written, ie: during a migration
+	FrozenCollections []string `envconfig:"optional"`
+
+	// collections where BSOs must be written with a sortindex, ie: bookmarks
+	RequireSortIndex []string `envconfig:"optional"`
+
+	// collections left out of usage reporting and the quota, ie: keys,meta
+	UsageExclude []string `envconfig:"optional"`
+
+	// seconds to remember deleted and expired BSOs, 0 disables tombstones
+	TombstoneTTL int `envconfig:"default=0"`
+
+	// most expired BSOs removed from a collection when it is written,
+	// 0 disables it
+	PruneOnWrite int `envconfig:"default=0"`
+
+	// keep the modified time of BSOs written with an unchanged payload
+	SkipUnchanged bool `envconfig:"default=false"`
+
+	// seconds to keep POST responses for retries with the same
+	// Idempotency-Key, 0 disables it
+	IdempotencyTTL int `envconfig:"default=0"`
+
+	// most POST responses kept per user for IdempotencyTTL
+	IdempotencyKeys int `envconfig:"default=20"`
+}
+
+// CollectionTTLs maps collection names to a TTL in seconds. It is configured
+// as a comma separated list of name:seconds pairs
+type CollectionTTLs map[string]int
+
+func (c *CollectionTTLs) Unmarshal(s string) error {
+	ttls := make(CollectionTTLs)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("Invalid collection TTL %q, expected name:seconds", pair)
+		}
+
+		ttl, err := strconv.Atoi(parts[1])
+		if err != nil || ttl < 1 {
+			return errors.Errorf("Invalid TTL for %s, must be > 0", parts[0])
+		}
+
+		ttls[parts[0]] = ttl
+	}
+
+	*c = ttls
+	return nil
+}
+
+// CollectionLimit overrides the LIMIT_x values for a single collection.
+// Zero values use the LIMIT_x value
+type CollectionLimit struct {
+	MaxPOSTRecords        int
+	MaxRecordPayloadBytes int
+	MaxBSOGetLimit        int
+	DefaultTTL            int // seconds
+	MaxTTL                int // seconds
+}
+
+// CollectionLimits maps collection names to their limits. It is configured
+// as a comma separated list of name.limit=value, ie:
+// history.max_ttl=5184000,crypto.max_record_payload_bytes=4096
+type CollectionLimits map[string]CollectionLimit
+
+func (c *CollectionLimits) Unmarshal(s string) error {
+	limits := make(CollectionLimits)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		name := strings.SplitN(parts[0], ".", 2)
+		if len(parts) != 2 || len(name) != 2 || name[0] == "" {
+			return errors.Errorf("Invalid collection limit %q, expected name.limit=value", pair)
+		}
+
+		value, err := strconv.Atoi(parts[1])
+		if err != nil || value < 1 {
+			return errors.Errorf("Invalid %s for %s, must be > 0", name[1], name[0])
+		}
+
+		limit := limits[name[0]]
+		switch name[1] {
+		case "max_post_records":
+			limit.MaxPOSTRecords = value
+		case "max_record_payload_bytes":
+			limit.MaxRecordPayloadBytes = value
+		case "max_bso_get_limit":
+			limit.MaxBSOGetLimit = value
+		case "default_ttl":
+			limit.DefaultTTL = value
+		case "max_ttl":
+			limit.MaxTTL = value
+		default:
+			return errors.Errorf("Unknown collection limit %q", name[1])
+		}
+		limits[name[0]] = limit
+	}
+
+	*c = limits
+	return nil
 }
 
 type PoolConfig struct {
 	Num           int `envconfig:"default=0"`
 	MaxSize       int `envconfig:"default=25"`
+	EvictPercent  int `envconfig:"default=10"`
+	MaxOpenDBs    int `envconfig:"default=0"`
+	MinResidency  int `envconfig:"default=0"` // seconds
+	SlowAcquireMS int `envconfig:"default=0"`
+	MaxWriters    int `envconfig:"default=0"`
+	WriterWaitMS  int `envconfig:"default=1000"`
 	PurgeMinHours int `envconfig:"default=168"`
 	PurgeMaxHours int `envconfig:"default=336"`
 	VacuumKB      int `envconfig:"default=0"`
 }
 
+// serve HTTPS and HTTP/2 directly instead of behind a TLS terminating proxy.
+// available as TLS_x
+type TLSConfig struct {
+	CertFile   string `envconfig:"optional"`
+	KeyFile    string `envconfig:"optional"`
+	MinVersion string `envconfig:"default=1.2"` // 1.0, 1.1 or 1.2
+}
+
+// forward writes to a secondary server, ie: while migrating users.
+// available as MIRROR_x
+type MirrorConfig struct {
+	Upstream   string `envconfig:"optional"` // base URL, empty disables mirroring
+	QueueSize  int    `envconfig:"default=1000"`
+	MaxRetries int    `envconfig:"default=3"`
+}
+
+// write every change to a user's data for change data capture.
+// available as CHANGES_x
+type ChangesConfig struct {
+	File       string `envconfig:"optional"` // JSON lines, empty disables it
+	BufferSize int    `envconfig:"default=10000"`
+}
+
+// fail fast when the disk holding the DBs returns errors.
+// available as BREAKER_x
+type BreakerConfig struct {
+	Threshold int  `envconfig:"default=0"`  // disk errors in Window that trip it, 0 disables it
+	Window    int  `envconfig:"default=60"` // seconds
+	Cooldown  int  `envconfig:"default=30"` // seconds
+	FailReads bool `envconfig:"default=false"`
+}
+
 type SqliteConfig struct {
 	CacheSize int `envconfig:"default=0"`
+	MmapSize  int `envconfig:"default=0"` // bytes
+
+	// store and verify a hash of every BSO payload
+	PayloadHash bool `envconfig:"default=false"`
+
+	// off, normal, full or extra. Trades durability on power loss for
+	// write speed
+	Synchronous string `envconfig:"default=full"`
 }
 
 var Config struct {
@@ -54,23 +264,77 @@ var Config struct {
 	Hostname string `envconfig:"optional"`
 	Host     string `envconfig:"default=0.0.0.0"`
 	Port     int
-	Secrets  []string
-	DataDir  string
+	Secrets  []string `envconfig:"optional"`
+	DataDir  []string // comma separated, users are spread across them
 	Pool     *PoolConfig
 	Sqlite   *SqliteConfig
+	TLS      *TLSConfig
+	Mirror   *MirrorConfig
+	Changes  *ChangesConfig
+	Breaker  *BreakerConfig
+
+	// file with one secret per line so they are not in the environment
+	SecretsFile string `envconfig:"optional"`
+
+	// read PROXY protocol v1/v2 headers from the load balancer so
+	// request remote addresses are the real clients
+	ProxyProtocol bool `envconfig:"default=false"`
+
+	// go read only when DATA_DIR has less free space in MB, 0 disables
+	DataDirMinFreeMB int `envconfig:"default=0"`
+
+	// send HOSTNAME in an X-Weave-Node header on every response
+	NodeHeader bool `envconfig:"default=false"`
 
 	// Enable the pprof web endpoint /debug/pprof/
 	EnablePprof bool `envconfig:"default=false"`
 
+	// Enable /debug/pool listing the open handlers
+	EnableDebugPool bool `envconfig:"default=false"`
+
+	// Enable /debug/repair/{uid} to check and fix a user's DB
+	EnableDebugRepair bool `envconfig:"default=false"`
+
+	// Enable /debug/snapshot/{uid} to export a user's data
+	EnableDebugSnapshot bool `envconfig:"default=false"`
+
+	// bearer token a snapshot import must send, imports are off without it
+	DebugSnapshotImportToken string `envconfig:"optional"`
+
+	// Enable /debug/freeze/{uid} to set the collections a user can not write
+	EnableDebugFreeze bool `envconfig:"default=false"`
+
 	// SyncUserHandler limits / configuration
 	// available as LIMIT_x
 	Limit *UserHandlerConfig
 
+	// SyncUserHandler behaviour
+	// available as SYNC_x
+	Sync *SyncConfig
+
 	// cache size in MB for /info/collections cache
 	InfoCacheSize int `envconfig:"default=0"`
 
 	// max skew for hawk timestamps in seconds
 	HawkTimestampMaxSkew int `envconfig:"default=60"`
+
+	// longest Authorization header that will be parsed
+	HawkMaxAuthBytes int `envconfig:"default=4096"`
+
+	// log every request rejected by hawk auth with a reason code
+	HawkLogRejections bool `envconfig:"default=false"`
+
+	// most secrets a token is checked with, 0 is all of them
+	HawkMaxSecrets int `envconfig:"default=0"`
+
+	// max size of all request headers
+	MaxHeaderBytes int `envconfig:"default=65536"`
+
+	// reuse client connections for more than one request
+	KeepAlive bool `envconfig:"default=true"`
+
+	// connections open at once, more wait to be accepted. 0 is unlimited
+	MaxConnections int `envconfig:"default=0"`
 }
 
 // so we can use config.Port and not config.Config.Port
@@ -79,18 +343,58 @@ var (
 	Log         *LogConfig
 	Host        string
 	Port        int
-	DataDir     string
+	DataDir     []string
 	Secrets     []string
+	SecretsFile string
 	Pool        *PoolConfig
 	Sqlite      *SqliteConfig
+	TLS         *TLSConfig
+	Mirror      *MirrorConfig
+	Changes     *ChangesConfig
+	Breaker     *BreakerConfig
 	EnablePprof bool
 
+	ProxyProtocol bool
+	NodeHeader    bool
+
+	EnableDebugPool     bool
+	EnableDebugRepair   bool
+	EnableDebugSnapshot bool
+	EnableDebugFreeze   bool
+
+	DebugSnapshotImportToken string
+
 	Limit *UserHandlerConfig
+	Sync  *SyncConfig
 
+	DataDirMinFreeMB     int
 	InfoCacheSize        int
 	HawkTimestampMaxSkew int
+	HawkMaxAuthBytes     int
+	HawkLogRejections    bool
+	HawkMaxSecrets       int
+	MaxHeaderBytes       int
+	KeepAlive            bool
+	MaxConnections       int
 )
 
+// ReadSecretsFile reads one secret per line, blank lines are skipped
+func ReadSecretsFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if secret := strings.TrimSpace(line); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets, nil
+}
+
 func init() {
 	if err := envconfig.Init(&Config); err != nil {
 		log.Fatalf("Config Error: %s\n", err)
@@ -100,28 +404,92 @@ func init() {
 		log.Fatal("Config.Error: PORT invalid")
 	}
 
-	if Config.DataDir != ":memory:" {
-		if _, err := os.Stat(Config.DataDir); os.IsNotExist(err) {
-			log.Fatal("Config Error: DATA_DIR does not exist")
+	if Config.Log.SampleRate < 1 {
+		log.Fatal("LOG_SAMPLE_RATE must be >= 1")
+	}
+
+	if Config.Log.SlowMS < 0 {
+		log.Fatal("LOG_SLOW_MS must be >= 0")
+	}
+
+	if Config.SecretsFile != "" {
+		if len(Config.Secrets) > 0 {
+			log.Fatal("Config Error: SECRETS and SECRETS_FILE can not both be set")
 		}
 
-		stat, err := os.Stat(Config.DataDir)
+		secrets, err := ReadSecretsFile(Config.SecretsFile)
+		if err != nil {
+			log.Fatalf("Config Error: SECRETS_FILE %s", err)
+		}
+		Config.Secrets = secrets
+	}
+
+	if len(Config.Secrets) == 0 {
+		log.Fatal("Config Error: SECRETS or SECRETS_FILE required")
+	}
+
+	for i, dataDir := range Config.DataDir {
+		if dataDir == ":memory:" {
+			if len(Config.DataDir) > 1 {
+				log.Fatal("Config Error: DATA_DIR :memory: can not be used with other directories")
+			}
+			continue
+		}
+
+		stat, err := os.Stat(dataDir)
 		if os.IsNotExist(err) {
-			log.Fatal("Config Error: DATA_DIR does not exist")
+			log.Fatalf("Config Error: DATA_DIR %s does not exist", dataDir)
 		}
 		if !stat.IsDir() {
-			log.Fatal("Config Error: DATA_DIR is not a directory")
+			log.Fatalf("Config Error: DATA_DIR %s is not a directory", dataDir)
 		}
 
-		Config.DataDir = filepath.Clean(Config.DataDir)
-		testfile := Config.DataDir + string(os.PathSeparator) + "test.writable"
+		dataDir = filepath.Clean(dataDir)
+		testfile := dataDir + string(os.PathSeparator) + "test.writable"
 		f, err := os.Create(testfile)
 		if err != nil {
-			log.Fatal("Config Error: DATA_DIR is not writable")
+			log.Fatalf("Config Error: DATA_DIR %s is not writable", dataDir)
 		} else {
 			f.Close()
 			os.Remove(testfile)
 		}
+
+		Config.DataDir[i] = dataDir
+	}
+
+	if (Config.TLS.CertFile == "") != (Config.TLS.KeyFile == "") {
+		log.Fatal("Config Error: TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	switch Config.TLS.MinVersion {
+	case "1.0", "1.1", "1.2":
+	default:
+		log.Fatal("Config Error: TLS_MIN_VERSION must be [1.0, 1.1, 1.2]")
+	}
+
+	if Config.Mirror.Upstream != "" {
+		if u, err := url.Parse(Config.Mirror.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal("Config Error: MIRROR_UPSTREAM must be an http or https URL")
+		}
+	}
+	if Config.Mirror.QueueSize < 1 {
+		log.Fatal("Config Error: MIRROR_QUEUE_SIZE must be >= 1")
+	}
+	if Config.Mirror.MaxRetries < 0 {
+		log.Fatal("Config Error: MIRROR_MAX_RETRIES must be >= 0")
+	}
+
+	if Config.Changes.BufferSize < 1 {
+		log.Fatal("Config Error: CHANGES_BUFFER_SIZE must be >= 1")
+	}
+
+	if Config.Breaker.Threshold < 0 {
+		log.Fatal("Config Error: BREAKER_THRESHOLD must be >= 0")
+	}
+	if Config.Breaker.Window < 1 {
+		log.Fatal("Config Error: BREAKER_WINDOW must be >= 1")
+	}
+	if Config.Breaker.Cooldown < 1 {
+		log.Fatal("Config Error: BREAKER_COOLDOWN must be >= 1")
 	}
 
 	switch Config.Log.Level {
@@ -130,6 +498,24 @@ func init() {
 		log.Fatalf("Config Error: LOG_LEVEL must be [panic, fatal, error, warn, info, debug]")
 	}
 
+	switch strings.ToLower(Config.Sqlite.Synchronous) {
+	case "off", "normal", "full", "extra":
+	default:
+		log.Fatal("Config Error: SQLITE_SYNCHRONOUS must be [off, normal, full, extra]")
+	}
+
+	switch Config.Sync.DefaultSort {
+	case "newest", "oldest", "index":
+	default:
+		log.Fatal("Config Error: SYNC_DEFAULT_SORT must be [newest, oldest, index]")
+	}
+
+	switch Config.Sync.DefaultAccept {
+	case "application/json", "application/newlines":
+	default:
+		log.Fatal("Config Error: SYNC_DEFAULT_ACCEPT must be [application/json, application/newlines]")
+	}
+
 	if Config.Hostname == "" {
 		Config.Hostname, _ = os.Hostname()
 	}
@@ -160,10 +546,71 @@ func init() {
 		log.Fatal("LIMIT_MAX_RECORD_PAYLOAD_BYTES must be >= 1")
 	}
 
+	if Config.Limit.MaxUserBytes < 0 {
+		log.Fatal("LIMIT_MAX_USER_BYTES must be >= 0")
+	}
+	if Config.Limit.MaxPOSTResults < 0 {
+		log.Fatal("LIMIT_MAX_POST_RESULTS must be >= 0")
+	}
+	if Config.Limit.MaxPagingRecords < 0 {
+		log.Fatal("LIMIT_MAX_PAGING_RECORDS must be >= 0")
+	}
+	if Config.Limit.MaxImportRecords < 0 {
+		log.Fatal("LIMIT_MAX_IMPORT_RECORDS must be >= 0")
+	}
+
+	if Config.Limit.MaxDecompressedBytes < 0 {
+		log.Fatal("LIMIT_MAX_DECOMPRESSED_BYTES must be >= 0")
+	}
+	if Config.Limit.MaxDecompressedBytes == 0 {
+		Config.Limit.MaxDecompressedBytes = Config.Limit.MaxRequestBytes
+	}
+
+	if Config.Sqlite.MmapSize < 0 {
+		log.Fatal("SQLITE_MMAP_SIZE must be >= 0")
+	}
+
+	if Config.Sync.TombstoneTTL < 0 {
+		log.Fatal("SYNC_TOMBSTONE_TTL must be >= 0")
+	}
+
+	if Config.Sync.PruneOnWrite < 0 {
+		log.Fatal("SYNC_PRUNE_ON_WRITE must be >= 0")
+	}
+
+	if Config.Sync.IdempotencyTTL < 0 {
+		log.Fatal("SYNC_IDEMPOTENCY_TTL must be >= 0")
+	}
+	if Config.Sync.IdempotencyKeys < 1 {
+		log.Fatal("SYNC_IDEMPOTENCY_KEYS must be >= 1")
+	}
+
+	if Config.DataDirMinFreeMB < 0 {
+		log.Fatal("DATA_DIR_MIN_FREE_MB must be >= 0")
+	}
+
 	if Config.InfoCacheSize < 0 {
 		log.Fatal("INFO_CACHE_SIZE must be >= 0")
 	}
 
+	if Config.Pool.MaxOpenDBs < 0 {
+		log.Fatal("POOL_MAX_OPEN_DBS must be >= 0")
+	}
+	if Config.Pool.EvictPercent < 1 || Config.Pool.EvictPercent > 100 {
+		log.Fatal("POOL_EVICT_PERCENT must be between 1 and 100")
+	}
+	if Config.Pool.MinResidency < 0 {
+		log.Fatal("POOL_MIN_RESIDENCY must be >= 0")
+	}
+	if Config.Pool.SlowAcquireMS < 0 {
+		log.Fatal("POOL_SLOW_ACQUIRE_MS must be >= 0")
+	}
+	if Config.Pool.MaxWriters < 0 {
+		log.Fatal("POOL_MAX_WRITERS must be >= 0")
+	}
+	if Config.Pool.WriterWaitMS < 0 {
+		log.Fatal("POOL_WRITER_WAIT_MS must be >= 0")
+	}
 	if Config.Pool.VacuumKB < 0 {
 		log.Fatal("POOL_VACUUM_KB must be >= 0")
 	}
@@ -181,16 +628,56 @@ func init() {
 		log.Fatal("HAWK_TIMESTAMP_MAX_SKEW must be >= 60")
 	}
 
+	if Config.HawkMaxAuthBytes < 1 {
+		log.Fatal("HAWK_MAX_AUTH_BYTES must be >= 1")
+	}
+
+	if Config.HawkMaxSecrets < 0 {
+		log.Fatal("HAWK_MAX_SECRETS must be >= 0")
+	}
+
+	if Config.MaxHeaderBytes < Config.HawkMaxAuthBytes {
+		log.Fatal("MAX_HEADER_BYTES must be >= HAWK_MAX_AUTH_BYTES")
+	}
+
+	if Config.MaxConnections < 0 {
+		log.Fatal("MAX_CONNECTIONS must be >= 0")
+	}
+
+	if Config.DebugSnapshotImportToken != "" && !Config.EnableDebugSnapshot {
+		log.Fatal("DEBUG_SNAPSHOT_IMPORT_TOKEN requires ENABLE_DEBUG_SNAPSHOT")
+	}
+
 	Hostname = Config.Hostname
 	Log = Config.Log
 	Host = Config.Host
 	Port = Config.Port
 	Secrets = Config.Secrets
+	SecretsFile = Config.SecretsFile
 	DataDir = Config.DataDir
+	DataDirMinFreeMB = Config.DataDirMinFreeMB
 	Pool = Config.Pool
 	EnablePprof = Config.EnablePprof
+	EnableDebugPool = Config.EnableDebugPool
+	EnableDebugRepair = Config.EnableDebugRepair
+	EnableDebugSnapshot = Config.EnableDebugSnapshot
+	DebugSnapshotImportToken = Config.DebugSnapshotImportToken
+	EnableDebugFreeze = Config.EnableDebugFreeze
 	Limit = Config.Limit
+	Sync = Config.Sync
 	Sqlite = Config.Sqlite
+	TLS = Config.TLS
+	Mirror = Config.Mirror
+	Changes = Config.Changes
+	Breaker = Config.Breaker
+	ProxyProtocol = Config.ProxyProtocol
+	NodeHeader = Config.NodeHeader
 	InfoCacheSize = Config.InfoCacheSize
 	HawkTimestampMaxSkew = Config.HawkTimestampMaxSkew
+	HawkMaxAuthBytes = Config.HawkMaxAuthBytes
+	HawkLogRejections = Config.HawkLogRejections
+	HawkMaxSecrets = Config.HawkMaxSecrets
+	MaxHeaderBytes = Config.MaxHeaderBytes
+	KeepAlive = Config.KeepAlive
+	MaxConnections = Config.MaxConnections
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"go.mozilla.org/hawk"
@@ -15,6 +19,7 @@ import (
 	"github.com/mozilla-services/go-syncstorage/config"
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/mozilla-services/go-syncstorage/web"
+	"github.com/mozilla-services/go-syncstorage/web/changesink"
 )
 
 func init() {
@@ -45,42 +50,162 @@ func main() {
 	syncLimitConfig.MaxTotalRecords = config.Limit.MaxTotalRecords
 	syncLimitConfig.MaxBatchTTL = config.Limit.MaxBatchTTL * 1000
 	syncLimitConfig.MaxRecordPayloadBytes = config.Limit.MaxRecordPayloadBytes
+	syncLimitConfig.MaxUserBytes = config.Limit.MaxUserBytes
+	syncLimitConfig.MaxPOSTResults = config.Limit.MaxPOSTResults
+	syncLimitConfig.MaxPagingRecords = config.Limit.MaxPagingRecords
+	syncLimitConfig.MaxImportRecords = config.Limit.MaxImportRecords
+	syncLimitConfig.AutoBSOIds = config.Sync.AutoBSOIds
+	syncLimitConfig.MultiCollectionGET = config.Sync.MultiCollectionGET
+	syncLimitConfig.MultiCollectionPOST = config.Sync.MultiCollectionPOST
+	syncLimitConfig.StrictSlash = config.Sync.StrictSlash
+	syncLimitConfig.StrictRecordCounts = config.Sync.StrictRecordCounts
+	syncLimitConfig.MissingCollectionNotFound = config.Sync.CollectionNotFound
+	syncLimitConfig.DefaultSort, _ = web.ParseSortType(config.Sync.DefaultSort)
+	syncLimitConfig.DefaultAccept = config.Sync.DefaultAccept
+	syncLimitConfig.PreviousModifiedHeader = config.Sync.PreviousModified
+	syncLimitConfig.MinTTLs = config.Sync.MinTTL
+	syncLimitConfig.MinTTLReject = config.Sync.MinTTLReject
+	syncLimitConfig.RequireSortIndex = config.Sync.RequireSortIndex
+	syncLimitConfig.FrozenCollections = config.Sync.FrozenCollections
+	syncLimitConfig.UsageExclude = config.Sync.UsageExclude
+	syncLimitConfig.IdempotencyTTL = config.Sync.IdempotencyTTL
+	syncLimitConfig.IdempotencyKeys = config.Sync.IdempotencyKeys
+
+	syncLimitConfig.CollectionLimits = make(map[string]web.CollectionLimits)
+	for name, limit := range config.Limit.Collections {
+		syncLimitConfig.CollectionLimits[name] = web.CollectionLimits(limit)
+	}
+
+	var metrics web.Metrics
+	if config.Log.Metrics {
+		metrics = web.NewLogMetrics(log.StandardLogger())
+	}
+	syncLimitConfig.Metrics = metrics
+
+	// change data capture, written in the background so a slow disk
+	// does not hold up requests
+	var changes *web.ChangeBuffer
+	if config.Changes.File != "" {
+		f, err := os.OpenFile(config.Changes.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err.Error(),
+				"file": config.Changes.File,
+			}).Fatal("Could not open CHANGES_FILE")
+		}
+		defer f.Close()
+
+		changes = web.NewChangeBuffer(config.Changes.BufferSize, changesink.New(changesink.NewJSONLines(f)))
+		syncLimitConfig.Changes = changes
+	}
 
 	// The base functionality is the sync 1.5 api
 	poolHandler := web.NewSyncPoolHandler(&web.SyncPoolConfig{
-		Basepath:      config.DataDir,
-		NumPools:      config.Pool.Num,
-		MaxPoolSize:   config.Pool.MaxSize,
-		VacuumKB:      config.Pool.VacuumKB,
-		DBConfig:      &syncstorage.Config{config.Sqlite.CacheSize},
+		Basepaths:    config.DataDir,
+		NumPools:     config.Pool.Num,
+		MaxPoolSize:  config.Pool.MaxSize,
+		EvictPercent: config.Pool.EvictPercent,
+		MaxOpenDBs:   config.Pool.MaxOpenDBs,
+		MinResidency: time.Duration(config.Pool.MinResidency) * time.Second,
+		SlowAcquire:  time.Duration(config.Pool.SlowAcquireMS) * time.Millisecond,
+		MaxWriters:   config.Pool.MaxWriters,
+		WriterWait:   time.Duration(config.Pool.WriterWaitMS) * time.Millisecond,
+		VacuumKB:     config.Pool.VacuumKB,
+		DBConfig: &syncstorage.Config{
+			CacheSize:     config.Sqlite.CacheSize,
+			MmapSize:      config.Sqlite.MmapSize,
+			PayloadHash:   config.Sqlite.PayloadHash,
+			TombstoneTTL:  config.Sync.TombstoneTTL * 1000,
+			Synchronous:   config.Sqlite.Synchronous,
+			PruneOnWrite:  config.Sync.PruneOnWrite,
+			SkipUnchanged: config.Sync.SkipUnchanged,
+		},
 		PurgeMinHours: config.Pool.PurgeMinHours,
 		PurgeMaxHours: config.Pool.PurgeMaxHours,
+		Metrics:       metrics,
 	}, syncLimitConfig)
 
 	var router http.Handler
 	router = poolHandler
 
+	// fail fast instead of piling up requests on a failing disk
+	if config.Breaker.Threshold > 0 {
+		breaker := web.NewCircuitBreaker(router, config.Breaker.Threshold,
+			time.Duration(config.Breaker.Window)*time.Second,
+			time.Duration(config.Breaker.Cooldown)*time.Second)
+		breaker.FailReads = config.Breaker.FailReads
+		breaker.Metrics = metrics
+		router = breaker
+	}
+
+	// periodic maintenance jobs
+	scheduler := web.NewScheduler()
+
+	// stop writes before a full disk can corrupt the DBs
+	var diskMonitor *web.DiskMonitor
+	if config.DataDirMinFreeMB > 0 && config.DataDir[0] != ":memory:" {
+		diskMonitor = web.NewDiskMonitor(config.DataDir, uint64(config.DataDirMinFreeMB)*1024*1024)
+		diskMonitor.Check()
+		scheduler.Register("disk_monitor", 10*time.Second, 0, diskMonitor.Check)
+		router = web.NewReadOnlyHandler(router, diskMonitor)
+	}
+
+	scheduler.Start()
+
+	var cacheHandler *web.CacheHandler
 	if config.InfoCacheSize > 0 {
-		router = web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		cacheHandler = web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		router = cacheHandler
 	}
 
 	// legacy weave hacks
 	router = web.NewWeaveHandler(router)
 
+	// decompress gzip'd request bodies. Hawk payload hashes are calculated
+	// on the data as sent so this must sit after the HawkHandler
+	router = web.NewGzipRequestHandler(router, config.Limit.MaxDecompressedBytes)
+
+	// forward writes to a secondary server. Bodies are copied before they
+	// are decompressed so the Hawk payload hash still matches upstream
+	var mirror *web.Mirror
+	if config.Mirror.Upstream != "" {
+		mirrorConfig := web.NewDefaultMirrorConfig(config.Mirror.Upstream)
+		mirrorConfig.QueueSize = config.Mirror.QueueSize
+		mirrorConfig.MaxRetries = config.Mirror.MaxRetries
+		mirrorConfig.MaxBodyBytes = config.Limit.MaxRequestBytes
+		mirrorConfig.BatchTTL = time.Duration(config.Limit.MaxBatchTTL) * time.Second
+		mirrorConfig.Metrics = metrics
+		mirror = web.NewMirror(mirrorConfig)
+		router = web.NewMirrorHandler(router, mirror)
+	}
+
 	// All sync 1.5 access requires Hawk Authorization
-	router = web.NewHawkHandler(router, config.Secrets)
+	hawkHandler := web.NewHawkHandler(router, config.Secrets)
+	hawkHandler.MaxAuthBytes = config.HawkMaxAuthBytes
+	hawkHandler.MaxSecretsTried = config.HawkMaxSecrets
+	hawkHandler.Metrics = metrics
+	if config.HawkLogRejections {
+		hawkHandler.RejectLogger = log.StandardLogger()
+	}
+	router = hawkHandler
+
+	if config.SecretsFile != "" {
+		go reloadSecrets(hawkHandler, config.SecretsFile)
+	}
 
 	// Serve non sync 1.5 endpoints
-	router = web.NewInfoHandler(router)
+	infoHandler := web.NewInfoHandler(router)
+	infoHandler.DiskMonitor = diskMonitor
+	router = infoHandler
 
 	// Log all the things
 	if config.Log.DisableHTTP != true {
 		logHandler := web.NewLogHandler(log.StandardLogger(), router)
 
-		if config.Log.OnlyHTTPErrors {
-			h := logHandler.(*web.LoggingHandler)
-			h.OnlyHTTPErrors = true
-		}
+		h := logHandler.(*web.LoggingHandler)
+		h.OnlyHTTPErrors = config.Log.OnlyHTTPErrors
+		h.SampleRate = config.Log.SampleRate
+		h.SlowRequest = time.Duration(config.Log.SlowMS) * time.Millisecond
 
 		router = logHandler
 	}
@@ -90,10 +215,51 @@ func main() {
 		router = web.NewPprofHandler(router)
 	}
 
+	if config.EnableDebugPool {
+		log.Info("Enabling open handler list at /debug/pool")
+		router = web.NewPoolDebugHandler(router, poolHandler)
+	}
+
+	if config.EnableDebugRepair {
+		log.Info("Enabling DB repair at /debug/repair/{uid}")
+		router = web.NewRepairDebugHandler(router, poolHandler)
+	}
+
+	if config.EnableDebugSnapshot {
+		log.Info("Enabling user export at /debug/snapshot/{uid}")
+		snapshotHandler := web.NewSnapshotDebugHandler(router, poolHandler)
+		snapshotHandler.Cache = cacheHandler
+		if config.DebugSnapshotImportToken != "" {
+			log.Info("Enabling user import at /debug/snapshot/{uid}")
+			snapshotHandler.ImportToken = config.DebugSnapshotImportToken
+		}
+		router = snapshotHandler
+	}
+
+	if config.EnableDebugFreeze {
+		log.Info("Enabling per user frozen collections at /debug/freeze/{uid}")
+		router = web.NewFreezeDebugHandler(router, poolHandler)
+	}
+
+	if config.NodeHeader {
+		router = web.NewNodeHeaderHandler(router, config.Hostname)
+	}
+
 	listenOn := config.Host + ":" + strconv.Itoa(config.Port)
 	server := &http.Server{
-		Addr:    listenOn,
-		Handler: router,
+		Addr:           listenOn,
+		Handler:        router,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(config.KeepAlive)
+
+	// plain HTTP is the default for running behind a TLS terminating proxy
+	if config.TLS.CertFile != "" {
+		tlsConfig, err := web.NewTLSConfig(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.MinVersion)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		server.TLSConfig = tlsConfig
 	}
 
 	if config.Log.Mozlog {
@@ -116,8 +282,18 @@ func main() {
 	log.WithFields(log.Fields{
 		"addr":                           listenOn,
 		"PID":                            os.Getpid(),
+		"DATA_DIR_MIN_FREE_MB":           config.DataDirMinFreeMB,
+		"LOG_METRICS":                    config.Log.Metrics,
+		"LOG_SAMPLE_RATE":                config.Log.SampleRate,
+		"LOG_SLOW_MS":                    config.Log.SlowMS,
 		"POOL_NUM":                       config.Pool.Num,
 		"POOL_MAX_SIZE":                  config.Pool.MaxSize,
+		"POOL_EVICT_PERCENT":             config.Pool.EvictPercent,
+		"POOL_MAX_OPEN_DBS":              config.Pool.MaxOpenDBs,
+		"POOL_MIN_RESIDENCY":             fmt.Sprintf("%d seconds", config.Pool.MinResidency),
+		"POOL_SLOW_ACQUIRE_MS":           config.Pool.SlowAcquireMS,
+		"POOL_MAX_WRITERS":               config.Pool.MaxWriters,
+		"POOL_WRITER_WAIT_MS":            config.Pool.WriterWaitMS,
 		"POOL_VACUUM_KB":                 config.Pool.VacuumKB,
 		"POOL_PURGE_MIN_HOURS":           config.Pool.PurgeMinHours,
 		"POOL_PURGE_MAX_HOURS":           config.Pool.PurgeMaxHours,
@@ -129,15 +305,138 @@ func main() {
 		"LIMIT_MAX_REQUEST_BYTES":        syncLimitConfig.MaxRequestBytes,
 		"LIMIT_MAX_BATCH_TTL":            fmt.Sprintf("%d seconds", syncLimitConfig.MaxBatchTTL/1000),
 		"LIMIT_MAX_RECORD_PAYLOAD_BYTES": syncLimitConfig.MaxRecordPayloadBytes,
+		"LIMIT_MAX_USER_BYTES":           syncLimitConfig.MaxUserBytes,
+		"LIMIT_MAX_POST_RESULTS":         syncLimitConfig.MaxPOSTResults,
+		"LIMIT_MAX_PAGING_RECORDS":       syncLimitConfig.MaxPagingRecords,
+		"LIMIT_MAX_IMPORT_RECORDS":       syncLimitConfig.MaxImportRecords,
+		"LIMIT_MAX_DECOMPRESSED_BYTES":   config.Limit.MaxDecompressedBytes,
+		"LIMIT_COLLECTIONS":              config.Limit.Collections,
+		"SYNC_AUTO_BSO_IDS":              syncLimitConfig.AutoBSOIds,
+		"SYNC_MULTI_COLLECTION_GET":      syncLimitConfig.MultiCollectionGET,
+		"SYNC_MULTI_COLLECTION_POST":     syncLimitConfig.MultiCollectionPOST,
+		"SYNC_STRICT_SLASH":              syncLimitConfig.StrictSlash,
+		"SYNC_STRICT_RECORD_COUNTS":      syncLimitConfig.StrictRecordCounts,
+		"SYNC_COLLECTION_NOT_FOUND":      syncLimitConfig.MissingCollectionNotFound,
+		"SYNC_DEFAULT_SORT":              config.Sync.DefaultSort,
+		"SYNC_DEFAULT_ACCEPT":            config.Sync.DefaultAccept,
+		"SYNC_PREVIOUS_MODIFIED":         syncLimitConfig.PreviousModifiedHeader,
+		"SYNC_MIN_TTL":                   syncLimitConfig.MinTTLs,
+		"SYNC_MIN_TTL_REJECT":            syncLimitConfig.MinTTLReject,
+		"SYNC_REQUIRE_SORT_INDEX":        syncLimitConfig.RequireSortIndex,
+		"SYNC_FROZEN_COLLECTIONS":        syncLimitConfig.FrozenCollections,
+		"SYNC_USAGE_EXCLUDE":             syncLimitConfig.UsageExclude,
+		"SYNC_TOMBSTONE_TTL":             fmt.Sprintf("%d seconds", config.Sync.TombstoneTTL),
+		"SYNC_PRUNE_ON_WRITE":            config.Sync.PruneOnWrite,
+		"SYNC_SKIP_UNCHANGED":            config.Sync.SkipUnchanged,
+		"SYNC_IDEMPOTENCY_TTL":           fmt.Sprintf("%d seconds", syncLimitConfig.IdempotencyTTL),
+		"SYNC_IDEMPOTENCY_KEYS":          syncLimitConfig.IdempotencyKeys,
 		"SQLITE3_CACHE_SIZE":             config.Sqlite.CacheSize,
+		"SQLITE_MMAP_SIZE":               config.Sqlite.MmapSize,
+		"SQLITE_PAYLOAD_HASH":            config.Sqlite.PayloadHash,
+		"SQLITE_SYNCHRONOUS":             config.Sqlite.Synchronous,
 		"INFO_CACHE_SIZE":                config.InfoCacheSize,
 		"HAWK_TIMESTAMP_MAX_SKEW":        hawk.MaxTimestampSkew.Seconds(),
+		"HAWK_MAX_AUTH_BYTES":            config.HawkMaxAuthBytes,
+		"HAWK_LOG_REJECTIONS":            config.HawkLogRejections,
+		"HAWK_MAX_SECRETS":               config.HawkMaxSecrets,
+		"MAX_HEADER_BYTES":               config.MaxHeaderBytes,
+		"KEEP_ALIVE":                     config.KeepAlive,
+		"MAX_CONNECTIONS":                config.MaxConnections,
+		"SECRETS_FILE":                   config.SecretsFile,
+		"TLS_CERT_FILE":                  config.TLS.CertFile,
+		"TLS_MIN_VERSION":                config.TLS.MinVersion,
+		"PROXY_PROTOCOL":                 config.ProxyProtocol,
+		"NODE_HEADER":                    config.NodeHeader,
+		"MIRROR_UPSTREAM":                config.Mirror.Upstream,
+		"MIRROR_QUEUE_SIZE":              config.Mirror.QueueSize,
+		"MIRROR_MAX_RETRIES":             config.Mirror.MaxRetries,
+		"CHANGES_FILE":                   config.Changes.File,
+		"CHANGES_BUFFER_SIZE":            config.Changes.BufferSize,
+		"BREAKER_THRESHOLD":              config.Breaker.Threshold,
+		"BREAKER_WINDOW":                 fmt.Sprintf("%d seconds", config.Breaker.Window),
+		"BREAKER_COOLDOWN":               fmt.Sprintf("%d seconds", config.Breaker.Cooldown),
+		"BREAKER_FAIL_READS":             config.Breaker.FailReads,
 	}).Info("HTTP Listening at " + listenOn)
 
-	err := httpdown.ListenAndServe(server, hd)
+	err := listenAndServe(server, hd, config.MaxConnections, config.ProxyProtocol)
 	if err != nil {
 		log.Error(err.Error())
 	}
 
+	scheduler.Stop()
 	poolHandler.StopHTTP()
+
+	if mirror != nil {
+		mirror.Stop()
+	}
+
+	if changes != nil {
+		changes.Stop()
+	}
+}
+
+// reloadSecrets reads the secrets file again on SIGHUP so secrets can be
+// rotated without a restart
+func reloadSecrets(hawkHandler *web.HawkHandler, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		secrets, err := config.ReadSecretsFile(path)
+		if err == nil && len(secrets) == 0 {
+			err = fmt.Errorf("no secrets in %s", path)
+		}
+
+		if err != nil {
+			log.WithField("err", err.Error()).Error("Could not reload SECRETS_FILE, keeping the current secrets")
+			continue
+		}
+
+		hawkHandler.SetSecrets(secrets)
+		log.WithField("secrets", len(secrets)).Info("Reloaded SECRETS_FILE")
+	}
+}
+
+// listenAndServe is httpdown.ListenAndServe with the options of limiting
+// open connections and reading PROXY protocol headers from a load balancer
+// before TLS and HTTP
+func listenAndServe(server *http.Server, hd *httpdown.HTTP, maxConnections int, proxyProtocol bool) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	if maxConnections > 0 {
+		l = web.NewLimitListener(l, maxConnections)
+	}
+
+	if proxyProtocol {
+		l = web.NewProxyListener(l)
+	}
+
+	if server.TLSConfig != nil {
+		l = tls.NewListener(l, server.TLSConfig)
+	}
+
+	hs := hd.Serve(server, l)
+
+	waiterr := make(chan error, 1)
+	go func() {
+		defer close(waiterr)
+		waiterr <- hs.Wait()
+	}()
+
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-waiterr:
+		return err
+	case <-signals:
+		signal.Stop(signals)
+		if err := hs.Stop(); err != nil {
+			return err
+		}
+		return <-waiterr
+	}
 }
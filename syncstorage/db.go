@@ -1,7 +1,10 @@
 package syncstorage
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -29,9 +32,15 @@ var (
 	ErrInvalidSortIndex      = errors.New("Invalid Sort Index")
 	ErrInvalidTTL            = errors.New("Invalid TTL")
 
+	ErrInvalidCollectionVersion = errors.New("Invalid Collection Version")
+
 	ErrInvalidLimit  = errors.New("Invalid LIMIT")
 	ErrInvalidOffset = errors.New("Invalid OFFSET")
 	ErrInvalidNewer  = errors.New("Invalid NEWER than")
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	ErrKeysetSort    = errors.New("Keyset paging requires sort newest or oldest")
+
+	ErrPayloadHashMismatch = errors.New("Payload does not match its hash")
 )
 
 // dbTx allows passing of sql.DB or sql.Tx
@@ -54,6 +63,29 @@ const (
 	DEFAULT_BSO_TTL = 100 * 365 * 24 * 60 * 60 * 1000
 )
 
+// sortBits is how many bits of a SortType each sort of a CompoundSort uses
+const sortBits = 2
+
+// CompoundSort orders by each sort in turn, later sorts break ties of the
+// earlier ones, ie: CompoundSort(SORT_INDEX, SORT_NEWEST). A single sort is
+// the same as that SortType.
+func CompoundSort(sorts ...SortType) SortType {
+	var compound SortType
+	for i := len(sorts) - 1; i >= 0; i-- {
+		compound = compound<<sortBits | sorts[i]
+	}
+	return compound
+}
+
+// Sorts splits a SortType into the sorts it orders by
+func (s SortType) Sorts() []SortType {
+	var sorts []SortType
+	for ; s != SORT_NONE; s >>= sortBits {
+		sorts = append(sorts, s&(1<<sortBits-1))
+	}
+	return sorts
+}
+
 type CollectionInfo struct {
 	Name     string
 	BSOs     int
@@ -89,6 +121,54 @@ type GetResults struct {
 	Total  int
 	More   bool
 	Offset int
+
+	// size of all the matched payloads in bytes, not just the returned ones
+	Bytes int
+
+	// where keyset paging continues, only set by GetBSOsAfter when there
+	// are more results
+	Next *Cursor
+}
+
+// Cursor is the last BSO of a page of keyset paging. The next page is
+// found with the (modified, id) index instead of skipping over the earlier
+// rows like OFFSET does, so deep pages cost the same as the first one
+type Cursor struct {
+	Modified int
+	Id       string
+
+	// Paged is how many records were returned before the cursor
+	Paged int
+}
+
+// String encodes the cursor for clients, they should treat it as opaque
+func (c *Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(
+		strconv.Itoa(c.Modified) + "," + strconv.Itoa(c.Paged) + "," + c.Id))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), ",", 3)
+	if len(parts) != 3 || !BSOIdOk(parts[2]) {
+		return nil, ErrInvalidCursor
+	}
+
+	modified, err := strconv.Atoi(parts[0])
+	if err != nil || modified < 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	paged, err := strconv.Atoi(parts[1])
+	if err != nil || paged < 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Cursor{Modified: modified, Id: parts[2], Paged: paged}, nil
 }
 
 func (g *GetResults) String() string {
@@ -126,10 +206,64 @@ type DB struct {
 	Path string
 
 	db *sql.DB
+
+	// store a hash of each payload and verify it when reading
+	hashPayloads bool
+
+	// how long to keep tombstones in milliseconds, 0 disables them
+	tombstoneTTL int
+
+	// most expired BSOs removed from a collection on a write, 0 disables it
+	pruneOnWrite int
+
+	// writes that do not change a BSO keep its modified time
+	skipUnchanged bool
+
+	// the CollectionVersions table exists, it is created on first use
+	hasVersions bool
 }
 
 type Config struct {
 	CacheSize int
+
+	// MmapSize is the max bytes of the db file sqlite memory maps
+	// for reads. 0 disables memory mapping. Each open DB can map up
+	// to this much so total usage is MmapSize * open DBs
+	MmapSize int
+
+	// PayloadHash stores a hash of payloads on write and verifies it
+	// on read to detect silent data corruption. It costs storage and CPU
+	PayloadHash bool
+
+	// TombstoneTTL is how long, in milliseconds, deleted and expired BSOs
+	// are remembered. 0 disables tombstones
+	TombstoneTTL int
+
+	// Synchronous is sqlite's synchronous setting: off, normal, full or
+	// extra. Empty uses sqlite's default, full. With the WAL journal normal
+	// is much faster and a crash of the server loses nothing, but a power
+	// loss or OS crash can lose the most recent writes. The DB is not
+	// corrupted by either
+	Synchronous string
+
+	// PruneOnWrite is the most expired BSOs removed from a collection each
+	// time it is written so busy collections stay small between purges.
+	// 0 disables it
+	PruneOnWrite int
+
+	// SkipUnchanged keeps the modified time of a BSO that is written again
+	// with the same payload and sortindex so other clients do not download
+	// it again. Its TTL is still updated without touching the collection
+	SkipUnchanged bool
+}
+
+// SynchronousOk checks the Synchronous setting of a Config is valid
+func SynchronousOk(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "off", "normal", "full", "extra":
+		return true
+	}
+	return false
 }
 
 func (d *DB) OpenWithConfig(conf *Config) (err error) {
@@ -149,11 +283,24 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 	if conf != nil {
 		if log.GetLevel() == log.DebugLevel {
 			log.WithFields(log.Fields{
-				"cache_size": conf.CacheSize,
+				"cache_size":  conf.CacheSize,
+				"mmap_size":   conf.MmapSize,
+				"synchronous": conf.Synchronous,
 			}).Debug("db config")
 		}
 
 		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size=%d;", conf.CacheSize))
+
+		if conf.MmapSize > 0 {
+			pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size=%d;", conf.MmapSize))
+		}
+
+		if conf.Synchronous != "" {
+			if !SynchronousOk(conf.Synchronous) {
+				return errors.Errorf("Invalid synchronous setting: %s", conf.Synchronous)
+			}
+			pragmas = append(pragmas, fmt.Sprintf("PRAGMA synchronous=%s;", strings.ToUpper(conf.Synchronous)))
+		}
 	}
 
 	for _, p := range pragmas {
@@ -188,9 +335,93 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 		}
 	}
 
+	if err := d.addPayloadHashColumn(); err != nil {
+		return errors.Wrap(err, "Could not add PayloadHash column")
+	}
+
+	if conf != nil {
+		d.hashPayloads = conf.PayloadHash
+		d.tombstoneTTL = conf.TombstoneTTL
+		d.pruneOnWrite = conf.PruneOnWrite
+		d.skipUnchanged = conf.SkipUnchanged
+	}
+
+	if err := d.db.QueryRow(sqlCheck, "CollectionVersions").Scan(&name); err == nil {
+		d.hasVersions = true
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	if d.tombstoneTTL > 0 {
+		if _, err := d.db.Exec(schemaTombstones); err != nil {
+			return errors.Wrap(err, "Could not create Tombstones table")
+		}
+	}
+
 	return nil
 }
 
+// addPayloadHashColumn adds the BSO.PayloadHash column to DBs created before
+// it existed. It is always there so toggling Config.PayloadHash never leaves
+// stale hashes behind. An empty hash is never verified.
+func (d *DB) addPayloadHashColumn() error {
+	rows, err := d.db.Query("PRAGMA table_info(BSO)")
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     interface{}
+		)
+
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if name == "PayloadHash" {
+			found = true
+		}
+	}
+	rows.Close()
+
+	if found {
+		return nil
+	}
+
+	_, err = d.db.Exec("ALTER TABLE BSO ADD COLUMN PayloadHash TEXT NOT NULL DEFAULT ''")
+	return err
+}
+
+// payloadHash returns what is stored in BSO.PayloadHash for a payload
+func (d *DB) payloadHash(payload string) string {
+	if !d.hashPayloads {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPayload checks a payload read from the DB against its stored hash
+func (d *DB) verifyPayload(cId int, bId, payload, hash string) error {
+	if !d.hashPayloads || hash == "" || hash == d.payloadHash(payload) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"path": d.Path,
+		"cId":  cId,
+		"bId":  bId,
+	}).Error("BSO payload hash mismatch")
+
+	return ErrPayloadHashMismatch
+}
+
 func (d *DB) Open() (err error) {
 	return d.OpenWithConfig(nil)
 }
@@ -285,7 +516,11 @@ func (d *DB) GetCollectionId(name string) (id int, err error) {
 func (d *DB) GetCollectionModified(cId int) (modified int, err error) {
 	d.Lock()
 	defer d.Unlock()
-	err = d.db.QueryRow("SELECT modified FROM Collections where Id=?", cId).Scan(&modified)
+	return d.getCollectionModified(d.db, cId)
+}
+
+func (d *DB) getCollectionModified(tx dbTx, cId int) (modified int, err error) {
+	err = tx.QueryRow("SELECT modified FROM Collections where Id=?", cId).Scan(&modified)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
@@ -293,6 +528,10 @@ func (d *DB) GetCollectionModified(cId int) (modified int, err error) {
 	return
 }
 
+// CreateCollection adds a collection and returns its id. Ids are never
+// reused, Collections is AUTOINCREMENT and DeleteCollection only removes
+// BSOs, so a stale client can not write into a different collection with
+// an old id.
 func (d *DB) CreateCollection(name string) (cId int, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -326,7 +565,9 @@ func (d *DB) CreateCollection(name string) (cId int, err error) {
 	return int(cId64), nil
 }
 
-func (d *DB) DeleteCollection(cId int) (err error) {
+// DeleteCollection removes all the BSOs in a collection. With tombstones
+// enabled the collection is touched so incremental syncs see the deletes
+func (d *DB) DeleteCollection(cId int) (modified int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -335,14 +576,37 @@ func (d *DB) DeleteCollection(cId int) (err error) {
 		return
 	}
 
+	modified = Now()
+
+	if err = d.tombstoneBSOs(tx, cId, modified); err != nil {
+		tx.Rollback()
+		return
+	}
+
 	dmlB := "DELETE FROM BSO WHERE CollectionId=?"
 
-	if _, err := tx.Exec(dmlB, cId); err != nil {
+	if _, err = tx.Exec(dmlB, cId); err != nil {
 		tx.Rollback()
-		return err
+		return
 	}
 
-	tx.Commit()
+	if err = d.deleteCollectionVersions(tx, cId); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if d.tombstoneTTL > 0 {
+		err = d.touchCollection(tx, cId, modified)
+	} else {
+		err = bumpGeneration(tx)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
 	return
 }
 
@@ -352,14 +616,41 @@ func (d *DB) DeleteEverything() (err error) {
 	d.Lock()
 	defer d.Unlock()
 
+	tx, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	if err = d.tombstoneEverything(tx, Now()); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = d.deleteCollectionVersions(tx); err != nil {
+		tx.Rollback()
+		return
+	}
+
 	// delete all BSO data and keep the other metadata around
 	dml := `
 		DELETE FROM BSO;
 		INSERT OR REPLACE INTO KeyValues (Key, Value) VALUES ("DELETE_EVERYTHING_DATE", ?);
-		VACUUM;
 		`
-	_, err = d.db.Exec(dml, time.Now().Format(time.RFC3339))
-	return
+	if _, err = tx.Exec(dml, time.Now().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	// VACUUM can not run inside a transaction
+	if _, err = d.db.Exec("VACUUM"); err != nil {
+		return
+	}
+
+	return bumpGeneration(d.db)
 }
 
 func (d *DB) TouchCollection(cId, modified int) (err error) {
@@ -476,6 +767,52 @@ func (d *DB) InfoCollectionCounts() (map[string]int, error) {
 	return results, nil
 }
 
+// ChangedBSOIds finds the BSOs across all collections that were modified
+// after since and up to and including until. The results map collection
+// names to BSO ids, oldest change first. At most limit ids are returned,
+// next is the offset of the following page or 0 when there are no more.
+func (d *DB) ChangedBSOIds(since, until, limit, offset int) (results map[string][]string, next int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !LimitOk(limit) {
+		return nil, 0, ErrInvalidLimit
+	}
+
+	if !OffsetOk(offset) {
+		return nil, 0, ErrInvalidOffset
+	}
+
+	// one extra row tells if there is another page
+	query := `SELECT c.Name, b.Id
+			  FROM BSO b, Collections c
+			  WHERE b.CollectionId=c.Id AND b.Modified > ? AND b.Modified <= ? AND b.TTL > ?
+			  ORDER BY b.Modified ASC, b.CollectionId, b.Id
+			  LIMIT ? OFFSET ?`
+
+	rows, err := d.db.Query(query, since, until, Now(), limit+1, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+	results = make(map[string][]string)
+	for count := 0; rows.Next(); count++ {
+		if count == limit {
+			next = offset + limit
+			break
+		}
+
+		var name, bId string
+		if err = rows.Scan(&name, &bId); err != nil {
+			return nil, 0, err
+		}
+		results[name] = append(results[name], bId)
+	}
+
+	return results, next, rows.Err()
+}
+
 type PostBSOInput []*PutBSOInput
 type PutBSOInput struct {
 	Id        string  `json:"id"`
@@ -504,27 +841,96 @@ func (d *DB) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
 	modified := Now() // same modified timestamp for all INSERT/UPDATES
 	results := NewPostResults(modified)
 
+	// with SkipUnchanged a POST that wrote nothing leaves the
+	// collection's modified time alone
+	written, unchanged := 0, 0
+
 	for _, data := range input {
 		err := d.putBSO(tx, cId, data.Id, modified, data.Payload, data.SortIndex, data.TTL)
-		if err != nil {
+		if err == errUnchanged {
+			unchanged++
+			results.AddSuccess(data.Id)
+			continue
+		} else if err != nil {
+			// a full or failing disk is not a problem with the BSO. Nothing
+			// is written so the client can retry the whole POST later
+			if IsDiskError(err) {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "PostBSOs rolled back at BSO %s", data.Id)
+			}
+
 			results.AddFailure(data.Id, err.Error())
 			continue
 		} else {
+			written++
 			results.AddSuccess(data.Id)
 		}
 	}
 
-	// update the collection
-	err = d.touchCollection(tx, cId, modified)
-	if err != nil {
+	if err = d.pruneExpired(tx, cId); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
-	tx.Commit()
+	if unchanged > 0 && written == 0 {
+		if results.Modified, err = d.getCollectionModified(tx, cId); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	} else if err = d.touchCollection(tx, cId, modified); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
+// UpdateBSO changes the fields of an existing BSO that are not nil. It
+// returns ErrNotFound if the BSO does not exist or has expired.
+func (d *DB) UpdateBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (modified int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if payload == nil && sortIndex == nil && ttl == nil {
+		return 0, ErrNothingToDo
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	if _, err = d.getBSO(tx, cId, bId); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	modified = Now()
+	if err = d.putBSO(tx, cId, bId, modified, payload, sortIndex, ttl); err == errUnchanged {
+		// a refreshed TTL may still have been written
+		if modified, err = d.getCollectionModified(tx, cId); err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		return
+	} else if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = d.touchCollection(tx, cId, modified); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
 // PutBSO creates or updates a BSO
 func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (modified int, err error) {
 	d.Lock()
@@ -538,7 +944,20 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 	modified = Now()
 	err = d.putBSO(tx, cId, bId, modified, payload, sortIndex, ttl)
 
-	if err != nil {
+	if err == errUnchanged {
+		// a refreshed TTL may still have been written
+		if modified, err = d.getCollectionModified(tx, cId); err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		return
+	} else if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = d.pruneExpired(tx, cId); err != nil {
 		tx.Rollback()
 		return
 	}
@@ -581,6 +1000,80 @@ func (d *DB) GetBSOs(
 	return
 }
 
+// GetBSOsAfter is GetBSOs with keyset paging. It returns the BSOs that
+// come after the after cursor, or the first page when it is nil. Only
+// SORT_NEWEST and SORT_OLDEST can be used since the cursor is a
+// modified timestamp
+func (d *DB) GetBSOsAfter(
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	sort SortType,
+	limit int,
+	after *Cursor) (r *GetResults, err error) {
+
+	if sort != SORT_NEWEST && sort != SORT_OLDEST {
+		return nil, ErrKeysetSort
+	}
+
+	if after == nil {
+		after = &Cursor{}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	r, err = d.queryBSOs(d.db, cId, ids, older, newer, sort, limit, 0, after)
+
+	return
+}
+
+// GetCollectionsBSOs searches several collections in a single transaction so
+// the results are consistent with each other. Each collection returns up to
+// limit BSOs and no more than maxTotal are returned across all of them. The
+// results are in the same order as cIds.
+func (d *DB) GetCollectionsBSOs(
+	cIds []int,
+	older int,
+	newer int,
+	sort SortType,
+	limit int,
+	maxTotal int) (results []*GetResults, err error) {
+
+	d.Lock()
+	defer d.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results = make([]*GetResults, len(cIds))
+	remaining := maxTotal
+	for i, cId := range cIds {
+		if remaining <= 0 {
+			results[i] = &GetResults{BSOs: make([]*BSO, 0)}
+			continue
+		}
+
+		cLimit := limit
+		if cLimit > remaining {
+			cLimit = remaining
+		}
+
+		results[i], err = d.getBSOs(tx, cId, nil, older, newer, sort, cLimit, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining -= len(results[i].BSOs)
+	}
+
+	return
+}
+
 func (d *DB) GetBSOModified(cId int, bId string) (modified int, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -623,6 +1116,13 @@ func (d *DB) DeleteBSOs(cId int, bIds ...string) (modified int, err error) {
 		return
 	}
 
+	modified = Now()
+
+	if err = d.tombstoneBSOs(tx, cId, modified, bIds...); err != nil {
+		tx.Rollback()
+		return
+	}
+
 	dml := "DELETE FROM BSO WHERE CollectionId=? AND Id IN (?" +
 		strings.Repeat(",?", len(bIds)-1) + ")"
 
@@ -639,8 +1139,6 @@ func (d *DB) DeleteBSOs(cId int, bIds ...string) (modified int, err error) {
 		return
 	}
 
-	modified = Now()
-
 	// update the collection
 	err = d.touchCollection(tx, cId, modified)
 	if err != nil {
@@ -657,10 +1155,25 @@ func (d *DB) PurgeExpired() (removed int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.tombstoneExpired(tx); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
 	dmlBSO := "DELETE FROM BSO WHERE TTL <= ?"
-	r, err := d.db.Exec(dmlBSO, Now())
+	r, err := tx.Exec(dmlBSO, Now())
 
 	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
 
@@ -668,6 +1181,28 @@ func (d *DB) PurgeExpired() (removed int, err error) {
 	return int(purged), err
 }
 
+// pruneExpired removes up to Config.PruneOnWrite expired BSOs from a
+// collection that is being written, oldest first
+func (d *DB) pruneExpired(tx dbTx, cId int) error {
+	if d.pruneOnWrite <= 0 {
+		return nil
+	}
+
+	now := Now()
+	expired := "SELECT rowid FROM BSO WHERE CollectionId=? AND TTL <= ? ORDER BY TTL LIMIT ?"
+
+	if d.tombstoneTTL > 0 {
+		dml := `INSERT OR REPLACE INTO Tombstones (CollectionId, Id, Modified)
+				SELECT CollectionId, Id, TTL FROM BSO WHERE rowid IN (` + expired + `) AND TTL > ?`
+		if _, err := tx.Exec(dml, cId, now, d.pruneOnWrite, now-d.tombstoneTTL); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec("DELETE FROM BSO WHERE rowid IN ("+expired+")", cId, now, d.pruneOnWrite)
+	return err
+}
+
 func (d *DB) Usage() (stats *DBPageStats, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -749,7 +1284,29 @@ func (d *DB) Vacuum() (err error) {
 }
 
 func (d *DB) touchCollection(tx dbTx, cId, modified int) (err error) {
-	_, err = tx.Exec(`UPDATE Collections SET modified=? WHERE Id=?`, modified, cId)
+	if _, err = tx.Exec(`UPDATE Collections SET modified=? WHERE Id=?`, modified, cId); err != nil {
+		return
+	}
+	return bumpGeneration(tx)
+}
+
+// Generation counts the writes to the DB. Clients can compare it with the
+// one from their last sync to tell if anything changed without checking
+// every collection
+func (d *DB) Generation() (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	value, err := getKey(d.db, "GENERATION")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func bumpGeneration(tx dbTx) (err error) {
+	_, err = tx.Exec(`INSERT OR REPLACE INTO KeyValues (Key, Value) VALUES ("GENERATION",
+		COALESCE((SELECT CAST(Value AS INTEGER) FROM KeyValues WHERE Key="GENERATION"), 0) + 1)`)
 	return
 }
 
@@ -787,6 +1344,10 @@ func (d *DB) putBSO(tx dbTx,
 		return
 	}
 
+	if err = d.removeTombstone(tx, cId, bId); err != nil {
+		return
+	}
+
 	// Do an UPDATE or an INSERT
 	if exists == true {
 		var t *int
@@ -849,6 +1410,22 @@ func (d *DB) getBSOs(
 	limit int,
 	offset int) (*GetResults, error) {
 
+	return d.queryBSOs(tx, cId, ids, older, newer, sort, limit, offset, nil)
+}
+
+// queryBSOs is getBSOs with keyset paging when after is not nil. A zero
+// Cursor starts from the first page
+func (d *DB) queryBSOs(
+	tx dbTx,
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	sort SortType,
+	limit int,
+	offset int,
+	after *Cursor) (*GetResults, error) {
+
 	if !OffsetOk(offset) {
 		return nil, ErrInvalidOffset
 	}
@@ -862,7 +1439,7 @@ func (d *DB) getBSOs(
 	}
 
 	cutOffTTL := Now()
-	query := "SELECT Id, SortIndex, Payload, Modified, TTL FROM BSO "
+	query := "SELECT Id, SortIndex, Payload, PayloadHash, Modified, TTL FROM BSO "
 	where := "WHERE CollectionId=? AND Modified < ? AND Modified > ? AND TTL > ?"
 	values := []interface{}{cId, older, newer, cutOffTTL}
 
@@ -878,30 +1455,62 @@ func (d *DB) getBSOs(
 		}
 	}
 
+	var orderCols []string
+	for _, s := range sort.Sorts() {
+		switch s {
+		case SORT_INDEX:
+			orderCols = append(orderCols, "SortIndex DESC")
+		case SORT_NEWEST:
+			orderCols = append(orderCols, "Modified DESC")
+		case SORT_OLDEST:
+			orderCols = append(orderCols, "Modified ASC")
+		}
+	}
+
+	// the Id breaks ties so every BSO has a place after the cursor
+	if after != nil {
+		if sort == SORT_NEWEST {
+			orderCols = append(orderCols, "Id DESC")
+		} else {
+			orderCols = append(orderCols, "Id ASC")
+		}
+	}
+
 	orderBy := ""
-	if sort == SORT_INDEX {
-		orderBy = "ORDER BY SortIndex DESC "
-	} else if sort == SORT_NEWEST {
-		orderBy = "ORDER BY Modified DESC "
-	} else if sort == SORT_OLDEST {
-		orderBy = "ORDER BY Modified ASC "
+	if len(orderCols) > 0 {
+		orderBy = "ORDER BY " + strings.Join(orderCols, ", ") + " "
 	}
 
+	// payloads are TEXT so they need a cast for LENGTH to count bytes
+	countQuery := "SELECT COUNT(1) NumRows, COALESCE(SUM(LENGTH(CAST(Payload AS BLOB))), 0) FROM BSO " + where + " " + orderBy
+	var totalRows, totalBytes int
+
+	if err := tx.QueryRow(countQuery, values...).Scan(&totalRows, &totalBytes); err != nil {
+		return nil, err
+	}
+
+	if after != nil && after.Id != "" {
+		op := "<"
+		if sort == SORT_OLDEST {
+			op = ">"
+		}
+		where += fmt.Sprintf(" AND (Modified %s ? OR (Modified = ? AND Id %s ?))", op, op)
+		values = append(values, after.Modified, after.Modified, after.Id)
+	}
+
+	// keyset paging gets an extra row to tell if there are more
 	limitStmt := "LIMIT ?"
-	values = append(values, limit)
+	if after != nil {
+		values = append(values, limit+1)
+	} else {
+		values = append(values, limit)
+	}
 
 	if offset != 0 {
 		limitStmt += " OFFSET ?"
 		values = append(values, offset)
 	}
 
-	countQuery := "SELECT COUNT(1) NumRows FROM BSO " + where + " " + orderBy
-	var totalRows int
-
-	if err := tx.QueryRow(countQuery, values...).Scan(&totalRows); err != nil {
-		return nil, err
-	}
-
 	resultQuery := fmt.Sprintf("%s %s %s %s", query, where, orderBy, limitStmt)
 	rows, err := tx.Query(resultQuery, values...)
 
@@ -921,13 +1530,33 @@ func (d *DB) getBSOs(
 	bsos := make([]*BSO, 0)
 	for rows.Next() {
 		b := &BSO{}
-		if err := rows.Scan(&b.Id, &b.SortIndex, &b.Payload, &b.Modified, &b.TTL); err != nil {
+		var hash string
+		if err := rows.Scan(&b.Id, &b.SortIndex, &b.Payload, &hash, &b.Modified, &b.TTL); err != nil {
+			return nil, err
+		} else if err := d.verifyPayload(cId, b.Id, b.Payload, hash); err != nil {
 			return nil, err
 		} else {
 			bsos = append(bsos, b)
 		}
 	}
 
+	if after != nil {
+		results := &GetResults{
+			BSOs:  bsos,
+			Total: totalRows,
+			Bytes: totalBytes,
+		}
+
+		if len(bsos) > limit {
+			last := bsos[limit-1]
+			results.BSOs = bsos[:limit]
+			results.More = true
+			results.Next = &Cursor{Modified: last.Modified, Id: last.Id, Paged: after.Paged + limit}
+		}
+
+		return results, nil
+	}
+
 	nextOffset := 0
 	more := (totalRows > limit+offset)
 	if more {
@@ -939,6 +1568,7 @@ func (d *DB) getBSOs(
 		Total:  totalRows,
 		More:   more,
 		Offset: nextOffset,
+		Bytes:  totalBytes,
 	}
 
 	return results, nil
@@ -954,8 +1584,9 @@ func (d *DB) getBSO(tx dbTx, cId int, bId string) (*BSO, error) {
 
 	b := &BSO{Id: bId}
 
-	query := "SELECT SortIndex, Payload, Modified, TTL FROM BSO WHERE CollectionId=? and Id=? and TTL >= ?"
-	err := tx.QueryRow(query, cId, bId, Now()).Scan(&b.SortIndex, &b.Payload, &b.Modified, &b.TTL)
+	var hash string
+	query := "SELECT SortIndex, Payload, PayloadHash, Modified, TTL FROM BSO WHERE CollectionId=? and Id=? and TTL >= ?"
+	err := tx.QueryRow(query, cId, bId, Now()).Scan(&b.SortIndex, &b.Payload, &hash, &b.Modified, &b.TTL)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -965,6 +1596,10 @@ func (d *DB) getBSO(tx dbTx, cId int, bId string) (*BSO, error) {
 		return nil, err
 	}
 
+	if err := d.verifyPayload(cId, bId, b.Payload, hash); err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
 
@@ -979,15 +1614,15 @@ func (d *DB) insertBSO(
 ) (err error) {
 	_, err = tx.Exec(`INSERT INTO BSO (
 			CollectionId, Id, SortIndex,
-			PayLoad, PayLoadSize,
+			PayLoad, PayLoadSize, PayloadHash,
 			Modified, TTL)
 			VALUES (
 				?,?,?,
-				?,?,
+				?,?,?,
 				?,?
 			)`,
 		cId, bId, sortIndex,
-		payload, len(payload),
+		payload, len(payload), d.payloadHash(payload),
 		modified, modified+ttl)
 
 	if log.GetLevel() == log.DebugLevel {
@@ -1005,6 +1640,9 @@ func (d *DB) insertBSO(
 	return
 }
 
+// errUnchanged is returned when SkipUnchanged left nothing to write
+var errUnchanged = errors.New("BSO unchanged")
+
 // updateBSO updates a BSO. Values that are not provided (pointers)
 // are not updated in the SQL statement
 func (d *DB) updateBSO(
@@ -1021,7 +1659,43 @@ func (d *DB) updateBSO(
 		return
 	}
 
-	var values = make([]interface{}, 7)
+	if d.skipUnchanged {
+		var (
+			curPayload   string
+			curSortIndex int
+		)
+
+		query := "SELECT Payload, SortIndex FROM BSO WHERE CollectionId=? AND Id=? AND TTL > ?"
+		err = tx.QueryRow(query, cId, bId, Now()).Scan(&curPayload, &curSortIndex)
+		if err != nil && err != sql.ErrNoRows {
+			return
+		}
+
+		// expired BSOs are always rewritten
+		if err == nil {
+			if payload != nil && *payload == curPayload {
+				payload = nil
+			}
+			if sortIndex != nil && *sortIndex == curSortIndex {
+				sortIndex = nil
+			}
+
+			// a new TTL does not change what clients download so it is
+			// refreshed without touching the collection
+			if payload == nil && sortIndex == nil {
+				if ttl != nil {
+					dml := "UPDATE BSO SET TTL=? WHERE CollectionId=? AND Id=?"
+					if _, err = tx.Exec(dml, *ttl+modified, cId, bId); err != nil {
+						return
+					}
+				}
+				return errUnchanged
+			}
+		}
+		err = nil
+	}
+
+	var values = make([]interface{}, 8)
 	i := 0
 	set := ""
 
@@ -1037,11 +1711,13 @@ func (d *DB) updateBSO(
 		if i != 0 {
 			set = set + ","
 		}
-		set = set + "Payload=?, PayloadSize=?"
+		set = set + "Payload=?, PayloadSize=?, PayloadHash=?"
 		values[i] = *payload
 		i += 1
 		values[i] = len(*payload)
 		i += 1
+		values[i] = d.payloadHash(*payload)
+		i += 1
 	}
 
 	if sortIndex != nil {
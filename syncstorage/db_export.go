@@ -0,0 +1,323 @@
+package syncstorage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ExportVersion is the version of the format written by Export. Import
+// reads this version and older ones.
+const ExportVersion = 1
+
+var ErrInvalidExport = errors.New("Invalid export")
+
+// An export is gzip'd JSON, one value per line. The first line is an
+// exportHeader, each collection is followed by its BSOs. Collections are
+// identified by name so an export does not depend on the ids in a DB.
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+const exportFormat = "syncstorage"
+
+type exportRecord struct {
+	// one of Collection or BSO is set
+	Collection *exportCollection `json:"c,omitempty"`
+	BSO        *exportBSO        `json:"b,omitempty"`
+}
+
+type exportCollection struct {
+	Name     string `json:"name"`
+	Modified int    `json:"modified"`
+	Version  *int   `json:"version,omitempty"` // see SetCollectionVersion
+}
+
+type exportBSO struct {
+	Id        string `json:"id"`
+	SortIndex int    `json:"sortindex"`
+	Payload   string `json:"payload"`
+	Modified  int    `json:"modified"`
+	Expires   int    `json:"expires"` // milliseconds, not a TTL
+}
+
+// Export writes all the collections and unexpired BSOs in the DB to w.
+// Batches and tombstones are left out.
+func (d *DB) Export(w io.Writer) error {
+	d.Lock()
+	defer d.Unlock()
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	if err := enc.Encode(exportHeader{Format: exportFormat, Version: ExportVersion}); err != nil {
+		return err
+	}
+
+	query := "SELECT Id, Name, Modified, NULL FROM Collections WHERE Modified != 0 ORDER BY Id"
+	if d.hasVersions {
+		query = `SELECT c.Id, c.Name, c.Modified, v.Version FROM Collections c
+			LEFT JOIN CollectionVersions v ON v.CollectionId = c.Id
+			WHERE c.Modified != 0 ORDER BY c.Id`
+	}
+
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return errors.Wrap(err, "Could not export collections")
+	}
+
+	type collection struct {
+		id int
+		exportCollection
+	}
+
+	var collections []collection
+	for rows.Next() {
+		var c collection
+		var version sql.NullInt64
+		if err := rows.Scan(&c.id, &c.Name, &c.Modified, &version); err != nil {
+			rows.Close()
+			return err
+		}
+		if version.Valid {
+			v := int(version.Int64)
+			c.Version = &v
+		}
+		collections = append(collections, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := Now()
+	for _, c := range collections {
+		if err := enc.Encode(exportRecord{Collection: &c.exportCollection}); err != nil {
+			return err
+		}
+
+		if err := d.exportBSOs(enc, c.id, now); err != nil {
+			return errors.Wrapf(err, "Could not export %s", c.Name)
+		}
+	}
+
+	return gz.Close()
+}
+
+func (d *DB) exportBSOs(enc *json.Encoder, cId, now int) error {
+	rows, err := d.db.Query(
+		"SELECT Id, SortIndex, Payload, PayloadHash, Modified, TTL FROM BSO WHERE CollectionId=? AND TTL > ? ORDER BY Id",
+		cId, now)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b exportBSO
+		var hash string
+		if err := rows.Scan(&b.Id, &b.SortIndex, &b.Payload, &hash, &b.Modified, &b.Expires); err != nil {
+			return err
+		}
+
+		if err := d.verifyPayload(cId, b.Id, b.Payload, hash); err != nil {
+			return err
+		}
+
+		if err := enc.Encode(exportRecord{BSO: &b}); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ImportLimits are checked for every BSO in an import, BSOs that break
+// them are skipped. Zero is unlimited.
+type ImportLimits struct {
+	MaxPayloadBytes int // per BSO
+	MaxBytes        int // of all payloads, ie: the user's quota
+	MaxRecords      int // collections and BSOs read, including skipped ones
+
+	// collections that do not count towards MaxBytes
+	Exclude []string
+}
+
+func (l *ImportLimits) excluded(collection string) bool {
+	for _, name := range l.Exclude {
+		if name == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// reasons a BSO was skipped by Import
+const (
+	SkipPayloadTooLarge = "payload_too_large"
+	SkipOverQuota       = "over_quota"
+)
+
+type ImportSkipped struct {
+	Collection string `json:"collection"`
+	Id         string `json:"id"`
+	Reason     string `json:"reason"`
+}
+
+// ImportReport describes what Import wrote and what it left out
+type ImportReport struct {
+	Collections int             `json:"collections"`
+	BSOs        int             `json:"bsos"`
+	Bytes       int             `json:"bytes"` // counted towards MaxBytes
+	Skipped     []ImportSkipped `json:"skipped"`
+}
+
+// Import replaces all the data in the DB with an export from Export. BSOs
+// that do not fit in limits are skipped and listed in the report. The DB
+// is unchanged if the export is invalid.
+func (d *DB) Import(r io.Reader, limits *ImportLimits) (*ImportReport, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if limits == nil {
+		limits = &ImportLimits{}
+	}
+
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	dec := json.NewDecoder(gz)
+
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil || header.Format != exportFormat {
+		return nil, ErrInvalidExport
+	}
+
+	if header.Version < 1 || header.Version > ExportVersion {
+		return nil, errors.Wrapf(ErrInvalidExport, "Unsupported version %d", header.Version)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	hasVersions := d.hasVersions
+	report := &ImportReport{Skipped: []ImportSkipped{}}
+	if err := d.importRecords(tx, dec, limits, report); err != nil {
+		tx.Rollback()
+		d.hasVersions = hasVersions
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		d.hasVersions = hasVersions
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (d *DB) importRecords(tx *sql.Tx, dec *json.Decoder, limits *ImportLimits, report *ImportReport) error {
+	dml := "DELETE FROM BSO; DELETE FROM Batches; UPDATE Collections SET Modified=0;"
+	if d.tombstoneTTL > 0 {
+		dml += "DELETE FROM Tombstones;"
+	}
+
+	if _, err := tx.Exec(dml); err != nil {
+		return errors.Wrap(err, "Could not clear DB")
+	}
+
+	if err := d.deleteCollectionVersions(tx); err != nil {
+		return errors.Wrap(err, "Could not clear DB")
+	}
+
+	cId := 0
+	collection := ""
+	for records := 1; ; records++ {
+		var record exportRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return ErrInvalidExport
+		}
+
+		if limits.MaxRecords > 0 && records > limits.MaxRecords {
+			return errors.Wrapf(ErrInvalidExport, "More than %d records", limits.MaxRecords)
+		}
+
+		switch {
+		case record.Collection != nil:
+			c := record.Collection
+			if !CollectionNameOk(c.Name) {
+				return ErrInvalidCollectionName
+			}
+
+			err := tx.QueryRow("SELECT Id FROM Collections WHERE Name=?", c.Name).Scan(&cId)
+			if err == sql.ErrNoRows {
+				var result sql.Result
+				if result, err = tx.Exec("INSERT INTO Collections (Name, Modified) VALUES (?,?)", c.Name, c.Modified); err == nil {
+					var id int64
+					id, err = result.LastInsertId()
+					cId = int(id)
+				}
+			} else if err == nil {
+				err = d.touchCollection(tx, cId, c.Modified)
+			}
+
+			if err == nil && c.Version != nil {
+				err = d.setCollectionVersion(tx, cId, *c.Version)
+			}
+
+			if err != nil {
+				return errors.Wrapf(err, "Could not import %s", c.Name)
+			}
+
+			collection = c.Name
+			report.Collections++
+
+		case record.BSO != nil:
+			b := record.BSO
+			if cId == 0 {
+				return ErrInvalidExport
+			}
+
+			if !BSOIdOk(b.Id) {
+				return ErrInvalidBSOId
+			}
+
+			size := len(b.Payload)
+			counted := !limits.excluded(collection)
+
+			reason := ""
+			if limits.MaxPayloadBytes > 0 && size > limits.MaxPayloadBytes {
+				reason = SkipPayloadTooLarge
+			} else if limits.MaxBytes > 0 && counted && report.Bytes+size > limits.MaxBytes {
+				reason = SkipOverQuota
+			}
+
+			if reason != "" {
+				report.Skipped = append(report.Skipped, ImportSkipped{Collection: collection, Id: b.Id, Reason: reason})
+				continue
+			}
+
+			if err := d.insertBSO(tx, cId, b.Id, b.Modified, b.Payload, b.SortIndex, b.Expires-b.Modified); err != nil {
+				return errors.Wrapf(err, "Could not import BSO %s", b.Id)
+			}
+
+			report.BSOs++
+			if counted {
+				report.Bytes += size
+			}
+
+		default:
+			return ErrInvalidExport
+		}
+	}
+}
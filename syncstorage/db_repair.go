@@ -0,0 +1,106 @@
+package syncstorage
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// RepairReport describes what Repair found and fixed
+type RepairReport struct {
+	// problems reported by PRAGMA integrity_check before and after the
+	// repair, empty when the DB is ok
+	Integrity      []string `json:"integrity"`
+	IntegrityAfter []string `json:"integrity_after"`
+
+	// rows removed because their collection does not exist
+	OrphanedBSOs    int `json:"orphaned_bsos"`
+	OrphanedBatches int `json:"orphaned_batches"`
+
+	Reindexed bool `json:"reindexed"`
+}
+
+// Ok is true when the DB passed the integrity check after the repair
+func (r *RepairReport) Ok() bool {
+	return len(r.IntegrityAfter) == 0
+}
+
+// Repair checks the integrity of the DB, rebuilds its indexes and removes
+// BSOs and batches that reference collections that do not exist.
+func (d *DB) Repair() (*RepairReport, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	report := &RepairReport{}
+
+	var err error
+	if report.Integrity, err = d.integrityCheck(); err != nil {
+		return nil, err
+	}
+
+	if _, err := d.db.Exec("REINDEX"); err != nil {
+		return nil, errors.Wrap(err, "Could not reindex")
+	}
+	report.Reindexed = true
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if report.OrphanedBSOs, err = deleteOrphans(tx, "BSO"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if report.OrphanedBatches, err = deleteOrphans(tx, "Batches"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if report.IntegrityAfter, err = d.integrityCheck(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// integrityCheck returns the problems PRAGMA integrity_check finds. It
+// must be called with the DB locked.
+func (d *DB) integrityCheck() ([]string, error) {
+	rows, err := d.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not check integrity")
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+
+	return problems, rows.Err()
+}
+
+// deleteOrphans removes rows from table with a CollectionId
+// that is not in Collections
+func deleteOrphans(tx *sql.Tx, table string) (int, error) {
+	r, err := tx.Exec("DELETE FROM " + table + " WHERE CollectionId NOT IN (SELECT Id FROM Collections)")
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not remove orphaned %s rows", table)
+	}
+
+	removed, err := r.RowsAffected()
+	return int(removed), err
+}
@@ -1,7 +1,10 @@
 package syncstorage
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
@@ -9,6 +12,9 @@ import (
 	"testing"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	logtest "github.com/Sirupsen/logrus/hooks/test"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,6 +57,141 @@ func TestNewDB(t *testing.T) {
 
 }
 
+func TestNewDBMmapSize(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "mmapsize")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for i, testSize := range []int{0, 1 << 20, 64 << 20} {
+		db, err := NewDB(fmt.Sprintf("%s/%d.db", dir, i), &Config{MmapSize: testSize})
+		if !assert.NoError(err) {
+			return
+		}
+
+		var mmapsize sql.NullInt64
+		err = db.db.QueryRow("PRAGMA mmap_size;").Scan(&mmapsize)
+		if assert.NoError(err) && assert.True(mmapsize.Valid) {
+			assert.Equal(testSize, int(mmapsize.Int64))
+		}
+		db.Close()
+	}
+}
+
+func TestNewDBSynchronous(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "synchronous")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		setting string
+		value   int
+	}{
+		{"", 2}, // sqlite's default, full
+		{"off", 0},
+		{"normal", 1},
+		{"FULL", 2},
+		{"extra", 3},
+	} {
+		db, err := NewDB(fmt.Sprintf("%s/%d.db", dir, i), &Config{Synchronous: test.setting})
+		if !assert.NoError(err) {
+			return
+		}
+
+		var synchronous int
+		err = db.db.QueryRow("PRAGMA synchronous;").Scan(&synchronous)
+		if assert.NoError(err) {
+			assert.Equal(test.value, synchronous, test.setting)
+		}
+		db.Close()
+	}
+
+	_, err = NewDB(dir+"/invalid.db", &Config{Synchronous: "sometimes"})
+	assert.Error(err)
+}
+
+// BenchmarkSynchronousWrites shows the effect of synchronous on writes
+// to a file backed DB
+func BenchmarkSynchronousWrites(b *testing.B) {
+	dir, err := ioutil.TempDir("", "synchronouswrites")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := strings.Repeat("x", 1024)
+	for _, setting := range []string{"full", "normal"} {
+		b.Run(setting, func(b *testing.B) {
+			db, err := NewDB(dir+"/"+setting+".db", &Config{Synchronous: setting})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			cId, _ := db.GetCollectionId("bookmarks")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.PutBSO(cId, strconv.Itoa(i%500), &payload, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRepeatedReads shows the effect of cache_size and mmap_size
+// on reading the same BSOs over and over from a file backed DB
+func BenchmarkRepeatedReads(b *testing.B) {
+	configs := []struct {
+		name string
+		conf *Config
+	}{
+		{"nocache", &Config{CacheSize: 0}},
+		{"cache", &Config{CacheSize: -2000}},
+		{"mmap", &Config{MmapSize: 64 << 20}},
+		{"cache+mmap", &Config{CacheSize: -2000, MmapSize: 64 << 20}},
+	}
+
+	dir, err := ioutil.TempDir("", "repeatedreads")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := strings.Repeat("x", 1024)
+	for _, c := range configs {
+		b.Run(c.name, func(b *testing.B) {
+			db, err := NewDB(dir+"/"+c.name+".db", c.conf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			cId, _ := db.GetCollectionId("bookmarks")
+			for i := 0; i < 500; i++ {
+				if _, err := db.PutBSO(cId, strconv.Itoa(i), &payload, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetBSO(cId, strconv.Itoa(i%500)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 // TestStaticCollectionId ensures common collection
 // names are map to standard id numbers. It should also
 // save database looks ups for these as they are
@@ -480,6 +621,83 @@ func TestPrivateGetBSOsSort(t *testing.T) {
 	}
 }
 
+func TestGeneration(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	defer removeTestDB(db)
+
+	generation := func() int {
+		g, err := db.Generation()
+		assert.NoError(err)
+		return g
+	}
+
+	assert.Equal(0, generation())
+
+	payload := "x"
+	_, err := db.PutBSO(1, "b0", &payload, nil, nil)
+	assert.NoError(err)
+	assert.Equal(1, generation())
+
+	// reads do not change it
+	db.GetBSO(1, "b0")
+	db.InfoCollections()
+	assert.Equal(1, generation())
+
+	_, err = db.PostBSOs(1, PostBSOInput{NewPutBSOInput("b1", &payload, nil, nil)})
+	assert.NoError(err)
+	_, err = db.UpdateBSO(1, "b1", &payload, nil, nil)
+	assert.NoError(err)
+	_, err = db.DeleteBSOs(1, "b0")
+	assert.NoError(err)
+	assert.Equal(4, generation())
+
+	_, err = db.DeleteCollection(1)
+	assert.NoError(err)
+	assert.NoError(db.DeleteEverything())
+	assert.Equal(6, generation())
+}
+
+func TestPrivateGetBSOsCompoundSort(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	defer removeTestDB(db)
+
+	tx, _ := db.db.Begin()
+	defer tx.Rollback()
+
+	cId := 1
+	modified := Now()
+
+	assert.Nil(db.insertBSO(tx, cId, "b3", modified-3, "a", 1, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b2", modified-2, "a", 2, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b1", modified-1, "a", 1, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b0", modified, "a", 2, DEFAULT_BSO_TTL))
+
+	for sort, expected := range map[SortType][]string{
+		CompoundSort(SORT_INDEX, SORT_NEWEST): {"b0", "b2", "b1", "b3"},
+		CompoundSort(SORT_INDEX, SORT_OLDEST): {"b2", "b0", "b3", "b1"},
+		CompoundSort(SORT_OLDEST, SORT_INDEX): {"b3", "b2", "b1", "b0"},
+		CompoundSort(SORT_NEWEST):             {"b0", "b1", "b2", "b3"},
+	} {
+		results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, sort, 10, 0)
+		if assert.NoError(err) {
+			var ids []string
+			for _, b := range results.BSOs {
+				ids = append(ids, b.Id)
+			}
+			assert.Equal(expected, ids, "%v", sort.Sorts())
+		}
+	}
+
+	// a single sort is unchanged
+	assert.Equal(SORT_INDEX, CompoundSort(SORT_INDEX))
+	assert.Equal([]SortType{SORT_INDEX, SORT_NEWEST}, CompoundSort(SORT_INDEX, SORT_NEWEST).Sorts())
+	assert.Nil(SORT_NONE.Sorts())
+}
+
 // Regression test for bug that deleted BSOs in *all* collections
 func TestDeleteBSOsInCorrectCollection(t *testing.T) {
 	db, _ := getTestDB()
@@ -607,7 +825,7 @@ func TestDeleteCollection(t *testing.T) {
 			}
 		}
 
-		err = db.DeleteCollection(cId)
+		_, err = db.DeleteCollection(cId)
 
 		// make sure it was deleted
 		if assert.Nil(err) {
@@ -731,6 +949,257 @@ func TestInfoCollectionCounts(t *testing.T) {
 	}
 }
 
+func TestChangedBSOIds(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	put := func(cId int, bId string) int {
+		modified, err := db.PutBSO(cId, bId, String("x"), nil, nil)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+		return modified
+	}
+
+	put(1, "before")
+	since := put(1, "since") // excluded
+	put(1, "b0")
+	put(2, "b1")
+	until := put(3, "until") // included
+	put(3, "after")
+
+	results, next, err := db.ChangedBSOIds(since, until, 10, 0)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(map[string][]string{
+		"clients": []string{"b0"},
+		"crypto":  []string{"b1"},
+		"forms":   []string{"until"},
+	}, results)
+	assert.Equal(0, next)
+
+	// paged
+	results, next, err = db.ChangedBSOIds(since, until, 2, 0)
+	if assert.NoError(err) {
+		assert.Equal(map[string][]string{
+			"clients": []string{"b0"},
+			"crypto":  []string{"b1"},
+		}, results)
+		assert.Equal(2, next)
+	}
+
+	results, next, err = db.ChangedBSOIds(since, until, 2, next)
+	if assert.NoError(err) {
+		assert.Equal(map[string][]string{"forms": []string{"until"}}, results)
+		assert.Equal(0, next)
+	}
+
+	_, _, err = db.ChangedBSOIds(since, until, 0, 0)
+	assert.Equal(ErrInvalidLimit, err)
+}
+
+func TestPayloadHash(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{PayloadHash: true})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId := 1
+	for _, payload := range []string{"original", "updated"} {
+		_, err := db.PutBSO(cId, "b0", String(payload), nil, nil)
+		if !assert.NoError(err) {
+			return
+		}
+
+		bso, err := db.GetBSO(cId, "b0")
+		if assert.NoError(err) {
+			assert.Equal(payload, bso.Payload)
+		}
+	}
+
+	// tamper with the stored data
+	_, err = db.db.Exec("UPDATE BSO SET Payload='corrupted' WHERE Id='b0'")
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = db.GetBSO(cId, "b0")
+	assert.Equal(ErrPayloadHashMismatch, err)
+
+	_, err = db.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_NEWEST, 10, 0)
+	assert.Equal(ErrPayloadHashMismatch, err)
+
+	// without hashing it goes unnoticed
+	db.hashPayloads = false
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("corrupted", bso.Payload)
+	}
+}
+
+func TestBSOGone(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{TombstoneTTL: 50})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId := 1
+	gone := func(bId string) bool {
+		g, err := db.BSOGone(cId, bId)
+		assert.NoError(err)
+		return g
+	}
+
+	db.PutBSO(cId, "deleted", String("x"), nil, nil)
+	db.PutBSO(cId, "expired", String("x"), nil, Int(1))
+	db.PutBSO(cId, "recreated", String("x"), nil, nil)
+
+	db.DeleteBSOs(cId, "deleted", "recreated", "never")
+	db.PutBSO(cId, "recreated", String("x"), nil, nil)
+
+	// Now() rounds up to 10ms so wait long enough for the TTL to pass
+	time.Sleep(20 * time.Millisecond)
+
+	assert.True(gone("deleted"))
+	assert.True(gone("expired"))
+	assert.False(gone("recreated"))
+	assert.False(gone("never"))
+
+	// expired BSOs are remembered after they are purged
+	_, err = db.PurgeExpired()
+	assert.NoError(err)
+	assert.True(gone("expired"))
+
+	// and forgotten after the TombstoneTTL
+	time.Sleep(60 * time.Millisecond)
+	assert.False(gone("deleted"))
+	assert.False(gone("expired"))
+
+	_, err = db.PurgeExpired()
+	assert.NoError(err)
+	var count int
+	db.db.QueryRow("SELECT COUNT(1) FROM Tombstones").Scan(&count)
+	assert.Equal(0, count)
+
+	{ // disabled
+		db, _ := getTestDB()
+		db.PutBSO(cId, "deleted", String("x"), nil, nil)
+		db.DeleteBSOs(cId, "deleted")
+		g, err := db.BSOGone(cId, "deleted")
+		assert.NoError(err)
+		assert.False(g)
+	}
+}
+
+func TestGetTombstones(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{TombstoneTTL: 50})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId := 1
+	db.PutBSO(cId, "b0", String("x"), nil, nil)
+	db.PutBSO(cId, "b1", String("x"), nil, nil)
+	db.PutBSO(cId, "b2", String("x"), nil, nil)
+
+	deleted0, _ := db.DeleteBSOs(cId, "b0")
+	time.Sleep(15 * time.Millisecond)
+	deleted1, _ := db.DeleteBSOs(cId, "b1")
+
+	tombstones, err := db.GetTombstones(cId, nil, MaxTimestamp, 0)
+	if assert.NoError(err) && assert.Len(tombstones, 2) {
+		assert.Equal(Tombstone{"b0", deleted0}, tombstones[0])
+		assert.Equal(Tombstone{"b1", deleted1}, tombstones[1])
+	}
+
+	// incremental syncs only see newer deletes
+	tombstones, err = db.GetTombstones(cId, nil, MaxTimestamp, deleted0)
+	if assert.NoError(err) && assert.Len(tombstones, 1) {
+		assert.Equal("b1", tombstones[0].Id)
+	}
+
+	tombstones, err = db.GetTombstones(cId, []string{"b0", "b2"}, MaxTimestamp, 0)
+	if assert.NoError(err) && assert.Len(tombstones, 1) {
+		assert.Equal("b0", tombstones[0].Id)
+	}
+
+	// old tombstones are hidden and then garbage collected
+	time.Sleep(60 * time.Millisecond)
+	tombstones, err = db.GetTombstones(cId, nil, MaxTimestamp, 0)
+	assert.NoError(err)
+	assert.Len(tombstones, 0)
+
+	_, err = db.PurgeExpired()
+	assert.NoError(err)
+	var count int
+	db.db.QueryRow("SELECT COUNT(1) FROM Tombstones").Scan(&count)
+	assert.Equal(0, count)
+
+	{ // disabled
+		db, _ := getTestDB()
+		db.PutBSO(cId, "b0", String("x"), nil, nil)
+		db.DeleteBSOs(cId, "b0")
+		tombstones, err := db.GetTombstones(cId, nil, MaxTimestamp, 0)
+		assert.NoError(err)
+		assert.Len(tombstones, 0)
+	}
+
+	{ // deleting a collection touches it so the tombstones are seen
+		db, _ := NewDB(":memory:", &Config{TombstoneTTL: 60000})
+		before, _ := db.PutBSO(cId, "b0", String("x"), nil, nil)
+		generation, _ := db.Generation()
+		time.Sleep(10 * time.Millisecond)
+
+		modified, err := db.DeleteCollection(cId)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.True(modified > before)
+
+		cModified, _ := db.GetCollectionModified(cId)
+		assert.Equal(modified, cModified)
+		g, _ := db.Generation()
+		assert.Equal(generation+1, g)
+
+		tombstones, err := db.GetTombstones(cId, nil, MaxTimestamp, before)
+		if assert.NoError(err) {
+			assert.Equal([]Tombstone{{"b0", modified}}, tombstones)
+		}
+	}
+
+	{ // deleting everything tombstones every collection
+		db, _ := NewDB(":memory:", &Config{TombstoneTTL: 60000})
+		db.PutBSO(1, "b0", String("x"), nil, nil)
+		db.PutBSO(2, "b1", String("x"), nil, nil)
+		db.PutBSO(2, "expired", String("x"), nil, Int(1))
+		time.Sleep(10 * time.Millisecond)
+
+		if !assert.NoError(db.DeleteEverything()) {
+			return
+		}
+
+		for cId, bId := range map[int]string{1: "b0", 2: "b1"} {
+			tombstones, err := db.GetTombstones(cId, nil, MaxTimestamp, 0)
+			if assert.NoError(err) && assert.Len(tombstones, 1) {
+				assert.Equal(bId, tombstones[0].Id)
+			}
+
+			gone, err := db.BSOGone(cId, bId)
+			assert.NoError(err)
+			assert.True(gone)
+		}
+	}
+}
+
 func TestPutBSO(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -774,6 +1243,40 @@ func TestPutBSO(t *testing.T) {
 	assert.Equal(2, bso2.SortIndex)
 }
 
+func TestUpdateBSO(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	created, _ := db.PutBSO(cId, "b0", String("foo"), Int(1), Int(60000))
+	before, _ := db.GetBSO(cId, "b0")
+
+	time.Sleep(10 * time.Millisecond)
+
+	modified, err := db.UpdateBSO(cId, "b0", nil, Int(2), nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(modified > created)
+
+	cModified, _ := db.GetCollectionModified(cId)
+	assert.Equal(modified, cModified)
+
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("foo", bso.Payload)
+		assert.Equal(2, bso.SortIndex)
+		assert.Equal(modified, bso.Modified)
+		assert.Equal(before.TTL, bso.TTL)
+	}
+
+	_, err = db.UpdateBSO(cId, "nope", String("x"), nil, nil)
+	assert.Equal(ErrNotFound, err)
+
+	_, err = db.UpdateBSO(cId, "b0", nil, nil, nil)
+	assert.Equal(ErrNothingToDo, err)
+}
+
 func TestPostBSOs(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -915,9 +1418,39 @@ func TestGetBSOs(t *testing.T) {
 		assert.True(results.More)
 		assert.Equal("b2", results.BSOs[0].Id)
 		assert.Equal("b1", results.BSOs[1].Id)
+		assert.Equal(5*len("Hello"), results.Bytes)
 	}
 }
 
+func TestGetCollectionsBSOs(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	for cId := 1; cId <= 3; cId++ {
+		for i := 0; i < 3; i++ {
+			_, err := db.PutBSO(cId, "b"+strconv.Itoa(i), String("Hello"), nil, nil)
+			if !assert.NoError(err) {
+				return
+			}
+		}
+	}
+
+	results, err := db.GetCollectionsBSOs([]int{1, 2, 3}, MaxTimestamp, 0, SORT_NEWEST, 2, 5)
+	if !assert.NoError(err) || !assert.Len(results, 3) {
+		return
+	}
+
+	// limited per collection
+	assert.Len(results[0].BSOs, 2)
+	assert.Equal(3, results[0].Total)
+	assert.True(results[0].More)
+	assert.Len(results[1].BSOs, 2)
+
+	// and in total
+	assert.Len(results[2].BSOs, 1)
+	assert.True(results[2].More)
+}
+
 func TestGetBSOModified(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -1055,6 +1588,295 @@ func TestPurgeExpired(t *testing.T) {
 	}
 }
 
+func TestPruneOnWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{PruneOnWrite: 2, TombstoneTTL: 60000})
+	if !assert.NoError(err) {
+		return
+	}
+
+	rows := func(cId int) (count int) {
+		assert.NoError(db.db.QueryRow("SELECT COUNT(1) FROM BSO WHERE CollectionId=?", cId).Scan(&count))
+		return
+	}
+
+	// expired a second ago, oldest first
+	tx, _ := db.db.Begin()
+	modified := Now() - 1000
+	for i, bId := range []string{"b0", "b1", "b2"} {
+		assert.NoError(db.insertBSO(tx, 1, bId, modified+i, "x", 0, 1))
+	}
+	assert.NoError(db.insertBSO(tx, 2, "other", modified, "x", 0, 1))
+	assert.NoError(tx.Commit())
+
+	payload := "x"
+	_, err = db.PutBSO(1, "new0", &payload, nil, nil)
+	assert.NoError(err)
+	assert.Equal(2, rows(1)) // b2 and new0
+
+	gone, _ := db.BSOGone(1, "b0")
+	assert.True(gone, "pruned BSOs are tombstoned")
+
+	_, err = db.PostBSOs(1, PostBSOInput{NewPutBSOInput("new1", &payload, nil, nil)})
+	assert.NoError(err)
+	assert.Equal(2, rows(1)) // new0 and new1
+
+	// other collections are left for the purge
+	assert.Equal(1, rows(2))
+
+	// disabled
+	db.pruneOnWrite = 0
+	tx, _ = db.db.Begin()
+	assert.NoError(db.insertBSO(tx, 1, "b3", modified, "x", 0, 1))
+	assert.NoError(tx.Commit())
+	_, err = db.PutBSO(1, "new2", &payload, nil, nil)
+	assert.NoError(err)
+	assert.Equal(4, rows(1))
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{SkipUnchanged: true})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	payload := "same"
+	sortIndex := 1
+	modified, err := db.PutBSO(cId, "b0", &payload, &sortIndex, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	bso, err := db.GetBSO(cId, "b0")
+	if !assert.NoError(err) {
+		return
+	}
+	oldTTL := bso.TTL
+
+	generation, _ := db.Generation()
+
+	// identical payload and sortindex keep the modified time but update the TTL
+	time.Sleep(10 * time.Millisecond)
+	ttl := 100000
+	touched, err := db.PutBSO(cId, "b0", &payload, &sortIndex, &ttl)
+	assert.NoError(err)
+	assert.Equal(modified, touched)
+
+	bso, err = db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal(modified, bso.Modified)
+		assert.NotEqual(oldTTL, bso.TTL)
+		oldTTL = bso.TTL
+	}
+
+	// a TTL alone does not touch the collection either
+	time.Sleep(10 * time.Millisecond)
+	results, err := db.PostBSOs(cId, PostBSOInput{&PutBSOInput{Id: "b0", Payload: &payload, TTL: &ttl}})
+	if assert.NoError(err) {
+		assert.Equal(modified, results.Modified)
+	}
+	bso, err = db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.NotEqual(oldTTL, bso.TTL)
+	}
+	touched, err = db.UpdateBSO(cId, "b0", nil, nil, &ttl)
+	assert.NoError(err)
+	assert.Equal(modified, touched)
+
+	// writes that change nothing do not touch the collection
+	time.Sleep(10 * time.Millisecond)
+	results, err = db.PostBSOs(cId, PostBSOInput{&PutBSOInput{Id: "b0", Payload: &payload}})
+	if assert.NoError(err) {
+		assert.Equal(touched, results.Modified)
+		assert.Equal([]string{"b0"}, results.Success)
+	}
+	unchanged, err := db.PutBSO(cId, "b0", &payload, nil, nil)
+	assert.NoError(err)
+	assert.Equal(touched, unchanged)
+	unchanged, err = db.UpdateBSO(cId, "b0", nil, &sortIndex, nil)
+	assert.NoError(err)
+	assert.Equal(touched, unchanged)
+
+	info, err := db.InfoCollections()
+	if assert.NoError(err) {
+		assert.Equal(modified, info["bookmarks"])
+	}
+	g, _ := db.Generation()
+	assert.Equal(generation, g)
+
+	// a changed payload bumps it
+	time.Sleep(10 * time.Millisecond)
+	changed := "changed"
+	newModified, err := db.PutBSO(cId, "b0", &changed, nil, nil)
+	assert.NoError(err)
+	bso, err = db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal(newModified, bso.Modified)
+		assert.NotEqual(modified, bso.Modified)
+		assert.Equal(changed, bso.Payload)
+	}
+
+	// disabled
+	time.Sleep(10 * time.Millisecond)
+	db.skipUnchanged = false
+	modified, err = db.PutBSO(cId, "b0", &changed, nil, nil)
+	assert.NoError(err)
+	bso, err = db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal(modified, bso.Modified)
+		assert.NotEqual(newModified, bso.Modified)
+	}
+}
+
+func TestPostBSOsDiskFull(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	cId := 1
+
+	var pageSize, pageCount int
+	assert.NoError(db.db.QueryRow("PRAGMA page_size").Scan(&pageSize))
+	assert.NoError(db.db.QueryRow("PRAGMA page_count").Scan(&pageCount))
+
+	// room for about two of the BSOs before the disk is "full"
+	payload := strings.Repeat("x", 4*pageSize)
+	_, err := db.db.Exec(fmt.Sprintf("PRAGMA max_page_count=%d", pageCount+10))
+	if !assert.NoError(err) {
+		return
+	}
+
+	input := PostBSOInput{}
+	for i := 0; i < 5; i++ {
+		input = append(input, NewPutBSOInput(fmt.Sprintf("b%d", i), &payload, nil, nil))
+	}
+
+	results, err := db.PostBSOs(cId, input)
+	assert.Nil(results)
+	assert.True(IsDiskError(err), "Expected a disk error, got %v", err)
+
+	// none of them were written
+	var count int
+	assert.NoError(db.db.QueryRow("SELECT COUNT(1) FROM BSO").Scan(&count))
+	assert.Equal(0, count)
+
+	modified, err := db.GetCollectionModified(cId)
+	assert.NoError(err)
+	assert.Equal(0, modified)
+}
+
+func TestGetBSOsAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	cId := 1
+
+	tx, _ := db.db.Begin()
+	modified := Now()
+	for i := 0; i < 25; i++ {
+		assert.NoError(db.insertBSO(tx, cId, fmt.Sprintf("b%02d", i), modified+i*10, "x", 0, 10000))
+	}
+	assert.NoError(tx.Commit())
+
+	// records every query so the keyset ones can be checked for OFFSET
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	hook := logtest.NewGlobal()
+	defer func() {
+		log.SetLevel(level)
+		log.StandardLogger().Hooks = make(log.LevelHooks)
+	}()
+
+	ids := func(bsos []*BSO) (ids []string) {
+		for _, b := range bsos {
+			ids = append(ids, b.Id)
+		}
+		return
+	}
+
+	for _, sort := range []SortType{SORT_NEWEST, SORT_OLDEST} {
+		var byOffset, byKeyset []string
+
+		offset := 0
+		for pages := 0; pages < 5; pages++ {
+			r, err := db.GetBSOs(cId, nil, MaxTimestamp, 0, sort, 10, offset)
+			if !assert.NoError(err) {
+				return
+			}
+			byOffset = append(byOffset, ids(r.BSOs)...)
+			if offset = r.Offset; !r.More {
+				break
+			}
+		}
+
+		hook.Reset()
+		var after *Cursor
+		for pages := 0; pages < 5; pages++ {
+			r, err := db.GetBSOsAfter(cId, nil, MaxTimestamp, 0, sort, 10, after)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(25, r.Total)
+			byKeyset = append(byKeyset, ids(r.BSOs)...)
+			if after = r.Next; !r.More {
+				assert.Nil(after)
+				break
+			}
+			assert.Equal(10*(pages+1), after.Paged)
+
+			// cursors survive a round trip through clients
+			after, err = ParseCursor(after.String())
+			assert.NoError(err)
+		}
+
+		assert.Len(byKeyset, 25)
+		assert.Equal(byOffset, byKeyset)
+
+		queries := 0
+		for _, e := range hook.Entries {
+			if q, ok := e.Data["query"].(string); ok {
+				queries++
+				assert.NotContains(q, "OFFSET")
+			}
+		}
+		assert.Equal(3, queries)
+	}
+
+	// BSOs with the same modified time are not skipped at page boundaries
+	tx, _ = db.db.Begin()
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.insertBSO(tx, 2, fmt.Sprintf("t%d", i), modified, "x", 0, 10000))
+	}
+	assert.NoError(tx.Commit())
+
+	var (
+		tied  []string
+		after *Cursor
+	)
+	for pages := 0; pages < 5; pages++ {
+		r, err := db.GetBSOsAfter(2, nil, MaxTimestamp, 0, SORT_NEWEST, 2, after)
+		if !assert.NoError(err) {
+			return
+		}
+		tied = append(tied, ids(r.BSOs)...)
+		if after = r.Next; !r.More {
+			break
+		}
+	}
+	assert.Equal([]string{"t4", "t3", "t2", "t1", "t0"}, tied)
+
+	_, err := db.GetBSOsAfter(cId, nil, MaxTimestamp, 0, SORT_INDEX, 10, nil)
+	assert.Equal(ErrKeysetSort, err)
+
+	for _, bad := range []string{"", "!!", (&Cursor{Modified: -1, Id: "a"}).String(), (&Cursor{Paged: -1, Id: "a"}).String(), "MTIz"} {
+		_, err := ParseCursor(bad)
+		assert.Equal(ErrInvalidCursor, err, bad)
+	}
+}
+
 func TestOptimize(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -1137,3 +1959,241 @@ func TestGetSetKeyValue(t *testing.T) {
 		assert.Equal("12345", val)
 	}
 }
+
+func TestRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+
+	bookmarks, _ := db.GetCollectionId("bookmarks")
+	cId, _ := db.CreateCollection("orphaned")
+	db.PutBSO(bookmarks, "keep", String("ok"), nil, nil)
+	db.PutBSO(cId, "b0", String("lost"), nil, nil)
+	db.PutBSO(cId, "b1", String("lost"), nil, nil)
+	db.BatchCreate(cId, "")
+
+	// the collection disappears without its BSOs and batches
+	if _, err := db.db.Exec("DELETE FROM Collections WHERE Id=?", cId); !assert.NoError(err) {
+		return
+	}
+
+	report, err := db.Repair()
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.True(report.Ok())
+	assert.Empty(report.Integrity)
+	assert.True(report.Reindexed)
+	assert.Equal(2, report.OrphanedBSOs)
+	assert.Equal(1, report.OrphanedBatches)
+
+	var count int
+	db.db.QueryRow("SELECT count(*) FROM BSO").Scan(&count)
+	assert.Equal(1, count)
+
+	// nothing left to fix
+	report, err = db.Repair()
+	if assert.NoError(err) {
+		assert.Equal(0, report.OrphanedBSOs)
+		assert.Equal(0, report.OrphanedBatches)
+	}
+}
+
+func TestCollectionIdsNotReused(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+
+	cId, err := db.CreateCollection("col1")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// deleting a collection keeps its id
+	if _, err := db.DeleteCollection(cId); !assert.NoError(err) {
+		return
+	}
+	if id, err := db.GetCollectionId("col1"); assert.NoError(err) {
+		assert.Equal(cId, id)
+	}
+
+	// even when the row is gone the id is not handed out again
+	if _, err := db.db.Exec("DELETE FROM Collections WHERE Id=?", cId); !assert.NoError(err) {
+		return
+	}
+
+	newId, err := db.CreateCollection("col2")
+	if assert.NoError(err) {
+		assert.True(newId > cId, "expected an id > %d, got %d", cId, newId)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	src, _ := getTestDB()
+	bookmarks, _ := src.GetCollectionId("bookmarks")
+	custom, _ := src.CreateCollection("custom")
+	src.PutBSO(bookmarks, "b0", String("zero"), Int(5), nil)
+	src.PutBSO(bookmarks, "b1", String("one"), nil, Int(60000))
+	src.PutBSO(custom, "c0", String("custom"), nil, nil)
+	src.PutBSO(custom, "gone", String("expired"), nil, Int(1))
+	src.SetCollectionVersion(custom, 3)
+
+	// let "gone" expire
+	time.Sleep(20 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if !assert.NoError(src.Export(&buf)) {
+		return
+	}
+
+	// the destination has data of its own that is replaced
+	dst, _ := getTestDB()
+	other, _ := dst.CreateCollection("other")
+	dst.CreateCollection("custom")
+	dst.PutBSO(other, "o0", String("replaced"), nil, nil)
+
+	report, err := dst.Import(bytes.NewReader(buf.Bytes()), nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(&ImportReport{Collections: 2, BSOs: 3, Bytes: 13, Skipped: []ImportSkipped{}}, report)
+
+	srcInfo, _ := src.InfoCollections()
+	dstInfo, _ := dst.InfoCollections()
+	assert.Equal(srcInfo, dstInfo)
+
+	versions, _ := dst.CollectionVersions()
+	assert.Equal(map[string]int{"custom": 3}, versions)
+
+	for _, name := range []string{"bookmarks", "custom"} {
+		srcId, _ := src.GetCollectionId(name)
+		dstId, _ := dst.GetCollectionId(name)
+
+		expected, err := src.GetBSOs(srcId, nil, MaxTimestamp, 0, SORT_NONE, 100, 0)
+		if !assert.NoError(err) {
+			return
+		}
+		got, err := dst.GetBSOs(dstId, nil, MaxTimestamp, 0, SORT_NONE, 100, 0)
+		if assert.NoError(err) {
+			assert.Equal(expected.BSOs, got.BSOs, name)
+		}
+	}
+
+	otherId, _ := dst.GetCollectionId("other")
+	if bsos, err := dst.GetBSOs(otherId, nil, MaxTimestamp, 0, SORT_NONE, 100, 0); assert.NoError(err) {
+		assert.Len(bsos.BSOs, 0)
+	}
+
+	// invalid exports leave the DB alone
+	_, err = dst.Import(strings.NewReader("nope"), nil)
+	assert.Equal(ErrInvalidExport, err)
+	data := buf.Bytes()
+	_, err = dst.Import(bytes.NewReader(data[:len(data)/2]), nil)
+	assert.Error(err)
+	info, _ := dst.InfoCollections()
+	assert.Equal(srcInfo, info)
+}
+
+func TestImportLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	src, _ := getTestDB()
+	bookmarks, _ := src.GetCollectionId("bookmarks")
+	tabs, _ := src.GetCollectionId("tabs")
+	src.PutBSO(bookmarks, "b0", String("12345"), nil, nil)
+	src.PutBSO(bookmarks, "big", String(strings.Repeat("x", 100)), nil, nil)
+	src.PutBSO(bookmarks, "b1", String("12345"), nil, nil)
+	src.PutBSO(bookmarks, "b2", String("12345"), nil, nil)
+	src.PutBSO(tabs, "t0", String("12345"), nil, nil)
+
+	var buf bytes.Buffer
+	if !assert.NoError(src.Export(&buf)) {
+		return
+	}
+
+	dst, _ := getTestDB()
+	report, err := dst.Import(bytes.NewReader(buf.Bytes()), &ImportLimits{
+		MaxPayloadBytes: 10,
+		MaxBytes:        12,
+		Exclude:         []string{"tabs"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(&ImportReport{
+		Collections: 2,
+		BSOs:        3,
+		Bytes:       10,
+		Skipped: []ImportSkipped{
+			{Collection: "bookmarks", Id: "b2", Reason: SkipOverQuota},
+			{Collection: "bookmarks", Id: "big", Reason: SkipPayloadTooLarge},
+		},
+	}, report)
+
+	// skipped BSOs were not written
+	cId, _ := dst.GetCollectionId("bookmarks")
+	for _, bId := range []string{"big", "b2"} {
+		_, err := dst.GetBSO(cId, bId)
+		assert.Equal(ErrNotFound, err, bId)
+	}
+
+	// excluded collections are not over quota
+	cId, _ = dst.GetCollectionId("tabs")
+	_, err = dst.GetBSO(cId, "t0")
+	assert.NoError(err)
+
+	{ // too many records, skipped ones count too, rejects the whole import
+		dst, _ := getTestDB()
+		_, err := dst.Import(bytes.NewReader(buf.Bytes()), &ImportLimits{
+			MaxPayloadBytes: 10,
+			MaxRecords:      6,
+		})
+		assert.Equal(ErrInvalidExport, errors.Cause(err))
+
+		cId, _ := dst.GetCollectionId("bookmarks")
+		_, err = dst.GetBSO(cId, "b0")
+		assert.Equal(ErrNotFound, err)
+
+		// 2 collections and 5 BSOs
+		_, err = dst.Import(bytes.NewReader(buf.Bytes()), &ImportLimits{MaxRecords: 7})
+		assert.NoError(err)
+	}
+}
+
+func TestCollectionVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	bookmarks, _ := db.GetCollectionId("bookmarks")
+	tabs, _ := db.GetCollectionId("tabs")
+
+	_, err := db.GetCollectionVersion(bookmarks)
+	assert.Equal(ErrNotFound, err)
+
+	assert.NoError(db.SetCollectionVersion(bookmarks, 1))
+	assert.NoError(db.SetCollectionVersion(bookmarks, 2))
+	assert.NoError(db.SetCollectionVersion(tabs, 0))
+	assert.Equal(ErrInvalidCollectionVersion, db.SetCollectionVersion(tabs, -1))
+
+	version, err := db.GetCollectionVersion(bookmarks)
+	assert.NoError(err)
+	assert.Equal(2, version)
+
+	versions, err := db.CollectionVersions()
+	assert.NoError(err)
+	assert.Equal(map[string]int{"bookmarks": 2, "tabs": 0}, versions)
+
+	// the version goes with the data
+	_, err = db.DeleteCollection(tabs)
+	assert.NoError(err)
+	versions, _ = db.CollectionVersions()
+	assert.Equal(map[string]int{"bookmarks": 2}, versions)
+
+	assert.NoError(db.DeleteEverything())
+	versions, _ = db.CollectionVersions()
+	assert.Len(versions, 0)
+}
@@ -0,0 +1,182 @@
+package syncstorage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// Tombstones remember BSOs that were deleted or expired for
+// Config.TombstoneTTL milliseconds so they can be told apart from BSOs that
+// never existed. The table is only created when tombstones are enabled.
+const schemaTombstones = `
+	CREATE TABLE IF NOT EXISTS Tombstones (
+		CollectionId	INTEGER NOT NULL,
+		Id				VARCHAR(64) NOT NULL,
+
+		-- when the BSO was deleted or expired, in milliseconds
+		Modified		INTEGER NOT NULL,
+
+		PRIMARY KEY (CollectionId, Id)
+	);
+	`
+
+// BSOGone checks if a BSO that can not be found was deleted or expired within
+// the last Config.TombstoneTTL. It is always false when tombstones are disabled.
+func (d *DB) BSOGone(cId int, bId string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.tombstoneTTL <= 0 {
+		return false, nil
+	}
+
+	now := Now()
+	cutOff := now - d.tombstoneTTL
+
+	var found int
+	query := `SELECT 1 FROM Tombstones WHERE CollectionId=? AND Id=? AND Modified > ?
+			  UNION ALL
+			  SELECT 1 FROM BSO WHERE CollectionId=? AND Id=? AND TTL <= ? AND TTL > ?`
+	err := d.db.QueryRow(query, cId, bId, cutOff, cId, bId, now, cutOff).Scan(&found)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// tombstoneBSOs records tombstones for the BSOs in a collection that are
+// about to be deleted. With no bIds the whole collection is being deleted.
+func (d *DB) tombstoneBSOs(tx dbTx, cId int, modified int, bIds ...string) error {
+	if d.tombstoneTTL <= 0 {
+		return nil
+	}
+
+	dml := `INSERT OR REPLACE INTO Tombstones (CollectionId, Id, Modified)
+			SELECT CollectionId, Id, ? FROM BSO WHERE CollectionId=? AND TTL > ?`
+	values := []interface{}{modified, cId, Now()}
+
+	if len(bIds) > 0 {
+		dml += " AND Id IN (?" + strings.Repeat(",?", len(bIds)-1) + ")"
+		for _, bId := range bIds {
+			values = append(values, bId)
+		}
+	}
+
+	_, err := tx.Exec(dml, values...)
+	return err
+}
+
+// tombstoneEverything records tombstones for every BSO of every collection
+// before DeleteEverything removes them
+func (d *DB) tombstoneEverything(tx dbTx, modified int) error {
+	if d.tombstoneTTL <= 0 {
+		return nil
+	}
+
+	dml := `INSERT OR REPLACE INTO Tombstones (CollectionId, Id, Modified)
+			SELECT CollectionId, Id, ? FROM BSO WHERE TTL > ?`
+	_, err := tx.Exec(dml, modified, Now())
+	return err
+}
+
+// tombstoneExpired records tombstones for expired BSOs that are about to be
+// purged and removes tombstones older than the TombstoneTTL
+func (d *DB) tombstoneExpired(tx dbTx) error {
+	if d.tombstoneTTL <= 0 {
+		return nil
+	}
+
+	now := Now()
+	cutOff := now - d.tombstoneTTL
+
+	dml := `INSERT OR REPLACE INTO Tombstones (CollectionId, Id, Modified)
+			SELECT CollectionId, Id, TTL FROM BSO WHERE TTL <= ? AND TTL > ?`
+	if _, err := tx.Exec(dml, now, cutOff); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("DELETE FROM Tombstones WHERE Modified <= ?", cutOff)
+	return err
+}
+
+// removeTombstone forgets a BSO was deleted when it is written again
+func (d *DB) removeTombstone(tx dbTx, cId int, bId string) error {
+	if d.tombstoneTTL <= 0 {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM Tombstones WHERE CollectionId=? AND Id=?", cId, bId)
+	return err
+}
+
+// Tombstone marks a BSO that was deleted or expired. Modified is when it
+// happened so clients doing incremental syncs with newer= see the deletion
+type Tombstone struct {
+	Id       string
+	Modified int
+}
+
+// MarshalJSON formats a Tombstone like a BSO without a payload
+func (t Tombstone) MarshalJSON() ([]byte, error) {
+	id, err := json.Marshal(t.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(`{"id":` + string(id) +
+		`,"modified":` + ModifiedToString(t.Modified) +
+		`,"deleted":true}`), nil
+}
+
+// GetTombstones returns the tombstones in a collection modified after newer
+// and before older, oldest first. When ids are provided only those are
+// returned. Tombstones older than the TombstoneTTL are never returned even
+// if they have not been garbage collected yet
+func (d *DB) GetTombstones(cId int, ids []string, older, newer int) ([]Tombstone, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	tombstones := []Tombstone{}
+	if d.tombstoneTTL <= 0 {
+		return tombstones, nil
+	}
+
+	if cutOff := Now() - d.tombstoneTTL; newer < cutOff {
+		newer = cutOff
+	}
+
+	query := "SELECT Id, Modified FROM Tombstones WHERE CollectionId=? AND Modified > ? AND Modified < ?"
+	values := []interface{}{cId, newer, older}
+
+	if len(ids) > 0 {
+		query += " AND Id IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+		for _, id := range ids {
+			values = append(values, id)
+		}
+	}
+
+	query += " ORDER BY Modified ASC"
+
+	rows, err := d.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Tombstone
+		if err := rows.Scan(&t.Id, &t.Modified); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, t)
+	}
+
+	return tombstones, rows.Err()
+}
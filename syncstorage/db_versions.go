@@ -0,0 +1,113 @@
+package syncstorage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// CollectionVersions records the payload format version clients say a
+// collection's data is in. The server never looks at payloads, it only
+// keeps the version for clients deciding when to migrate their data. The
+// table is only created when a version is first set.
+const schemaCollectionVersions = `
+	CREATE TABLE IF NOT EXISTS CollectionVersions (
+		CollectionId	INTEGER NOT NULL,
+		Version			INTEGER NOT NULL,
+
+		PRIMARY KEY (CollectionId)
+	);
+	`
+
+// GetCollectionVersion returns the format version of a collection,
+// ErrNotFound when it was never set
+func (d *DB) GetCollectionVersion(cId int) (version int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.hasVersions {
+		return 0, ErrNotFound
+	}
+
+	err = d.db.QueryRow("SELECT Version FROM CollectionVersions WHERE CollectionId=?", cId).Scan(&version)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// SetCollectionVersion records the format version of a collection. It is
+// forgotten when the collection is deleted.
+func (d *DB) SetCollectionVersion(cId, version int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.setCollectionVersion(d.db, cId, version)
+}
+
+// CollectionVersions maps collection names to their format version. Only
+// collections with a version are included.
+func (d *DB) CollectionVersions() (map[string]int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	results := make(map[string]int)
+	if !d.hasVersions {
+		return results, nil
+	}
+
+	rows, err := d.db.Query(`SELECT c.Name, v.Version FROM CollectionVersions v
+		JOIN Collections c ON c.Id = v.CollectionId`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var version int
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, err
+		}
+		results[name] = version
+	}
+
+	return results, rows.Err()
+}
+
+func (d *DB) setCollectionVersion(tx dbTx, cId, version int) error {
+	if version < 0 {
+		return ErrInvalidCollectionVersion
+	}
+
+	if !d.hasVersions {
+		if _, err := tx.Exec(schemaCollectionVersions); err != nil {
+			return err
+		}
+		// callers rolling back tx must restore it
+		d.hasVersions = true
+	}
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO CollectionVersions (CollectionId, Version) VALUES (?,?)", cId, version)
+	return err
+}
+
+// deleteCollectionVersions forgets the versions of cIds, all of them when
+// there are none
+func (d *DB) deleteCollectionVersions(tx dbTx, cIds ...int) error {
+	if !d.hasVersions {
+		return nil
+	}
+
+	if len(cIds) == 0 {
+		_, err := tx.Exec("DELETE FROM CollectionVersions")
+		return err
+	}
+
+	values := make([]interface{}, len(cIds))
+	for i, cId := range cIds {
+		values[i] = cId
+	}
+
+	_, err := tx.Exec("DELETE FROM CollectionVersions WHERE CollectionId IN (?"+strings.Repeat(",?", len(cIds)-1)+")", values...)
+	return err
+}
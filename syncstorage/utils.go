@@ -1,9 +1,14 @@
 package syncstorage
 
 import (
+	"crypto/rand"
 	"fmt"
 	"regexp"
+	"syscall"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 )
 
 // 2099 ... somebody else's problem by then (I hope)
@@ -90,5 +95,57 @@ func CollectionNameOk(cName string) bool {
 	return cNameCheck.MatchString(cName)
 }
 
+// crockford's base32 alphabet, used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewBSOId generates a new BSO id for clients that do not provide their own.
+// The ids are ULIDs, 26 characters that sort by creation time:
+// 48 bits of milliseconds since the epoch followed by 80 random bits.
+func NewBSOId() string {
+	var data [16]byte
+
+	ms := uint64(time.Now().UnixNano() / 1000 / 1000)
+	for i := 5; i >= 0; i-- {
+		data[i] = byte(ms)
+		ms >>= 8
+	}
+
+	if _, err := rand.Read(data[6:]); err != nil {
+		panic("syncstorage: could not read random bytes: " + err.Error())
+	}
+
+	// 128 bits encode into 26 base32 characters with the first
+	// character only using the top 3 bits (2 bits of padding)
+	id := make([]byte, 26)
+	var acc uint
+	var bits uint
+	pos := len(id) - 1
+	for i := len(data) - 1; i >= 0; i-- {
+		acc |= uint(data[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			id[pos] = ulidAlphabet[acc&31]
+			pos--
+			acc >>= 5
+			bits -= 5
+		}
+	}
+	id[pos] = ulidAlphabet[acc&31]
+
+	return string(id)
+}
+
+// IsDiskError is true for I/O errors and a full disk. A corrupted file
+// is a problem with one DB, not with the disk holding it
+func IsDiskError(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case sqlite3.Error:
+		return cause.Code == sqlite3.ErrIoErr || cause.Code == sqlite3.ErrFull
+	case syscall.Errno:
+		return cause == syscall.EIO || cause == syscall.ENOSPC
+	}
+	return false
+}
+
 func String(s string) *string { return &s }
 func Int(u int) *int          { return &u }
@@ -1,12 +1,17 @@
 package syncstorage
 
 import (
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -113,3 +118,51 @@ func TestValidateSortIndex(t *testing.T) {
 	}
 
 }
+
+func TestNewBSOId(t *testing.T) {
+	assert := assert.New(t)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewBSOId()
+		if !assert.Len(id, 26) || !assert.True(BSOIdOk(id), id) {
+			return
+		}
+
+		assert.False(seen[id], "duplicate id generated")
+		seen[id] = true
+	}
+
+	// the leading timestamp makes later ids sort after earlier ones
+	first := NewBSOId()
+	time.Sleep(2 * time.Millisecond)
+	assert.True(first < NewBSOId())
+}
+
+func TestIsDiskError(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "diskerror")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// a file that is not a DB is broken, the disk is not
+	path := dir + "/garbage.db"
+	if !assert.NoError(ioutil.WriteFile(path, []byte(strings.Repeat("garbage", 1000)), 0644)) {
+		return
+	}
+
+	_, err = NewDB(path, nil)
+	if assert.Error(err) {
+		assert.False(IsDiskError(err), err.Error())
+	}
+
+	assert.True(IsDiskError(errors.Wrap(sqlite3.Error{Code: sqlite3.ErrIoErr}, "wrapped")))
+	assert.True(IsDiskError(sqlite3.Error{Code: sqlite3.ErrFull}))
+	assert.False(IsDiskError(sqlite3.Error{Code: sqlite3.ErrCorrupt}))
+	assert.True(IsDiskError(errors.Wrap(syscall.EIO, "wrapped")))
+	assert.False(IsDiskError(ErrNotFound))
+	assert.False(IsDiskError(nil))
+}
@@ -71,13 +71,15 @@ func (s *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if req.Method == "GET" && infoCollectionsRoute.MatchString(req.URL.Path) { // info/collections
+	// only the full info/collections is cached, filtered ones like
+	// ?newer= go straight through
+	if req.Method == "GET" && infoCollectionsRoute.MatchString(req.URL.Path) && req.URL.RawQuery == "" { // info/collections
 		s.infoCollection(uid, w, req)
 	} else if req.Method == "GET" && infoConfigurationRoute.MatchString(req.URL.Path) { // info/configuration
 		s.infoConfiguration(uid, w, req)
 	} else {
 		// clear the cache for the  user
-		if req.Method == "POST" || req.Method == "PUT" || req.Method == "DELETE" {
+		if req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" || req.Method == "DELETE" {
 			if log.GetLevel() == log.DebugLevel {
 				log.WithFields(log.Fields{
 					"uid": uid,
@@ -90,10 +92,17 @@ func (s *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Clear forgets the cached data of a user, ie: after their data was
+// changed without a request going through the CacheHandler
+func (s *CacheHandler) Clear(uid string) {
+	s.cache.Set(uid, nil)
+}
+
 // for serialization of the json body and last modified header
 // values into one []byte. The X-Last-Modified timestamp is 13 bytes
 // ie: 1234567890.12.
 // TODO: update this to 14 before my 307th birthday on Nov 20th, 2286.
+// The X-Weave-Generation, which may be empty, follows it up to a newline
 const lastModifiedBytes = 13
 
 // infoCollection caches a user's info/collection data. It will clear
@@ -103,15 +112,22 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 	if data, err := s.cache.Get(uid); err == nil && len(data) > 0 {
 		// TODO in change this
 		lastModified := string(data[:lastModifiedBytes])
+		end := lastModifiedBytes + bytes.IndexByte(data[lastModifiedBytes:], '\n')
+		generation := string(data[lastModifiedBytes:end])
+		body := data[end+1:]
 
 		if log.GetLevel() == log.DebugLevel {
 			log.WithFields(log.Fields{
 				"uid":      uid,
 				"modified": lastModified,
-				"data_len": len(data) - lastModifiedBytes,
+				"data_len": len(body),
 			}).Debug("CacheHandler HIT")
 		}
 
+		if generation != "" {
+			w.Header().Set("X-Weave-Generation", generation)
+		}
+
 		modified, _ := ConvertTimestamp(lastModified)
 		if sentNotModified(w, req, modified) {
 			return
@@ -120,7 +136,7 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 		// add the the X-Last-Modified header
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("X-Last-Modified", lastModified)
-		io.Copy(w, bytes.NewReader(data[lastModifiedBytes:]))
+		io.Copy(w, bytes.NewReader(body))
 		return
 	}
 
@@ -130,10 +146,13 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 
 	// cache the results for next time if successful response
 	if cacheWriter.code == http.StatusOK {
-		data := make([]byte, cacheWriter.Len()+lastModifiedBytes)
+		generation := w.Header().Get("X-Weave-Generation")
+		data := make([]byte, lastModifiedBytes, lastModifiedBytes+len(generation)+1+cacheWriter.Len())
 
 		copy(data, w.Header().Get("X-Last-Modified"))
-		copy(data[lastModifiedBytes:], cacheWriter.Bytes())
+		data = append(data, generation...)
+		data = append(data, '\n')
+		data = append(data, cacheWriter.Bytes()...)
 
 		s.cache.Set(uid, data)
 		if log.GetLevel() == log.DebugLevel {
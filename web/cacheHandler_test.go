@@ -129,9 +129,42 @@ func TestCacheHandlerInfoCollections(t *testing.T) {
 
 		assert.Equal(resp.Body.String(), resp2.Body.String())
 		assert.Equal(resp.Header().Get("X-Last-Modified"), resp2.Header().Get("X-Last-Modified"))
+
+		// filtered requests are not served from the cache
+		resp3 := request("GET", syncurl(uid, "info/collections?newer=99999999999"), nil, handler)
+		assert.Equal("{}", resp3.Body.String())
 	}
 }
 
+func TestCacheHandlerGeneration(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewCacheHandler(NewSyncUserHandler(uid, db, nil), DefaultCacheHandlerConfig)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	resp := requestheaders("PUT", syncurl(uid, "storage/col/bso0"), strings.NewReader(`{"payload":"x"}`), header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	miss := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal("1", miss.Header().Get("X-Weave-Generation"))
+
+	// hits replay the generation the response was cached with
+	hit := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(miss.Body.String(), hit.Body.String())
+	assert.Equal("1", hit.Header().Get("X-Weave-Generation"))
+
+	header = make(http.Header)
+	header.Set("X-If-Modified-Since", miss.Header().Get("X-Last-Modified"))
+	notModified := requestheaders("GET", syncurl(uid, "info/collections"), nil, header, handler)
+	assert.Equal(http.StatusNotModified, notModified.Code)
+	assert.Equal("1", notModified.Header().Get("X-Weave-Generation"))
+}
+
 func TestCacheHandlerInfoConfiguration(t *testing.T) {
 	assert := assert.New(t)
 
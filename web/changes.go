@@ -0,0 +1,105 @@
+package web
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ChangeOp is the kind of write a Change records
+type ChangeOp string
+
+const (
+	ChangePut              ChangeOp = "put"    // a BSO was created or updated
+	ChangeDelete           ChangeOp = "delete" // a BSO was deleted
+	ChangeDeleteCollection ChangeOp = "delete_collection"
+	ChangeDeleteEverything ChangeOp = "delete_everything"
+)
+
+// Change describes a single write to a user's data. BsoId is empty for
+// collection deletes and Collection is empty when everything is deleted.
+// Modified is in milliseconds.
+type Change struct {
+	Uid        string   `json:"uid"`
+	Collection string   `json:"collection,omitempty"`
+	BsoId      string   `json:"bso_id,omitempty"`
+	Op         ChangeOp `json:"op"`
+	Modified   int      `json:"modified"`
+}
+
+// ChangeSink receives every write made through a SyncUserHandler, ie: for
+// change data capture. Send is called while the user's request is being
+// handled so it must not block.
+type ChangeSink interface {
+	Send(Change)
+}
+
+// ChangeBuffer is a ChangeSink that queues changes and delivers them to a
+// callback in the background. Changes sent while the buffer is full are
+// dropped so slow consumers never hold up requests.
+type ChangeBuffer struct {
+	changes chan Change
+	fn      func(Change)
+	done    chan struct{}
+
+	sync.Mutex
+	dropped int
+	stopped bool
+}
+
+func NewChangeBuffer(size int, fn func(Change)) *ChangeBuffer {
+	b := &ChangeBuffer{
+		changes: make(chan Change, size),
+		fn:      fn,
+		done:    make(chan struct{}),
+	}
+
+	go b.run()
+	return b
+}
+
+func (b *ChangeBuffer) Send(c Change) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.stopped {
+		return
+	}
+
+	select {
+	case b.changes <- c:
+	default:
+		b.dropped++
+		if b.dropped == 1 || b.dropped%1000 == 0 {
+			log.WithFields(log.Fields{
+				"dropped": b.dropped,
+			}).Warn("ChangeBuffer: full, changes dropped")
+		}
+	}
+}
+
+// Dropped is the number of changes dropped because the buffer was full
+func (b *ChangeBuffer) Dropped() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.dropped
+}
+
+// Stop delivers the changes already buffered and returns when they are done
+func (b *ChangeBuffer) Stop() {
+	b.Lock()
+	if !b.stopped {
+		b.stopped = true
+		close(b.changes)
+	}
+	b.Unlock()
+
+	<-b.done
+}
+
+func (b *ChangeBuffer) run() {
+	defer close(b.done)
+	for c := range b.changes {
+		b.fn(c)
+	}
+}
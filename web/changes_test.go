@@ -0,0 +1,144 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	sync.Mutex
+	changes []Change
+}
+
+func (s *recordingSink) Send(c Change) {
+	s.Lock()
+	defer s.Unlock()
+	s.changes = append(s.changes, c)
+}
+
+// take returns the changes since the last call without their Modified
+func (s *recordingSink) take() []Change {
+	s.Lock()
+	defer s.Unlock()
+	changes := s.changes
+	s.changes = nil
+	for i := range changes {
+		changes[i].Modified = 0
+	}
+	return changes
+}
+
+func TestSyncUserHandlerChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	sink := &recordingSink{}
+	config := NewDefaultSyncUserHandlerConfig()
+	config.Changes = sink
+	handler := NewSyncUserHandler(uid, db, config)
+
+	// PUT
+	resp := jsonrequest("PUT", syncurl(uid, "storage/bookmarks/b0"), strings.NewReader(`{"payload":"x"}`), handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		sink.Lock()
+		assert.Equal(resp.Header().Get("X-Last-Modified"), syncstorage.ModifiedToString(sink.changes[0].Modified))
+		sink.Unlock()
+		assert.Equal([]Change{{Uid: uid, Collection: "bookmarks", BsoId: "b0", Op: ChangePut}}, sink.take())
+	}
+
+	// POST, only the BSOs that were written
+	body := `[{"id":"b1","payload":"x"},{"id":"b2","sortindex":"nope"}]`
+	resp = jsonrequest("POST", syncurl(uid, "storage/bookmarks"), strings.NewReader(body), handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{{Uid: uid, Collection: "bookmarks", BsoId: "b1", Op: ChangePut}}, sink.take())
+	}
+
+	// a batch is a change when it is committed
+	resp = jsonrequest("POST", syncurl(uid, "storage/tabs?batch=true"), strings.NewReader(`[{"id":"t1","payload":"x"}]`), handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code) {
+		return
+	}
+	assert.Len(sink.take(), 0)
+
+	var results PostResults
+	assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+	resp = jsonrequest("POST", syncurl(uid, "storage/tabs?commit=true&batch="+results.Batch), strings.NewReader(`[{"id":"t2","payload":"x"}]`), handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{
+			{Uid: uid, Collection: "tabs", BsoId: "t1", Op: ChangePut},
+			{Uid: uid, Collection: "tabs", BsoId: "t2", Op: ChangePut},
+		}, sink.take())
+	}
+
+	// DELETE
+	resp = request("DELETE", syncurl(uid, "storage/bookmarks/b0"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{{Uid: uid, Collection: "bookmarks", BsoId: "b0", Op: ChangeDelete}}, sink.take())
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage/tabs?ids=t1,t2"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{
+			{Uid: uid, Collection: "tabs", BsoId: "t1", Op: ChangeDelete},
+			{Uid: uid, Collection: "tabs", BsoId: "t2", Op: ChangeDelete},
+		}, sink.take())
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage/bookmarks"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{{Uid: uid, Collection: "bookmarks", Op: ChangeDeleteCollection}}, sink.take())
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal([]Change{{Uid: uid, Op: ChangeDeleteEverything}}, sink.take())
+	}
+
+	// reads are not changes
+	request("GET", syncurl(uid, "storage/tabs"), nil, handler)
+	assert.Len(sink.take(), 0)
+}
+
+func TestChangeBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	var received []Change
+	release := make(chan struct{})
+	buffer := NewChangeBuffer(2, func(c Change) {
+		<-release
+		received = append(received, c)
+	})
+
+	buffer.Send(Change{BsoId: "0"})
+
+	// wait for the consumer to take the first one
+	for len(buffer.changes) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// fill the buffer, Send never blocks
+	buffer.Send(Change{BsoId: "1"})
+	buffer.Send(Change{BsoId: "2"})
+	buffer.Send(Change{BsoId: "3"})
+	assert.Equal(1, buffer.Dropped())
+
+	close(release)
+	buffer.Stop()
+
+	if assert.Len(received, 3) {
+		assert.Equal("0", received[0].BsoId)
+		assert.Equal("2", received[2].BsoId)
+	}
+
+	// ignored after stopping
+	buffer.Send(Change{BsoId: "4"})
+	assert.Len(received, 3)
+}
@@ -0,0 +1,65 @@
+// Package changesink delivers web.Change events to a message broker or a
+// file. Events are keyed by uid so a partitioned broker, ie: Kafka, keeps
+// each user's changes in order.
+package changesink
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mozilla-services/go-syncstorage/web"
+)
+
+// Producer publishes a single message. A Kafka client satisfies it with a
+// thin wrapper, ie: for sarama's SyncProducer:
+//
+//	func (p *saramaProducer) Produce(key, value []byte) error {
+//		_, _, err := p.SendMessage(&sarama.ProducerMessage{
+//			Topic: p.topic,
+//			Key:   sarama.ByteEncoder(key),
+//			Value: sarama.ByteEncoder(value),
+//		})
+//		return err
+//	}
+type Producer interface {
+	Produce(key, value []byte) error
+}
+
+// New returns a callback for web.NewChangeBuffer that sends each change to
+// p as JSON. Changes that fail to produce are logged and skipped.
+func New(p Producer) func(web.Change) {
+	return func(c web.Change) {
+		value, err := json.Marshal(c)
+		if err == nil {
+			err = p.Produce([]byte(c.Uid), value)
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uid": c.Uid,
+				"err": err.Error(),
+			}).Error("changesink: could not produce change")
+		}
+	}
+}
+
+// JSONLines is a Producer that writes one JSON message per line, ie: to a
+// file tailed by a log shipper
+type JSONLines struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{w: w}
+}
+
+func (j *JSONLines) Produce(key, value []byte) error {
+	j.Lock()
+	defer j.Unlock()
+
+	_, err := j.w.Write(append(value, '\n'))
+	return err
+}
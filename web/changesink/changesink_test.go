@@ -0,0 +1,57 @@
+package changesink
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/web"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingProducer struct {
+	keys   []string
+	values []string
+	err    error
+}
+
+func (p *recordingProducer) Produce(key, value []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.keys = append(p.keys, string(key))
+	p.values = append(p.values, string(value))
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &recordingProducer{}
+	send := New(p)
+	send(web.Change{Uid: "10", Collection: "bookmarks", BsoId: "b0", Op: web.ChangePut, Modified: 1234})
+	send(web.Change{Uid: "10", Op: web.ChangeDeleteEverything, Modified: 1240})
+
+	assert.Equal([]string{"10", "10"}, p.keys)
+	assert.Equal([]string{
+		`{"uid":"10","collection":"bookmarks","bso_id":"b0","op":"put","modified":1234}`,
+		`{"uid":"10","op":"delete_everything","modified":1240}`,
+	}, p.values)
+
+	// errors are logged, not returned
+	p.err = errors.New("broker down")
+	send(web.Change{Uid: "10", Op: web.ChangeDeleteEverything, Modified: 1250})
+	assert.Len(p.values, 2)
+}
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	send := New(NewJSONLines(&buf))
+	send(web.Change{Uid: "1", Collection: "tabs", Op: web.ChangeDeleteCollection, Modified: 10})
+	send(web.Change{Uid: "2", Collection: "tabs", BsoId: "t1", Op: web.ChangeDelete, Modified: 20})
+
+	assert.Equal(t,
+		`{"uid":"1","collection":"tabs","op":"delete_collection","modified":10}`+"\n"+
+			`{"uid":"2","collection":"tabs","bso_id":"t1","op":"delete","modified":20}`+"\n",
+		buf.String())
+}
@@ -0,0 +1,196 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (b breakerState) String() string {
+	switch b {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops sending requests to the DBs when the disk holding
+// them is failing so they fail fast with a 503 instead of slowly with a 500.
+// It trips after Threshold disk errors, see syncstorage.IsDiskError, within
+// Window. While open writes, and reads with FailReads, are rejected. After
+// Cooldown it lets a single request through to test the disk, if that works
+// it closes again otherwise it stays open for another Cooldown.
+type CircuitBreaker struct {
+	sync.Mutex
+
+	handler http.Handler
+
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	FailReads bool
+
+	// Metrics receives state changes, nil discards them
+	Metrics Metrics
+
+	state    breakerState
+	errors   []time.Time // disk errors in the last Window, oldest first
+	openedAt time.Time
+	probing  bool // a request is testing the disk in the half open state
+
+	now func() time.Time
+}
+
+func NewCircuitBreaker(h http.Handler, threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		handler:   h,
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+func (b *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	session, ok := SessionFromContext(req.Context())
+	if !ok {
+		session = &Session{}
+		req = req.WithContext(NewSessionContext(req.Context(), session))
+	}
+
+	guarded := b.FailReads
+	switch req.Method {
+	case "GET", "HEAD":
+	default:
+		guarded = true
+	}
+
+	probe := false
+	if guarded {
+		var allowed bool
+		if allowed, probe = b.allow(); !allowed {
+			retryAfter := int(b.Cooldown / time.Second)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			sendRequestProblem(w, req, http.StatusServiceUnavailable,
+				errors.New("Storage unavailable, too many disk errors"))
+			return
+		}
+	}
+
+	// deferred so a panicking probe does not leave the breaker waiting
+	// for a result forever. A panic says nothing about the disk
+	finished := false
+	defer func() {
+		if finished {
+			b.record(syncstorage.IsDiskError(session.ErrorResult), probe)
+		} else if probe {
+			b.Lock()
+			b.probing = false
+			b.Unlock()
+		}
+	}()
+
+	b.handler.ServeHTTP(w, req)
+	finished = true
+}
+
+// allow checks if a request can go through. probe is set for the single
+// request that tests the disk when the breaker is half open
+func (b *CircuitBreaker) allow() (allowed, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true, false
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return false, false
+		}
+		b.setState(breakerHalfOpen)
+	}
+
+	if b.probing {
+		return false, false
+	}
+
+	b.probing = true
+	return true, true
+}
+
+// record updates the state with the outcome of a request
+func (b *CircuitBreaker) record(diskError, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+
+	if probe {
+		b.probing = false
+		if diskError {
+			b.openedAt = now
+			b.setState(breakerOpen)
+		} else {
+			b.errors = b.errors[:0]
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	if !diskError || b.state != breakerClosed {
+		return
+	}
+
+	// forget errors older than the window
+	kept := b.errors[:0]
+	for _, t := range b.errors {
+		if now.Sub(t) < b.Window {
+			kept = append(kept, t)
+		}
+	}
+	b.errors = append(kept, now)
+
+	if len(b.errors) >= b.Threshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// setState must be called with the breaker locked
+func (b *CircuitBreaker) setState(state breakerState) {
+	if state == b.state {
+		return
+	}
+
+	fields := log.Fields{"from": b.state.String(), "to": state.String()}
+	if state == breakerOpen {
+		log.WithFields(fields).Error("CircuitBreaker: disk errors, failing requests")
+	} else {
+		log.WithFields(fields).Info("CircuitBreaker: state changed")
+	}
+
+	if b.Metrics != nil {
+		b.Metrics.Incr("breaker.state", "state:"+state.String())
+	}
+
+	b.state = state
+}
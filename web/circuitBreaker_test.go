@@ -0,0 +1,113 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingDBHandler stands in for a DB on a broken disk
+type failingDBHandler struct {
+	failing bool
+	calls   int
+}
+
+func (h *failingDBHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+	if h.failing {
+		InternalError(w, r, errors.Wrap(sqlite3.Error{Code: sqlite3.ErrIoErr}, "Could not write"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	db := &failingDBHandler{failing: true}
+	metrics := &recordingMetrics{}
+	breaker := NewCircuitBreaker(db, 3, time.Minute, 30*time.Second)
+	breaker.Metrics = metrics
+
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	url := syncurl(uniqueUID(), "storage/col/bso0")
+
+	// errors outside the window do not count
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusInternalServerError, request("PUT", url, nil, breaker).Code)
+	}
+	now = now.Add(2 * time.Minute)
+	assert.Equal(http.StatusInternalServerError, request("PUT", url, nil, breaker).Code)
+	assert.Equal(breakerClosed, breaker.state)
+
+	// other errors do not count
+	other := NewCircuitBreaker(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		InternalError(w, r, errors.New("not a disk error"))
+	}), 1, time.Minute, time.Minute)
+	request("PUT", url, nil, other)
+	assert.Equal(breakerClosed, other.state)
+
+	// trips
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusInternalServerError, request("PUT", url, nil, breaker).Code)
+	}
+	assert.Equal(breakerOpen, breaker.state)
+	assert.Equal([]string{"breaker.state|state:open"}, metrics.counts)
+
+	// fast fails writes without touching the DB, reads still go through
+	calls := db.calls
+	resp := request("PUT", url, nil, breaker)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Equal("30", resp.Header().Get("Retry-After"))
+	assert.Equal(calls, db.calls)
+	assert.Equal(http.StatusInternalServerError, request("GET", url, nil, breaker).Code)
+
+	breaker.FailReads = true
+	assert.Equal(http.StatusServiceUnavailable, request("GET", url, nil, breaker).Code)
+
+	// half opens after the cooldown, a failing probe opens it again
+	now = now.Add(31 * time.Second)
+	assert.Equal(http.StatusInternalServerError, request("PUT", url, nil, breaker).Code)
+	assert.Equal(breakerOpen, breaker.state)
+	assert.Equal(http.StatusServiceUnavailable, request("PUT", url, nil, breaker).Code)
+
+	// only one request probes at a time
+	now = now.Add(31 * time.Second)
+	if allowed, probe := breaker.allow(); assert.True(allowed) && assert.True(probe) {
+		allowed, _ := breaker.allow()
+		assert.False(allowed)
+		breaker.record(true, true)
+	}
+
+	// a panicking probe lets the next request probe
+	panics := NewCircuitBreaker(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}), 1, time.Minute, time.Minute)
+	panics.state, panics.openedAt, panics.now = breakerHalfOpen, now, breaker.now
+	assert.Panics(func() { request("PUT", url, nil, panics) })
+	assert.False(panics.probing)
+	assert.Equal(breakerHalfOpen, panics.state)
+
+	// and recovers
+	db.failing = false
+	now = now.Add(31 * time.Second)
+	assert.Equal(http.StatusOK, request("PUT", url, nil, breaker).Code)
+	assert.Equal(breakerClosed, breaker.state)
+	assert.Equal(http.StatusOK, request("PUT", url, nil, breaker).Code)
+
+	assert.Equal([]string{
+		"breaker.state|state:open",
+		"breaker.state|state:half_open",
+		"breaker.state|state:open",
+		"breaker.state|state:half_open",
+		"breaker.state|state:open",
+		"breaker.state|state:half_open",
+		"breaker.state|state:closed",
+	}, metrics.counts)
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var freezeRoute = regexp.MustCompile(`^/debug/freeze/([0-9]+)$`)
+
+// FreezeDebugHandler serves /debug/freeze/{uid} to manage the collections
+// a user can read but not write. GET responds with them, PUT replaces them
+// with a JSON list of collection names and DELETE goes back to the
+// server's SyncUserHandlerConfig.FrozenCollections.
+type FreezeDebugHandler struct {
+	handler http.Handler
+	pool    *SyncPoolHandler
+}
+
+func NewFreezeDebugHandler(h http.Handler, pool *SyncPoolHandler) *FreezeDebugHandler {
+	return &FreezeDebugHandler{handler: h, pool: pool}
+}
+
+func (h *FreezeDebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	matches := freezeRoute.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	uid := matches[1]
+
+	var err error
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		var collections []string
+		if req.Body == nil || json.NewDecoder(req.Body).Decode(&collections) != nil || collections == nil {
+			sendRequestProblem(w, req, http.StatusBadRequest, errors.New("Body must be a list of collection names"))
+			return
+		}
+		err = h.pool.FreezeUser(uid, collections)
+	case "DELETE":
+		err = h.pool.FreezeUser(uid, nil)
+	default:
+		sendRequestProblem(w, req, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	var (
+		collections []string
+		own         bool
+	)
+	if err == nil {
+		collections, own, err = h.pool.UserFrozen(uid)
+	}
+
+	if err == errTooManyOpenDBs || err == errUserMoving {
+		w.Header().Add("Retry-After", strconv.Itoa(30))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		InternalError(w, req, errors.Wrap(err, "Could not freeze user"))
+		return
+	}
+
+	if collections == nil {
+		collections = []string{}
+	}
+
+	JSON(w, req, http.StatusOK, struct {
+		Collections []string `json:"collections"`
+		Own         bool     `json:"own"`
+	}{collections, own})
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreezeDebugHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "freeze")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.FrozenCollections = []string{"bookmarks"}
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(dir), config)
+	defer pool.StopHTTP()
+
+	uid := "42"
+	handler := NewFreezeDebugHandler(pool, pool)
+
+	resp := request("GET", "http://test/debug/freeze/"+uid, nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(`{"collections":["bookmarks"],"own":false}`, strings.TrimSpace(resp.Body.String()))
+	}
+
+	resp = request("PUT", "http://test/debug/freeze/"+uid, strings.NewReader(`["tabs","forms"]`), handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(`{"collections":["tabs","forms"],"own":true}`, strings.TrimSpace(resp.Body.String()))
+	}
+
+	resp = jsonrequest("PUT", syncurl(uid, "storage/tabs/t0"), strings.NewReader(`{"payload":"x"}`), handler)
+	assert.Equal(http.StatusLocked, resp.Code)
+	resp = jsonrequest("PUT", syncurl(uid, "storage/bookmarks/b0"), strings.NewReader(`{"payload":"x"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	resp = request("DELETE", "http://test/debug/freeze/"+uid, nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(`{"collections":["bookmarks"],"own":false}`, strings.TrimSpace(resp.Body.String()))
+	}
+
+	for _, bad := range []string{"", "null", `"tabs"`, `{}`} {
+		resp = request("PUT", "http://test/debug/freeze/"+uid, strings.NewReader(bad), handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, bad)
+	}
+
+	resp = request("POST", "http://test/debug/freeze/"+uid, nil, handler)
+	assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+}
@@ -0,0 +1,25 @@
+package web
+
+import (
+	"net/http"
+)
+
+// PoolDebugHandler serves /debug/pool, a list of the open handlers in a
+// SyncPoolHandler. It shows which users are hot and if eviction is working.
+type PoolDebugHandler struct {
+	handler http.Handler
+	pool    *SyncPoolHandler
+}
+
+func NewPoolDebugHandler(h http.Handler, pool *SyncPoolHandler) *PoolDebugHandler {
+	return &PoolDebugHandler{handler: h, pool: pool}
+}
+
+func (h *PoolDebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/debug/pool" {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	JSON(w, req, http.StatusOK, h.pool.Handlers())
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolDebugHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.NumPools = 2
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	for _, uid := range []string{"10", "11", "12", "10"} {
+		p := pool.pools[pool.poolIndex(uid)]
+		element, _, err := p.getElement(uid)
+		if !assert.NoError(err) {
+			return
+		}
+		p.releaseElement(element)
+		time.Sleep(time.Millisecond)
+	}
+
+	// still in use
+	inUse, _, _ := pool.pools[pool.poolIndex("11")].getElement("11")
+	defer pool.pools[pool.poolIndex("11")].releaseElement(inUse)
+
+	handler := NewPoolDebugHandler(EchoHandler, pool)
+	resp := request("GET", "http://test/debug/pool", nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	var infos []HandlerInfo
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &infos)) || !assert.Len(infos, 3) {
+		return
+	}
+
+	// most recently used first
+	assert.Equal("11", infos[0].Uid)
+	assert.Equal("10", infos[1].Uid)
+	assert.Equal("12", infos[2].Uid)
+
+	assert.Equal(1, infos[0].InUse)
+	assert.Equal(0, infos[1].InUse)
+	assert.Equal(pool.poolIndex("12"), uint16(infos[2].Pool))
+	for _, info := range infos {
+		assert.False(info.Stopped)
+		assert.False(info.Created.After(info.LastUsed))
+	}
+
+	// everything else is passed through
+	resp = request("GET", "http://test/1.5/10/info/collections", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Body.String())
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var repairRoute = regexp.MustCompile(`^/debug/repair/([0-9]+)$`)
+
+// RepairDebugHandler serves POST /debug/repair/{uid}. It checks and fixes
+// a user's DB and responds with a syncstorage.RepairReport of what it found.
+type RepairDebugHandler struct {
+	handler http.Handler
+	pool    *SyncPoolHandler
+}
+
+func NewRepairDebugHandler(h http.Handler, pool *SyncPoolHandler) *RepairDebugHandler {
+	return &RepairDebugHandler{handler: h, pool: pool}
+}
+
+func (h *RepairDebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	matches := repairRoute.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	if req.Method != "POST" {
+		sendRequestProblem(w, req, http.StatusMethodNotAllowed, errors.New("Repair requires a POST"))
+		return
+	}
+
+	report, err := h.pool.RepairUser(matches[1])
+	if err == errTooManyOpenDBs || err == errUserMoving {
+		w.Header().Add("Retry-After", strconv.Itoa(30))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		InternalError(w, req, errors.Wrap(err, "Could not repair DB"))
+		return
+	}
+
+	JSON(w, req, http.StatusOK, report)
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairDebugHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "repair")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(dir), nil)
+	defer pool.StopHTTP()
+
+	uid := "42"
+	body := `[{"id":"b0","payload":"x"},{"id":"b1","payload":"y"}]`
+	resp := jsonrequest("POST", syncurl(uid, "storage/orphaned"), strings.NewReader(body), pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	// the collection disappears behind the open handler's back
+	path, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+	raw, err := sql.Open("sqlite3", filepath.Join(path, file))
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = raw.Exec("DELETE FROM Collections WHERE Name='orphaned'")
+	raw.Close()
+	if !assert.NoError(err) {
+		return
+	}
+
+	handler := NewRepairDebugHandler(EchoHandler, pool)
+	resp = request("POST", "http://test/debug/repair/"+uid, nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var report syncstorage.RepairReport
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &report)) {
+			assert.Equal(2, report.OrphanedBSOs)
+			assert.True(report.Reindexed)
+			assert.True(report.Ok())
+		}
+	}
+
+	// repaired, nothing left to fix
+	resp = request("POST", "http://test/debug/repair/"+uid, nil, handler)
+	assert.Contains(resp.Body.String(), `"orphaned_bsos":0`)
+
+	resp = request("GET", "http://test/debug/repair/"+uid, nil, handler)
+	assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+
+	// everything else is passed through
+	resp = request("GET", "http://test/1.5/10/info/collections", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Body.String())
+}
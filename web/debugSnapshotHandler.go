@@ -0,0 +1,98 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+var snapshotRoute = regexp.MustCompile(`^/debug/snapshot/([0-9]+)$`)
+
+// SnapshotDebugHandler serves /debug/snapshot/{uid} for backup and restore
+// tools. GET responds with an export of all the user's data and PUT
+// replaces the user's data with an export in the request body. PUT responds
+// with a syncstorage.ImportReport listing BSOs skipped for breaking limits.
+type SnapshotDebugHandler struct {
+	handler http.Handler
+	pool    *SyncPoolHandler
+
+	// Cache is cleared of a user's data after an import, nil if there is
+	// no CacheHandler
+	Cache *CacheHandler
+
+	// ImportToken must be sent as "Authorization: Bearer <token>" with
+	// a PUT. Imports are disabled when it is empty
+	ImportToken string
+}
+
+func NewSnapshotDebugHandler(h http.Handler, pool *SyncPoolHandler) *SnapshotDebugHandler {
+	return &SnapshotDebugHandler{handler: h, pool: pool}
+}
+
+func (h *SnapshotDebugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	matches := snapshotRoute.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	uid := matches[1]
+
+	switch req.Method {
+	case "GET":
+		// errors after the export started streaming can only be logged
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename="+uid+".export.gz")
+		if err := h.pool.ExportUser(uid, w); err != nil {
+			sendSnapshotError(w, req, errors.Wrap(err, "Could not export user"))
+		}
+	case "PUT":
+		if !h.importAllowed(req) {
+			sendRequestProblem(w, req, http.StatusForbidden, errors.New("Import not allowed"))
+			return
+		}
+
+		if req.Body == nil {
+			sendRequestProblem(w, req, http.StatusBadRequest, errors.New("Import requires a body"))
+			return
+		}
+
+		report, err := h.pool.ImportUser(uid, req.Body)
+		if h.Cache != nil {
+			h.Cache.Clear(uid)
+		}
+
+		if err != nil {
+			sendSnapshotError(w, req, errors.Wrap(err, "Could not import user"))
+			return
+		}
+
+		JSON(w, req, http.StatusOK, report)
+	default:
+		sendRequestProblem(w, req, http.StatusMethodNotAllowed, errors.New("Snapshots require a GET or PUT"))
+	}
+}
+
+// importAllowed checks the request has the ImportToken
+func (h *SnapshotDebugHandler) importAllowed(req *http.Request) bool {
+	if h.ImportToken == "" {
+		return false
+	}
+	expected := "Bearer " + h.ImportToken
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+func sendSnapshotError(w http.ResponseWriter, req *http.Request, err error) {
+	switch errors.Cause(err) {
+	case errTooManyOpenDBs, errUserMoving:
+		w.Header().Add("Retry-After", strconv.Itoa(30))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable, err)
+	case syncstorage.ErrInvalidExport, syncstorage.ErrInvalidBSOId, syncstorage.ErrInvalidCollectionName:
+		sendRequestProblem(w, req, http.StatusBadRequest, err)
+	default:
+		InternalError(w, req, err)
+	}
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// importrequest PUTs an export with the token in the Authorization header
+func importrequest(uid string, export io.Reader, token string, h http.Handler) *httptest.ResponseRecorder {
+	header := make(http.Header)
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return requestheaders("PUT", "http://test/debug/snapshot/"+uid, export, header, h)
+}
+
+func TestSnapshotDebugHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(dir), nil)
+	defer pool.StopHTTP()
+
+	src, dst := "42", "43"
+	body := `[{"id":"b0","payload":"x","sortindex":3},{"id":"b1","payload":"y"}]`
+	resp := jsonrequest("POST", syncurl(src, "storage/bookmarks"), strings.NewReader(body), pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	resp = jsonrequest("PUT", syncurl(src, "storage/custom/c0"), strings.NewReader(`{"payload":"z"}`), pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	handler := NewSnapshotDebugHandler(pool, pool)
+
+	resp = request("GET", "http://test/debug/snapshot/"+src, nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	export := resp.Body.Bytes()
+
+	// imports are off without an ImportToken
+	resp = importrequest(dst, bytes.NewReader(export), "", handler)
+	assert.Equal(http.StatusForbidden, resp.Code)
+
+	handler.ImportToken = "t0ken"
+	for _, token := range []string{"", "wrong"} {
+		resp = importrequest(dst, bytes.NewReader(export), token, handler)
+		assert.Equal(http.StatusForbidden, resp.Code, token)
+	}
+
+	resp = importrequest(dst, bytes.NewReader(export), "t0ken", handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	assert.Equal(`{"collections":2,"bsos":3,"bytes":3,"skipped":[]}`, strings.TrimSpace(resp.Body.String()))
+
+	for _, path := range []string{"info/collections", "storage/bookmarks?full=1", "storage/custom?full=1"} {
+		expected := request("GET", syncurl(src, path), nil, pool)
+		got := request("GET", syncurl(dst, path), nil, pool)
+		assert.Equal(http.StatusOK, got.Code, path)
+		assert.JSONEq(expected.Body.String(), got.Body.String(), path)
+		assert.Equal(expected.Header().Get("X-Last-Modified"), got.Header().Get("X-Last-Modified"), path)
+	}
+
+	resp = importrequest(dst, strings.NewReader("not an export"), "t0ken", handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	resp = request("POST", "http://test/debug/snapshot/"+dst, nil, handler)
+	assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+
+	// everything else is passed through
+	handler = NewSnapshotDebugHandler(EchoHandler, pool)
+	resp = request("GET", "http://test/1.5/10/info/collections", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Body.String())
+}
+
+func TestSnapshotDebugHandlerLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// export from a server with the default limits
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(filepath.Join(dir, "a")), nil)
+	defer pool.StopHTTP()
+
+	uid := "42"
+	body := `[{"id":"small","payload":"x"},{"id":"large","payload":"` + strings.Repeat("x", 100) + `"}]`
+	resp := jsonrequest("POST", syncurl(uid, "storage/bookmarks"), strings.NewReader(body), pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("GET", "http://test/debug/snapshot/"+uid, nil, NewSnapshotDebugHandler(pool, pool))
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	export := resp.Body.Bytes()
+
+	// and import into one with a smaller payload limit
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxRecordPayloadBytes = 50
+	limited := NewSyncPoolHandler(NewDefaultSyncPoolConfig(filepath.Join(dir, "b")), config)
+	defer limited.StopHTTP()
+
+	importer := NewSnapshotDebugHandler(limited, limited)
+	importer.ImportToken = "t0ken"
+	resp = importrequest(uid, bytes.NewReader(export), "t0ken", importer)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	var report syncstorage.ImportReport
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &report)) {
+		assert.Equal(1, report.BSOs)
+		assert.Equal([]syncstorage.ImportSkipped{
+			{Collection: "bookmarks", Id: "large", Reason: syncstorage.SkipPayloadTooLarge},
+		}, report.Skipped)
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks"), nil, limited)
+	assert.Equal(`["small"]`, strings.TrimSpace(resp.Body.String()))
+}
@@ -0,0 +1,123 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DiskMonitor watches the free space on the disks holding the DBs. When it
+// drops below a threshold on any of them the server goes read only since
+// writing to a full disk risks corrupting the DBs. It goes back to normal
+// once enough space is free again
+type DiskMonitor struct {
+	sync.Mutex
+
+	paths   []string
+	minFree uint64
+
+	// returns the bytes available on the disk holding path
+	freeSpace func(path string) (uint64, error)
+
+	readOnly bool
+}
+
+func NewDiskMonitor(paths []string, minFree uint64) *DiskMonitor {
+	return &DiskMonitor{
+		paths:     paths,
+		minFree:   minFree,
+		freeSpace: diskFreeSpace,
+	}
+}
+
+// diskFreeSpace returns the bytes available to unprivileged users
+func diskFreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func (m *DiskMonitor) ReadOnly() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.readOnly
+}
+
+// Check updates the read only state from the current free space. Errors
+// are logged and leave the state unchanged. It is meant to be run by a
+// Scheduler
+func (m *DiskMonitor) Check() {
+	var (
+		lowest   uint64
+		lowestOn string
+	)
+
+	for _, path := range m.paths {
+		free, err := m.freeSpace(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path": path,
+			}).Errorf("DiskMonitor: could not get free space, %s", err.Error())
+			return
+		}
+
+		if lowestOn == "" || free < lowest {
+			lowest, lowestOn = free, path
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	readOnly := lowest < m.minFree
+	if readOnly == m.readOnly {
+		return
+	}
+
+	m.readOnly = readOnly
+	fields := log.Fields{
+		"path":     lowestOn,
+		"free":     lowest,
+		"min_free": m.minFree,
+	}
+
+	if readOnly {
+		log.WithFields(fields).Warn("DiskMonitor: low disk space, entering read only mode")
+	} else {
+		log.WithFields(fields).Info("DiskMonitor: disk space recovered, leaving read only mode")
+	}
+}
+
+// ReadOnlyHandler rejects requests that write data with a 503
+// while the DiskMonitor is in read only mode
+type ReadOnlyHandler struct {
+	handler http.Handler
+	monitor *DiskMonitor
+}
+
+func NewReadOnlyHandler(h http.Handler, monitor *DiskMonitor) *ReadOnlyHandler {
+	return &ReadOnlyHandler{
+		handler: h,
+		monitor: monitor,
+	}
+}
+
+func (h *ReadOnlyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+	default:
+		if h.monitor.ReadOnly() {
+			w.Header().Set("Retry-After", "300")
+			sendRequestProblem(w, req, http.StatusServiceUnavailable,
+				errors.New("Server is read only, low disk space"))
+			return
+		}
+	}
+
+	h.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskMonitorReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	free := map[string]uint64{"/data0": 2000, "/data1": 2000}
+	monitor := NewDiskMonitor([]string{"/data0", "/data1"}, 1000)
+	monitor.freeSpace = func(path string) (uint64, error) {
+		return free[path], nil
+	}
+
+	handler := NewReadOnlyHandler(EchoHandler, monitor)
+	info := NewInfoHandler(handler)
+	info.DiskMonitor = monitor
+
+	check := func(readOnly bool) {
+		monitor.Check()
+		assert.Equal(readOnly, monitor.ReadOnly())
+
+		resp := request("POST", "http://test/1.5/1/storage/col", bytes.NewBufferString("data"), info)
+		resp2 := request("GET", "http://test/1.5/1/storage/col", nil, info)
+		heartbeat := request("GET", "http://test/__heartbeat__", nil, info)
+
+		assert.Equal(http.StatusOK, resp2.Code)
+		assert.Equal(http.StatusOK, heartbeat.Code)
+
+		if readOnly {
+			assert.Equal(http.StatusServiceUnavailable, resp.Code)
+			assert.NotEmpty(resp.Header().Get("Retry-After"))
+			assert.Equal("OK, read only: low disk space", heartbeat.Body.String())
+		} else {
+			assert.Equal(http.StatusOK, resp.Code)
+			assert.Equal("OK", heartbeat.Body.String())
+		}
+	}
+
+	check(false)
+
+	// any disk running low is enough
+	free["/data1"] = 999
+	check(true)
+
+	free["/data1"] = 1000
+	check(false)
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(data []byte) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(data)
+	gz.Close()
+	return buf
+}
+
+func TestGzipRequestHandlerNewlines(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewGzipRequestHandler(NewSyncUserHandler(uid, db, nil), 1024*1024)
+
+	body := gzipped([]byte(`{"id":"bso0", "payload": "zero"}
+{"id":"bso1", "payload": "one"}
+{"id":"bso2", "payload": "two"}
+`))
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/newlines")
+	header.Set("Content-Encoding", "gzip")
+
+	resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var results PostResults
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+		return
+	}
+
+	assert.Len(results.Success, 3)
+	assert.Len(results.Failed, 0)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	bso, err := db.GetBSO(cId, "bso1")
+	if assert.NoError(err) {
+		assert.Equal("one", bso.Payload)
+	}
+}
+
+func TestGzipRequestHandlerPassThrough(t *testing.T) {
+	assert := assert.New(t)
+	handler := NewGzipRequestHandler(EchoHandler, 1024)
+
+	resp := request("POST", "http://test/", bytes.NewBufferString("plain"), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("plain", resp.Body.String())
+}
+
+func TestGzipRequestHandlerInvalid(t *testing.T) {
+	assert := assert.New(t)
+	handler := NewGzipRequestHandler(EchoHandler, 1024)
+
+	header := make(http.Header)
+	header.Set("Content-Encoding", "gzip")
+	resp := requestheaders("POST", "http://test/", bytes.NewBufferString("not gzip"), header, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+}
+
+func TestGzipRequestHandlerDecompressionBomb(t *testing.T) {
+	assert := assert.New(t)
+
+	// ~10MB of zeros compresses down to ~10KB
+	maxBytes := 1024
+	handler := NewGzipRequestHandler(EchoHandler, maxBytes)
+
+	header := make(http.Header)
+	header.Set("Content-Encoding", "gzip")
+
+	{ // over the limit is rejected before the wrapped handler sees anything
+		body := gzipped(make([]byte, 10*1024*1024))
+		resp := requestheaders("POST", "http://test/", body, header, handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // exactly at the limit is ok
+		body := gzipped(bytes.Repeat([]byte("a"), maxBytes))
+		resp := requestheaders("POST", "http://test/", body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(maxBytes, resp.Body.Len())
+	}
+}
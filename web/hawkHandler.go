@@ -5,11 +5,12 @@ import (
 	"crypto/sha256"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mozilla-services/go-syncstorage/token"
 	"github.com/pkg/errors"
 	"github.com/willf/bloom"
@@ -22,6 +23,23 @@ var (
 	ErrTokenExpired = errors.New("Token is expired")
 )
 
+// reason codes logged for rejected requests
+const (
+	RejectAuthTooLarge  = "auth_too_large"
+	RejectMalformed     = "malformed_header"
+	RejectReplay        = "nonce_replay"
+	RejectNoAuth        = "no_auth"
+	RejectAuthError     = "auth_error"
+	RejectUnknown       = "unknown"
+	RejectInvalidToken  = "invalid_token"
+	RejectTimestampSkew = "timestamp_skew"
+	RejectInvalidMAC    = "invalid_mac"
+	RejectUIDMismatch   = "uid_mismatch"
+	RejectContentType   = "content_type"
+	RejectBodyRead      = "body_read"
+	RejectPayloadHash   = "payload_hash"
+)
+
 type HawkHandler struct {
 	handler http.Handler
 
@@ -34,9 +52,32 @@ type HawkHandler struct {
 	lastRotate    time.Time
 	bloomLock     sync.Mutex
 
-	secrets []string
+	// secrets can be replaced while serving, see SetSecrets
+	secrets     []string
+	secretsLock sync.RWMutex
+
+	// token.ParseToken, tests replace it to see which secrets are tried
+	parseToken func(secret []byte, tokenSecret string) (token.Token, error)
+
+	// MaxSecretsTried is how many of the first secrets a token is checked
+	// with since each one costs a HKDF and HMAC. 0 tries them all
+	MaxSecretsTried int
+
+	// largest Authorization header that will be parsed, 0 is unlimited
+	MaxAuthBytes int
+
+	// RejectLogger gets a line with a reason code and the client address
+	// for every rejected request, nil disables it
+	RejectLogger logrus.FieldLogger
+
+	// Metrics counts timestamp skew rejections, nil discards them. A spike
+	// usually means the server's clock drifted rather than the clients'
+	Metrics Metrics
 }
 
+// DefaultMaxAuthBytes is much larger than any real Hawk header
+const DefaultMaxAuthBytes = 4096
+
 func NewHawkHandler(handler http.Handler, secrets []string) *HawkHandler {
 	// the m value for the bloom filter is likely larger than
 	// we need. It figures 60,000 requests/minute * 50 = 3,000,000 bits
@@ -47,11 +88,42 @@ func NewHawkHandler(handler http.Handler, secrets []string) *HawkHandler {
 	return &HawkHandler{
 		handler:       handler,
 		secrets:       secrets,
+		parseToken:    token.ParseToken,
 		bloomPrev:     bloom.New(m, 5),
 		bloomNow:      bloom.New(m, 5),
 		bloomHalflife: 30 * time.Second,
 		lastRotate:    time.Now(),
+		MaxAuthBytes:  DefaultMaxAuthBytes,
+	}
+}
+
+// Secrets returns the secrets tokens are checked with. The slice must not
+// be modified
+func (h *HawkHandler) Secrets() []string {
+	h.secretsLock.RLock()
+	defer h.secretsLock.RUnlock()
+	return h.secrets
+}
+
+// secretsToTry returns the secrets a token is checked with, in the order
+// they were configured and no more than MaxSecretsTried of them
+func (h *HawkHandler) secretsToTry() []string {
+	secrets := h.Secrets()
+	if h.MaxSecretsTried > 0 && len(secrets) > h.MaxSecretsTried {
+		secrets = secrets[:h.MaxSecretsTried]
 	}
+	return secrets
+}
+
+// SetSecrets replaces the secrets used to check tokens so they can be rotated
+// without a restart. Requests already checking a token finish with the
+// secrets they started with.
+func (h *HawkHandler) SetSecrets(secrets []string) {
+	secrets = append([]string(nil), secrets...)
+
+	h.secretsLock.Lock()
+	h.secrets = secrets
+	h.secretsLock.Unlock()
 }
 
 func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -68,7 +140,8 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		session = ctxSession
 	}
 
-	// Step 1: Ensure the Hawk header is OK. Use ParseRequestHeader
+	// Step 1: Ensure the Hawk header is OK. Oversized headers are rejected
+	// before any time is wasted parsing them. Use ParseRequestHeader
 	// so the token does not have to be parsed twice to extract
 	// the UID from it.
 	//
@@ -76,28 +149,34 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// causes clients to fetch new tokens from the tokenserver. In practice most hawk errors
 	// can not be resolved with a new token, e.g: time skew too high, nonce replay, etc.
 	// there's no sense putting unnecessary load on the token service.
+	if h.MaxAuthBytes > 0 && len(r.Header.Get("Authorization")) > h.MaxAuthBytes {
+		h.reject(w, r, http.StatusBadRequest, RejectAuthTooLarge,
+			errors.Errorf("Hawk: Authorization header exceeds %d bytes", h.MaxAuthBytes))
+		return
+	}
+
 	auth, err := hawk.NewAuthFromRequest(r, nil, h.hawkNonceNotFound)
 	if err != nil {
 		if e, ok := err.(hawk.AuthFormatError); ok {
-			sendRequestProblem(w, r, http.StatusForbidden,
+			h.reject(w, r, http.StatusForbidden, RejectMalformed,
 				errors.Errorf("Hawk: Malformed hawk header, field: %s, err: %s", e.Field, e.Err))
 		} else if authError, ok := err.(hawk.AuthError); ok {
 			w.Header().Set("WWW-Authenticate", "Hawk")
 			switch authError {
 			case hawk.ErrReplay: // log the replay'd nonce
 				authInfo, _ := hawk.ParseRequestHeader(r.Header.Get("Authorization"))
-				sendRequestProblem(w, r, http.StatusForbidden,
+				h.reject(w, r, http.StatusForbidden, RejectReplay,
 					errors.Errorf("Hawk: Replay nonce=%s", authInfo.Nonce))
 			case hawk.ErrNoAuth:
 				// send a 401 for no Authorization header issues to force clients to
 				// fetch a new token. See https://bugzilla.mozilla.org/show_bug.cgi?id=1318799
 				// reasons.
-				sendRequestProblem(w, r, http.StatusUnauthorized, errors.Wrap(err, "Hawk: AuthError"))
+				h.reject(w, r, http.StatusUnauthorized, RejectNoAuth, errors.Wrap(err, "Hawk: AuthError"))
 			default:
-				sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: AuthError"))
+				h.reject(w, r, http.StatusForbidden, RejectAuthError, errors.Wrap(err, "Hawk: AuthError"))
 			}
 		} else {
-			sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: Unknown Error"))
+			h.reject(w, r, http.StatusForbidden, RejectUnknown, errors.Wrap(err, "Hawk: Unknown Error"))
 		}
 		return
 	}
@@ -108,15 +187,15 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		tokenError  error = ErrTokenInvalid
 	)
 
-	for _, secret := range h.secrets {
-		parsedToken, tokenError = token.ParseToken([]byte(secret), auth.Credentials.ID)
+	for _, secret := range h.secretsToTry() {
+		parsedToken, tokenError = h.parseToken([]byte(secret), auth.Credentials.ID)
 		if tokenError == nil { // found the right secret
 			break
 		}
 	}
 
 	if tokenError != nil {
-		sendRequestProblem(w, r, http.StatusUnauthorized, errors.Wrap(tokenError, "Hawk: Invalid token"))
+		h.reject(w, r, http.StatusUnauthorized, RejectInvalidToken, errors.Wrap(tokenError, "Hawk: Invalid token"))
 		return
 	} else {
 		// required to these manually so the auth.Valid()
@@ -132,23 +211,29 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// special case, want to see how far client clocks are off
 		if err == hawk.ErrTimestampSkew {
 			skew := auth.ActualTimestamp.Sub(auth.Timestamp)
-			sendRequestProblem(w, r, http.StatusForbidden, errors.Errorf("Hawk: timestamp skew too large %0.3f", skew.Seconds()))
+			if h.Metrics != nil {
+				client := "client:behind"
+				if skew < 0 {
+					client = "client:ahead"
+				}
+				h.Metrics.Incr("hawk.timestamp_skew", client)
+			}
+			h.reject(w, r, http.StatusForbidden, RejectTimestampSkew, errors.Errorf("Hawk: timestamp skew too large %0.3f", skew.Seconds()))
 		} else {
-			sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: auth invalid"))
+			h.reject(w, r, http.StatusForbidden, RejectInvalidMAC, errors.Wrap(err, "Hawk: auth invalid"))
 		}
 		return
 	}
 
-	// Step 4: Make sure token UID matches path UID for sync paths
-	if strings.HasPrefix(r.URL.Path, "/1.5/") {
+	// Step 4: Make sure token UID matches path UID for every API version
+	if pathUID := extractUID(r.URL.Path); pathUID != "" {
 		tokenUid := parsedToken.Payload.UidString()
-		pathUID := extractUID(r.URL.Path)
 		if tokenUid != pathUID {
 			// Ref: https://bugzilla.mozilla.org/show_bug.cgi?id=1304137
 			// a strange series of events can cause clients to use a token that doesn't
 			// match the URL. Sending a 401 should cause clients to abort, fetch a new token
 			// and regenerate the correct URL
-			sendRequestProblem(w, r, http.StatusUnauthorized,
+			h.reject(w, r, http.StatusUnauthorized, RejectUIDMismatch,
 				errors.Errorf("Hawk: UID in URL (%s) != Token UID (%s)", pathUID, tokenUid))
 			return
 		}
@@ -158,14 +243,14 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if auth.Hash != nil {
 		contentType := r.Header.Get("Content-Type")
 		if contentType == "" {
-			sendRequestProblem(w, r, http.StatusBadRequest,
+			h.reject(w, r, http.StatusBadRequest, RejectContentType,
 				errors.New("Hawk: Content-Type required"))
 			return
 		}
 
 		mediaType, _, err := mime.ParseMediaType(contentType)
 		if err != nil {
-			sendRequestProblem(w, r, http.StatusBadRequest,
+			h.reject(w, r, http.StatusBadRequest, RejectContentType,
 				errors.Wrap(err, "Hawk: Could not parse Content-Type"))
 			return
 		}
@@ -173,7 +258,7 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// read and replace io.Reader
 		content, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			sendRequestProblem(w, r, http.StatusBadRequest,
+			h.reject(w, r, http.StatusBadRequest, RejectBodyRead,
 				errors.Wrap(err, "Hawk: Could not read request body"))
 			return
 		}
@@ -183,7 +268,7 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pHash.Write(content)
 		if !auth.ValidHash(pHash) {
 			w.Header().Set("WWW-Authenticate", "Hawk")
-			sendRequestProblem(w, r, http.StatusForbidden,
+			h.reject(w, r, http.StatusForbidden, RejectPayloadHash,
 				errors.New("Hawk: payload hash invalid"))
 			return
 		}
@@ -191,10 +276,33 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Step 6: Update the session token and pass it on
 	session.Token = parsedToken.Payload
+	session.Credentials = auth.Credentials
 	h.handler.ServeHTTP(w, r)
 
 }
 
+// reject sends the error for a request that failed authentication and logs
+// why to the RejectLogger
+func (h *HawkHandler) reject(w http.ResponseWriter, r *http.Request, status int, reason string, err error) {
+	if h.RejectLogger != nil {
+		remote, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+		if splitErr != nil {
+			remote = r.RemoteAddr
+		}
+
+		h.RejectLogger.WithFields(logrus.Fields{
+			"reason": reason,
+			"remote": remote,
+			"status": status,
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"err":    err.Error(),
+		}).Warn("Hawk: request rejected")
+	}
+
+	sendRequestProblem(w, r, status, err)
+}
+
 func (h *HawkHandler) hawkNonceNotFound(nonce string, t time.Time, creds *hawk.Credentials) bool {
 	// From the Docs:
 	//   The nonce is generated by the client, and is a string unique across all
@@ -8,9 +8,13 @@ import (
 	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	logtest "github.com/Sirupsen/logrus/hooks/test"
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/mozilla-services/go-syncstorage/token"
 	"github.com/stretchr/testify/assert"
@@ -104,6 +108,15 @@ func TestHawkUidMismatchFails(t *testing.T) {
 	req, _ := hawkrequest("GET", syncurl("67890", "info/collections"), tok)
 	resp := sendrequest(req, hawkH)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// paths of other API versions are checked too
+	req, _ = hawkrequest("GET", "http://synchost/2.0/67890/info/collections", tok)
+	resp = sendrequest(req, hawkH)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	req, _ = hawkrequest("GET", "http://synchost/2.0/12345/info/collections", tok)
+	resp = sendrequest(req, hawkH)
+	assert.Equal(t, http.StatusOK, resp.Code)
 }
 
 // TestHawkNoAuthorizationError401 tests that the server sends a 401 status when
@@ -119,13 +132,33 @@ func TestHawkNoAuthorizationError401(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
 }
 
+func TestHawkMaxAuthBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	hawkH.MaxAuthBytes = 1024
+
+	header := make(http.Header)
+	header.Set("Authorization", "Hawk id=\""+strings.Repeat("x", 1024)+"\"")
+	resp := requestheaders("GET", syncurl(uid, "info/collections"), nil, header, hawkH)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Contains(resp.Body.String(), "Authorization header exceeds 1024 bytes")
+
+	// normal sized headers still work
+	tok := testtoken(hawkH.secrets[0], uid)
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	resp = sendrequest(req, hawkH)
+	assert.Equal(http.StatusOK, resp.Code)
+}
+
 func TestHawkMultiSecrets(t *testing.T) {
 	t.Parallel()
 
 	var uid uint64 = 12345
 	hawkH := NewHawkHandler(EchoHandler, []string{"one", "two", "three"})
 
-	for _, secret := range hawkH.secrets {
+	for _, secret := range hawkH.Secrets() {
 		tok := testtoken(secret, uid)
 		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
 		resp := sendrequest(req, hawkH)
@@ -135,6 +168,225 @@ func TestHawkMultiSecrets(t *testing.T) {
 	}
 }
 
+func TestHawkSetSecrets(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var uid uint64 = 12346
+	hawkH := NewHawkHandler(EchoHandler, []string{"old"})
+
+	get := func(secret string) int {
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), testtoken(secret, uid))
+		return sendrequest(req, hawkH).Code
+	}
+
+	assert.Equal(http.StatusOK, get("old"))
+	assert.Equal(http.StatusUnauthorized, get("new"))
+
+	secrets := []string{"new", "old"}
+	hawkH.SetSecrets(secrets)
+	secrets[0] = "changed" // the handler keeps its own copy
+
+	assert.Equal(http.StatusOK, get("new"))
+	assert.Equal(http.StatusOK, get("old"))
+
+	hawkH.SetSecrets([]string{"new"})
+	assert.Equal(http.StatusUnauthorized, get("old"))
+
+	// requests during a rotation see one set of secrets or the other
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			assert.Equal(http.StatusOK, get("new"))
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		hawkH.SetSecrets([]string{"new", strconv.Itoa(i)})
+	}
+	<-done
+}
+
+func TestHawkSecretOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12347
+	hawkH := NewHawkHandler(EchoHandler, []string{"a", "b", "c"})
+
+	var tried []string
+	hawkH.parseToken = func(secret []byte, tokenSecret string) (token.Token, error) {
+		tried = append(tried, string(secret))
+		return token.ParseToken(secret, tokenSecret)
+	}
+
+	get := func(secret string) int {
+		tried = nil
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), testtoken(secret, uid))
+		return sendrequest(req, hawkH).Code
+	}
+
+	assert.Equal(http.StatusOK, get("c"))
+	assert.Equal([]string{"a", "b", "c"}, tried)
+
+	// secrets are always tried in the configured order
+	assert.Equal(http.StatusOK, get("a"))
+	assert.Equal([]string{"a"}, tried)
+	assert.Equal(http.StatusOK, get("c"))
+	assert.Equal([]string{"a", "b", "c"}, tried)
+
+	// invalid tokens only get MaxSecretsTried checks
+	hawkH.MaxSecretsTried = 2
+	assert.Equal(http.StatusUnauthorized, get("nope"))
+	assert.Equal([]string{"a", "b"}, tried)
+
+	// the same token gets the same answer whatever was checked before it
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, get("b"))
+		assert.Equal([]string{"a", "b"}, tried)
+		assert.Equal(http.StatusOK, get("a"))
+		assert.Equal([]string{"a"}, tried)
+		assert.Equal(http.StatusUnauthorized, get("c"))
+	}
+}
+
+func TestHawkRejectLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12347
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	hawkH.MaxAuthBytes = 1024
+
+	logger, hook := logtest.NewNullLogger()
+	hawkH.RejectLogger = logger
+
+	url := syncurl(uid, "storage/col")
+	tok := testtoken("sekret", uid)
+
+	signed := func(method, contentType, body string) (*http.Request, *hawk.Auth) {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req, auth := hawkrequestbody(method, url, tok, contentType, r)
+		req.RemoteAddr = "203.0.113.7:51234"
+		return req, auth
+	}
+
+	replayed, _ := signed("GET", "", "")
+	sendrequest(replayed, hawkH)
+
+	tests := map[string]func() *http.Request{
+		RejectAuthTooLarge: func() *http.Request {
+			req, _ := signed("GET", "", "")
+			req.Header.Set("Authorization", "Hawk id=\""+strings.Repeat("x", 1024)+"\"")
+			return req
+		},
+		RejectMalformed: func() *http.Request {
+			req, _ := signed("GET", "", "")
+			req.Header.Set("Authorization", `Hawk id="x", ts="not a number"`)
+			return req
+		},
+		RejectReplay: func() *http.Request {
+			return replayed
+		},
+		RejectNoAuth: func() *http.Request {
+			req, _ := signed("GET", "", "")
+			req.Header.Del("Authorization")
+			return req
+		},
+		RejectAuthError: func() *http.Request {
+			req, _ := signed("POST", "", "")
+			req.Header.Del("Authorization")
+			req.URL.RawQuery = "bewit=x"
+			return req
+		},
+		RejectInvalidToken: func() *http.Request {
+			req, _ := hawkrequest("GET", url, testtoken("other", uid))
+			req.RemoteAddr = "203.0.113.7:51234"
+			return req
+		},
+		RejectTimestampSkew: func() *http.Request {
+			req, auth := signed("GET", "", "")
+			auth.Timestamp = auth.Timestamp.Add(-time.Hour)
+			req.Header.Set("Authorization", auth.RequestHeader())
+			return req
+		},
+		RejectInvalidMAC: func() *http.Request {
+			req, _ := signed("GET", "", "")
+			req.Method = "DELETE"
+			return req
+		},
+		RejectUIDMismatch: func() *http.Request {
+			req, _ := hawkrequest("GET", syncurl(uid+1, "storage/col"), tok)
+			req.RemoteAddr = "203.0.113.7:51234"
+			return req
+		},
+		RejectContentType: func() *http.Request {
+			req, _ := signed("POST", "application/json", "[]")
+			req.Header.Del("Content-Type")
+			return req
+		},
+		RejectBodyRead: func() *http.Request {
+			req, _ := signed("POST", "application/json", "[]")
+			req.Body = ioutil.NopCloser(iotest.TimeoutReader(strings.NewReader("[]")))
+			return req
+		},
+		RejectPayloadHash: func() *http.Request {
+			req, _ := signed("POST", "application/json", "[]")
+			req.Body = ioutil.NopCloser(strings.NewReader("{}"))
+			return req
+		},
+	}
+
+	for reason, makeRequest := range tests {
+		hook.Reset()
+		resp := sendrequest(makeRequest(), hawkH)
+		assert.NotEqual(http.StatusOK, resp.Code, reason)
+
+		if entry := hook.LastEntry(); assert.NotNil(entry, reason) {
+			assert.Len(hook.Entries, 1, reason)
+			assert.Equal(logrus.WarnLevel, entry.Level, reason)
+			assert.Equal(reason, entry.Data["reason"], reason)
+			assert.Equal("203.0.113.7", entry.Data["remote"], reason)
+			assert.Equal(resp.Code, entry.Data["status"], reason)
+		}
+	}
+
+	// accepted requests are not logged
+	hook.Reset()
+	req, _ := signed("GET", "", "")
+	assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
+	assert.Nil(hook.LastEntry())
+}
+
+func TestHawkTimestampSkewMetric(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12348
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	metrics := &recordingMetrics{}
+	hawkH.Metrics = metrics
+
+	send := func(skew time.Duration, secret string) int {
+		req, auth := hawkrequest("GET", syncurl(uid, "info/collections"), testtoken(secret, uid))
+		auth.Timestamp = auth.Timestamp.Add(skew)
+		req.Header.Set("Authorization", auth.RequestHeader())
+		return sendrequest(req, hawkH).Code
+	}
+
+	assert.Equal(http.StatusForbidden, send(-time.Hour, "sekret"))
+	assert.Equal(http.StatusForbidden, send(time.Hour, "sekret"))
+	assert.Equal([]string{
+		"hawk.timestamp_skew|client:behind",
+		"hawk.timestamp_skew|client:ahead",
+	}, metrics.counts)
+
+	// other failures are not counted
+	assert.Equal(http.StatusUnauthorized, send(0, "other"))
+	assert.Equal(http.StatusOK, send(0, "sekret"))
+	assert.Len(metrics.counts, 2)
+}
+
 func TestHawkAuthGET(t *testing.T) {
 
 	var uid uint64 = 12345
@@ -172,6 +424,14 @@ func TestHawkAuthPOST(t *testing.T) {
 
 	// make sure the payload made it through unscathed to EchoHandler
 	assert.Equal(payload, resp.Body.String())
+
+	// the hash uses the lower cased media type without parameters
+	for _, contentType := range []string{"Text/Plain; Charset=UTF-8", "APPLICATION/JSON", "application/json ; charset=utf-8"} {
+		body := bytes.NewBufferString(payload)
+		req, _ := hawkrequestbody("POST", syncurl(uid, "storage/collections/boom"), tok, contentType, body)
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusOK, resp.Code, contentType)
+	}
 }
 
 func TestHawkNonceCheckFunc(t *testing.T) {
@@ -255,6 +515,22 @@ func TestHawkAuthNonceRequest(t *testing.T) {
 	assert.NotEqual(t, http.StatusOK, resp2.Code)
 }
 
+// BenchmarkHawkManySecrets checks tokens made with the last of many secrets
+func BenchmarkHawkManySecrets(b *testing.B) {
+	secrets := make([]string, 50)
+	for i := range secrets {
+		secrets[i] = "sekret" + strconv.Itoa(i)
+	}
+
+	hawkH := NewHawkHandler(EchoHandler, secrets)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tok := testtoken(secrets[len(secrets)-1], uint64(i))
+		req, _ := hawkrequest("GET", "/", tok)
+		sendrequest(req, hawkH)
+	}
+}
+
 func BenchmarkHawkAuth(b *testing.B) {
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
 	for i := 0; i < b.N; i++ {
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,25 +13,51 @@ import (
 // InfoHandler serves endpoints that are not part of the sync 1.5
 // api that a syncserver should provide
 type InfoHandler struct {
-	router *mux.Router
+	router  *mux.Router
+	handler http.Handler
+
+	// API versions passed on to the wrapped handler. Requests for any
+	// other version get an error listing these
+	SupportedVersions []string
+
+	// when set the heartbeat reports if the server is read only
+	DiskMonitor *DiskMonitor
+
+	// formats errors for the unsupported API version response and
+	// every handler it wraps. nil uses DefaultErrorFormatter
+	ErrorFormatter ErrorFormatter
+}
+
+// unsupportedVersion is sent so clients can detect they are
+// talking to a server that does not speak their API version
+type unsupportedVersion struct {
+	Err       string   `json:"err"`
+	Version   string   `json:"version"`
+	Supported []string `json:"supported"`
 }
 
 func NewInfoHandler(h http.Handler) *InfoHandler {
 
 	r := mux.NewRouter()
 	server := &InfoHandler{
-		router: r,
+		router:            r,
+		handler:           h,
+		SupportedVersions: apiVersions(),
 	}
 
 	r.NotFoundHandler = h
 	r.HandleFunc("/", server.handleRoot)
 	r.HandleFunc("/__heartbeat__", server.handleHeartbeat)
 	r.HandleFunc("/__version__", server.handleVersion)
+	r.PathPrefix("/{version:[0-9]+\\.[0-9]+}/").HandlerFunc(server.handleAPIVersion)
 
 	return server
 }
 
 func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.ErrorFormatter != nil {
+		req = req.WithContext(NewErrorFormatterContext(req.Context(), h.ErrorFormatter))
+	}
 	h.router.ServeHTTP(w, req)
 }
 
@@ -39,9 +66,35 @@ func (h *InfoHandler) handleRoot(w http.ResponseWriter, req *http.Request) {
 }
 
 func (h *InfoHandler) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
+	if h.DiskMonitor != nil && h.DiskMonitor.ReadOnly() {
+		OKResponse(w, "OK, read only: low disk space")
+		return
+	}
 	OKResponse(w, "OK")
 }
 
+func (h *InfoHandler) handleAPIVersion(w http.ResponseWriter, req *http.Request) {
+	version := mux.Vars(req)["version"]
+	for _, v := range h.SupportedVersions {
+		if v == version {
+			h.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+
+	if h.ErrorFormatter != nil {
+		sendRequestProblem(w, req, http.StatusNotFound,
+			errors.New("Unsupported API version "+version))
+		return
+	}
+
+	JSON(w, req, http.StatusNotFound, unsupportedVersion{
+		Err:       "Unsupported API version " + version,
+		Version:   version,
+		Supported: h.SupportedVersions,
+	})
+}
+
 func (h *InfoHandler) handleVersion(w http.ResponseWriter, req *http.Request) {
 	dir, err := os.Getwd()
 	if err != nil {
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoHandlerUnsupportedVersion(t *testing.T) {
+	assert := assert.New(t)
+	handler := NewInfoHandler(EchoHandler)
+
+	resp := request("GET", "http://test/1.0/1/info/collections", nil, handler)
+	if !assert.Equal(http.StatusNotFound, resp.Code) {
+		return
+	}
+
+	var body struct {
+		Err       string
+		Version   string
+		Supported []string
+	}
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &body)) {
+		assert.Equal("Unsupported API version 1.0", body.Err)
+		assert.Equal("1.0", body.Version)
+		assert.Equal([]string{"1.5"}, body.Supported)
+	}
+
+	// supported versions and everything else are passed through
+	for _, path := range []string{"/1.5/1/info/collections", "/foo/bar"} {
+		resp = request("GET", "http://test"+path, nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, path)
+	}
+
+	handler.SupportedVersions = []string{"1.0", "1.5"}
+	resp = request("GET", "http://test/1.0/1/info/collections", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitListener accepts at most Max connections at a time. Accept blocks
+// until an open connection is closed so excess clients wait in the kernel's
+// listen backlog instead of using up file descriptors.
+type LimitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func NewLimitListener(l net.Listener, max int) *LimitListener {
+	return &LimitListener{
+		Listener: l,
+		slots:    make(chan struct{}, max),
+	}
+}
+
+// Max is the number of connections that can be open at once
+func (l *LimitListener) Max() int {
+	return cap(l.slots)
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// limitConn frees its slot once no matter how many times it is closed
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitListener(t *testing.T) {
+	assert := assert.New(t)
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewLimitListener(raw, 2)
+	defer l.Close()
+	assert.Equal(2, l.Max())
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+	}
+
+	accept := func() <-chan net.Conn {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				accepted <- c
+			}
+		}()
+		return accepted
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-accept():
+			conns = append(conns, c)
+		case <-time.After(time.Second):
+			t.Fatal("Expected connection to be accepted")
+		}
+	}
+
+	// the third waits for a free slot
+	third := accept()
+	select {
+	case <-third:
+		t.Fatal("Expected connection over the limit to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing twice only frees one slot
+	conns[0].Close()
+	conns[0].Close()
+	select {
+	case c := <-third:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Expected connection to be accepted after a close")
+	}
+
+	assert.Len(l.slots, 1)
+	conns[1].Close()
+	assert.Len(l.slots, 0)
+}
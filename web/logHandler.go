@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -20,9 +21,21 @@ func NewLogHandler(l logrus.FieldLogger, h http.Handler) http.Handler {
 }
 
 type LoggingHandler struct {
+	// successful requests seen for sampling, first so atomic operations
+	// on it are 64 bit aligned on 32 bit platforms
+	successes uint64
+
 	logger         logrus.FieldLogger
 	handler        http.Handler
 	OnlyHTTPErrors bool
+
+	// SampleRate logs 1 in SampleRate successful requests, errors are
+	// always logged. 0 or 1 logs every request
+	SampleRate int
+
+	// SlowRequest successful requests that take longer are always
+	// logged, 0 disables it
+	SlowRequest time.Duration
 }
 
 func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -41,7 +54,8 @@ func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		h.handler.ServeHTTP(logger, req)
 	}
 
-	took := int(time.Duration(time.Since(start).Nanoseconds()) / time.Millisecond)
+	elapsed := time.Since(start)
+	took := int(time.Duration(elapsed.Nanoseconds()) / time.Millisecond)
 
 	uri := req.RequestURI
 
@@ -83,6 +97,11 @@ func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// a 304 keeps its errno but is sampled like other successes
+	if (errno == 0 || errno == http.StatusNotModified) && !h.sampled(elapsed) {
+		return
+	}
+
 	// common fields to log with every request
 	fields := logrus.Fields{
 		"agent":  req.UserAgent(),
@@ -109,6 +128,19 @@ func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.logger.WithFields(fields).Info(logMsg)
 }
 
+// sampled decides if a successful request is logged
+func (h *LoggingHandler) sampled(elapsed time.Duration) bool {
+	if h.SampleRate <= 1 {
+		return true
+	}
+
+	if h.SlowRequest > 0 && elapsed >= h.SlowRequest {
+		return true
+	}
+
+	return atomic.AddUint64(&h.successes, 1)%uint64(h.SampleRate) == 1
+}
+
 // mozlog represents the MozLog standard format https://github.com/mozilla-services/Dockerflow/blob/master/docs/mozlog.md
 type mozlog struct {
 	Timestamp  int64
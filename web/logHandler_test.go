@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	logtest "github.com/Sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -178,6 +179,49 @@ func TestLogHandlerCauseFromContext(t *testing.T) {
 	}
 }
 
+func TestLogHandlerSampleRate(t *testing.T) {
+	assert := assert.New(t)
+
+	logger, hook := logtest.NewNullLogger()
+	handler := NewLogHandler(logger, OKFailHandler).(*LoggingHandler)
+	handler.SampleRate = 4
+
+	count := func(path string, n int) int {
+		hook.Reset()
+		for i := 0; i < n; i++ {
+			request("GET", path, nil, handler)
+		}
+		return len(hook.Entries)
+	}
+
+	assert.Equal(3, count("/ok", 12))
+	assert.Equal(12, count("/fail", 12), "errors are always logged")
+
+	notModified := NewLogHandler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})).(*LoggingHandler)
+	notModified.SampleRate = 4
+	hook.Reset()
+	for i := 0; i < 12; i++ {
+		request("GET", "/notmodified", nil, notModified)
+	}
+	if assert.Len(hook.Entries, 3, "304s are sampled") {
+		assert.Equal(http.StatusNotModified, hook.Entries[0].Data["errno"])
+	}
+
+	// slow requests are always logged
+	slow := NewLogHandler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})).(*LoggingHandler)
+	slow.SampleRate = 4
+	slow.SlowRequest = time.Millisecond
+	hook.Reset()
+	for i := 0; i < 4; i++ {
+		request("GET", "/slow", nil, slow)
+	}
+	assert.Len(hook.Entries, 4)
+}
+
 func TestLogHandlerMozlogFormatter(t *testing.T) {
 	assert := assert.New(t)
 	fields := logrus.Fields{
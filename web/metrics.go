@@ -0,0 +1,46 @@
+package web
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Metrics receives measurements from the handlers. Tags are
+// "key:value" strings, ie: "result:miss"
+type Metrics interface {
+	Timing(name string, d time.Duration, tags ...string)
+	Incr(name string, tags ...string)
+}
+
+// NopMetrics discards all measurements. It is used when
+// no Metrics are configured
+type NopMetrics struct{}
+
+func (NopMetrics) Timing(string, time.Duration, ...string) {}
+func (NopMetrics) Incr(string, ...string)                  {}
+
+// LogMetrics writes measurements as log entries so they end up
+// wherever the logs go. With LOG_MOZLOG they are mozsvc.metrics
+type LogMetrics struct {
+	logger *log.Logger
+}
+
+func NewLogMetrics(logger *log.Logger) *LogMetrics {
+	return &LogMetrics{logger: logger}
+}
+
+func (m *LogMetrics) Timing(name string, d time.Duration, tags ...string) {
+	m.logger.WithFields(log.Fields{
+		"metric": name,
+		"t":      int64(d / time.Millisecond),
+		"tags":   tags,
+	}).Info("timing")
+}
+
+func (m *LogMetrics) Incr(name string, tags ...string) {
+	m.logger.WithFields(log.Fields{
+		"metric": name,
+		"tags":   tags,
+	}).Info("incr")
+}
@@ -0,0 +1,447 @@
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"go.mozilla.org/hawk"
+)
+
+type MirrorConfig struct {
+	// Upstream is the base URL of the secondary server, ie: https://node2:8000
+	Upstream string
+
+	// QueueSize is how many writes can wait to be forwarded. Writes
+	// arriving when it is full are dropped
+	QueueSize int
+
+	// MaxRetries for writes the upstream fails with a 5xx or network error.
+	// Retries back off from RetryDelay
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// largest request body that is mirrored, bigger ones are only applied
+	// locally. It should match the largest request the server accepts
+	MaxBodyBytes int
+
+	// BatchTTL is how long the upstream id of a batch is remembered. It
+	// should match how long the servers keep uncommitted batches
+	BatchTTL time.Duration
+
+	Client  *http.Client
+	Metrics Metrics
+}
+
+func NewDefaultMirrorConfig(upstream string) *MirrorConfig {
+	return &MirrorConfig{
+		Upstream:     strings.TrimRight(upstream, "/"),
+		QueueSize:    1000,
+		MaxRetries:   3,
+		RetryDelay:   100 * time.Millisecond,
+		MaxBodyBytes: 2 * 1024 * 1024,
+		BatchTTL:     2 * time.Hour,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// mirrorOp is a write that was applied locally and waits to be forwarded
+type mirrorOp struct {
+	method string
+	uri    string
+	header http.Header
+	body   []byte
+	creds  hawk.Credentials
+
+	// batch is the local id of the batch the write appends to or
+	// commits. newBatch is the id the local server gave a batch=true
+	// request. Both are translated to the ids the upstream uses
+	batch    string
+	newBatch string
+	commit   bool
+}
+
+// batchKey identifies a batch in the upstream id map. Batch ids are only
+// unique within a user's collection
+func (op *mirrorOp) batchKey(id string) string {
+	path := op.uri
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path + "?" + id
+}
+
+// Mirror forwards writes to a secondary server in the background, ie: to
+// migrate users between nodes without downtime. Forwarded requests are
+// signed again with the client's token for the upstream host, so the
+// upstream must share the same token SECRETS.
+type Mirror struct {
+	config  *MirrorConfig
+	metrics Metrics
+	queue   chan *mirrorOp
+	done    chan struct{}
+
+	// local batch ids to upstream batch ids, batchList is ordered oldest
+	// first so expired ones are trimmed off the front. Only used by run()
+	batches   map[string]*list.Element
+	batchList *list.List
+
+	// stops enqueue sending on a closed queue
+	sync.RWMutex
+	stopped bool
+}
+
+func NewMirror(config *MirrorConfig) *Mirror {
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = NopMetrics{}
+	}
+
+	m := &Mirror{
+		config:    config,
+		metrics:   metrics,
+		queue:     make(chan *mirrorOp, config.QueueSize),
+		done:      make(chan struct{}),
+		batches:   make(map[string]*list.Element),
+		batchList: list.New(),
+	}
+
+	go m.run()
+	return m
+}
+
+// enqueue adds a write to be forwarded. It never blocks, the write is
+// dropped when the queue is full
+func (m *Mirror) enqueue(op *mirrorOp) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.stopped {
+		return false
+	}
+
+	select {
+	case m.queue <- op:
+		return true
+	default:
+		m.metrics.Incr("mirror.forward", "result:dropped")
+		log.WithFields(log.Fields{
+			"method": op.method,
+			"path":   op.uri,
+		}).Warn("Mirror: queue full, write dropped")
+		return false
+	}
+}
+
+// Stop forwards the writes already queued and returns when they are done
+func (m *Mirror) Stop() {
+	m.Lock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.queue)
+	}
+	m.Unlock()
+
+	<-m.done
+}
+
+func (m *Mirror) run() {
+	defer close(m.done)
+	for op := range m.queue {
+		m.forward(op)
+	}
+}
+
+// mirrorBatch is the upstream id of a batch created through the Mirror
+type mirrorBatch struct {
+	key      string
+	upstream string
+	expires  time.Time
+}
+
+// expireBatches forgets batches older than BatchTTL, the servers have
+// purged them so anything added to them would be rejected
+func (m *Mirror) expireBatches(now time.Time) {
+	for e := m.batchList.Front(); e != nil; e = m.batchList.Front() {
+		if now.Before(e.Value.(*mirrorBatch).expires) {
+			return
+		}
+		m.forgetBatch(e)
+	}
+}
+
+func (m *Mirror) forgetBatch(e *list.Element) {
+	m.batchList.Remove(e)
+	delete(m.batches, e.Value.(*mirrorBatch).key)
+}
+
+// forward sends op to the upstream, retrying network errors and 5xx
+// responses. 4xx responses will not get better and are not retried
+func (m *Mirror) forward(op *mirrorOp) {
+	uri := op.uri
+	if op.batch != "" {
+		m.expireBatches(time.Now())
+		e, ok := m.batches[op.batchKey(op.batch)]
+		if !ok {
+			// the upstream never created this batch so anything added
+			// to it would be rejected
+			m.metrics.Incr("mirror.forward", "result:skipped")
+			log.WithFields(log.Fields{
+				"method": op.method,
+				"path":   op.uri,
+			}).Warn("Mirror: unknown batch, write skipped")
+			return
+		}
+
+		if op.commit {
+			m.forgetBatch(e)
+		}
+		uri = replaceQueryParam(uri, "batch", e.Value.(*mirrorBatch).upstream)
+	}
+
+	var err error
+	delay := m.config.RetryDelay
+
+	for attempt := 0; attempt <= m.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var (
+			status int
+			body   []byte
+		)
+		status, body, err = m.send(op, uri)
+		if err == nil && status < 500 {
+			if status >= 400 {
+				m.metrics.Incr("mirror.forward", "result:rejected", "status:"+strconv.Itoa(status))
+				log.WithFields(log.Fields{
+					"method": op.method,
+					"path":   op.uri,
+					"status": status,
+				}).Warn("Mirror: write rejected by upstream")
+			} else {
+				m.metrics.Incr("mirror.forward", "result:ok")
+				if op.newBatch != "" {
+					m.rememberBatch(op, body)
+				}
+			}
+			return
+		}
+
+		if err == nil {
+			err = errors.Errorf("Upstream responded %d", status)
+		}
+	}
+
+	m.metrics.Incr("mirror.forward", "result:failed")
+	log.WithFields(log.Fields{
+		"method": op.method,
+		"path":   op.uri,
+		"err":    err.Error(),
+	}).Error("Mirror: could not forward write")
+}
+
+// rememberBatch maps the batch id the local server created to the one
+// in the upstream's response
+func (m *Mirror) rememberBatch(op *mirrorOp, body []byte) {
+	var results struct {
+		Batch string `json:"batch"`
+	}
+	if err := json.Unmarshal(body, &results); err != nil || results.Batch == "" {
+		log.WithFields(log.Fields{
+			"method": op.method,
+			"path":   op.uri,
+		}).Warn("Mirror: upstream did not return a batch id")
+		return
+	}
+
+	now := time.Now()
+	m.expireBatches(now)
+
+	key := op.batchKey(op.newBatch)
+	if e, ok := m.batches[key]; ok {
+		m.forgetBatch(e)
+	}
+	m.batches[key] = m.batchList.PushBack(&mirrorBatch{
+		key:      key,
+		upstream: results.Batch,
+		expires:  now.Add(m.config.BatchTTL),
+	})
+}
+
+// send makes the request to the upstream. Every attempt is signed with a
+// fresh Hawk timestamp and nonce for the upstream's host
+func (m *Mirror) send(op *mirrorOp, uri string) (int, []byte, error) {
+	req, err := http.NewRequest(op.method, m.config.Upstream+uri, bytes.NewReader(op.body))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for name, vals := range op.header {
+		req.Header[name] = vals
+	}
+
+	auth := hawk.NewRequestAuth(req, &op.creds, 0)
+	if len(op.body) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		h := auth.PayloadHash(mediaType)
+		h.Write(op.body)
+		auth.SetHash(h)
+	}
+	req.Header.Set("Authorization", auth.RequestHeader())
+
+	resp, err := m.config.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	// only batch ids are read from responses, which are small
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// replaceQueryParam sets key to val in the query string of uri
+func replaceQueryParam(uri, key, val string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	q.Set(key, val)
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// MirrorHandler queues successful POST, PUT, PATCH and DELETE requests to be
+// forwarded by a Mirror. Reads are only served locally. It must sit inside
+// the HawkHandler, which provides the credentials to sign forwarded requests
+// with.
+type MirrorHandler struct {
+	handler http.Handler
+	mirror  *Mirror
+}
+
+func NewMirrorHandler(h http.Handler, mirror *Mirror) *MirrorHandler {
+	return &MirrorHandler{handler: h, mirror: mirror}
+}
+
+func (h *MirrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+	default:
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	// keep a copy of the body to send later. Bodies that are too large
+	// are passed on untouched and not mirrored
+	var body []byte
+	mirror := true
+	if req.Body != nil {
+		limit := int64(h.mirror.config.MaxBodyBytes)
+		buf, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil {
+			sendRequestProblem(w, req, http.StatusBadRequest, errors.Wrap(err, "Could not read body"))
+			return
+		}
+
+		if int64(len(buf)) > limit {
+			mirror = false
+			req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buf), req.Body))
+		} else {
+			body = buf
+			req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		}
+	}
+
+	// the id of a new batch is only known from the response
+	batchFound, batchId, batchCommit := GetBatchIdAndCommit(req)
+	newBatch := batchFound && batchId == "true" && !batchCommit
+
+	logger := &mirrorResponseWriter{responseLogger: responseLogger{w: w}, capture: newBatch}
+	h.handler.ServeHTTP(logger, req)
+
+	// handlers that never write are a 200
+	status := logger.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if !mirror || status < 200 || status >= 300 {
+		return
+	}
+
+	// a response replayed for an Idempotency-Key was not written again
+	// locally, the upstream got the original request
+	if logger.Header().Get("Idempotent-Replayed") == "true" {
+		h.mirror.metrics.Incr("mirror.forward", "result:replayed")
+		return
+	}
+
+	session, ok := SessionFromContext(req.Context())
+	if !ok || session.Credentials.ID == "" {
+		h.mirror.metrics.Incr("mirror.forward", "result:skipped")
+		return
+	}
+
+	header := make(http.Header)
+	for _, name := range []string{"Content-Type", "Content-Encoding", "User-Agent"} {
+		if v := req.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+
+	op := &mirrorOp{
+		method: req.Method,
+		uri:    req.URL.RequestURI(),
+		header: header,
+		body:   body,
+		creds:  session.Credentials,
+		commit: batchCommit,
+	}
+
+	if newBatch {
+		var results struct {
+			Batch string `json:"batch"`
+		}
+		if err := json.Unmarshal(logger.body.Bytes(), &results); err != nil || results.Batch == "" {
+			h.mirror.metrics.Incr("mirror.forward", "result:skipped")
+			return
+		}
+		op.newBatch = results.Batch
+	} else if batchFound && batchId != "true" {
+		op.batch = batchId
+	}
+
+	h.mirror.enqueue(op)
+}
+
+// mirrorResponseWriter keeps a copy of the response body when capture
+// is set
+type mirrorResponseWriter struct {
+	responseLogger
+	capture bool
+	body    bytes.Buffer
+}
+
+func (m *mirrorResponseWriter) Write(b []byte) (int, error) {
+	if m.capture {
+		m.body.Write(b)
+	}
+	return m.responseLogger.Write(b)
+}
@@ -0,0 +1,327 @@
+package web
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/hawk"
+)
+
+type forwarded struct {
+	method, uri, body string
+}
+
+// fakeUpstream records the requests it gets. The first failures requests
+// get a 503. New batches are given an id of its own
+type fakeUpstream struct {
+	sync.Mutex
+	failures int
+	requests []forwarded
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, forwarded{
+		method: r.Method,
+		uri:    r.URL.RequestURI(),
+		body:   string(body),
+	})
+
+	if r.URL.Query().Get("batch") == "true" {
+		w.Write([]byte(`{"batch":"upstream"}`))
+	}
+}
+
+func (f *fakeUpstream) received() []forwarded {
+	f.Lock()
+	defer f.Unlock()
+	return append([]forwarded(nil), f.requests...)
+}
+
+// newTestMirror starts an upstream that requires Hawk auth signed with
+// the same secret as the local server
+func newTestMirror(upstream *fakeUpstream, secret string) (*Mirror, *recordingMetrics, func()) {
+	server := httptest.NewServer(NewHawkHandler(upstream, []string{secret}))
+
+	metrics := &recordingMetrics{}
+	config := NewDefaultMirrorConfig(server.URL + "/")
+	config.RetryDelay = time.Millisecond
+	config.Metrics = metrics
+	return NewMirror(config), metrics, server.Close
+}
+
+// upstreamURI is the RequestURI the upstream gets for a syncurl
+func upstreamURI(uid uint64, path string) string {
+	return "/1.5/" + strconv.FormatUint(uid, 10) + "/" + path
+}
+
+func TestMirrorHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, _ := strconv.ParseUint(uniqueUID(), 10, 64)
+	tok := testtoken("sekret", uid)
+
+	upstream := &fakeUpstream{failures: 1}
+	mirror, metrics, closeUpstream := newTestMirror(upstream, "sekret")
+	defer closeUpstream()
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		if string(body) == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write(body)
+	})
+	handler := NewHawkHandler(NewMirrorHandler(local, mirror), []string{"sekret"})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req, _ := hawkrequestbody(method, syncurl(uid, path), tok, "application/json", reader)
+		return sendrequest(req, handler)
+	}
+
+	// the local response is not changed
+	resp := send("POST", "storage/col", "data")
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("data", resp.Body.String())
+
+	send("DELETE", "storage/col/bso", "")
+
+	// reads and failed writes are not forwarded
+	send("GET", "storage/col", "")
+	send("PUT", "storage/col/bso", "bad")
+
+	mirror.Stop()
+
+	// requests are signed again for the upstream's host, the
+	// first attempt got a 503 and was retried with a new nonce
+	received := upstream.received()
+	if assert.Len(received, 2) {
+		assert.Equal(forwarded{
+			method: "POST",
+			uri:    upstreamURI(uid, "storage/col"),
+			body:   "data",
+		}, received[0])
+		assert.Equal("DELETE", received[1].method)
+		assert.Equal(upstreamURI(uid, "storage/col/bso"), received[1].uri)
+	}
+
+	assert.Equal([]string{"mirror.forward|result:ok", "mirror.forward|result:ok"}, metrics.counts)
+
+	// nothing is queued after stopping
+	send("POST", "storage/col", "late")
+	assert.Len(upstream.received(), 2)
+}
+
+func TestMirrorRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, _ := strconv.ParseUint(uniqueUID(), 10, 64)
+
+	// the upstream does not share the token secret
+	upstream := &fakeUpstream{}
+	mirror, metrics, closeUpstream := newTestMirror(upstream, "other")
+	defer closeUpstream()
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := NewHawkHandler(NewMirrorHandler(local, mirror), []string{"sekret"})
+
+	req, _ := hawkrequest("DELETE", syncurl(uid, "storage/col"), testtoken("sekret", uid))
+	assert.Equal(http.StatusOK, sendrequest(req, handler).Code)
+
+	mirror.Stop()
+
+	assert.Len(upstream.received(), 0)
+	assert.Equal([]string{"mirror.forward|result:rejected,status:401"}, metrics.counts)
+}
+
+func TestMirrorBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, _ := strconv.ParseUint(uniqueUID(), 10, 64)
+	tok := testtoken("sekret", uid)
+
+	upstream := &fakeUpstream{}
+	mirror, metrics, closeUpstream := newTestMirror(upstream, "sekret")
+	defer closeUpstream()
+
+	// the local server numbers its batches differently
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("batch") == "true" {
+			w.Write([]byte(`{"batch":"local"}`))
+		}
+	})
+	handler := NewHawkHandler(NewMirrorHandler(local, mirror), []string{"sekret"})
+
+	send := func(path string) {
+		req, _ := hawkrequestbody("POST", syncurl(uid, path), tok, "application/json", strings.NewReader("[]"))
+		assert.Equal(http.StatusOK, sendrequest(req, handler).Code)
+	}
+
+	send("storage/col?batch=true")
+	send("storage/col?batch=local")
+	send("storage/col?batch=local&commit=true")
+
+	// after the commit the batch is not known anymore
+	send("storage/col?batch=local")
+
+	// batches the upstream never saw are not forwarded
+	send("storage/other?batch=local")
+
+	mirror.Stop()
+
+	received := upstream.received()
+	if assert.Len(received, 3) {
+		assert.Equal(upstreamURI(uid, "storage/col?batch=true"), received[0].uri)
+		assert.Equal(upstreamURI(uid, "storage/col?batch=upstream"), received[1].uri)
+		assert.Equal(upstreamURI(uid, "storage/col?batch=upstream&commit=true"), received[2].uri)
+	}
+
+	assert.Equal([]string{
+		"mirror.forward|result:ok",
+		"mirror.forward|result:ok",
+		"mirror.forward|result:ok",
+		"mirror.forward|result:skipped",
+		"mirror.forward|result:skipped",
+	}, metrics.counts)
+}
+
+func TestMirrorBatchExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, _ := strconv.ParseUint(uniqueUID(), 10, 64)
+	tok := testtoken("sekret", uid)
+
+	upstream := &fakeUpstream{}
+	server := httptest.NewServer(NewHawkHandler(upstream, []string{"sekret"}))
+	defer server.Close()
+
+	metrics := &recordingMetrics{}
+	config := NewDefaultMirrorConfig(server.URL)
+	config.BatchTTL = 20 * time.Millisecond
+	config.Metrics = metrics
+	mirror := NewMirror(config)
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("batch") == "true" {
+			w.Write([]byte(`{"batch":"local"}`))
+		}
+	})
+	handler := NewHawkHandler(NewMirrorHandler(local, mirror), []string{"sekret"})
+
+	send := func(path string) {
+		req, _ := hawkrequestbody("POST", syncurl(uid, path), tok, "application/json", strings.NewReader("[]"))
+		assert.Equal(http.StatusOK, sendrequest(req, handler).Code)
+	}
+
+	send("storage/col?batch=true")
+	send("storage/other?batch=true")
+	time.Sleep(50 * time.Millisecond)
+
+	// abandoned batches are forgotten
+	send("storage/col?batch=local")
+	mirror.Stop()
+
+	assert.Len(upstream.received(), 2)
+	assert.Len(mirror.batches, 0)
+	assert.Equal(0, mirror.batchList.Len())
+	assert.Equal([]string{
+		"mirror.forward|result:ok",
+		"mirror.forward|result:ok",
+		"mirror.forward|result:skipped",
+	}, metrics.counts)
+}
+
+func TestMirrorIdempotentReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, _ := strconv.ParseUint(uniqueUID(), 10, 64)
+	tok := testtoken("sekret", uid)
+
+	upstream := &fakeUpstream{}
+	mirror, metrics, closeUpstream := newTestMirror(upstream, "sekret")
+	defer closeUpstream()
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") != "" {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	})
+	handler := NewHawkHandler(NewMirrorHandler(local, mirror), []string{"sekret"})
+
+	req, _ := hawkrequestbody("POST", syncurl(uid, "storage/col"), tok, "application/json", strings.NewReader("[]"))
+	req.Header.Set("Idempotency-Key", "k1")
+	assert.Equal(http.StatusOK, sendrequest(req, handler).Code)
+	mirror.Stop()
+
+	assert.Len(upstream.received(), 0)
+	assert.Equal([]string{"mirror.forward|result:replayed"}, metrics.counts)
+}
+
+func TestMirrorQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	// hold up the first forward so the queue fills
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	metrics := &recordingMetrics{}
+	config := NewDefaultMirrorConfig(server.URL)
+	config.QueueSize = 2
+	config.Metrics = metrics
+	mirror := NewMirror(config)
+
+	op := &mirrorOp{
+		method: "DELETE",
+		uri:    "/1.5/10/storage",
+		header: make(http.Header),
+		creds:  hawk.Credentials{ID: "id", Key: "key", Hash: sha256.New},
+	}
+	assert.True(mirror.enqueue(op))
+
+	// wait for the worker to take it off the queue
+	for len(mirror.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.True(mirror.enqueue(op))
+	assert.True(mirror.enqueue(op))
+	assert.False(mirror.enqueue(op), "expected the write to be shed")
+
+	close(release)
+	mirror.Stop()
+
+	assert.Equal([]string{
+		"mirror.forward|result:dropped",
+		"mirror.forward|result:ok",
+		"mirror.forward|result:ok",
+		"mirror.forward|result:ok",
+	}, metrics.counts)
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,10 +26,11 @@ var (
 )
 
 func init() {
-	uidregex = regexp.MustCompile(`/1\.5/([0-9]+)`)
+	uidregex = regexp.MustCompile(`/[0-9]+\.[0-9]+/([0-9]+)`)
 }
 
-// extractUID extracts the UID from the path in http.Request
+// extractUID extracts the UID from the path in http.Request for
+// any API version, ie: /1.5/{uid} or /2.0/{uid}
 func extractUID(path string) string {
 	matches := uidregex.FindStringSubmatch(path)
 	if len(matches) > 0 {
@@ -44,6 +47,38 @@ type PostResults struct {
 	Modified int
 	Success  []string
 	Failed   map[string][]string
+
+	// Truncated is set when Limit dropped ids from Success or Failed
+	Truncated bool
+}
+
+// Limit keeps at most max ids in each of Success and Failed so a huge batch
+// can not produce a huge response. The lowest failed ids are kept so the
+// response is the same every time. max <= 0 is unlimited
+func (p *PostResults) Limit(max int) {
+	if max <= 0 {
+		return
+	}
+
+	if len(p.Success) > max {
+		p.Success = p.Success[:max]
+		p.Truncated = true
+	}
+
+	if len(p.Failed) > max {
+		ids := make([]string, 0, len(p.Failed))
+		for id := range p.Failed {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		failed := make(map[string][]string, max)
+		for _, id := range ids[:max] {
+			failed[id] = p.Failed[id]
+		}
+		p.Failed = failed
+		p.Truncated = true
+	}
 }
 
 // MarshalJSON manually creates the JSON string since the modified needs to be
@@ -89,6 +124,10 @@ func (p *PostResults) MarshalJSON() ([]byte, error) {
 		buf.WriteString(`"`)
 	}
 
+	if p.Truncated {
+		buf.WriteString(`,"truncated":true`)
+	}
+
 	buf.WriteString("}")
 	return buf.Bytes(), nil
 }
@@ -96,10 +135,11 @@ func (p *PostResults) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON reverses custom formatting from MarshalJSON
 func (p *PostResults) UnmarshalJSON(data []byte) error {
 	var tmp struct {
-		Modified float64
-		Batch    string
-		Success  []string
-		Failed   map[string][]string
+		Modified  float64
+		Batch     string
+		Success   []string
+		Failed    map[string][]string
+		Truncated bool
 	}
 
 	if err := json.Unmarshal(data, &tmp); err != nil {
@@ -110,6 +150,7 @@ func (p *PostResults) UnmarshalJSON(data []byte) error {
 	p.Batch = tmp.Batch
 	p.Success = tmp.Success
 	p.Failed = tmp.Failed
+	p.Truncated = tmp.Truncated
 	return nil
 }
 
@@ -293,13 +334,45 @@ func JsonNewline(w http.ResponseWriter, r *http.Request, val interface{}) {
 }
 
 func JsonNewlineStatus(w http.ResponseWriter, r *http.Request, statusCode int, val interface{}) {
-	if strings.Contains(r.Header.Get("Accept"), "application/newlines") {
+	accept := r.Header.Get("Accept")
+	newlines := acceptQuality(accept, "application/newlines")
+	if newlines > 0 && newlines >= acceptQuality(accept, "application/json") {
 		NewLine(w, r, statusCode, val)
 	} else {
 		JSON(w, r, statusCode, val)
 	}
 }
 
+// ErrorFormatter writes the response for a failed request. Embedders can
+// set one on the InfoHandler to match the error schema of their other
+// services. The legacy weave error codes are not passed through it since
+// sync clients parse them
+type ErrorFormatter func(w http.ResponseWriter, r *http.Request, code int, reason error)
+
+type formatterKey int
+
+var fKey formatterKey = 0
+
+// NewErrorFormatterContext makes sendRequestProblem use f for requests
+// with the returned context
+func NewErrorFormatterContext(ctx context.Context, f ErrorFormatter) context.Context {
+	return context.WithValue(ctx, fKey, f)
+}
+
+// errorFormatterFromContext returns the ErrorFormatter attached to ctx
+// or DefaultErrorFormatter
+func errorFormatterFromContext(ctx context.Context) ErrorFormatter {
+	if f, ok := ctx.Value(fKey).(ErrorFormatter); ok && f != nil {
+		return f
+	}
+	return DefaultErrorFormatter
+}
+
+// DefaultErrorFormatter responds with {"err": "<reason>"}
+func DefaultErrorFormatter(w http.ResponseWriter, r *http.Request, code int, reason error) {
+	JSONError(w, reason.Error(), code)
+}
+
 type jsonerr struct {
 	Err string `json:"err"`
 }
@@ -323,6 +396,42 @@ func ConvertTimestamp(ts string) (int, error) {
 	return int(f * 1000), nil
 }
 
+// ParseSortType converts the sync 1.5 sort param into a SortType. It can
+// be a comma separated list, ie: index,newest, where later sorts break ties
+// of earlier ones. newest and oldest can not be used together.
+func ParseSortType(v string) (syncstorage.SortType, error) {
+	var (
+		sorts           []syncstorage.SortType
+		index, modified bool
+		errInvalidSort  = errors.New("Invalid sort value")
+	)
+
+	for _, name := range strings.Split(v, ",") {
+		switch name {
+		case "newest", "oldest":
+			if modified {
+				return syncstorage.SORT_NONE, errInvalidSort
+			}
+			modified = true
+			if name == "newest" {
+				sorts = append(sorts, syncstorage.SORT_NEWEST)
+			} else {
+				sorts = append(sorts, syncstorage.SORT_OLDEST)
+			}
+		case "index":
+			if index {
+				return syncstorage.SORT_NONE, errInvalidSort
+			}
+			index = true
+			sorts = append(sorts, syncstorage.SORT_INDEX)
+		default:
+			return syncstorage.SORT_NONE, errInvalidSort
+		}
+	}
+
+	return syncstorage.CompoundSort(sorts...), nil
+}
+
 // AcceptHeaderOk checks the Accept header is
 // application/json or application/newlines. If not, it will write an error and
 // return false
@@ -338,14 +447,12 @@ func AcceptHeaderOk(w http.ResponseWriter, r *http.Request) bool {
 		return true
 	}
 
-	mediatype := getMediaType(accept)
-
-	if mediatype == "application/json" || mediatype == "application/newlines" {
+	if acceptsMediaType(accept, "application/json") || acceptsMediaType(accept, "application/newlines") {
 		return true
 	}
 
 	for _, rewrite := range rewriteAccept {
-		if strings.Contains(accept, rewrite) {
+		if acceptsMediaType(accept, rewrite) {
 			r.Header.Set("Accept", "application/json")
 			return true
 		}
@@ -382,7 +489,36 @@ func sendRequestProblem(w http.ResponseWriter, req *http.Request, responseCode i
 		session.ErrorResult = reason
 	}
 
-	JSONError(w, reason.Error(), responseCode)
+	errorFormatterFromContext(req.Context())(w, req, responseCode, reason)
+}
+
+// acceptsMediaType checks if an Accept header lists mediatype without q=0
+func acceptsMediaType(accept, mediatype string) bool {
+	return acceptQuality(accept, mediatype) > 0
+}
+
+// acceptQuality is the highest q value given to mediatype in the comma
+// separated media types of an Accept header, 0 if it is not listed. Case,
+// whitespace and other parameters like charset are ignored
+func acceptQuality(accept, mediatype string) (quality float64) {
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != mediatype {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if q > quality {
+			quality = q
+		}
+	}
+	return
 }
 
 // getMediaType extracts the mediatype portion from the http request header Content-Type
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +27,8 @@ func TestExtractUID(t *testing.T) {
 		"/1.5/123/info/collections":        "123",
 		"/1.5/123/storage/collectionname":  "123",
 		"/1.5/123/storage/collectionname/": "123",
+		"/2.0/123/storage/collectionname":  "123",
+		"/2.0/":                            "",
 	}
 
 	for path, expected := range paths {
@@ -39,6 +42,12 @@ func TestAcceptHeaderOk(t *testing.T) {
 	acceptable := []string{
 		"application/json",
 		"application/newlines",
+		"Application/JSON",
+		"application/json; charset=utf-8",
+		"application/newlines;q=0.9",
+		"text/html, application/json",
+		"application/json, */*",
+		"TEXT/HTML ,  APPLICATION/NEWLINES ; Q=0.5",
 	}
 
 	for _, contentType := range acceptable {
@@ -54,6 +63,8 @@ func TestAcceptHeaderOk(t *testing.T) {
 		"*/*",
 		"application/*",
 		"*/json",
+		"Application/*",
+		"text/html, */*; q=0.1",
 
 		// https://github.com/mostlygeek/go-syncstorage/issues/85
 		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
@@ -74,6 +85,7 @@ func TestAcceptHeaderOk(t *testing.T) {
 		"application/xhtml+xml",
 		"application/xml",
 		"text/html,application/xhtml+xml,application/xml;q=0.9",
+		"application/json;q=0",
 	}
 
 	for _, contentType := range notAcceptable {
@@ -86,6 +98,27 @@ func TestAcceptHeaderOk(t *testing.T) {
 
 }
 
+func TestJsonNewlineAccept(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		"application/json":                             "application/json",
+		"Application/Newlines":                         "application/newlines",
+		"application/newlines; charset=utf-8":          "application/newlines",
+		"application/json, application/newlines":       "application/newlines",
+		"application/newlines;q=0.5, application/json": "application/json",
+		"application/newlines;q=0, */*":                "application/json",
+	}
+
+	for accept, expected := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		JsonNewline(w, req, []string{"a", "b"})
+		assert.Equal(expected, w.Header().Get("Content-Type"), accept)
+	}
+}
+
 func TestJSONError(t *testing.T) {
 	assert := assert.New(t)
 
@@ -107,6 +140,67 @@ func TestJSONError(t *testing.T) {
 	}
 }
 
+func TestErrorFormatter(t *testing.T) {
+	assert := assert.New(t)
+
+	formatter := func(w http.ResponseWriter, r *http.Request, code int, reason error) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": code,
+			"detail": reason.Error(),
+		})
+	}
+
+	uid := "123456"
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+
+	tests := []struct {
+		code    int
+		handler http.Handler
+		req     *http.Request
+	}{
+		{http.StatusNotFound, handler, httptest.NewRequest("GET", "/1.5/"+uid+"/nope", nil)},
+		{http.StatusBadRequest, handler, httptest.NewRequest("GET", "/1.5/"+uid+"/storage/bookmarks?limit=x", nil)},
+		{http.StatusUnauthorized, hawkH, httptest.NewRequest("GET", "/1.5/"+uid+"/info/collections", nil)},
+		{http.StatusNotFound, EchoHandler, httptest.NewRequest("GET", "/9.9/"+uid+"/info/collections", nil)},
+	}
+
+	for _, test := range tests {
+		infoH := NewInfoHandler(test.handler)
+		infoH.ErrorFormatter = formatter
+
+		w := httptest.NewRecorder()
+		infoH.ServeHTTP(w, test.req)
+
+		var body struct {
+			Status int    `json:"status"`
+			Detail string `json:"detail"`
+		}
+		path := test.req.URL.String()
+		if assert.Equal(test.code, w.Code, path) &&
+			assert.NoError(json.Unmarshal(w.Body.Bytes(), &body), path) {
+			assert.Equal("application/problem+json", w.Header().Get("Content-Type"), path)
+			assert.Equal(test.code, body.Status, path)
+			assert.NotEqual("", body.Detail, path)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(NewErrorFormatterContext(req.Context(), formatter))
+	w := httptest.NewRecorder()
+	InternalError(w, req, errors.New("oops"))
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Contains(w.Body.String(), `"detail":"oops"`)
+
+	// without a formatter in the context the default is used
+	w = httptest.NewRecorder()
+	InternalError(w, httptest.NewRequest("GET", "/", nil), errors.New("oops"))
+	assert.Equal(`{"err":"oops"}`, w.Body.String())
+}
+
 func TestGetMediaType(t *testing.T) {
 	assert := assert.New(t)
 	assert.Equal("text/plain", getMediaType("text/plain"))
@@ -0,0 +1,20 @@
+package web
+
+import "net/http"
+
+// NodeHeaderHandler adds an X-Weave-Node header with the name of the
+// server to every response. It helps to find which node served a request
+// when there are many behind a load balancer.
+type NodeHeaderHandler struct {
+	handler http.Handler
+	node    string
+}
+
+func NewNodeHeaderHandler(h http.Handler, node string) *NodeHeaderHandler {
+	return &NodeHeaderHandler{handler: h, node: node}
+}
+
+func (n *NodeHeaderHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Weave-Node", n.node)
+	n.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeHeaderHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewNodeHeaderHandler(EchoHandler, "sync-1.localdomain")
+	resp := request("GET", "/1.5/123/info/collections", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("sync-1.localdomain", resp.Header().Get("X-Weave-Node"))
+
+	// errors get it too
+	notFound := NewNodeHeaderHandler(http.NotFoundHandler(), "sync-1.localdomain")
+	resp = request("GET", "/nope", nil, notFound)
+	assert.Equal(http.StatusNotFound, resp.Code)
+	assert.Equal("sync-1.localdomain", resp.Header().Get("X-Weave-Node"))
+}
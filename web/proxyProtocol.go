@@ -0,0 +1,192 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultProxyHeaderTimeout is how long a new connection has to send its
+// PROXY protocol header
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("Invalid PROXY protocol header")
+)
+
+// ProxyListener accepts connections from a load balancer that sends
+// PROXY protocol v1 or v2 headers. The RemoteAddr of its connections is the
+// client from the header so http.Request.RemoteAddr is the real client.
+// Connections without a header keep their own address, ie: health checks.
+type ProxyListener struct {
+	net.Listener
+	HeaderTimeout time.Duration
+}
+
+func NewProxyListener(l net.Listener) *ProxyListener {
+	return &ProxyListener{Listener: l, HeaderTimeout: DefaultProxyHeaderTimeout}
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: l.HeaderTimeout,
+	}, nil
+}
+
+// proxyConn reads the header on first use rather than in Accept so a slow
+// client can not hold up accepting other connections
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readProxyHeader(c.r)
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a PROXY protocol header from r and returns the
+// client address in it. The address is nil when there is no header or it
+// does not carry an address, ie: v1 UNKNOWN or v2 LOCAL.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if b, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(b, proxyV1Prefix) {
+			return readProxyV1(r)
+		}
+	case proxyV2Signature[0]:
+		if b, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+
+	return nil, nil
+}
+
+// readProxyV1 parses the text header, ie:
+// PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the spec limits v1 headers to 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.Atoi(parts[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errProxyHeader
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errProxyHeader
+	}
+
+	// LOCAL, ie: health checks from the proxy itself
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+
+	// other protocols are allowed but do not carry a usable address
+	return nil, nil
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	v2 := func(cmd, fam byte, addrs []byte) string {
+		var b bytes.Buffer
+		b.Write(proxyV2Signature)
+		b.WriteByte(cmd)
+		b.WriteByte(fam)
+		binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+		b.Write(addrs)
+		return b.String()
+	}
+
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb}
+	ipv6 := append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)
+	ipv6 = append(ipv6, 0xc8, 0x22, 0x01, 0xbb)
+
+	for header, expected := range map[string]string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n":    "203.0.113.7:51234",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n": "[2001:db8::7]:51234",
+		"PROXY UNKNOWN\r\n":   "",
+		v2(0x21, 0x11, ipv4):  "203.0.113.7:51234",
+		v2(0x21, 0x21, ipv6):  "[2001:db8::7]:51234",
+		v2(0x20, 0x00, nil):   "", // LOCAL
+		"GET / HTTP/1.1\r\n":  "", // no header
+		"POST / HTTP/1.1\r\n": "",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET /": "203.0.113.7:51234",
+	} {
+		r := bufio.NewReader(strings.NewReader(header + "rest"))
+		addr, err := readProxyHeader(r)
+		if !assert.NoError(err, header) {
+			continue
+		}
+
+		if expected == "" {
+			assert.Nil(addr, header)
+		} else if assert.NotNil(addr, header) {
+			assert.Equal(expected, addr.String(), header)
+		}
+
+		// only the header is consumed
+		rest, _ := ioutil.ReadAll(r)
+		assert.True(strings.HasSuffix(string(rest), "rest"), header)
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 nope 10.0.0.1 51234 443\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 99999 443\r\n",
+		"PROXY TCP4 203.0.113.7\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443" + strings.Repeat(" ", 100),
+		v2(0x11, 0x11, ipv4), // wrong version
+		v2(0x21, 0x11, ipv4[:4]),
+	} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(bad)))
+		assert.Equal(errProxyHeader, err, bad)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer l.Close()
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(NewProxyListener(l))
+
+	send := func(data string) string {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(err) {
+			return ""
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(data))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(err) {
+			return ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert.Equal("203.0.113.7:51234",
+		send("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET / HTTP/1.0\r\n\r\n"))
+
+	// without a header it is the address of the connection
+	assert.True(strings.HasPrefix(send("GET / HTTP/1.0\r\n\r\n"), "127.0.0.1:"))
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Scheduler runs maintenance jobs periodically, each in its own goroutine.
+// A random jitter is added to every interval so jobs on many servers do not
+// all run at the same time. A panic in a job is logged and the job keeps
+// its schedule.
+type Scheduler struct {
+	sync.Mutex
+
+	jobs    []*scheduledJob
+	stop    chan struct{}
+	running sync.WaitGroup
+	started bool
+}
+
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	jitter   time.Duration
+	run      func()
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		stop: make(chan struct{}),
+	}
+}
+
+// Register adds a job that runs every interval plus up to jitter. Jobs
+// registered after Start begin right away.
+func (s *Scheduler) Register(name string, interval, jitter time.Duration, run func()) {
+	s.Lock()
+	defer s.Unlock()
+
+	job := &scheduledJob{
+		name:     name,
+		interval: interval,
+		jitter:   jitter,
+		run:      run,
+	}
+
+	s.jobs = append(s.jobs, job)
+	if s.started {
+		s.startJob(job)
+	}
+}
+
+func (s *Scheduler) Start() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.started {
+		return
+	}
+
+	s.started = true
+	for _, job := range s.jobs {
+		s.startJob(job)
+	}
+}
+
+// Stop prevents jobs from running again and waits for the running ones to
+// finish. A stopped Scheduler can not be restarted.
+func (s *Scheduler) Stop() {
+	s.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.Unlock()
+
+	s.running.Wait()
+}
+
+// startJob must be called with the scheduler locked
+func (s *Scheduler) startJob(job *scheduledJob) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		for {
+			wait := job.interval
+			if job.jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(job.jitter)))
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				job.runSafely()
+			}
+		}
+	}()
+}
+
+func (job *scheduledJob) runSafely() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"job":   job.name,
+				"panic": r,
+			}).Error("Scheduler: job panicked")
+		}
+	}()
+
+	job.run()
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		lock   sync.Mutex
+		runs   []time.Time
+		panics int
+	)
+
+	scheduler := NewScheduler()
+	scheduler.Register("counter", 20*time.Millisecond, 5*time.Millisecond, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		runs = append(runs, time.Now())
+	})
+
+	// a panicking job keeps running and does not take the others down
+	scheduler.Register("panics", 20*time.Millisecond, 0, func() {
+		lock.Lock()
+		panics++
+		lock.Unlock()
+		panic("oops")
+	})
+
+	start := time.Now()
+	scheduler.Start()
+	time.Sleep(110 * time.Millisecond)
+	scheduler.Stop()
+
+	lock.Lock()
+	numRuns, numPanics := len(runs), panics
+	lock.Unlock()
+
+	// 20-25ms apart, 110ms allows for 4 or 5 runs
+	assert.True(numRuns >= 3 && numRuns <= 5, "ran %d times", numRuns)
+	assert.True(numPanics >= 3, "panicking job ran %d times", numPanics)
+	if numRuns > 0 {
+		assert.True(runs[0].Sub(start) >= 20*time.Millisecond, "ran before the interval")
+	}
+
+	// nothing runs after Stop
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(numRuns, len(runs))
+	lock.Unlock()
+}
+
+func TestSchedulerStopWaitsForJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	finished := make(chan struct{})
+	scheduler := NewScheduler()
+	scheduler.Register("slow", time.Millisecond, 0, func() {
+		time.Sleep(30 * time.Millisecond)
+		select {
+		case <-finished:
+		default:
+			close(finished)
+		}
+	})
+
+	scheduler.Start()
+	time.Sleep(10 * time.Millisecond)
+	scheduler.Stop()
+
+	select {
+	case <-finished:
+	default:
+		assert.Fail("Stop returned before the running job finished")
+	}
+}
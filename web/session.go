@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/mozilla-services/go-syncstorage/token"
+	"go.mozilla.org/hawk"
 )
 
 type sessionKey int
@@ -13,6 +14,10 @@ var sKey sessionKey = 0
 type Session struct {
 	Token       token.TokenPayload
 	ErrorResult error
+
+	// Credentials the request was signed with. The Mirror uses them
+	// to sign forwarded requests for the upstream
+	Credentials hawk.Credentials
 }
 
 func NewSessionContext(ctx context.Context, ses *Session) context.Context {
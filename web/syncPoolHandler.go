@@ -3,20 +3,16 @@ package web
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/pkg/errors"
 )
 
-const (
-	conflictAttempts = 3
-	conflictSleep    = 250 * time.Millisecond
-)
-
 type SyncPoolHandler struct {
 	StoppableHandler
 
@@ -26,28 +22,66 @@ type SyncPoolHandler struct {
 	// contention for parallel requests
 	pools []*handlerPool
 
+	// limits concurrent writes across all pools, nil is unlimited
+	writes *writeLimiter
+
 	userHandlerConfig *SyncUserHandlerConfig
+	metrics           Metrics
 }
 
 type SyncPoolConfig struct {
-	Basepath    string
+	// Basepaths are the directories DB files are stored in. Users are
+	// spread across them by a hash of their uid so changing the list
+	// moves users to a different directory
+	Basepaths   []string
 	NumPools    int
 	TTL         time.Duration
 	MaxPoolSize int
 
+	// EvictPercent is how much of MaxPoolSize is evicted at once when a
+	// pool is full. Too many reopens hot users, too few leaves the pool
+	// over capacity. 0 uses DefaultEvictPercent
+	EvictPercent int
+
+	// MinResidency keeps newly created handlers from being evicted for a
+	// while so handlers opened with Warm are still there when their traffic
+	// arrives. The pool grows past MaxPoolSize when all of its handlers are
+	// this young, MaxOpenDBs is still enforced. Warming more uids than
+	// MaxPoolSize is pointless, Warm stops when the pool is full.
+	MinResidency time.Duration
+
+	// SlowAcquire logs a warning when getting the handler for a request,
+	// including opening its DB, takes longer. 0 disables it
+	SlowAcquire time.Duration
+
+	// MaxOpenDBs limits the number of open DBs across all pools
+	// to stay under the open file ulimit. 0 is unlimited
+	MaxOpenDBs int
+
+	// MaxWriters limits the requests writing to DBs at the same time
+	// across all pools so bursts of writes do not thrash the disk. Writes
+	// wait up to WriterWait for a slot, then get a 503. Reads are not
+	// limited. 0 is unlimited
+	MaxWriters int
+	WriterWait time.Duration
+
 	VacuumKB      int
 	PurgeMinHours int
 	PurgeMaxHours int
 
 	DBConfig *syncstorage.Config
+
+	// Metrics receives pool measurements, nil discards them
+	Metrics Metrics
 }
 
 func NewDefaultSyncPoolConfig(basepath string) *SyncPoolConfig {
 	return &SyncPoolConfig{
-		Basepath:      basepath,
+		Basepaths:     []string{basepath},
 		NumPools:      1,
 		TTL:           5 * time.Minute,
 		MaxPoolSize:   100,
+		EvictPercent:  DefaultEvictPercent,
 		VacuumKB:      0, // disabled by default
 		PurgeMinHours: 24 * 7,
 		PurgeMaxHours: 24 * 7 * 2,
@@ -61,19 +95,46 @@ func NewSyncPoolHandler(config *SyncPoolConfig, userHandlerConfig *SyncUserHandl
 		userHandlerConfig = NewDefaultSyncUserHandlerConfig()
 	}
 
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = NopMetrics{}
+	}
+
+	var dbSlots chan struct{}
+	if config.MaxOpenDBs > 0 {
+		dbSlots = make(chan struct{}, config.MaxOpenDBs)
+	}
+
+	var writes *writeLimiter
+	if config.MaxWriters > 0 {
+		writes = &writeLimiter{
+			slots:   make(chan struct{}, config.MaxWriters),
+			wait:    config.WriterWait,
+			metrics: metrics,
+		}
+	}
+
 	pools := make([]*handlerPool, config.NumPools, config.NumPools)
 	for i := 0; i < config.NumPools; i++ {
 		pools[i] = newHandlerPool(
-			config.Basepath,
+			config.Basepaths,
 			config.MaxPoolSize,
+			config.EvictPercent,
+			config.MinResidency,
+			config.SlowAcquire,
+			dbSlots,
+			writes,
 			config.DBConfig,
-			userHandlerConfig)
+			userHandlerConfig,
+			metrics)
 	}
 
 	server := &SyncPoolHandler{
 		config:            config,
 		pools:             pools,
 		userHandlerConfig: userHandlerConfig,
+		metrics:           metrics,
+		writes:            writes,
 	}
 
 	return server
@@ -112,46 +173,207 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	poolId := s.poolIndex(uid)
 
-	// if a request comes in while an element is being
-	// cleaned up/closing, we retry a few times before failing
-	for i := 1; i <= conflictAttempts; i++ {
-		element, newElement, err = s.pools[poolId].getElement(uid)
-		if err != nil {
-			if err == errElementStopped {
-
-				log.WithFields(log.Fields{
-					"uid":     uid,
-					"attempt": i,
-				}).Info("pool.getElement conflict")
-
-				if i == conflictAttempts {
-					w.Header().Add("Retry-After", strconv.Itoa(60))
-					sendRequestProblem(w, req, http.StatusConflict,
-						errors.New("DB pool too busy"))
-					return
-				}
-
-				time.Sleep(conflictSleep)
-			} else {
-				InternalError(w, req, errors.Wrap(err, "Could not get Pool Element"))
-				return
-			}
-		} else {
-			break
-		}
+	element, newElement, err = s.pools[poolId].getElement(uid)
+	if err == errTooManyOpenDBs {
+		w.Header().Add("Retry-After", strconv.Itoa(5))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable,
+			errors.New("DB pool too busy"))
+		return
+	} else if err == errUserMoving {
+		w.Header().Add("Retry-After", strconv.Itoa(30))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		InternalError(w, req, errors.Wrap(err, "Could not get Pool Element"))
+		return
 	}
 
+	// keep the element from being evicted while the request is in flight
+	defer s.pools[poolId].releaseElement(element)
+
 	if newElement {
-		element.handler.TidyUp(
-			time.Duration(s.config.PurgeMinHours)*time.Hour,
-			time.Duration(s.config.PurgeMaxHours)*time.Hour,
-			s.config.VacuumKB)
+		s.tidyUp(element)
 	}
 
 	// pass it on
 	element.handler.ServeHTTP(w, req)
 }
 
+// writeLimiter holds the MaxWriters slots shared by all users. A
+// SyncUserHandler takes one after its requestLock so writes queued
+// behind the same user do not hold slots other users could use
+type writeLimiter struct {
+	slots   chan struct{}
+	wait    time.Duration
+	metrics Metrics
+}
+
+// acquire reserves a slot, waiting up to wait for one to free up. A nil
+// writeLimiter is unlimited
+func (l *writeLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.wait > 0 {
+		start := time.Now()
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+			l.metrics.Timing("pool.write_wait", time.Since(start))
+			return true
+		case <-timer.C:
+		}
+	}
+
+	l.metrics.Incr("pool.write_shed")
+	return false
+}
+
+func (l *writeLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// Warm opens handlers for uids before their requests arrive, ie: recently
+// active users after a deploy. Each pool stops warming once it is full
+func (s *SyncPoolHandler) Warm(uids []string) error {
+	poolUids := make([][]string, len(s.pools))
+	for _, uid := range uids {
+		poolId := s.poolIndex(uid)
+		poolUids[poolId] = append(poolUids[poolId], uid)
+	}
+
+	for poolId, uids := range poolUids {
+		created, err := s.pools[poolId].Warm(uids)
+		for _, element := range created {
+			s.tidyUp(element)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "Could not warm pool")
+		}
+	}
+
+	return nil
+}
+
+// MoveUser relocates a user's DB files from one of the Basepaths to another,
+// ie: to balance disk usage. The user's requests get a 503 during the move.
+// It fails if the user has requests in flight.
+func (s *SyncPoolHandler) MoveUser(uid, fromBase, toBase string) error {
+	return s.pools[s.poolIndex(uid)].moveUser(uid, fromBase, toBase)
+}
+
+// RepairUser checks and fixes a user's DB, opening it if required. The
+// handler is kept in the pool while it is repaired.
+func (s *SyncPoolHandler) RepairUser(uid string) (report *syncstorage.RepairReport, err error) {
+	err = s.withHandler(uid, func(h *SyncUserHandler) (err error) {
+		report, err = h.Repair()
+		return
+	})
+	return
+}
+
+// ExportUser writes a snapshot of a user's data to w, opening their DB if
+// required
+func (s *SyncPoolHandler) ExportUser(uid string, w io.Writer) error {
+	return s.withHandler(uid, func(h *SyncUserHandler) error {
+		return h.Export(w)
+	})
+}
+
+// ImportUser replaces a user's data with a snapshot from ExportUser, ie:
+// to restore a backup or copy a user to a new uid
+func (s *SyncPoolHandler) ImportUser(uid string, r io.Reader) (report *syncstorage.ImportReport, err error) {
+	err = s.withHandler(uid, func(h *SyncUserHandler) (err error) {
+		report, err = h.Import(r)
+		return
+	})
+	return
+}
+
+// FreezeUser replaces SyncUserHandlerConfig.FrozenCollections for a user,
+// nil goes back to them
+func (s *SyncPoolHandler) FreezeUser(uid string, collections []string) error {
+	return s.withHandler(uid, func(h *SyncUserHandler) error {
+		return h.SetFrozen(collections)
+	})
+}
+
+// UserFrozen returns the collections a user can not write and if they are
+// the user's own list
+func (s *SyncPoolHandler) UserFrozen(uid string) (collections []string, own bool, err error) {
+	err = s.withHandler(uid, func(h *SyncUserHandler) (err error) {
+		collections, own, err = h.Frozen()
+		return
+	})
+	return
+}
+
+// withHandler calls fn with the user's handler, keeping it in the pool
+// until fn returns
+func (s *SyncPoolHandler) withHandler(uid string, fn func(*SyncUserHandler) error) error {
+	pool := s.pools[s.poolIndex(uid)]
+
+	element, newElement, err := pool.getElement(uid)
+	if err != nil {
+		return err
+	}
+	defer pool.releaseElement(element)
+
+	if newElement {
+		s.tidyUp(element)
+	}
+
+	return fn(element.handler)
+}
+
+// WalkUIDs calls fn with the uid of every user with a DB in the Basepaths,
+// ie: for maintenance jobs. It stops at the first error returned by fn.
+func (s *SyncPoolHandler) WalkUIDs(fn func(uid string) error) error {
+	for _, basepath := range s.config.Basepaths {
+		if err := WalkUIDs(basepath, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers lists the open handlers of all the pools, most recently used first
+func (s *SyncPoolHandler) Handlers() []HandlerInfo {
+	infos := handlerInfoByLastUsed{}
+	for i, p := range s.pools {
+		infos = append(infos, p.handlers(i)...)
+	}
+
+	sort.Stable(infos)
+	return infos
+}
+
+type handlerInfoByLastUsed []HandlerInfo
+
+func (h handlerInfoByLastUsed) Len() int           { return len(h) }
+func (h handlerInfoByLastUsed) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h handlerInfoByLastUsed) Less(i, j int) bool { return h[i].LastUsed.After(h[j].LastUsed) }
+
+// tidyUp purges expired data from newly opened handlers
+func (s *SyncPoolHandler) tidyUp(element *poolElement) {
+	element.handler.TidyUp(
+		time.Duration(s.config.PurgeMinHours)*time.Hour,
+		time.Duration(s.config.PurgeMaxHours)*time.Hour,
+		s.config.VacuumKB)
+}
+
 // Stop immediately stops serving web requests and then it
 // stops all additional handlers
 func (s *SyncPoolHandler) StopHTTP() {
@@ -2,6 +2,9 @@ package web
 
 import (
 	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -15,9 +18,24 @@ import (
 )
 
 var (
-	errElementStopped = errors.New("handler is Stopped")
+	errTooManyOpenDBs = errors.New("Too many open DBs")
+	errUserMoving     = errors.New("User is being moved")
 )
 
+// how long to wait for another pool to free up a DB slot
+const dbSlotWait = 250 * time.Millisecond
+
+// how long stopHandlers waits for in flight requests to release their
+// handlers before stopping them anyway
+const drainTimeout = 30 * time.Second
+
+// a uid reopened this soon after it was evicted is thrashing, a sign
+// the pool is too small for the working set of users
+const thrashWindow = time.Minute
+
+// DefaultEvictPercent of a full pool is evicted to make room
+const DefaultEvictPercent = 10
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -28,6 +46,16 @@ type poolElement struct {
 
 	uid     string
 	handler *SyncUserHandler
+
+	// number of getElement callers that have not released the element yet.
+	// Elements in use are never evicted. Protected by the handlerPool's lock
+	refs int
+
+	// when the handler was opened, see handlerPool.minResidency
+	created time.Time
+
+	// when getElement last returned it. Protected by the handlerPool's lock
+	lastUsed time.Time
 }
 
 // handlerPool has a big job. It opens DBs on demand and
@@ -35,9 +63,13 @@ type poolElement struct {
 type handlerPool struct {
 	sync.Mutex
 
-	base     []string
+	// directories DB files are spread across, split into path parts
+	bases    [][]string
 	elements map[string]*poolElement
 
+	// uids whose DB files are being moved by MoveUser
+	moving map[string]bool
+
 	// lru keeps a list with the recently used elements in Front and the
 	// oldest in the back
 	lru    *list.List
@@ -46,19 +78,58 @@ type handlerPool struct {
 	// the max size of the pool
 	maxPoolSize int
 
+	// percent of maxPoolSize evicted at once when the pool is full
+	evictPercent int
+
+	// newly created handlers are not evicted for this long so warmed
+	// handlers survive until their traffic arrives
+	minResidency time.Duration
+
+	// dbSlots is shared between all pools and limits the total number of
+	// open DBs across them. It is nil when there is no limit.
+	dbSlots chan struct{}
+
+	// writes is shared between all pools and given to every handler to
+	// limit concurrent writes, nil when there is no limit
+	writes *writeLimiter
+
+	// getElement calls taking longer than this are logged, 0 disables it
+	slowAcquire time.Duration
+
+	// number of handlers evicted, to tell if a slow getElement evicted any
+	evictions int
+
+	// recently evicted uids, kept for thrashWindow to spot ones that
+	// are reopened right after being evicted. evictedList is ordered
+	// most recently evicted first so expired ones are trimmed off the back
+	evicted     map[string]*list.Element
+	evictedList *list.List
+
 	// Configurations
 	dbConfig          *syncstorage.Config
 	userHandlerConfig *SyncUserHandlerConfig
+
+	metrics Metrics
+	logger  *log.Logger
+
+	// opens the DBs, replaceable for testing
+	openDB func(file string, config *syncstorage.Config) (*syncstorage.DB, error)
 }
 
-func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Config, userHandlerConfig *SyncUserHandlerConfig) *handlerPool {
+func newHandlerPool(basepaths []string, maxPoolSize, evictPercent int, minResidency, slowAcquire time.Duration, dbSlots chan struct{}, writes *writeLimiter, dbConfig *syncstorage.Config, userHandlerConfig *SyncUserHandlerConfig, metrics Metrics) *handlerPool {
 
-	var path []string
+	if evictPercent <= 0 {
+		evictPercent = DefaultEvictPercent
+	}
+
+	bases := make([][]string, len(basepaths))
+	for i, basepath := range basepaths {
+		// support in-memory only sqlite3 databases for testing
+		if basepath == ":memory:" {
+			bases[i] = []string{":memory:"}
+			continue
+		}
 
-	// support in-memory only sqlite3 databases for testing
-	if basepath == ":memory:" {
-		path = []string{":memory:"}
-	} else {
 		newBasePath, err := filepath.Abs(basepath)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -67,52 +138,261 @@ func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Conf
 			}).Panic("Could not determine absolute basepath")
 		}
 
-		path = strings.Split(
+		bases[i] = strings.Split(
 			filepath.Clean(newBasePath),
 			string(os.PathSeparator),
 		)
 	}
 
 	pool := &handlerPool{
-		base:              path,
+		bases:             bases,
 		elements:          make(map[string]*poolElement),
+		moving:            make(map[string]bool),
+		evicted:           make(map[string]*list.Element),
+		evictedList:       list.New(),
 		lru:               list.New(),
 		lrumap:            make(map[string]*list.Element),
 		maxPoolSize:       maxPoolSize,
+		evictPercent:      evictPercent,
+		minResidency:      minResidency,
+		slowAcquire:       slowAcquire,
+		dbSlots:           dbSlots,
+		writes:            writes,
 		dbConfig:          dbConfig,
 		userHandlerConfig: userHandlerConfig,
+		metrics:           metrics,
+		logger:            log.StandardLogger(),
+		openDB:            syncstorage.NewDB,
 	}
 
 	return pool
 }
 
+// cleanupHandlers stops and removes up to maxClean of the least
+// recently used handlers
 func (p *handlerPool) cleanupHandlers(maxClean int) {
-	numCleaned := 0
+	p.Lock()
+	defer p.Unlock()
+	p.evict(maxClean)
+}
+
+// evict stops and removes up to maxClean idle least recently used handlers
+// older than minResidency. It must be called with the pool locked.
+func (p *handlerPool) evict(maxClean int) (numEvicted int) {
 	lruElement := p.lru.Back()
-	for lruElement != nil && numCleaned < maxClean {
+	for numEvicted < maxClean && lruElement != nil {
 		element := lruElement.Value.(*poolElement)
-
-		element.handler.StopHTTP()
 		next := lruElement.Prev()
 
-		p.Lock()
-		p.lru.Remove(lruElement)
-		delete(p.lrumap, element.uid)
-		delete(p.elements, element.uid)
-		p.Unlock()
+		if element.refs == 0 && time.Since(element.created) >= p.minResidency {
+			p.remove(lruElement)
+			numEvicted++
+			p.evictions++
+			p.rememberEvicted(element.uid)
+		}
 
 		lruElement = next
-		numCleaned++
 	}
+
+	return
+}
+
+type evictedUID struct {
+	uid     string
+	at      time.Time
+	reopens int // times reopened within thrashWindow of an eviction
+}
+
+// rememberEvicted records when uid was evicted and forgets uids evicted
+// longer than thrashWindow ago. It must be called with the pool locked.
+func (p *handlerPool) rememberEvicted(uid string) {
+	now := time.Now()
+	for le := p.evictedList.Back(); le != nil; le = p.evictedList.Back() {
+		if now.Sub(le.Value.(*evictedUID).at) <= thrashWindow {
+			break
+		}
+		p.forgetEvicted(le)
+	}
+
+	if le, ok := p.evicted[uid]; ok {
+		le.Value.(*evictedUID).at = now
+		p.evictedList.MoveToFront(le)
+	} else {
+		p.evicted[uid] = p.evictedList.PushFront(&evictedUID{uid: uid, at: now})
+	}
+}
+
+// forgetEvicted removes an evicted uid. It must be called with the pool locked.
+func (p *handlerPool) forgetEvicted(le *list.Element) {
+	p.evictedList.Remove(le)
+	delete(p.evicted, le.Value.(*evictedUID).uid)
 }
 
-// stopHandlers stops all handlers from servicing HTTP requests
+// checkThrash reports a uid being reopened shortly after it was evicted.
+// It must be called with the pool locked.
+func (p *handlerPool) checkThrash(uid string) {
+	le, ok := p.evicted[uid]
+	if !ok {
+		return
+	}
+
+	e := le.Value.(*evictedUID)
+	since := time.Since(e.at)
+	if since > thrashWindow {
+		p.forgetEvicted(le)
+		return
+	}
+
+	e.reopens++
+	p.metrics.Incr("pool.thrash")
+	p.logger.WithFields(log.Fields{
+		"uid":     uid,
+		"t":       int64(since / time.Millisecond),
+		"reopens": e.reopens,
+	}).Warn("Pool: handler reopened soon after eviction")
+}
+
+// remove stops the element's handler and takes it out of the pool.
+// It must be called with the pool locked.
+func (p *handlerPool) remove(lruElement *list.Element) {
+	element := lruElement.Value.(*poolElement)
+
+	p.lru.Remove(lruElement)
+	delete(p.lrumap, element.uid)
+	delete(p.elements, element.uid)
+
+	element.handler.StopHTTP()
+	p.releaseDBSlot()
+}
+
+// acquireDBSlot reserves one of the shared DB slots before a DB is opened.
+// When they are all in use the pool's own least recently used handler is
+// closed to make room. If that is not possible it waits a little for another
+// pool to free one up. It must be called with the pool locked and unlocks it
+// while waiting so the pool's handlers can still be used and evicted. Callers
+// must recompute anything they read from the pool or disk before calling it:
+// whether the uid is moving, its element and where its DB is.
+func (p *handlerPool) acquireDBSlot() bool {
+	if p.dbSlots == nil {
+		return true
+	}
+
+	select {
+	case p.dbSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if p.evict(1) > 0 {
+		select {
+		case p.dbSlots <- struct{}{}:
+			return true
+		default:
+		}
+	}
+
+	p.Unlock()
+	defer p.Lock()
+
+	select {
+	case p.dbSlots <- struct{}{}:
+		return true
+	case <-time.After(dbSlotWait):
+		return false
+	}
+}
+
+func (p *handlerPool) releaseDBSlot() {
+	if p.dbSlots != nil {
+		<-p.dbSlots
+	}
+}
+
+// stopHandlers stops all handlers from servicing HTTP requests. Handlers
+// in use are given up to drainTimeout to be released first so long writes
+// are not cut off.
 func (p *handlerPool) stopHandlers() {
-	p.cleanupHandlers(p.lru.Len())
+	p.drain(drainTimeout)
+
+	p.Lock()
+	defer p.Unlock()
+	for p.lru.Len() > 0 {
+		p.remove(p.lru.Back())
+	}
+}
+
+// drain waits until no handlers are in use or the timeout passes. The pool
+// is not locked while waiting so requests can release their handlers.
+func (p *handlerPool) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.Lock()
+		inUse := 0
+		for _, element := range p.elements {
+			if element.refs > 0 {
+				inUse++
+			}
+		}
+		p.Unlock()
+
+		if inUse == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			log.WithFields(log.Fields{
+				"in_use": inUse,
+			}).Warn("Pool: stopping handlers that are still in use")
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// releaseElement marks the caller of getElement as done with the element
+// so it can be evicted again
+func (p *handlerPool) releaseElement(element *poolElement) {
+	p.Lock()
+	defer p.Unlock()
+	element.refs--
+}
+
+// Warm opens handlers for uids ahead of traffic so their first request
+// does not pay the DB open cost. It stops when the pool is full rather than
+// evicting handlers to make room. The newly created elements are returned.
+func (p *handlerPool) Warm(uids []string) ([]*poolElement, error) {
+	var created []*poolElement
+
+	for _, uid := range uids {
+		p.Lock()
+		full := p.lru.Len() >= p.maxPoolSize
+		p.Unlock()
+
+		if full {
+			break
+		}
+
+		element, elementCreated, err := p.getElement(uid)
+		if err == errUserMoving {
+			continue
+		} else if err != nil {
+			return created, err
+		}
+
+		p.releaseElement(element)
+
+		if elementCreated {
+			created = append(created, element)
+		}
+	}
+
+	return created, nil
 }
 
 // getElement returns the requested poolElement and if it had to create a new one
-// to fulfill the request
+// to fulfill the request. The element will not be evicted until it is returned
+// with releaseElement.
 func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 	var (
 		element *poolElement
@@ -120,13 +400,70 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 		dbFile  string
 	)
 
+	start := time.Now()
+
 	p.Lock()
 	defer p.Unlock()
 
 	elementCreated := false
 
-	if element, ok = p.elements[uid]; !ok {
-		if len(p.base) == 1 && p.base[0] == ":memory:" {
+	// waiting for the lock, evicting and opening DBs all add to the
+	// latency of requests. Slow ones point at a pool that is too small
+	if p.slowAcquire > 0 {
+		evictions := p.evictions
+		defer func() {
+			if took := time.Since(start); took > p.slowAcquire {
+				p.logger.WithFields(log.Fields{
+					"uid":     uid,
+					"t":       int64(took / time.Millisecond),
+					"created": elementCreated,
+					"evicted": p.evictions - evictions,
+				}).Warn("Pool: slow handler acquisition")
+			}
+		}()
+	}
+
+	if p.moving[uid] {
+		return nil, false, errUserMoving
+	}
+
+	// a handler stopped outside of the pool's eviction is useless. Discard
+	// it and open a fresh one so the request still succeeds
+	if element, ok = p.elements[uid]; ok && element.handler.IsStopped() {
+		p.remove(p.lrumap[uid])
+		ok = false
+	}
+
+	if !ok {
+		if p.lru.Len() > p.maxPoolSize {
+			p.evict(1 + p.maxPoolSize*p.evictPercent/100)
+		}
+
+		if !p.acquireDBSlot() {
+			return nil, false, errTooManyOpenDBs
+		}
+
+		// the pool may have been unlocked while waiting for a slot. The uid
+		// could have started moving or had a handler opened in the mean time
+		if p.moving[uid] {
+			p.releaseDBSlot()
+			return nil, false, errUserMoving
+		}
+
+		if element, ok = p.elements[uid]; ok {
+			if element.handler.IsStopped() {
+				p.remove(p.lrumap[uid])
+				ok = false
+			} else {
+				p.releaseDBSlot()
+			}
+		}
+	}
+
+	if !ok {
+		// the DB path is only worked out once the slot is held so a user
+		// moved while waiting is opened in their new base
+		if base := p.base(uid); len(base) == 1 && base[0] == ":memory:" {
 			dbFile = ":memory:"
 		} else {
 			storageDir, filename := p.PathAndFile(uid)
@@ -134,6 +471,7 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 			// create the sub-directory tree if required
 			if _, err := os.Stat(storageDir); os.IsNotExist(err) {
 				if err := os.MkdirAll(storageDir, 0755); err != nil {
+					p.releaseDBSlot()
 					return nil, false, errors.Wrap(err, "Could not create datadir")
 				}
 			}
@@ -142,22 +480,23 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 			dbFile = storageDir + string(os.PathSeparator) + filename
 		}
 
-		if p.lru.Len() > p.maxPoolSize {
-			// nasty, kinda low level locking. Since p.cleanuphandlers also
-			// locks, unlock/lock here to avoid deadlocks
-			p.Unlock()
-			p.cleanupHandlers(1 + p.maxPoolSize/10) // clean up ~10%
-			p.Lock()
-		}
-
-		db, err := syncstorage.NewDB(dbFile, p.dbConfig)
+		start := time.Now()
+		db, err := p.openDB(dbFile, p.dbConfig)
 		if err != nil {
+			p.releaseDBSlot()
 			return nil, false, errors.Wrap(err, "Could not create DB")
 		}
+		p.metrics.Timing("pool.db_open", time.Since(start), "result:miss")
+		p.metrics.Incr("pool.get_element", "result:miss")
+		p.checkThrash(uid)
+
+		handler := NewSyncUserHandler(uid, db, p.userHandlerConfig)
+		handler.writes = p.writes
 
 		element = &poolElement{
 			uid:     uid,
-			handler: NewSyncUserHandler(uid, db, p.userHandlerConfig),
+			handler: handler,
+			created: time.Now(),
 		}
 
 		elementCreated = true
@@ -167,16 +506,47 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 		listElement := p.lru.PushFront(element)
 		p.lrumap[uid] = listElement
 	} else {
-		if element.handler.IsStopped() {
-			return nil, false, errElementStopped
-		}
-
 		p.lru.MoveToFront(p.lrumap[uid])
+		p.metrics.Incr("pool.get_element", "result:hit")
 	}
 
+	element.refs++
+	element.lastUsed = time.Now()
 	return element, elementCreated, nil
 }
 
+// HandlerInfo describes an open handler in a pool
+type HandlerInfo struct {
+	Pool     int       `json:"pool"`
+	Uid      string    `json:"uid"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	InUse    int       `json:"in_use"`
+	Stopped  bool      `json:"stopped"`
+}
+
+// handlers lists the open handlers, most recently used first. The pool is
+// only locked long enough to copy the list
+func (p *handlerPool) handlers(poolId int) []HandlerInfo {
+	p.Lock()
+	defer p.Unlock()
+
+	infos := make([]HandlerInfo, 0, p.lru.Len())
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		element := e.Value.(*poolElement)
+		infos = append(infos, HandlerInfo{
+			Pool:     poolId,
+			Uid:      element.uid,
+			Created:  element.created,
+			LastUsed: element.lastUsed,
+			InUse:    element.refs,
+			Stopped:  element.handler.IsStopped(),
+		})
+	}
+
+	return infos
+}
+
 // TwoLevelPath creates a reverse sub-directory path structure
 // e.g. uid:123456 => DATA_ROOT/65/43/123456.db
 func TwoLevelPath(uid string) []string {
@@ -196,12 +566,188 @@ func TwoLevelPath(uid string) []string {
 	}
 }
 
+// base picks the directory a uid's DB is stored in. New users get one
+// chosen by a hash of the uid so it is the same for every pool and across
+// restarts. Users moved with MoveUser are found where their DB is.
+func (p *handlerPool) base(uid string) []string {
+	if len(p.bases) == 1 {
+		return p.bases[0]
+	}
+
+	// use different bytes of the hash than SyncPoolHandler.poolIndex so
+	// the users of a pool are spread across all the directories
+	h := sha1.Sum([]byte(uid))
+	hashed := p.bases[binary.BigEndian.Uint32(h[:4])%uint32(len(p.bases))]
+
+	if dbExists(hashed, uid) {
+		return hashed
+	}
+
+	for _, base := range p.bases {
+		if dbExists(base, uid) {
+			return base
+		}
+	}
+
+	return hashed
+}
+
 func (p *handlerPool) PathAndFile(uid string) (path string, file string) {
+	return pathAndFile(p.base(uid), uid)
+}
+
+// pathAndFile is where a uid's DB is in the base directory
+func pathAndFile(base []string, uid string) (path string, file string) {
+	parts := make([]string, 0, len(base)+2)
+	parts = append(parts, base...)
 	path = string(os.PathSeparator) +
 		filepath.Join(
-			append(p.base, TwoLevelPath(uid)...)...,
+			append(parts, TwoLevelPath(uid)...)...,
 		)
 
 	file = uid + ".db"
 	return
 }
+
+func dbExists(base []string, uid string) bool {
+	path, file := pathAndFile(base, uid)
+	_, err := os.Stat(filepath.Join(path, file))
+	return err == nil
+}
+
+// WalkUIDs calls fn with the uid of every DB in basepath. It follows the
+// TwoLevelPath layout and ignores files that do not belong there. The uids
+// are streamed so millions of users do not have to fit in memory. Walking
+// stops at the first error returned by fn.
+func WalkUIDs(basepath string, fn func(uid string) error) error {
+	if basepath == ":memory:" {
+		return nil
+	}
+
+	base := filepath.Clean(basepath)
+	return filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".db") {
+			return nil
+		}
+
+		uid := strings.TrimSuffix(info.Name(), ".db")
+		expected := filepath.Join(append([]string{base}, TwoLevelPath(uid)...)...)
+		if uid == "" || filepath.Dir(path) != expected {
+			return nil
+		}
+
+		return fn(uid)
+	})
+}
+
+// moveUser relocates a uid's DB files from one base directory to another.
+// An open handler is closed first and requests for the uid get
+// errUserMoving until the files are in their new place.
+func (p *handlerPool) moveUser(uid, fromBase, toBase string) error {
+	var from, to []string
+	for i, basepath := range p.bases {
+		joined := string(os.PathSeparator) + filepath.Join(basepath...)
+		if joined == filepath.Clean(fromBase) {
+			from = p.bases[i]
+		}
+		if joined == filepath.Clean(toBase) {
+			to = p.bases[i]
+		}
+	}
+
+	if from == nil || to == nil {
+		return errors.Errorf("MoveUser: %s and %s must both be configured base paths", fromBase, toBase)
+	}
+
+	p.Lock()
+	if p.moving[uid] {
+		p.Unlock()
+		return errUserMoving
+	}
+
+	if element, ok := p.elements[uid]; ok {
+		if element.refs > 0 {
+			p.Unlock()
+			return errors.New("MoveUser: user is in use")
+		}
+		p.remove(p.lrumap[uid])
+	}
+
+	p.moving[uid] = true
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		delete(p.moving, uid)
+		p.Unlock()
+	}()
+
+	fromPath, file := pathAndFile(from, uid)
+	toPath, _ := pathAndFile(to, uid)
+
+	if _, err := os.Stat(filepath.Join(fromPath, file)); err != nil {
+		return errors.Wrap(err, "MoveUser: could not find DB")
+	}
+
+	if err := os.MkdirAll(toPath, 0755); err != nil {
+		return errors.Wrap(err, "MoveUser: could not create directory")
+	}
+
+	// copy everything before removing anything so a failure part way
+	// through leaves the original DB untouched
+	var moved []string
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		src := filepath.Join(fromPath, file+suffix)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+
+		dst := filepath.Join(toPath, file+suffix)
+		if err := copyFile(src, dst); err != nil {
+			for _, f := range moved {
+				os.Remove(filepath.Join(toPath, f))
+			}
+			return errors.Wrap(err, "MoveUser: could not copy DB")
+		}
+		moved = append(moved, file+suffix)
+	}
+
+	for _, f := range moved {
+		if err := os.Remove(filepath.Join(fromPath, f)); err != nil {
+			return errors.Wrap(err, "MoveUser: could not remove old DB")
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies src to dst and syncs it to disk. os.Rename can not be
+// used since base directories are usually on different disks
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
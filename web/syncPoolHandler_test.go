@@ -1,9 +1,25 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	logtest "github.com/Sirupsen/logrus/hooks/test"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,34 +30,204 @@ func testSyncPoolConfig() *SyncPoolConfig {
 	return config
 }
 
-func TestSyncPoolHandlerStatusConflict(t *testing.T) {
-	if testing.Short() {
-		t.Skip()
+// recordingMetrics keeps the names of everything it is sent
+type recordingMetrics struct {
+	sync.Mutex
+	timings []string
+	counts  []string
+}
+
+func (m *recordingMetrics) Timing(name string, d time.Duration, tags ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.timings = append(m.timings, name+"|"+strings.Join(tags, ","))
+}
+
+func (m *recordingMetrics) Incr(name string, tags ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.counts = append(m.counts, name+"|"+strings.Join(tags, ","))
+}
+
+func TestSyncPoolDBOpenMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := &recordingMetrics{}
+	config := testSyncPoolConfig()
+	config.Metrics = metrics
+	handler := NewSyncPoolHandler(config, nil)
+	pool := handler.pools[0]
+
+	uid := uniqueUID()
+
+	// miss
+	el, _, err := pool.getElement(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	pool.releaseElement(el)
+	assert.Equal([]string{"pool.db_open|result:miss"}, metrics.timings)
+	assert.Equal([]string{"pool.get_element|result:miss"}, metrics.counts)
+
+	// hit, no DB was opened
+	el, _, err = pool.getElement(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	pool.releaseElement(el)
+	assert.Len(metrics.timings, 1)
+	assert.Equal("pool.get_element|result:hit", metrics.counts[1])
+}
+
+func TestSyncPoolWarm(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.NumPools = 2
+	config.MaxPoolSize = 5
+	handler := NewSyncPoolHandler(config, nil)
+
+	uids := []string{uniqueUID(), uniqueUID(), uniqueUID(), uniqueUID()}
+	if !assert.NoError(handler.Warm(uids)) {
 		return
 	}
 
+	for _, uid := range uids {
+		pool := handler.pools[handler.poolIndex(uid)]
+		el, created, err := pool.getElement(uid)
+		if !assert.NoError(err) {
+			return
+		}
+		pool.releaseElement(el)
+		assert.False(created, "expected a hit for "+uid)
+	}
+}
+
+func TestSyncPoolWarmRespectsMaxPoolSize(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 2
+	handler := NewSyncPoolHandler(config, nil)
+	pool := handler.pools[0]
+
+	el, _, _ := pool.getElement("live")
+	pool.releaseElement(el)
+
+	created, err := pool.Warm([]string{"1", "2", "3"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// only fills the pool up, the live handler is not evicted to make room
+	assert.Len(created, 1)
+	assert.Equal(2, pool.lru.Len())
+	assert.NotNil(pool.elements["live"])
+}
+
+func TestSyncPoolMinResidency(t *testing.T) {
+	assert := assert.New(t)
+
+	burst := func(pool *handlerPool) {
+		for i := 0; i < 10; i++ {
+			el, _, _ := pool.getElement(uniqueUID())
+			pool.releaseElement(el)
+		}
+	}
+
+	{ // warmed handler survives a burst of traffic for other uids
+		config := testSyncPoolConfig()
+		config.MaxPoolSize = 2
+		config.MinResidency = time.Minute
+		handler := NewSyncPoolHandler(config, nil)
+		pool := handler.pools[0]
+
+		pool.Warm([]string{"warmed"})
+		burst(pool)
+		assert.NotNil(pool.elements["warmed"])
+
+		// once it is past the window it can be evicted again
+		pool.Lock()
+		pool.elements["warmed"].created = time.Now().Add(-time.Hour)
+		pool.Unlock()
+
+		burst(pool)
+		assert.Nil(pool.elements["warmed"])
+	}
+
+	{ // without a window it is evicted
+		config := testSyncPoolConfig()
+		config.MaxPoolSize = 2
+		handler := NewSyncPoolHandler(config, nil)
+		pool := handler.pools[0]
+
+		pool.Warm([]string{"warmed"})
+		burst(pool)
+		assert.Nil(pool.elements["warmed"])
+	}
+}
+
+func TestSyncPoolEvictPercent(t *testing.T) {
+	assert := assert.New(t)
+
+	for percent, expected := range map[int]int{
+		0:   3, // default 10%
+		10:  3,
+		50:  11,
+		100: 21,
+	} {
+		config := testSyncPoolConfig()
+		config.MaxPoolSize = 20
+		config.EvictPercent = percent
+		handler := NewSyncPoolHandler(config, nil)
+		pool := handler.pools[0]
+
+		// one over capacity, the next new uid triggers an eviction
+		for i := 0; i < 21; i++ {
+			el, _, _ := pool.getElement(uniqueUID())
+			pool.releaseElement(el)
+		}
+		assert.Equal(0, pool.evictions)
+
+		el, _, _ := pool.getElement(uniqueUID())
+		pool.releaseElement(el)
+		assert.Equal(expected, pool.evictions, "percent %d", percent)
+		assert.Equal(22-expected, pool.lru.Len(), "percent %d", percent)
+	}
+}
+
+func TestSyncPoolHandlerRecreatesStopped(t *testing.T) {
 	assert := assert.New(t)
 
 	uid := uniqueUID()
 	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	pool := handler.pools[0]
 
-	el, _, err := handler.pools[0].getElement(uid)
+	el, _, err := pool.getElement(uid)
 	if !assert.NoError(err) {
 		return
 	}
+	pool.releaseElement(el)
 
 	// !! Stop It. to simulate a TTL cleanup
 	el.handler.StopHTTP()
 
-	// test for conflict
-	url := syncurl(uid, "info/collections")
-	resp := request("GET", url, nil, handler)
-	if !assert.Equal(http.StatusConflict, resp.Code) {
+	fresh, created, err := pool.getElement(uid)
+	if !assert.NoError(err) {
 		return
 	}
+	pool.releaseElement(fresh)
 
-	retryAfter := resp.Header().Get("Retry-After")
-	assert.NotEqual("", retryAfter)
+	assert.True(created)
+	assert.False(fresh.handler.IsStopped())
+	assert.NotEqual(el, fresh)
+	assert.Equal(1, pool.lru.Len())
+
+	// and the request goes through
+	el.handler.StopHTTP()
+	fresh.handler.StopHTTP()
+	resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
 }
 
 func TestSyncPoolHandlerStop(t *testing.T) {
@@ -111,14 +297,138 @@ func TestSyncPoolHandlerLRU(t *testing.T) {
 func TestSyncPoolCleanupHandlers(t *testing.T) {
 	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
 	pool := handler.pools[0]
-	pool.getElement("1")
-	pool.getElement("2")
-	pool.getElement("3")
+	for _, uid := range []string{"1", "2", "3"} {
+		el, _, _ := pool.getElement(uid)
+		pool.releaseElement(el)
+	}
 
 	pool.cleanupHandlers(2)
 	assert.Equal(t, 1, pool.lru.Len())
 }
 
+func TestSyncPoolCleanupSkipsInUse(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	pool := handler.pools[0]
+
+	// "1" is the least recently used but is still in use
+	inUse, _, err := pool.getElement("1")
+	if !assert.NoError(err) {
+		return
+	}
+
+	for _, uid := range []string{"2", "3"} {
+		el, _, _ := pool.getElement(uid)
+		pool.releaseElement(el)
+	}
+
+	// the next LRU candidates are evicted instead
+	pool.cleanupHandlers(1)
+	assert.Equal(2, pool.lru.Len())
+	assert.NotNil(pool.elements["1"])
+	assert.Nil(pool.elements["2"])
+	assert.False(inUse.handler.IsStopped())
+
+	// nothing but in use elements left, nothing to evict
+	pool.cleanupHandlers(2)
+	assert.Equal(1, pool.lru.Len())
+	assert.False(inUse.handler.IsStopped())
+
+	// once released it can be evicted
+	pool.releaseElement(inUse)
+	pool.cleanupHandlers(1)
+	assert.Equal(0, pool.lru.Len())
+	assert.True(inUse.handler.IsStopped())
+}
+
+// blockingSink holds up the request sending a change until released
+type blockingSink struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) Send(c Change) {
+	s.started <- struct{}{}
+	<-s.release
+}
+
+func TestSyncPoolEvictDuringRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &blockingSink{started: make(chan struct{}), release: make(chan struct{})}
+	userConfig := NewDefaultSyncUserHandlerConfig()
+	userConfig.Changes = sink
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 2
+	handler := NewSyncPoolHandler(config, userConfig)
+	pool := handler.pools[0]
+
+	uid := uniqueUID()
+	writeDone := make(chan int)
+	go func() {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		body := bytes.NewBufferString(`{"payload":"x"}`)
+		writeDone <- requestheaders("PUT", syncurl(uid, "storage/bookmarks/bso0"), body, header, handler).Code
+	}()
+	<-sink.started
+
+	// other users fill the pool while the write is in flight
+	for i := 0; i < 5; i++ {
+		resp := request("GET", syncurl(uniqueUID(), "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	pool.Lock()
+	element := pool.elements[uid]
+	pool.Unlock()
+	if assert.NotNil(element, "in use handler was evicted") {
+		assert.False(element.handler.IsStopped())
+	}
+
+	close(sink.release)
+	assert.Equal(http.StatusOK, <-writeDone)
+
+	// and can be evicted once the request is done
+	pool.cleanupHandlers(10)
+	assert.True(element.handler.IsStopped())
+}
+
+func TestSyncPoolStopDrainsInUse(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	pool := handler.pools[0]
+
+	uid := uniqueUID()
+	element, _, err := pool.getElement(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// a slow write in flight while the pool is stopped
+	writeDone := make(chan int)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		body := bytes.NewBufferString(`{"payload":"x"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/bookmarks/bso0"), body, header, element.handler)
+		pool.releaseElement(element)
+		writeDone <- resp.Code
+	}()
+
+	start := time.Now()
+	handler.StopHTTP()
+	assert.True(time.Since(start) >= 50*time.Millisecond, "StopHTTP did not wait for the write")
+
+	assert.Equal(http.StatusOK, <-writeDone)
+	assert.True(element.handler.IsStopped())
+	assert.Equal(0, pool.lru.Len())
+}
+
 func TestSyncPoolPassesConfigToUserHandler(t *testing.T) {
 	assert := assert.New(t)
 	config := &SyncUserHandlerConfig{
@@ -147,3 +457,767 @@ func TestSyncPoolPassesConfigToUserHandler(t *testing.T) {
 	assert.Equal(el.handler.config.MaxBatchTTL, 7)
 	assert.Equal(el.handler.config.MaxRecordPayloadBytes, 8)
 }
+
+func TestSyncPoolMaxOpenDBs(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.NumPools = 2
+	config.MaxPoolSize = 100
+	config.MaxOpenDBs = 3
+	handler := NewSyncPoolHandler(config, nil)
+
+	// lock all the pools to get a consistent count
+	openDBs := func() (num int) {
+		for _, p := range handler.pools {
+			p.Lock()
+			defer p.Unlock()
+			num += len(p.elements)
+		}
+		return
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		errs    []error
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uid := uniqueUID()
+			pool := handler.pools[handler.poolIndex(uid)]
+			el, _, err := pool.getElement(uid)
+			if err == nil {
+				if num := openDBs(); num > config.MaxOpenDBs {
+					err = errors.Errorf("%d DBs open", num)
+				}
+				pool.releaseElement(el)
+			} else if err == errTooManyOpenDBs {
+				err = nil
+			}
+
+			if err != nil {
+				errLock.Lock()
+				errs = append(errs, err)
+				errLock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Len(errs, 0)
+	assert.True(openDBs() <= config.MaxOpenDBs)
+	assert.Equal(openDBs(), len(handler.pools[0].dbSlots))
+
+	{ // a full pool of DBs in the other pool results in a 503
+		config.NumPools = 1
+		config.MaxOpenDBs = 1
+		handler := NewSyncPoolHandler(config, nil)
+
+		uid := uniqueUID()
+		resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		// simulate a slot held by another pool
+		handler.pools[0].cleanupHandlers(1)
+		handler.pools[0].dbSlots <- struct{}{}
+
+		resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+		assert.Equal(http.StatusServiceUnavailable, resp.Code)
+		assert.NotEqual("", resp.Header().Get("Retry-After"))
+	}
+
+	{ // waiting for a slot does not hold the pool's lock
+		config.NumPools = 1
+		config.MaxOpenDBs = 1
+		handler := NewSyncPoolHandler(config, nil)
+		pool := handler.pools[0]
+
+		uidA := uniqueUID()
+		elA, _, err := pool.getElement(uidA)
+		if !assert.NoError(err) {
+			return
+		}
+
+		// uidA is in use so it can not be evicted to make room for uidB
+		result := make(chan error)
+		go func() {
+			el, _, err := pool.getElement(uniqueUID())
+			if err == nil {
+				pool.releaseElement(el)
+			}
+			result <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		el, _, err := pool.getElement(uidA)
+		if assert.NoError(err) {
+			pool.releaseElement(el)
+		}
+		assert.True(time.Since(start) < dbSlotWait/2, "blocked by the waiting request")
+
+		// freeing the slot in the same pool lets the waiting request through
+		pool.releaseElement(elA)
+		pool.cleanupHandlers(1)
+		assert.NoError(<-result)
+	}
+}
+
+// slowSink holds up writes while recording how many write slots are in use
+type slowSink struct {
+	sync.Mutex
+	slots   chan struct{}
+	maxUsed int
+}
+
+func (s *slowSink) Send(c Change) {
+	s.Lock()
+	if used := len(s.slots); used > s.maxUsed {
+		s.maxUsed = used
+	}
+	s.Unlock()
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestSyncPoolMaxWriters(t *testing.T) {
+	assert := assert.New(t)
+
+	// write sends many concurrent PUTs for different users and
+	// returns the response codes
+	write := func(handler *SyncPoolHandler) map[int]int {
+		var (
+			wg    sync.WaitGroup
+			lock  sync.Mutex
+			codes = make(map[int]int)
+		)
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				header := make(http.Header)
+				header.Set("Content-Type", "application/json")
+				body := bytes.NewBufferString(`{"payload": "x"}`)
+				resp := requestheaders("PUT", syncurl(uniqueUID(), "storage/col/bso0"), body, header, handler)
+
+				lock.Lock()
+				codes[resp.Code]++
+				lock.Unlock()
+				if resp.Code == http.StatusServiceUnavailable {
+					assert.NotEqual("", resp.Header().Get("Retry-After"))
+				}
+			}()
+		}
+
+		wg.Wait()
+		return codes
+	}
+
+	newHandler := func(wait time.Duration) (*SyncPoolHandler, *slowSink, *recordingMetrics) {
+		config := testSyncPoolConfig()
+		config.NumPools = 2
+		config.MaxPoolSize = 20
+		config.MaxWriters = 2
+		config.WriterWait = wait
+
+		metrics := &recordingMetrics{}
+		config.Metrics = metrics
+
+		sink := &slowSink{}
+		userConfig := NewDefaultSyncUserHandlerConfig()
+		userConfig.Changes = sink
+		handler := NewSyncPoolHandler(config, userConfig)
+		sink.slots = handler.writes.slots
+		return handler, sink, metrics
+	}
+
+	{ // writes wait for a slot
+		handler, sink, metrics := newHandler(5 * time.Second)
+		codes := write(handler)
+		assert.Equal(map[int]int{http.StatusOK: 10}, codes)
+		assert.True(sink.maxUsed <= 2, "%d writers at once", sink.maxUsed)
+		assert.Contains(metrics.timings, "pool.write_wait|")
+		assert.Len(handler.writes.slots, 0)
+	}
+
+	{ // and are shed when none free up in time
+		handler, sink, metrics := newHandler(time.Millisecond)
+		codes := write(handler)
+		assert.True(codes[http.StatusServiceUnavailable] > 0)
+		assert.Equal(10, codes[http.StatusOK]+codes[http.StatusServiceUnavailable])
+		assert.True(sink.maxUsed <= 2, "%d writers at once", sink.maxUsed)
+		assert.Contains(metrics.counts, "pool.write_shed|")
+
+		// reads are not limited
+		handler.writes.slots <- struct{}{}
+		handler.writes.slots <- struct{}{}
+		resp := request("GET", syncurl(uniqueUID(), "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	{ // writes queued behind the same user do not hold slots
+		handler, _, _ := newHandler(time.Millisecond)
+		busy, other := uniqueUID(), uniqueUID()
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 6)
+		put := func(uid string) {
+			defer wg.Done()
+			header := make(http.Header)
+			header.Set("Content-Type", "application/json")
+			body := bytes.NewBufferString(`{"payload": "x"}`)
+			codes <- requestheaders("PUT", syncurl(uid, "storage/col/bso0"), body, header, handler).Code
+		}
+
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go put(busy)
+		}
+		time.Sleep(5 * time.Millisecond)
+		wg.Add(1)
+		put(other)
+		wg.Wait()
+
+		close(codes)
+		for code := range codes {
+			assert.Equal(http.StatusOK, code)
+		}
+	}
+}
+
+// TestSyncPoolConcurrentEviction has many goroutines acquiring handlers while
+// the pool is constantly evicting them to catch use-after-close problems
+func TestSyncPoolConcurrentEviction(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+		return
+	}
+
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 2
+	handler := NewSyncPoolHandler(config, nil)
+	pool := handler.pools[0]
+
+	uids := make([]string, 10)
+	for i := range uids {
+		uids[i] = uniqueUID()
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		errs    []error
+	)
+
+	addErr := func(err error) {
+		errLock.Lock()
+		errs = append(errs, err)
+		errLock.Unlock()
+	}
+
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				uid := uids[(g+i)%len(uids)]
+
+				// exercise the TidyUp on create path directly as it
+				// runs outside of a request
+				el, created, err := pool.getElement(uid)
+				if err != nil {
+					addErr(err)
+					continue
+				}
+
+				if created {
+					if _, _, err := el.handler.TidyUp(time.Hour, time.Hour, 0); err != nil {
+						addErr(errors.Wrap(err, "TidyUp"))
+					}
+				}
+				pool.releaseElement(el)
+
+				// in use handlers are never evicted so every request succeeds
+				resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+				if resp.Code != http.StatusOK {
+					addErr(errors.Errorf("%d: %s", resp.Code, resp.Body.String()))
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	assert.Len(errs, 0)
+}
+
+func TestSyncPoolBasepaths(t *testing.T) {
+	assert := assert.New(t)
+
+	{ // a single directory keeps the original layout
+		pool := newHandlerPool([]string{"/data"}, 10, 0, 0, 0, nil, nil, nil, nil, NopMetrics{})
+		path, file := pool.PathAndFile("123456")
+		assert.Equal("/data/65/43", path)
+		assert.Equal("123456.db", file)
+	}
+
+	bases := []string{"/disk0", "/disk1", "/disk2"}
+	pool0 := newHandlerPool(bases, 10, 0, 0, 0, nil, nil, nil, nil, NopMetrics{})
+	pool1 := newHandlerPool(bases, 10, 0, 0, 0, nil, nil, nil, nil, NopMetrics{})
+
+	counts := make(map[string]int)
+	numUids := 3000
+	for i := 0; i < numUids; i++ {
+		uid := strconv.Itoa(100000 + i)
+		path, _ := pool0.PathAndFile(uid)
+
+		// the same uid always gets the same directory
+		path1, _ := pool1.PathAndFile(uid)
+		if !assert.Equal(path, path1) {
+			return
+		}
+
+		counts[strings.SplitN(path, "/", 3)[1]]++
+	}
+
+	// and the uids are spread evenly
+	if assert.Len(counts, len(bases)) {
+		for base, count := range counts {
+			assert.InDelta(numUids/len(bases), count, float64(numUids)/10, base)
+		}
+	}
+}
+
+func TestSyncPoolMoveUser(t *testing.T) {
+	assert := assert.New(t)
+
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "moveuser")
+		if !assert.NoError(err) {
+			return
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	config := testSyncPoolConfig()
+	config.Basepaths = dirs
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+
+	uid := uniqueUID()
+	pool := handler.pools[handler.poolIndex(uid)]
+	from, to := dirs[0], dirs[1]
+	if path, _ := pool.PathAndFile(uid); !strings.HasPrefix(path, from) {
+		from, to = to, from
+	}
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+	body := bytes.NewBufferString(`[{"id":"bso0", "payload":"zero"}, {"id":"bso1", "payload":"one"}]`)
+	resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	assert.Error(handler.MoveUser(uid, from, "/not/a/base"))
+
+	if !assert.NoError(handler.MoveUser(uid, from, to)) {
+		return
+	}
+
+	fromPath, file := pathAndFile(strings.Split(from, string(os.PathSeparator)), uid)
+	_, err := os.Stat(filepath.Join(fromPath, file))
+	assert.True(os.IsNotExist(err), "DB should be removed from the old base")
+
+	path, _ := pool.PathAndFile(uid)
+	assert.True(strings.HasPrefix(path, to), "DB should be found in the new base")
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks?full=1&sort=index"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var bsos []struct{ Id, Payload string }
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bsos)) && assert.Len(bsos, 2) {
+			payloads := map[string]string{bsos[0].Id: bsos[0].Payload, bsos[1].Id: bsos[1].Payload}
+			assert.Equal(map[string]string{"bso0": "zero", "bso1": "one"}, payloads)
+		}
+	}
+
+	{ // in use users can not be moved
+		element, _, err := pool.getElement(uid)
+		if assert.NoError(err) {
+			assert.Error(handler.MoveUser(uid, to, from))
+			pool.releaseElement(element)
+		}
+	}
+}
+
+func TestSyncPoolMoveUserWaitingForSlot(t *testing.T) {
+	assert := assert.New(t)
+
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "moveuser")
+		if !assert.NoError(err) {
+			return
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	config := testSyncPoolConfig()
+	config.Basepaths = dirs
+	config.MaxOpenDBs = 1
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+
+	uid := uniqueUID()
+	pool := handler.pools[handler.poolIndex(uid)]
+	from, to := dirs[0], dirs[1]
+	if path, _ := pool.PathAndFile(uid); !strings.HasPrefix(path, from) {
+		from, to = to, from
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	body := bytes.NewBufferString(`[{"id":"bso0", "payload":"zero"}]`)
+	resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	// simulate the only slot being held by another pool
+	pool.cleanupHandlers(1)
+	pool.dbSlots <- struct{}{}
+
+	result := make(chan error)
+	go func() {
+		element, _, err := pool.getElement(uid)
+		if err == nil {
+			pool.releaseElement(element)
+		}
+		result <- err
+	}()
+
+	// the user is moved while getElement waits for a slot
+	time.Sleep(50 * time.Millisecond)
+	if !assert.NoError(handler.MoveUser(uid, from, to)) {
+		return
+	}
+	<-pool.dbSlots
+
+	if !assert.NoError(<-result) {
+		return
+	}
+
+	fromPath, file := pathAndFile(strings.Split(from, string(os.PathSeparator)), uid)
+	_, err := os.Stat(filepath.Join(fromPath, file))
+	assert.True(os.IsNotExist(err), "DB should not be recreated in the old base")
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(`["bso0"]`, strings.TrimSpace(resp.Body.String()))
+}
+
+func TestSyncPoolWalkUIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "walkuids")
+		if !assert.NoError(err) {
+			return
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	config := testSyncPoolConfig()
+	config.Basepaths = dirs
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+
+	expected := make(map[string]bool)
+	for _, uid := range []string{"1", "12", "123", "1234", "123456", "987654321"} {
+		pool := handler.pools[handler.poolIndex(uid)]
+		element, _, err := pool.getElement(uid)
+		if !assert.NoError(err) {
+			return
+		}
+		pool.releaseElement(element)
+		expected[uid] = true
+	}
+
+	// files that are not user DBs are skipped
+	ioutil.WriteFile(filepath.Join(dirs[0], "notes.txt"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dirs[0], "555.db"), []byte("x"), 0644)
+
+	found := make(map[string]bool)
+	err := handler.WalkUIDs(func(uid string) error {
+		assert.False(found[uid], "duplicate uid %s", uid)
+		found[uid] = true
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(expected, found)
+
+	// errors stop the walk
+	calls := 0
+	stop := errors.New("stop")
+	err = handler.WalkUIDs(func(uid string) error {
+		calls++
+		return stop
+	})
+	assert.Equal(stop, err)
+	assert.Equal(1, calls)
+}
+
+func TestSyncPoolSlowAcquire(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 1
+	config.SlowAcquire = 5 * time.Millisecond
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+
+	pool := handler.pools[0]
+	logger, hook := logtest.NewNullLogger()
+	pool.logger = logger
+	pool.openDB = func(file string, config *syncstorage.Config) (*syncstorage.DB, error) {
+		time.Sleep(10 * time.Millisecond)
+		return syncstorage.NewDB(file, config)
+	}
+
+	get := func(uid string) {
+		element, _, err := pool.getElement(uid)
+		if assert.NoError(err) {
+			pool.releaseElement(element)
+		}
+	}
+
+	get("1")
+	if assert.Len(hook.Entries, 1) {
+		entry := hook.LastEntry()
+		assert.Equal(logrus.WarnLevel, entry.Level)
+		assert.Equal("1", entry.Data["uid"])
+		assert.Equal(true, entry.Data["created"])
+		assert.Equal(0, entry.Data["evicted"])
+	}
+
+	// hits are fast
+	get("1")
+	assert.Len(hook.Entries, 1)
+
+	get("2")
+	get("3") // pool is over MaxPoolSize, evicts
+	if assert.Len(hook.Entries, 3) {
+		assert.Equal("3", hook.LastEntry().Data["uid"])
+		assert.Equal(1, hook.LastEntry().Data["evicted"])
+	}
+
+	// disabled
+	pool.slowAcquire = 0
+	get("4")
+	assert.Len(hook.Entries, 3)
+}
+
+func TestSyncPoolThrash(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := &recordingMetrics{}
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 1
+	config.Metrics = metrics
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+
+	pool := handler.pools[0]
+	logger, hook := logtest.NewNullLogger()
+	pool.logger = logger
+
+	thrashes := func() (n int) {
+		metrics.Lock()
+		defer metrics.Unlock()
+		for _, c := range metrics.counts {
+			if c == "pool.thrash|" {
+				n++
+			}
+		}
+		return
+	}
+
+	get := func(uid string) {
+		element, _, err := pool.getElement(uid)
+		if assert.NoError(err) {
+			pool.releaseElement(element)
+		}
+	}
+
+	get("1")
+	get("2")
+	get("3") // evicts 1
+	assert.Equal(0, thrashes())
+	assert.Len(hook.Entries, 0)
+
+	get("1") // reopened right after eviction
+	assert.Equal(1, thrashes())
+	if assert.Len(hook.Entries, 1) {
+		assert.Equal(logrus.WarnLevel, hook.LastEntry().Level)
+		assert.Equal("1", hook.LastEntry().Data["uid"])
+		assert.Equal(1, hook.LastEntry().Data["reopens"])
+	}
+
+	// evicted and reopened again counts up
+	get("4")
+	get("5")
+	get("1")
+	assert.Equal(2, thrashes())
+	if assert.Len(hook.Entries, 2) {
+		assert.Equal(2, hook.LastEntry().Data["reopens"])
+	}
+
+	// reopening long after eviction is not thrashing
+	get("6")
+	get("7")
+	pool.Lock()
+	pool.evicted["1"].Value.(*evictedUID).at = time.Now().Add(-2 * thrashWindow)
+	pool.Unlock()
+	get("1")
+	assert.Equal(2, thrashes())
+	pool.Lock()
+	assert.Nil(pool.evicted["1"])
+	pool.Unlock()
+
+	// uids evicted longer than thrashWindow ago are trimmed off the list
+	pool.Lock()
+	for le := pool.evictedList.Front(); le != nil; le = le.Next() {
+		le.Value.(*evictedUID).at = time.Now().Add(-2 * thrashWindow)
+	}
+	pool.rememberEvicted("8")
+	assert.Equal(1, pool.evictedList.Len())
+	assert.Len(pool.evicted, 1)
+	assert.NotNil(pool.evicted["8"])
+	pool.Unlock()
+}
+
+// benchMetrics keeps just enough to report cold opens in benchmarks
+type benchMetrics struct {
+	sync.Mutex
+	opens    int
+	openTime time.Duration
+}
+
+func (m *benchMetrics) Timing(name string, d time.Duration, tags ...string) {
+	if name != "pool.db_open" {
+		return
+	}
+	m.Lock()
+	m.opens++
+	m.openTime += d
+	m.Unlock()
+}
+
+func (m *benchMetrics) Incr(name string, tags ...string) {}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// BenchmarkPoolMixedLoad sends a mix of reads and writes for random uids
+// through the pool. When there are more uids than the pool holds
+// handlers are evicted and DBs reopened, which is the cost to tune
+// POOL_MAX_SIZE and POOL_MAX_OPEN_DBS against. DBs are :memory: so every
+// uid gets its own isolated DB and runs are reproducible
+func BenchmarkPoolMixedLoad(b *testing.B) {
+	cases := []struct {
+		uids     int
+		poolSize int
+	}{
+		{10, 100},   // everything stays open
+		{100, 100},  // pool just fits
+		{1000, 100}, // constant eviction
+		{1000, 1000},
+	}
+
+	body := `[{"id":"a","payload":"hello"},{"id":"b","payload":"world"}]`
+
+	for _, c := range cases {
+		c := c
+		b.Run(fmt.Sprintf("uids=%d/pool=%d", c.uids, c.poolSize), func(b *testing.B) {
+			metrics := &benchMetrics{}
+			config := testSyncPoolConfig()
+			config.NumPools = 4
+			config.MaxPoolSize = c.poolSize / config.NumPools
+			config.Metrics = metrics
+			handler := NewSyncPoolHandler(config, nil)
+			defer handler.StopHTTP()
+
+			var (
+				mu        sync.Mutex
+				latencies durations
+				seed      int64
+			)
+
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				seed++
+				rnd := rand.New(rand.NewSource(seed))
+				mu.Unlock()
+
+				var local durations
+				for pb.Next() {
+					uid := rnd.Intn(c.uids) + 1
+					t := time.Now()
+					switch n := rnd.Intn(10); {
+					case n < 2: // 20% writes
+						jsonrequest("POST", syncurl(uid, "storage/bookmarks"), strings.NewReader(body), handler)
+					case n < 6:
+						request("GET", syncurl(uid, "info/collections"), nil, handler)
+					default:
+						request("GET", syncurl(uid, "storage/bookmarks?full=1&limit=10"), nil, handler)
+					}
+					local = append(local, time.Since(t))
+				}
+
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+			elapsed := time.Since(start)
+			b.StopTimer()
+
+			if len(latencies) == 0 {
+				return
+			}
+			sort.Sort(latencies)
+			p99 := latencies[len(latencies)*99/100]
+
+			evictions := 0
+			for _, p := range handler.pools {
+				p.Lock()
+				evictions += p.evictions
+				p.Unlock()
+			}
+
+			var avgOpen time.Duration
+			if metrics.opens > 0 {
+				avgOpen = metrics.openTime / time.Duration(metrics.opens)
+			}
+
+			b.Logf("req/s=%.0f p99=%v cold_opens=%d avg_open=%v evictions=%d",
+				float64(len(latencies))/elapsed.Seconds(), p99,
+				metrics.opens, avgOpen, evictions)
+		})
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +34,80 @@ type SyncUserHandlerConfig struct {
 	MaxTotalBytes         int
 	MaxBatchTTL           int
 	MaxRecordPayloadBytes int // largest BSO payload
+	MaxUserBytes          int // quota of payload bytes per user, 0 is unlimited
+	MaxPOSTResults        int // ids listed in success and failed of POST responses, 0 is unlimited
+	MaxPagingRecords      int // records a GET can page through with offset, 0 is unlimited
+	MaxImportRecords      int // collections and BSOs in a snapshot import, 0 is unlimited
+
+	// Behaviour
+	AutoBSOIds          bool // generate ids for POSTed BSOs without one
+	MultiCollectionGET  bool // allow GET /storage?collections=a,b,c
+	MultiCollectionPOST bool // allow POST /storage with BSOs for several collections
+	StrictSlash         bool // 404 on paths with a trailing slash instead of ignoring it
+	StrictRecordCounts  bool // 400 POSTs where X-Weave-Records or X-Weave-Total-Records are wrong
+
+	// 404 on GET of a collection that has never been written, as it is
+	// missing from info/collections, instead of an empty list. It lets
+	// clients tell a collection that was never synced from an empty one
+	MissingCollectionNotFound bool
+
+	// sort order for GETs without a sort param, SORT_NONE means SORT_NEWEST
+	DefaultSort syncstorage.SortType
+
+	// send the modified time a BSO had before a PUT or PATCH changed it
+	// in X-Weave-Previous-Modified so clients can tell they overwrote a
+	// newer write
+	PreviousModifiedHeader bool
+
+	// response format for requests without an Accept header,
+	// application/json or application/newlines. Empty is application/json
+	DefaultAccept string
+
+	// minimum TTL in seconds for BSOs written to specific collections.
+	// Lower TTLs are raised to the minimum or rejected with MinTTLReject
+	MinTTLs      map[string]int
+	MinTTLReject bool
+
+	// collections where every BSO written must have a sortindex
+	RequireSortIndex []string
+
+	// limits for specific collections that override the ones above
+	CollectionLimits map[string]CollectionLimits
+
+	// collections that can be read but not written, ie: during a data
+	// migration. A user's own list, see SetFrozen, replaces it
+	FrozenCollections []string
+
+	// seconds a POST response is kept to be sent again to clients that
+	// retry with the same Idempotency-Key header, 0 disables it
+	IdempotencyTTL int
+
+	// most POST responses kept per user for IdempotencyTTL
+	IdempotencyKeys int
+
+	// collections left out of info/collection_usage, info/quota and the
+	// MaxUserBytes quota. Writes to them are never over quota
+	UsageExclude []string
+
+	// Changes receives every write, ie: for change data capture. nil
+	// disables it
+	Changes ChangeSink
+
+	// Metrics receives measurements, nil discards them
+	Metrics Metrics
+}
+
+// CollectionLimits override the SyncUserHandlerConfig limits for a single
+// collection. Zero values use the limits of the SyncUserHandlerConfig
+type CollectionLimits struct {
+	MaxPOSTRecords        int
+	MaxRecordPayloadBytes int
+	MaxBSOGetLimit        int
+
+	// TTLs in seconds. DefaultTTL is given to BSOs written without a TTL
+	// and higher TTLs are lowered to MaxTTL. Zero means no limit
+	DefaultTTL int
+	MaxTTL     int
 }
 
 func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
@@ -44,9 +120,15 @@ func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
 		MaxTotalRecords:       10000,
 		MaxTotalBytes:         100 * 1024 * 1024,
 		MaxRecordPayloadBytes: 1024 * 256,
+		MaxImportRecords:      1000000,
+
+		IdempotencyKeys: 20,
 
 		// batches older than this are likely to be purged
 		MaxBatchTTL: 2 * 60 * 60 * 1000, // 2 hours in milliseconds
+
+		DefaultSort:   syncstorage.SORT_NEWEST,
+		DefaultAccept: "application/json",
 	}
 }
 
@@ -68,12 +150,29 @@ type SyncUserHandler struct {
 	// need to be synchronized
 	lastChange time.Time
 
-	config *SyncUserHandlerConfig
+	// collection name => id so repeated requests skip the DB lookup.
+	// Protected by requestLock
+	cids map[string]int
+
+	// the user's frozen collections, loaded on first use. Protected
+	// by requestLock
+	frozen       []string
+	frozenLoaded bool
+
+	// recent POST responses by Idempotency-Key, oldest first. Protected
+	// by requestLock
+	idempotentResponses []*idempotentResponse
+
+	// limits concurrent writes across users, set by the pool. nil is
+	// unlimited
+	writes *writeLimiter
+
+	config  *SyncUserHandlerConfig
+	metrics Metrics
 }
 
 func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerConfig) *SyncUserHandler {
 
-	// https://docs.services.mozilla.com/storage/apis-1.5.html
 	r := mux.NewRouter()
 
 	if config == nil {
@@ -81,36 +180,77 @@ func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerC
 	}
 
 	server := &SyncUserHandler{
-		uid:    uid,
-		router: r,
-		db:     db,
-		config: config,
+		uid:     uid,
+		router:  r,
+		db:      db,
+		cids:    make(map[string]int),
+		config:  config,
+		metrics: config.Metrics,
+	}
+
+	if server.metrics == nil {
+		server.metrics = NopMetrics{}
+	}
+
+	for version, registerRoutes := range apiRoutes {
+		registerRoutes(server, r, "/"+version+"/"+uid)
+	}
+
+	// errors are always JSON, mux's default 404 is text/plain
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sendRequestProblem(w, req, http.StatusNotFound, errors.New("Not Found"))
+	})
+
+	return server
+}
+
+// apiRoutes maps an API version to the function that registers its routes.
+// Versions are served side by side so a new one can be added without
+// touching the routes of the others
+var apiRoutes = map[string]func(s *SyncUserHandler, r *mux.Router, prefix string){
+	"1.5": routes15,
+}
+
+// apiVersions returns the API versions that have routes, sorted
+func apiVersions() []string {
+	versions := make([]string, 0, len(apiRoutes))
+	for version := range apiRoutes {
+		versions = append(versions, version)
 	}
+	sort.Strings(versions)
+	return versions
+}
 
+// routes15 registers the sync 1.5 API under prefix, ie: /1.5/{uid}
+// https://docs.services.mozilla.com/storage/apis-1.5.html
+func routes15(s *SyncUserHandler, r *mux.Router, prefix string) {
 	// top level deletions for the user and their storage
 	// Note: not part of the sub-routers since since they don't end with a `/`
-	r.HandleFunc("/1.5/"+uid, server.hDeleteEverything).Methods("DELETE")
-	r.HandleFunc("/1.5/"+uid+"/storage", server.hDeleteEverything).Methods("DELETE")
+	r.HandleFunc(prefix, s.notFrozen(s.hDeleteEverything)).Methods("DELETE")
+	r.HandleFunc(prefix+"/storage", s.notFrozen(s.hDeleteEverything)).Methods("DELETE")
+	r.HandleFunc(prefix+"/storage", s.hStorageGET).Methods("GET")
+	r.HandleFunc(prefix+"/storage", s.idempotent(s.hStoragePOST)).Methods("POST")
 
-	v := r.PathPrefix("/1.5/" + uid + "/").Subrouter()
+	v := r.PathPrefix(prefix + "/").Subrouter()
 
 	info := v.PathPrefix("/info/").Subrouter()
-	info.HandleFunc("/collections", server.hInfoCollections).Methods("GET")
-	info.HandleFunc("/collection_usage", server.hInfoCollectionUsage).Methods("GET")
-	info.HandleFunc("/collection_counts", server.hInfoCollectionCounts).Methods("GET")
-	info.HandleFunc("/configuration", server.hInfoConfiguration).Methods("GET")
-	info.HandleFunc("/quota", server.hInfoQuota).Methods("GET")
+	info.HandleFunc("/collections", s.hInfoCollections).Methods("GET")
+	info.HandleFunc("/collection_usage", s.hInfoCollectionUsage).Methods("GET")
+	info.HandleFunc("/collection_counts", s.hInfoCollectionCounts).Methods("GET")
+	info.HandleFunc("/configuration", s.hInfoConfiguration).Methods("GET")
+	info.HandleFunc("/quota", s.hInfoQuota).Methods("GET")
+	info.HandleFunc("/collection_versions", s.hInfoCollectionVersions).Methods("GET")
+	info.HandleFunc("/collection_versions/{collection}", s.notFrozen(s.hCollectionVersionPUT)).Methods("PUT")
 
 	storage := v.PathPrefix("/storage/").Subrouter()
 
-	storage.HandleFunc("/{collection}", server.hCollectionGET).Methods("GET")
-	storage.HandleFunc("/{collection}", server.hCollectionPOST).Methods("POST")
-	storage.HandleFunc("/{collection}", server.hCollectionDELETE).Methods("DELETE")
-	storage.HandleFunc("/{collection}/{bsoId}", server.hBsoGET).Methods("GET")
-	storage.HandleFunc("/{collection}/{bsoId}", server.hBsoPUT).Methods("PUT")
-	storage.HandleFunc("/{collection}/{bsoId}", server.hBsoDELETE).Methods("DELETE")
-
-	return server
+	storage.HandleFunc("/{collection}", s.hCollectionGET).Methods("GET")
+	storage.HandleFunc("/{collection}", s.idempotent(s.notFrozen(s.hCollectionPOST))).Methods("POST")
+	storage.HandleFunc("/{collection}", s.notFrozen(s.hCollectionDELETE)).Methods("DELETE")
+	storage.HandleFunc("/{collection}/{bsoId}", s.hBsoGET).Methods("GET")
+	storage.HandleFunc("/{collection}/{bsoId}", s.notFrozen(s.hBsoPUT)).Methods("PUT")
+	storage.HandleFunc("/{collection}/{bsoId}", s.notFrozen(s.hBsoPATCH)).Methods("PATCH")
+	storage.HandleFunc("/{collection}/{bsoId}", s.notFrozen(s.hBsoDELETE)).Methods("DELETE")
 }
 
 // TidyUp will purge expired BSOs and Batches. When the database has exceeded
@@ -118,6 +258,15 @@ func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerC
 // potentially be a long operation as the database vacuumed needs to rewrite
 // the entire database file
 func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int) (skipped bool, took time.Duration, err error) {
+	// serialize with requests and StopHTTP so the db
+	// can not be closed while tidying up
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return true, 0, nil
+	}
+
 	// Purge Expired BSOs
 	start := time.Now()
 
@@ -270,8 +419,25 @@ func (s *SyncUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// the trailing slash is dropped rather than redirecting to the path
+	// without it. Clients resend redirected POSTs as GETs
+	if !s.config.StrictSlash && len(req.URL.Path) > 1 && strings.HasSuffix(req.URL.Path, "/") {
+		req.URL.Path = strings.TrimRight(req.URL.Path, "/")
+		req.URL.RawPath = strings.TrimRight(req.URL.RawPath, "/")
+	}
+
+	w = &generationWriter{ResponseWriter: w, db: s.db}
+
 	switch req.Method {
-	case "POST", "PUT", "DELETE":
+	case "POST", "PUT", "PATCH", "DELETE":
+		if !s.writes.acquire() {
+			w.Header().Add("Retry-After", strconv.Itoa(5))
+			sendRequestProblem(w, req, http.StatusServiceUnavailable,
+				errors.New("Too many concurrent writes"))
+			return
+		}
+		defer s.writes.release()
+
 		// make sure all X-Last-Modified values are unique we sleep for a bit
 		var toSleep time.Duration
 
@@ -322,33 +488,160 @@ func (s *SyncUserHandler) StopHTTP() {
 	}
 }
 
+// Repair checks and fixes the user's DB. It is serialized with requests
+// so nothing else touches the DB while it is being repaired
+func (s *SyncUserHandler) Repair() (*syncstorage.RepairReport, error) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return nil, errors.New("SyncUserHandler stopped")
+	}
+
+	report, err := s.db.Repair()
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"uid":              s.uid,
+		"integrity":        len(report.Integrity),
+		"integrity_after":  len(report.IntegrityAfter),
+		"orphaned_bsos":    report.OrphanedBSOs,
+		"orphaned_batches": report.OrphanedBatches,
+	}).Info("SyncUserHandler - Repair")
+
+	return report, nil
+}
+
+// Export writes a snapshot of all the user's data to w
+func (s *SyncUserHandler) Export(w io.Writer) error {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return errors.New("SyncUserHandler stopped")
+	}
+
+	return s.db.Export(w)
+}
+
+// Import replaces all the user's data with a snapshot from Export. BSOs
+// over MaxRecordPayloadBytes or the MaxUserBytes quota are skipped, the
+// per request record limits do not apply. Snapshots with more than
+// MaxImportRecords are rejected.
+func (s *SyncUserHandler) Import(r io.Reader) (*syncstorage.ImportReport, error) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return nil, errors.New("SyncUserHandler stopped")
+	}
+
+	report, err := s.db.Import(r, &syncstorage.ImportLimits{
+		MaxPayloadBytes: s.config.MaxRecordPayloadBytes,
+		MaxBytes:        s.config.MaxUserBytes,
+		MaxRecords:      s.config.MaxImportRecords,
+		Exclude:         s.config.UsageExclude,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"uid":         s.uid,
+		"collections": report.Collections,
+		"bsos":        report.BSOs,
+		"skipped":     len(report.Skipped),
+	}).Info("SyncUserHandler - Import")
+
+	return report, nil
+}
+
+// SetFrozen replaces FrozenCollections for this user. nil goes back to
+// FrozenCollections, an empty list freezes nothing.
+func (s *SyncUserHandler) SetFrozen(collections []string) error {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return errors.New("SyncUserHandler stopped")
+	}
+
+	value := ""
+	if collections != nil {
+		encoded, err := json.Marshal(collections)
+		if err != nil {
+			return err
+		}
+		value = string(encoded)
+	}
+
+	if err := s.db.SetKey(frozenKey, value); err != nil {
+		return err
+	}
+
+	// reloaded on next use
+	s.frozenLoaded = false
+
+	log.WithFields(log.Fields{
+		"uid":         s.uid,
+		"collections": collections,
+	}).Info("SyncUserHandler - SetFrozen")
+
+	return nil
+}
+
+// Frozen returns the collections that can not be written and if they are
+// the user's own list rather than FrozenCollections
+func (s *SyncUserHandler) Frozen() (collections []string, own bool, err error) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	if s.IsStopped() {
+		return nil, false, errors.New("SyncUserHandler stopped")
+	}
+
+	return s.frozenCollections()
+}
+
 // getcid looks up a collection by name and returns its id. If it doesn't
 // exist it will create it if automake is true
 func (s *SyncUserHandler) getcid(r *http.Request, automake bool) (cId int, err error) {
-	collection := mux.Vars(r)["collection"]
+	return s.collectionId(mux.Vars(r)["collection"], automake)
+}
 
+// collectionId is getcid for a collection name that doesn't come from the URL
+func (s *SyncUserHandler) collectionId(collection string, automake bool) (cId int, err error) {
 	if !syncstorage.CollectionNameOk(collection) {
 		err = syncstorage.ErrInvalidCollectionName
 		return
 	}
 
-	cId, err = s.db.GetCollectionId(collection)
-
-	if err == nil {
-		return
+	if cId, ok := s.cids[collection]; ok {
+		return cId, nil
 	}
 
+	cId, err = s.db.GetCollectionId(collection)
+
 	if err == syncstorage.ErrNotFound && automake {
 		cId, err = s.db.CreateCollection(collection)
 	}
 
+	if err == nil {
+		s.cids[collection] = cId
+	}
+
 	return
 }
 
-// hInfoQuota calculates the total disk space used by the user by calculating
-// it based on the number of DB pages used * size of each page.
-// TODO actually implement quotas in the system.
+// hInfoQuota returns [used, limit] in KB like info/collection_usage. The
+// limit is MaxUserBytes, null when there is no quota
 func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
 	results, err := s.db.InfoCollectionUsage()
 	if err != nil {
 		InternalError(w, r, err)
@@ -366,23 +659,40 @@ func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
 	}
 
 	used := 0
-	for _, bytes := range results {
-		used += bytes
+	for name, bytes := range results {
+		if !s.usageExcluded(name) {
+			used += bytes
+		}
 	}
 
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("X-Last-Modified", m)
 
-	tmp := float64(used) / 1024
-	JsonNewline(w, r, []*float64{&tmp, nil}) // crazy pointer cause need the nil
+	usedKB := float64(used) / 1024
+	quota := []*float64{&usedKB, nil} // crazy pointer cause need the nil
+	if s.config.MaxUserBytes > 0 {
+		limitKB := float64(s.config.MaxUserBytes) / 1024
+		quota[1] = &limitKB
+	}
+	JsonNewline(w, r, quota)
 }
 
 func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Request) {
 
-	if !AcceptHeaderOk(w, r) {
+	if !s.acceptHeaderOk(w, r) {
 		return
 	}
 
+	// newer limits the response to collections modified after it
+	newer := 0
+	if v := r.URL.Query().Get("newer"); v != "" {
+		var err error
+		if newer, err = parseNewer(v); err != nil {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
 	if info, err := s.db.InfoCollections(); err != nil {
 		InternalError(w, r, err)
 		return
@@ -398,6 +708,14 @@ func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Reques
 			return
 		}
 
+		if newer > 0 {
+			for name, modtime := range info {
+				if modtime <= newer {
+					delete(info, name)
+				}
+			}
+		}
+
 		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("X-Last-Modified", m)
 		w.Header().Set("Content-Type", "application/json")
@@ -415,7 +733,19 @@ func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *SyncUserHandler) hInfoCollectionUsage(w http.ResponseWriter, r *http.Request) {
-	if !AcceptHeaderOk(w, r) {
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	// the sync 1.5 api says data should be in KB, ?unit=bytes is for
+	// tooling that needs exact numbers
+	var inBytes bool
+	switch unit := r.URL.Query().Get("unit"); unit {
+	case "", "kb":
+	case "bytes":
+		inBytes = true
+	default:
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid unit %q, expected kb or bytes", unit))
 		return
 	}
 
@@ -433,237 +763,792 @@ func (s *SyncUserHandler) hInfoCollectionUsage(w http.ResponseWriter, r *http.Re
 		InternalError(w, r, err)
 		return
 	} else {
-		// the sync 1.5 api says data should be in KB
+		for name := range results {
+			if s.usageExcluded(name) {
+				delete(results, name)
+			}
+		}
+
+		m := syncstorage.ModifiedToString(modified)
+		w.Header().Set("X-Last-Modified", m)
+
+		if inBytes {
+			JsonNewline(w, r, results)
+			return
+		}
+
 		resultsKB := make(map[string]float64)
 		for name, bytes := range results {
 			resultsKB[name] = float64(bytes) / 1024
 		}
-		m := syncstorage.ModifiedToString(modified)
-		w.Header().Set("X-Last-Modified", m)
-		JsonNewline(w, r, resultsKB)
-	}
-}
+		JsonNewline(w, r, resultsKB)
+	}
+}
+
+// hInfoCollectionCounts returns the number of BSOs in each collection.
+// With ?newer only collections modified after it are included, collections
+// that were emptied since then have a count of 0
+func (s *SyncUserHandler) hInfoCollectionCounts(w http.ResponseWriter, r *http.Request) {
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	newer := 0
+	if v := r.URL.Query().Get("newer"); v != "" {
+		var err error
+		if newer, err = parseNewer(v); err != nil {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	results, err := s.db.InfoCollectionCounts()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if newer > 0 {
+		info, err := s.db.InfoCollections()
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		changed := make(map[string]int)
+		for name, modtime := range info {
+			if modtime > newer {
+				changed[name] = results[name]
+			}
+		}
+		results = changed
+	}
+
+	modified, err := s.db.LastModified()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if sentNotModified(w, r, modified) {
+		return
+	}
+
+	m := syncstorage.ModifiedToString(modified)
+	w.Header().Set("X-Last-Modified", m)
+	JsonNewline(w, r, results)
+}
+
+// hInfoCollectionVersions returns the format version of every collection
+// that has one, see hCollectionVersionPUT
+func (s *SyncUserHandler) hInfoCollectionVersions(w http.ResponseWriter, r *http.Request) {
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	results, err := s.db.CollectionVersions()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	modified, err := s.db.LastModified()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if sentNotModified(w, r, modified) {
+		return
+	}
+
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	JsonNewline(w, r, results)
+}
+
+// hCollectionVersionPUT sets the payload format version of a collection
+// from a body like {"version":2}. Clients use it to decide when their data
+// needs migrating, the server does not check payloads against it.
+func (s *SyncUserHandler) hCollectionVersionPUT(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Version *int `json:"version"`
+	}
+
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&body) != nil || body.Version == nil {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New(`Body must be {"version":N}`))
+		return
+	}
+
+	cId, err := s.getcid(r, true)
+	if err != nil {
+		if err == syncstorage.ErrInvalidCollectionName {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+		} else {
+			InternalError(w, r, err)
+		}
+		return
+	}
+
+	if err := s.db.SetCollectionVersion(cId, *body.Version); err != nil {
+		if err == syncstorage.ErrInvalidCollectionVersion {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+		} else {
+			InternalError(w, r, err)
+		}
+		return
+	}
+
+	JSON(w, r, http.StatusOK, body)
+}
+
+func (s *SyncUserHandler) hInfoConfiguration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{
+		"max_post_records":%d,
+		"max_post_bytes":%d,
+		"max_total_records":%d,
+		"max_total_bytes":%d,
+		"max_request_bytes":%d,
+	    "max_record_payload_bytes":%d}`,
+		s.config.MaxPOSTRecords,
+		s.config.MaxPOSTBytes,
+		s.config.MaxTotalRecords,
+		s.config.MaxTotalBytes,
+		s.config.MaxRequestBytes,
+		s.config.MaxRecordPayloadBytes,
+	)
+}
+
+// bsoQuery holds the query params that control searching for BSOs
+type bsoQuery struct {
+	ids    []string
+	newer  int
+	older  int
+	full   bool
+	limit  int
+	offset int
+	sort   syncstorage.SortType
+
+	// the requested limit was lowered to MaxBSOGetLimit
+	clamped bool
+
+	// keyset paging continues after the cursor, nil is the first page
+	keyset bool
+	after  *syncstorage.Cursor
+
+	// also return tombstones for deleted BSOs
+	includeDeleted bool
+}
+
+// parseNewer converts a sync two decimal timestamp from a newer param
+// into milliseconds
+func parseNewer(v string) (int, error) {
+	floatNew, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid newer param format")
+	}
+
+	newer := int(floatNew * 1000)
+	if !syncstorage.NewerOk(newer) {
+		return 0, errors.New("Invalid newer value")
+	}
+
+	return newer, nil
+}
+
+// parseBSOQuery extracts and validates the search params of a GET request.
+// All errors returned are the client's fault
+func (s *SyncUserHandler) parseBSOQuery(r *http.Request) (*bsoQuery, error) {
+	var err error
+
+	q := &bsoQuery{
+		older: syncstorage.MaxTimestamp,
+		sort:  s.config.DefaultSort,
+	}
+
+	if q.sort == syncstorage.SORT_NONE {
+		q.sort = syncstorage.SORT_NEWEST
+	}
+
+	if err = r.ParseForm(); err != nil {
+		return nil, errors.Wrap(err, "Bad query parameters")
+	}
+
+	if v := r.Form.Get("ids"); v != "" {
+		q.ids = strings.Split(v, ",")
+
+		if len(q.ids) > s.config.MaxPOSTRecords {
+			return nil, errors.New("Exceeded max batch size")
+		}
+
+		for i, id := range q.ids {
+			id = strings.TrimSpace(id)
+			if syncstorage.BSOIdOk(id) {
+				q.ids[i] = id
+			} else {
+				return nil, errors.Errorf("Invalid bso id %s", id)
+			}
+		}
+
+		if len(q.ids) > 100 {
+			return nil, errors.New("Too many ids provided")
+		}
+	}
+
+	// we expect to get sync's two decimal timestamps, these need
+	// to be converted to milliseconds
+	if v := r.Form.Get("older"); v != "" {
+		floatNew, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid older param format")
+		}
+
+		q.older = int(floatNew * 1000)
+		if !syncstorage.NewerOk(q.newer) {
+			return nil, errors.New("Invalid older value")
+		}
+	}
+
+	if v := r.Form.Get("newer"); v != "" {
+		if q.newer, err = parseNewer(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := r.Form.Get("full"); v != "" {
+		q.full = true
+	}
+
+	if v := r.Form.Get("include_deleted"); v != "" && v != "0" {
+		q.includeDeleted = true
+	}
+
+	if v := r.Form.Get("limit"); v != "" {
+		q.limit, err = strconv.Atoi(v)
+		if err != nil || !syncstorage.LimitOk(q.limit) {
+			errMessage := "Invalid limit value"
+			if err != nil {
+				return nil, errors.Wrap(err, errMessage)
+			}
+			return nil, errors.New(errMessage)
+		}
+	}
+
+	// assign a default value for limit if nothing is supplied
+	maxLimit := s.limits(mux.Vars(r)["collection"]).MaxBSOGetLimit
+	if q.limit > maxLimit {
+		q.clamped = true
+	}
+	if q.limit <= 0 || q.limit > maxLimit {
+		q.limit = maxLimit
+	}
+
+	if v := r.Form.Get("offset"); v != "" {
+		q.offset, err = strconv.Atoi(v)
+		if err != nil || !syncstorage.OffsetOk(q.offset) {
+			errMessage := "Invalid offset value"
+			if err != nil {
+				return nil, errors.Wrap(err, errMessage)
+			}
+			return nil, errors.New(errMessage)
+		}
+	}
+
+	if v := r.Form.Get("sort"); v != "" {
+		if q.sort, err = ParseSortType(v); err != nil {
+			return nil, err
+		}
+	}
+
+	// an empty after opts into keyset paging from the first page
+	if _, ok := r.Form["after"]; ok {
+		if q.offset != 0 {
+			return nil, errors.New("offset and after can not be used together")
+		}
+		if q.sort != syncstorage.SORT_NEWEST && q.sort != syncstorage.SORT_OLDEST {
+			return nil, errors.New("after requires sort=newest or sort=oldest")
+		}
+
+		q.keyset = true
+		if v := r.Form.Get("after"); v != "" {
+			if q.after, err = syncstorage.ParseCursor(v); err != nil {
+				return nil, errors.Wrap(err, "Invalid after value")
+			}
+		}
+	}
+
+	return q, nil
+}
+
+func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request) {
+
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	cId, err := s.getcid(r, false)
+
+	if err != nil {
+		if err == syncstorage.ErrNotFound {
+			if s.config.MissingCollectionNotFound {
+				sendRequestProblem(w, r, http.StatusNotFound, errors.New("Collection not found"))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("[]"))
+			return
+		} else {
+			InternalError(w, r, err)
+			return
+		}
+	}
+
+	q, err := s.parseBSOQuery(r)
+	if err != nil {
+		sendRequestProblem(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// this is way down here since IO is more expensive
+	// than parsing if the GET params are valid
+	cmodified, err := s.db.GetCollectionModified(cId)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	} else if cmodified == 0 && s.config.MissingCollectionNotFound {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.New("Collection not found"))
+		return
+	} else if sentNotModified(w, r, cmodified) {
+		return
+	}
+
+	m := syncstorage.ModifiedToString(cmodified)
+
+	// paging stops at MaxPagingRecords. X-Weave-Paging-Limit tells clients
+	// the records ended there and not at the end of the collection
+	paged := q.offset
+	if q.after != nil {
+		paged = q.after.Paged
+	}
+
+	var capped, ok bool
+	if q.limit, capped, ok = s.capPaging(w, r, paged, q.limit); !ok {
+		return
+	}
+
+	var results *syncstorage.GetResults
+	if q.keyset {
+		results, err = s.db.GetBSOsAfter(cId, q.ids, q.older, q.newer, q.sort, q.limit, q.after)
+	} else {
+		results, err = s.db.GetBSOs(cId, q.ids, q.older, q.newer, q.sort, q.limit, q.offset)
+	}
+	if err != nil {
+		s.readError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Last-Modified", m)
+	w.Header().Set("X-Weave-Records", strconv.Itoa(results.Total))
+
+	// the records past a clamped limit are paged with X-Weave-Next-Offset
+	if q.clamped {
+		maxLimit := s.limits(mux.Vars(r)["collection"]).MaxBSOGetLimit
+		w.Header().Set("X-Weave-Limit-Clamped", strconv.Itoa(maxLimit))
+	}
+	if results.More {
+		if capped {
+			w.Header().Set("X-Weave-Paging-Limit", strconv.Itoa(s.config.MaxPagingRecords))
+		} else if q.keyset {
+			w.Header().Set("X-Weave-Next-Cursor", results.Next.String())
+		} else {
+			w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(results.Offset))
+		}
+	}
+
+	// lets clients show progress while paging through the results
+	if q.full {
+		w.Header().Set("X-Weave-Bytes", strconv.Itoa(results.Bytes))
+	}
+
+	if !q.includeDeleted {
+		JsonNewline(w, r, bsoResults(results, q.full))
+		return
+	}
+
+	// tombstones are not paged, they are all sent with the first page.
+	// Records are always objects so clients can tell the deleted ones apart
+	var records []interface{}
+	if q.offset == 0 && q.after == nil {
+		tombstones, err := s.db.GetTombstones(cId, q.ids, q.older, q.newer)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+		for _, t := range tombstones {
+			records = append(records, t)
+		}
+	}
+
+	for _, b := range results.BSOs {
+		if q.full {
+			records = append(records, b)
+		} else {
+			records = append(records, map[string]string{"id": b.Id})
+		}
+	}
+
+	if records == nil {
+		records = []interface{}{}
+	}
+
+	JsonNewline(w, r, records)
+}
+
+// bsoResults returns the BSOs when full is set otherwise only their ids
+func bsoResults(results *syncstorage.GetResults, full bool) interface{} {
+	if full {
+		return results.BSOs
+	}
+
+	bsoIds := make([]string, len(results.BSOs))
+	for i, b := range results.BSOs {
+		bsoIds[i] = b.Id
+	}
+	return bsoIds
+}
+
+// hStorageGET handles the extensions to the sync 1.5 api that search
+// across collections
+func (s *SyncUserHandler) hStorageGET(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["changed_since"]; ok {
+		s.hStorageChanged(w, r)
+	} else {
+		s.hStorageCollections(w, r)
+	}
+}
+
+// hStorageChanged lists the BSOs modified after ?changed_since and up
+// to ?changed_until, which defaults to now, in all collections. It is meant
+// for auditing and debugging what changed for a user in a window of time.
+// The response maps each collection to the ids of its changed BSOs.
+func (s *SyncUserHandler) hStorageChanged(w http.ResponseWriter, r *http.Request) {
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+
+	since, err := ConvertTimestamp(query.Get("changed_since"))
+	if err != nil || !syncstorage.NewerOk(since) {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid changed_since value"))
+		return
+	}
+
+	until := syncstorage.MaxTimestamp
+	if v := query.Get("changed_until"); v != "" {
+		if until, err = ConvertTimestamp(v); err != nil || until < since {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid changed_until value"))
+			return
+		}
+	}
+
+	// paged like collection GETs, at most MaxBSOGetLimit ids at a time
+	limit := s.config.MaxBSOGetLimit
+	if v := query.Get("limit"); v != "" {
+		if l, err := strconv.Atoi(v); err != nil || !syncstorage.LimitOk(l) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid limit value"))
+			return
+		} else if l < limit {
+			limit = l
+		}
+	}
+
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || !syncstorage.OffsetOk(offset) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid offset value"))
+			return
+		}
+	}
+
+	var capped, ok bool
+	if limit, capped, ok = s.capPaging(w, r, offset, limit); !ok {
+		return
+	}
+
+	results, next, err := s.db.ChangedBSOIds(since, until, limit, offset)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if next > 0 {
+		if capped {
+			w.Header().Set("X-Weave-Paging-Limit", strconv.Itoa(s.config.MaxPagingRecords))
+		} else {
+			w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(next))
+		}
+	}
+	JSON(w, r, http.StatusOK, results)
+}
+
+// hStorageCollections fetches BSOs from several collections, given as
+// ?collections=a,b,c, in a single request. It is an opt in extension
+// to the sync 1.5 api to save clients round trips. The response maps each
+// collection to its results. The limit applies to each collection and no
+// more than MaxBSOGetLimit BSOs are returned in total.
+func (s *SyncUserHandler) hStorageCollections(w http.ResponseWriter, r *http.Request) {
+	if !s.config.MultiCollectionGET {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.New("Multi collection GET not enabled"))
+		return
+	}
+
+	if !s.acceptHeaderOk(w, r) {
+		return
+	}
+
+	q, err := s.parseBSOQuery(r)
+	if err != nil {
+		sendRequestProblem(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// paging and ids are per collection and do not make sense here
+	if q.ids != nil || q.offset != 0 {
+		sendRequestProblem(w, r, http.StatusBadRequest,
+			errors.New("ids and offset not supported with multiple collections"))
+		return
+	}
+
+	v := r.Form.Get("collections")
+	if v == "" {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Missing collections"))
+		return
+	}
+
+	var (
+		names     []string
+		cIds      []int
+		modified  int
+		collected = make(map[string]interface{})
+	)
+
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !syncstorage.CollectionNameOk(name) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid collection %s", name))
+			return
+		}
+
+		if _, seen := collected[name]; seen {
+			continue
+		}
+
+		// collections that don't exist have no results
+		collected[name] = []string{}
+
+		cId, err := s.collectionId(name, false)
+		if err == syncstorage.ErrNotFound {
+			continue
+		} else if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		cmodified, err := s.db.GetCollectionModified(cId)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		if cmodified > modified {
+			modified = cmodified
+		}
 
-func (s *SyncUserHandler) hInfoCollectionCounts(w http.ResponseWriter, r *http.Request) {
-	if !AcceptHeaderOk(w, r) {
-		return
+		names = append(names, name)
+		cIds = append(cIds, cId)
 	}
-	results, err := s.db.InfoCollectionCounts()
-	if err != nil {
-		InternalError(w, r, err)
+
+	if sentNotModified(w, r, modified) {
 		return
 	}
 
-	modified, err := s.db.LastModified()
+	results, err := s.db.GetCollectionsBSOs(cIds, q.older, q.newer, q.sort, q.limit, s.config.MaxBSOGetLimit)
 	if err != nil {
-		InternalError(w, r, err)
+		s.readError(w, r, err)
 		return
 	}
 
-	if sentNotModified(w, r, modified) {
-		return
+	total := 0
+	for i, result := range results {
+		collected[names[i]] = bsoResults(result, q.full)
+		total += len(result.BSOs)
 	}
 
-	m := syncstorage.ModifiedToString(modified)
-	w.Header().Set("X-Last-Modified", m)
-	JsonNewline(w, r, results)
-}
-
-func (s *SyncUserHandler) hInfoConfiguration(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-		"max_post_records":%d,
-		"max_post_bytes":%d,
-		"max_total_records":%d,
-		"max_total_bytes":%d,
-		"max_request_bytes":%d,
-	    "max_record_payload_bytes":%d}`,
-		s.config.MaxPOSTRecords,
-		s.config.MaxPOSTBytes,
-		s.config.MaxTotalRecords,
-		s.config.MaxTotalBytes,
-		s.config.MaxRequestBytes,
-		s.config.MaxRecordPayloadBytes,
-	)
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	w.Header().Set("X-Weave-Records", strconv.Itoa(total))
+	JSON(w, r, http.StatusOK, collected)
 }
 
-func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request) {
-
-	if !AcceptHeaderOk(w, r) {
+// hStoragePOST writes BSOs to several collections in a single request. The
+// body is a JSON object mapping collection names to the list of BSOs that
+// would be POSTed to each of them. It is an opt in extension to the sync
+// 1.5 api to save clients round trips. Every collection is checked before
+// any are written, then each is written in its own transaction. The
+// response maps each collection to its results.
+func (s *SyncUserHandler) hStoragePOST(w http.ResponseWriter, r *http.Request) {
+	if !s.config.MultiCollectionPOST {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.New("Multi collection POST not enabled"))
 		return
 	}
 
-	// query params that control searching
-	var (
-		err    error
-		ids    []string
-		newer  int
-		older  int
-		full   bool
-		limit  int
-		offset int
-		sort   = syncstorage.SORT_NEWEST
-	)
+	if ct := getMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		sendRequestProblem(w, r, http.StatusUnsupportedMediaType, errors.Errorf("Not acceptable Content-Type: %s", ct))
+		return
+	}
 
-	cId, err := s.getcid(r, false)
+	var body map[string][]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err == io.EOF {
+		sendRequestProblem(w, r, http.StatusBadRequest, ErrEmptyPOSTBody)
+		return
+	} else if err != nil {
+		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Could not unmarshal Request body"))
+		return
+	} else if len(body) == 0 {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Missing collections"))
+		return
+	}
 
+	frozen, _, err := s.frozenCollections()
 	if err != nil {
-		if err == syncstorage.ErrNotFound {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte("[]"))
-			return
-		} else {
-			InternalError(w, r, err)
-			return
-		}
+		InternalError(w, r, err)
+		return
 	}
 
-	if err = r.ParseForm(); err != nil {
-		sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Bad query parameters"))
-		return
+	// always write the collections in the same order
+	names := make([]string, 0, len(body))
+	for name := range body {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	if v := r.Form.Get("ids"); v != "" {
-		ids = strings.Split(v, ",")
+	var (
+		bsos     = make(map[string]syncstorage.PostBSOInput)
+		results  = make(map[string]*syncstorage.PostResults)
+		counted  syncstorage.PostBSOInput // towards the quota
+		modified int
+	)
 
-		if len(ids) > s.config.MaxPOSTRecords {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Exceeded max batch size"))
+	for _, name := range names {
+		if !syncstorage.CollectionNameOk(name) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid collection %s", name))
 			return
 		}
 
-		for i, id := range ids {
-			id = strings.TrimSpace(id)
-			if syncstorage.BSOIdOk(id) {
-				ids[i] = id
-			} else {
-				sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid bso id %s", id))
+		for _, f := range frozen {
+			if f == name {
+				sendRequestProblem(w, r, http.StatusLocked, errors.Errorf("Collection %s is frozen", name))
 				return
 			}
 		}
 
-		if len(ids) > 100 {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Too many ids provided"))
+		limits := s.limits(name)
+		toProcess, result, err := rawToPostBSOInput(body[name], limits.MaxRecordPayloadBytes)
+		if err != nil {
+			WeaveInvalidWBOError(w, r, errors.Wrapf(err, "Failed turning %s into BSO work list", name))
 			return
 		}
-	}
 
-	// we expect to get sync's two decimal timestamps, these need
-	// to be converted to milliseconds
-	if v := r.Form.Get("older"); v != "" {
-		floatNew, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid older param format"))
+		if len(toProcess) > limits.MaxPOSTRecords {
+			sendRequestProblem(w, r, http.StatusRequestEntityTooLarge,
+				errors.Errorf("Exceed %d BSO per request in %s", limits.MaxPOSTRecords, name))
 			return
 		}
 
-		older = int(floatNew * 1000)
-		if !syncstorage.NewerOk(newer) {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid older value"))
-			return
+		if s.config.AutoBSOIds {
+			assignBSOIds(toProcess)
 		}
-	} else {
-		older = syncstorage.MaxTimestamp
-	}
 
-	if v := r.Form.Get("newer"); v != "" {
-		floatNew, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid newer param format"))
+		toProcess = s.enforceCollectionTTL(name, toProcess)
+		toProcess = s.enforceMinTTL(name, toProcess, result)
+		toProcess = s.enforceSortIndex(name, toProcess, result)
+
+		if !s.usageExcluded(name) {
+			counted = append(counted, toProcess...)
+		}
+
+		bsos[name] = toProcess
+		results[name] = result
+
+		// handle X-If-Unmodified-Since against all the collections
+		cId, err := s.collectionId(name, false)
+		if err == syncstorage.ErrNotFound {
+			continue
+		} else if err != nil {
+			InternalError(w, r, err)
 			return
 		}
 
-		newer = int(floatNew * 1000)
-		if !syncstorage.NewerOk(newer) {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid newer value"))
+		cmodified, err := s.db.GetCollectionModified(cId)
+		if err != nil {
+			InternalError(w, r, err)
 			return
 		}
-	}
 
-	if v := r.Form.Get("full"); v != "" {
-		full = true
+		if cmodified > modified {
+			modified = cmodified
+		}
 	}
 
-	if v := r.Form.Get("limit"); v != "" {
-		limit, err = strconv.Atoi(v)
-		if err != nil || !syncstorage.LimitOk(limit) {
-			errMessage := "Invalid limit value"
-			if err != nil {
-				err = errors.Wrap(err, errMessage)
-			} else {
-				err = errors.New(errMessage)
-			}
-			sendRequestProblem(w, r, http.StatusBadRequest, err)
-			return
-		}
+	if sentNotModified(w, r, modified) {
+		return
 	}
 
-	// assign a default value for limit if nothing is supplied
-	if limit <= 0 || limit > s.config.MaxBSOGetLimit {
-		limit = s.config.MaxBSOGetLimit
+	if !s.fitsQuota(w, r, counted) {
+		return
 	}
 
-	if v := r.Form.Get("offset"); v != "" {
-		offset, err = strconv.Atoi(v)
-		if err != nil || !syncstorage.OffsetOk(offset) {
-			errMessage := "Invalid offset value"
-			if err != nil {
-				err = errors.Wrap(err, errMessage)
-			} else {
-				err = errors.New(errMessage)
-			}
-			sendRequestProblem(w, r, http.StatusBadRequest, err)
+	collected := make(map[string]*PostResults)
+	for _, name := range names {
+		cId, err := s.collectionId(name, true)
+		if err != nil {
+			InternalError(w, r, err)
 			return
 		}
-	}
 
-	if v := r.Form.Get("sort"); v != "" {
-		switch v {
-		case "newest":
-			sort = syncstorage.SORT_NEWEST
-		case "oldest":
-			sort = syncstorage.SORT_OLDEST
-		case "index":
-			sort = syncstorage.SORT_INDEX
-		default:
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid sort value"))
+		postResults, err := s.db.PostBSOs(cId, bsos[name])
+		if err != nil {
+			InternalError(w, r, errors.Wrapf(err, "Could not write %s", name))
 			return
 		}
-	}
 
-	// this is way down here since IO is more expensive
-	// than parsing if the GET params are valid
-	cmodified, err := s.db.GetCollectionModified(cId)
-	if err != nil {
-		InternalError(w, r, err)
-		return
-	} else if sentNotModified(w, r, cmodified) {
-		return
-	}
+		for bsoId, failMessage := range postResults.Failed {
+			results[name].Failed[bsoId] = failMessage
+		}
 
-	results, err := s.db.GetBSOs(cId, ids, older, newer, sort, limit, offset)
-	if err != nil {
-		InternalError(w, r, err)
-		return
-	}
-	m := syncstorage.ModifiedToString(cmodified)
-	w.Header().Set("X-Last-Modified", m)
+		s.sendChanges(ChangePut, name, postResults.Modified, postResults.Success...)
 
-	w.Header().Set("X-Weave-Records", strconv.Itoa(results.Total))
-	if results.More {
-		w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(results.Offset))
-	}
+		if postResults.Modified > modified {
+			modified = postResults.Modified
+		}
 
-	if full {
-		JsonNewline(w, r, results.BSOs)
-	} else {
-		bsoIds := make([]string, len(results.BSOs))
-		for i, b := range results.BSOs {
-			bsoIds[i] = b.Id
+		p := &PostResults{
+			Modified: postResults.Modified,
+			Success:  postResults.Success,
+			Failed:   results[name].Failed,
 		}
-		JsonNewline(w, r, bsoIds)
+		p.Limit(s.config.MaxPOSTResults)
+		collected[name] = p
 	}
+
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	JSON(w, r, http.StatusOK, collected)
 }
 
+// hCollectionPOST writes BSOs to a collection. A body that is empty or only
+// whitespace is rejected with a 400 as it usually means a client failed to
+// serialize its data. The only exception is a batch commit, which may
+// legitimately carry no new BSOs.
 func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request) {
 	// accept text/plain from old (broken) clients
 	ct := getMediaType(r.Header.Get("Content-Type"))
@@ -672,8 +1557,16 @@ func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	cId, err := s.getcid(r, true) // automake the collection if it doesn't exit
-	if err != nil {
+	// handle X-If-Unmodified-Since and X-If-Modified-Since. A missing
+	// collection was never modified so it is checked before it is made
+	cmodified := 0
+	cId, err := s.getcid(r, false)
+	if err == nil {
+		cmodified, err = s.db.GetCollectionModified(cId)
+	}
+
+	missing := err == syncstorage.ErrNotFound
+	if err != nil && !missing {
 		if err == syncstorage.ErrInvalidCollectionName {
 			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid collection name"))
 		} else {
@@ -682,15 +1575,31 @@ func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// handle X-If-Unmodified-Since and X-If-Modified-Since
-	cmodified, err := s.db.GetCollectionModified(cId)
-	if err != nil {
-		InternalError(w, r, err)
-		return
-	} else if sentNotModified(w, r, cmodified) {
+	if sentNotModified(w, r, cmodified) {
 		return
 	}
 
+	if missing {
+		cId, err = s.getcid(r, true) // automake the collection if it doesn't exit
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+	}
+
+	// CHECK the declared size against the quota before reading the body.
+	// Without a Content-Length the BSOs are checked after parsing
+	if r.ContentLength > 0 && !s.usageExcluded(mux.Vars(r)["collection"]) {
+		if remaining, limited, err := s.remainingQuota(); err != nil {
+			InternalError(w, r, err)
+			return
+		} else if limited && r.ContentLength > int64(remaining) {
+			WeaveOverQuota(w, r, errors.Errorf("Quota exceeded, Content-Length(%d) > %d remaining",
+				r.ContentLength, remaining))
+			return
+		}
+	}
+
 	batchFound, batchId, batchCommit := GetBatchIdAndCommit(r)
 	if batchCommit && !batchFound {
 		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Batch ID expected with commit"))
@@ -706,15 +1615,36 @@ func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request
 // the addition of atomic commits from multiple POST requests
 func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.ResponseWriter, r *http.Request) {
 
-	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
+	limits := s.limits(mux.Vars(r)["collection"])
+	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, limits.MaxRecordPayloadBytes)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		if err == ErrEmptyPOSTBody {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+		} else {
+			WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		}
 		return
 	}
 
-	if len(bsoToBeProcessed) > s.config.MaxPOSTRecords {
+	if len(bsoToBeProcessed) > limits.MaxPOSTRecords {
 		sendRequestProblem(w, r, http.StatusRequestEntityTooLarge,
-			errors.Errorf("Exceed %d BSO per request", s.config.MaxPOSTRecords))
+			errors.Errorf("Exceed %d BSO per request", limits.MaxPOSTRecords))
+		return
+	}
+
+	if !s.recordCountOk(w, r, len(bsoToBeProcessed)+len(results.Failed)) {
+		return
+	}
+
+	if s.config.AutoBSOIds {
+		assignBSOIds(bsoToBeProcessed)
+	}
+
+	bsoToBeProcessed = s.enforceCollectionTTL(mux.Vars(r)["collection"], bsoToBeProcessed)
+	bsoToBeProcessed = s.enforceMinTTL(mux.Vars(r)["collection"], bsoToBeProcessed, results)
+	bsoToBeProcessed = s.enforceSortIndex(mux.Vars(r)["collection"], bsoToBeProcessed, results)
+
+	if !s.quotaOk(w, r, mux.Vars(r)["collection"], bsoToBeProcessed) {
 		return
 	}
 
@@ -729,8 +1659,10 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 			results.Failed[bsoId] = failMessage
 		}
 
+		s.sendChanges(ChangePut, mux.Vars(r)["collection"], postResults.Modified, postResults.Success...)
+
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(postResults.Modified))
-		JsonNewline(w, r, &PostResults{
+		s.sendPostResults(w, r, http.StatusOK, &PostResults{
 			Modified: postResults.Modified,
 			Success:  postResults.Success,
 			Failed:   results.Failed,
@@ -741,6 +1673,7 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 // hCollectionPOSTBatch handles batch=? requests. It is called internally by hCollectionPOST
 // to handle batch request logic
 func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.ResponseWriter, r *http.Request) {
+	limits := s.limits(mux.Vars(r)["collection"])
 
 	// CHECK client provided headers to quickly determine if batch exceeds limits
 	// this is meant to be a cheap(er) check without actually having to parse the
@@ -757,7 +1690,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 				case "X-Weave-Bytes":
 					max = s.config.MaxPOSTBytes
 				case "X-Weave-Records":
-					max = s.config.MaxPOSTRecords
+					max = limits.MaxPOSTRecords
 				}
 
 				if intVal > max {
@@ -783,16 +1716,44 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	}
 
 	// EXTRACT actual data to check
-	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
+	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, limits.MaxRecordPayloadBytes)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
-		return
+		if err == ErrEmptyPOSTBody {
+			// the final commit may legitimately have no new BSOs to add
+			if _, _, batchCommit := GetBatchIdAndCommit(r); !batchCommit {
+				sendRequestProblem(w, r, http.StatusBadRequest, err)
+				return
+			}
+
+			bsoToBeProcessed = syncstorage.PostBSOInput{}
+			results = syncstorage.NewPostResults(syncstorage.Now())
+		} else {
+			WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+			return
+		}
 	}
 
 	// CHECK actual BSOs sent to see if they exceed limits
-	if len(bsoToBeProcessed) > s.config.MaxPOSTRecords {
+	if len(bsoToBeProcessed) > limits.MaxPOSTRecords {
 		sendRequestProblem(w, r, http.StatusRequestEntityTooLarge,
-			errors.Errorf("Exceeded %d BSO per request", s.config.MaxPOSTRecords))
+			errors.Errorf("Exceeded %d BSO per request", limits.MaxPOSTRecords))
+		return
+	}
+
+	// CHECK the client sent as many BSOs as it said it would
+	if !s.recordCountOk(w, r, len(bsoToBeProcessed)+len(results.Failed)) {
+		return
+	}
+
+	if s.config.AutoBSOIds {
+		assignBSOIds(bsoToBeProcessed)
+	}
+
+	bsoToBeProcessed = s.enforceCollectionTTL(mux.Vars(r)["collection"], bsoToBeProcessed)
+	bsoToBeProcessed = s.enforceMinTTL(mux.Vars(r)["collection"], bsoToBeProcessed, results)
+	bsoToBeProcessed = s.enforceSortIndex(mux.Vars(r)["collection"], bsoToBeProcessed, results)
+
+	if !s.quotaOk(w, r, mux.Vars(r)["collection"], bsoToBeProcessed) {
 		return
 	}
 
@@ -800,7 +1761,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	if len(results.Failed) > 0 {
 		modified := syncstorage.Now()
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
-		JsonNewline(w, r, &PostResults{
+		s.sendPostResults(w, r, http.StatusOK, &PostResults{
 			Modified: modified,
 			Success:  nil,
 			Failed:   results.Failed,
@@ -933,6 +1894,17 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			return
 		}
 
+		// a client that lost or repeated part of a batch should not commit it
+		if declared, err := strconv.Atoi(r.Header.Get("X-Weave-Total-Records")); s.config.StrictRecordCounts && err == nil {
+			if declared != numInBatch {
+				s.db.BatchRemove(dbBatchId)
+				WeaveInvalidWBOError(w, r,
+					errors.Errorf("X-Weave-Total-Records is %d but Batch(%d) has %d BSOs",
+						declared, dbBatchId, numInBatch))
+				return
+			}
+		}
+
 		postData := make(syncstorage.PostBSOInput, len(rawJSON), len(rawJSON))
 		for i, bsoJSON := range rawJSON {
 			var bso syncstorage.PutBSOInput
@@ -963,6 +1935,13 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			}
 		}
 
+		// CHECK the whole batch fits in the quota, each append only
+		// checked its own BSOs
+		if !s.quotaOk(w, r, mux.Vars(r)["collection"], postData) {
+			s.db.BatchRemove(dbBatchId)
+			return
+		}
+
 		postResults, err := s.db.PostBSOs(collectionId, postData)
 		if err != nil {
 			InternalError(w, r, err)
@@ -981,9 +1960,11 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 		// DELETE the batch from the DB
 		s.db.BatchRemove(dbBatchId)
 
+		s.sendChanges(ChangePut, mux.Vars(r)["collection"], postResults.Modified, postResults.Success...)
+
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(postResults.Modified))
 
-		JsonNewline(w, r, &PostResults{
+		s.sendPostResults(w, r, http.StatusOK, &PostResults{
 			Modified: postResults.Modified,
 			Success:  appendedOkIds,
 			Failed:   failures,
@@ -1000,7 +1981,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 		}
 
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
-		JsonNewlineStatus(w, r, http.StatusAccepted, &PostResults{
+		s.sendPostResults(w, r, http.StatusAccepted, &PostResults{
 			Batch:    batchIdString(dbBatchId),
 			Modified: modified,
 			Success:  appendedOkIds,
@@ -1015,6 +1996,10 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 
 	if err != nil {
 		if err == syncstorage.ErrNotFound {
+			// a missing collection was never modified, like in hCollectionPOST
+			if sentNotModified(w, r, 0) {
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			fmt.Fprintf(w, `{"modified":%s}`, syncstorage.ModifiedToString(syncstorage.Now()))
 			return
@@ -1048,12 +2033,19 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 			InternalError(w, r, err)
 			return
 		}
+
+		s.sendChanges(ChangeDelete, mux.Vars(r)["collection"], modified, bidlist...)
 	} else {
-		err = s.db.DeleteCollection(cId)
+		// the collection may get a new id when it is recreated
+		delete(s.cids, mux.Vars(r)["collection"])
+
+		modified, err = s.db.DeleteCollection(cId)
 		if err != nil {
 			InternalError(w, r, err)
 			return
 		}
+
+		s.sendChanges(ChangeDeleteCollection, mux.Vars(r)["collection"], modified)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1062,7 +2054,7 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 
 func (s *SyncUserHandler) hBsoGET(w http.ResponseWriter, r *http.Request) {
 
-	if !AcceptHeaderOk(w, r) {
+	if !s.acceptHeaderOk(w, r) {
 		return
 	}
 
@@ -1106,15 +2098,44 @@ func (s *SyncUserHandler) hBsoGET(w http.ResponseWriter, r *http.Request) {
 		JsonNewline(w, r, bso)
 	} else {
 		if err == syncstorage.ErrNotFound {
-			sendRequestProblem(w, r, http.StatusNotFound, errors.Wrap(err, "BSO Not Found"))
+			// with tombstones enabled clients can tell recently deleted
+			// or expired BSOs apart and stop asking for them
+			if gone, goneErr := s.db.BSOGone(cId, bId); goneErr != nil {
+				InternalError(w, r, goneErr)
+			} else if gone {
+				sendRequestProblem(w, r, http.StatusGone, errors.New("BSO Gone"))
+			} else {
+				sendRequestProblem(w, r, http.StatusNotFound, errors.Wrap(err, "BSO Not Found"))
+			}
 		} else {
-			InternalError(w, r, err)
+			s.readError(w, r, err)
 		}
 	}
 }
 
+// readError sends a 500 for errors reading BSOs. Corrupted payloads are
+// counted so they can be found and quarantined
+func (s *SyncUserHandler) readError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == syncstorage.ErrPayloadHashMismatch {
+		s.metrics.Incr("storage.quarantine", "reason:payload_hash")
+	}
+
+	InternalError(w, r, err)
+}
+
 func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
-	if !AcceptHeaderOk(w, r) {
+	s.putBSO(w, r, false)
+}
+
+// hBsoPATCH changes only the fields sent, ie: a new sortindex without
+// sending the payload again. Unlike PUT it never creates a BSO
+func (s *SyncUserHandler) hBsoPATCH(w http.ResponseWriter, r *http.Request) {
+	s.putBSO(w, r, true)
+}
+
+// putBSO handles PUT and, with patch, PATCH of a single BSO
+func (s *SyncUserHandler) putBSO(w http.ResponseWriter, r *http.Request, patch bool) {
+	if !s.acceptHeaderOk(w, r) {
 		return
 	}
 
@@ -1144,20 +2165,34 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 	}
 
 	modified, err = s.db.GetBSOModified(cId, bId)
+	previous := modified
 	if err != nil {
 		if err != syncstorage.ErrNotFound {
 			InternalError(w, r, errors.Wrap(err, "Could not get Modified ts"))
 			return
 		}
+
+		if patch {
+			sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("BSO %s not found", bId))
+			return
+		}
 	}
 
 	if sentNotModified(w, r, modified) {
 		return
 	}
 
+	// If-None-Match: * only creates, it never overwrites an existing BSO
+	if err == nil && strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+		sendRequestProblem(w, r, http.StatusPreconditionFailed,
+			errors.Errorf("BSO %s already exists", bId))
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		InternalError(w, r, errors.New("PUT could not read JSON body"))
+		InternalError(w, r, errors.Errorf("%s could not read JSON body", r.Method))
 		return
 	}
 
@@ -1167,29 +2202,72 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if bso.Payload != nil && len(*bso.Payload) > s.config.MaxRecordPayloadBytes {
-		sendRequestProblem(w, r,
-			http.StatusRequestEntityTooLarge,
-			errors.New("Payload too big"))
+	limits := s.limits(mux.Vars(r)["collection"])
+	if bso.Payload != nil && len(*bso.Payload) > limits.MaxRecordPayloadBytes {
+		sendRequestProblem(w, r, http.StatusRequestEntityTooLarge, ErrPayloadTooLarge)
 		return
 	}
 
+	// a PATCH keeps the sortindex the BSO already has
+	if !patch && bso.SortIndex == nil && s.sortIndexRequired(mux.Vars(r)["collection"]) {
+		sendRequestProblem(w, r, http.StatusBadRequest,
+			errors.Errorf("sortindex is required in %s", mux.Vars(r)["collection"]))
+		return
+	}
+
+	// a PATCH without a TTL keeps the one the BSO already has
+	if !patch && bso.TTL == nil && limits.DefaultTTL > 0 {
+		tmp := limits.DefaultTTL
+		bso.TTL = &tmp
+	}
+
+	if bso.TTL != nil && limits.MaxTTL > 0 && *bso.TTL > limits.MaxTTL {
+		tmp := limits.MaxTTL
+		bso.TTL = &tmp
+	}
+
 	// change bso.TTL to milliseconds (what the db uses)
 	// from seconds (what client's send)
 	if bso.TTL != nil {
 		tmp := *bso.TTL * 1000
 		bso.TTL = &tmp
+
+		if min, ok := s.minTTL(mux.Vars(r)["collection"]); ok && tmp < min {
+			if s.config.MinTTLReject {
+				sendRequestProblem(w, r, http.StatusBadRequest,
+					errors.Errorf("TTL below minimum of %d seconds", min/1000))
+				return
+			}
+
+			bso.TTL = &min
+		}
+	}
+
+	if !s.quotaOk(w, r, mux.Vars(r)["collection"], syncstorage.PostBSOInput{&bso}) {
+		return
 	}
 
-	modified, err = s.db.PutBSO(cId, bId, bso.Payload, bso.SortIndex, bso.TTL)
+	if patch {
+		modified, err = s.db.UpdateBSO(cId, bId, bso.Payload, bso.SortIndex, bso.TTL)
+	} else {
+		modified, err = s.db.PutBSO(cId, bId, bso.Payload, bso.SortIndex, bso.TTL)
+	}
 
-	if err != nil {
+	if err == syncstorage.ErrNotFound {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("BSO %s not found", bId))
+		return
+	} else if err != nil {
 		sendRequestProblem(w, r, http.StatusBadRequest, err)
 		return
 	}
+
+	s.sendChanges(ChangePut, mux.Vars(r)["collection"], modified, bId)
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Last-Modified", m)
+	if s.config.PreviousModifiedHeader && previous > 0 {
+		w.Header().Set("X-Weave-Previous-Modified", syncstorage.ModifiedToString(previous))
+	}
 	w.Write([]byte(m))
 }
 
@@ -1233,6 +2311,8 @@ func (s *SyncUserHandler) hBsoDELETE(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
+		s.sendChanges(ChangeDelete, mux.Vars(r)["collection"], modified, bso.Id)
+
 		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-Last-Modified", m)
@@ -1241,11 +2321,15 @@ func (s *SyncUserHandler) hBsoDELETE(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *SyncUserHandler) hDeleteEverything(w http.ResponseWriter, r *http.Request) {
+	s.cids = make(map[string]int)
 	err := s.db.DeleteEverything()
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
-		m := syncstorage.ModifiedToString(syncstorage.Now())
+		modified := syncstorage.Now()
+		s.sendChanges(ChangeDeleteEverything, "", modified)
+
+		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-Last-Modified", m)
 		w.Write([]byte(m))
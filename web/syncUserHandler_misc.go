@@ -9,11 +9,22 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/pkg/errors"
 )
 
+// ErrEmptyPOSTBody is returned by RequestToPostBSOInput when the request body is
+// empty or only contains whitespace. A body of `[]` is not considered empty.
+var ErrEmptyPOSTBody = errors.New("POST body is empty")
+
+// ErrPayloadTooLarge is the reason BSOs with a payload over the
+// MaxRecordPayloadBytes limit are not written. A PUT or PATCH responds with
+// a 413, a POST lists the BSO in failed with it and writes the rest
+var ErrPayloadTooLarge = errors.New("Payload too large")
+
 // RequestToPostBSOInput extracts and unmarshals request.Body into a syncstorage.PostBSOInput. It
 // returns a PostResults as well since it also validates BSOs
 func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
@@ -22,28 +33,48 @@ func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
 	error,
 ) {
 
-	// bsoToBeProcessed will actually get sent to the DB
-	bsoToBeProcessed := syncstorage.PostBSOInput{}
-	results := syncstorage.NewPostResults(syncstorage.Now())
-
 	// a list of all the raw json encoded BSOs
 	var raw []json.RawMessage
 
+	if r.Body == nil {
+		return nil, nil, ErrEmptyPOSTBody
+	}
+
 	if ct := getMediaType(r.Header.Get("Content-Type")); ct == "application/json" || ct == "text/plain" {
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&raw)
-		if err != nil {
+		if err == io.EOF { // nothing but whitespace
+			return nil, nil, ErrEmptyPOSTBody
+		} else if err != nil {
 			return nil, nil, errors.Wrap(err, "Could not unmarshal Request body")
 		}
 	} else { // deal with application/newlines
 		raw = ReadNewlineJSON(r.Body)
+		if len(raw) == 0 { // ReadNewlineJSON skips blank lines
+			return nil, nil, ErrEmptyPOSTBody
+		}
 	}
 
+	return rawToPostBSOInput(raw, maxPayloadSize)
+}
+
+// rawToPostBSOInput validates a list of JSON encoded BSOs. BSOs that are
+// invalid or too large are added to the PostResults as failures
+func rawToPostBSOInput(raw []json.RawMessage, maxPayloadSize int) (
+	syncstorage.PostBSOInput,
+	*syncstorage.PostResults,
+	error,
+) {
+
+	// bsoToBeProcessed will actually get sent to the DB
+	bsoToBeProcessed := syncstorage.PostBSOInput{}
+	results := syncstorage.NewPostResults(syncstorage.Now())
+
 	for _, rawJSON := range raw {
 		var b syncstorage.PutBSOInput
 		if parseErr := parseIntoBSO(rawJSON, &b); parseErr == nil {
 			if b.Payload != nil && len(*b.Payload) > maxPayloadSize {
-				results.AddFailure(b.Id, "Payload too large")
+				results.AddFailure(b.Id, ErrPayloadTooLarge.Error())
 			} else {
 				bsoToBeProcessed = append(bsoToBeProcessed, &b)
 			}
@@ -70,6 +101,447 @@ func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
 	return bsoToBeProcessed, results, nil
 }
 
+// assignBSOIds gives BSOs without an id a server generated one
+func assignBSOIds(bsos syncstorage.PostBSOInput) {
+	for _, b := range bsos {
+		if b.Id == "" {
+			b.Id = syncstorage.NewBSOId()
+		}
+	}
+}
+
+// limits returns the limits for a collection, the SyncUserHandlerConfig
+// limits are used where it has no CollectionLimits of its own
+func (s *SyncUserHandler) limits(collection string) CollectionLimits {
+	l := s.config.CollectionLimits[collection]
+	if l.MaxPOSTRecords == 0 {
+		l.MaxPOSTRecords = s.config.MaxPOSTRecords
+	}
+	if l.MaxRecordPayloadBytes == 0 {
+		l.MaxRecordPayloadBytes = s.config.MaxRecordPayloadBytes
+	}
+	if l.MaxBSOGetLimit == 0 {
+		l.MaxBSOGetLimit = s.config.MaxBSOGetLimit
+	}
+	return l
+}
+
+// enforceCollectionTTL gives BSOs without a TTL the collection's DefaultTTL
+// and lowers TTLs, in milliseconds, above its MaxTTL
+func (s *SyncUserHandler) enforceCollectionTTL(collection string, bsos syncstorage.PostBSOInput) syncstorage.PostBSOInput {
+	limits := s.limits(collection)
+	if limits.DefaultTTL == 0 && limits.MaxTTL == 0 {
+		return bsos
+	}
+
+	for _, b := range bsos {
+		if b.TTL == nil && limits.DefaultTTL > 0 {
+			tmp := limits.DefaultTTL * 1000
+			b.TTL = &tmp
+		}
+
+		if b.TTL != nil && limits.MaxTTL > 0 && *b.TTL > limits.MaxTTL*1000 {
+			tmp := limits.MaxTTL * 1000
+			b.TTL = &tmp
+		}
+	}
+
+	return bsos
+}
+
+// minTTL returns the minimum TTL in milliseconds for a collection
+func (s *SyncUserHandler) minTTL(collection string) (ttl int, ok bool) {
+	seconds, ok := s.config.MinTTLs[collection]
+	return seconds * 1000, ok
+}
+
+// enforceMinTTL raises TTLs, in milliseconds, that are below the collection's
+// minimum. With MinTTLReject those BSOs are removed and recorded as failures
+// instead. BSOs without a TTL are left alone: new ones never expire and
+// updates keep the TTL they already have.
+func (s *SyncUserHandler) enforceMinTTL(collection string, bsos syncstorage.PostBSOInput, results *syncstorage.PostResults) syncstorage.PostBSOInput {
+	min, ok := s.minTTL(collection)
+	if !ok {
+		return bsos
+	}
+
+	filtered := bsos[:0]
+	for _, b := range bsos {
+		if b.TTL != nil && *b.TTL < min {
+			if s.config.MinTTLReject {
+				results.AddFailure(b.Id, fmt.Sprintf("TTL below minimum for: %s", b.Id))
+				continue
+			}
+
+			tmp := min
+			b.TTL = &tmp
+		}
+
+		filtered = append(filtered, b)
+	}
+
+	return filtered
+}
+
+// sortIndexRequired is true for collections where BSOs must have a sortindex
+func (s *SyncUserHandler) sortIndexRequired(collection string) bool {
+	for _, name := range s.config.RequireSortIndex {
+		if name == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// generationWriter adds X-Weave-Generation, see syncstorage.DB.Generation,
+// just before the headers are sent so it includes the request's own write
+type generationWriter struct {
+	http.ResponseWriter
+	db          *syncstorage.DB
+	wroteHeader bool
+}
+
+func (w *generationWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if generation, err := w.db.Generation(); err == nil {
+			w.Header().Set("X-Weave-Generation", strconv.Itoa(generation))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *generationWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// acceptHeaderOk is AcceptHeaderOk with the configured DefaultAccept for
+// requests without an Accept header
+func (s *SyncUserHandler) acceptHeaderOk(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Accept") == "" && s.config.DefaultAccept != "" {
+		r.Header.Set("Accept", s.config.DefaultAccept)
+	}
+	return AcceptHeaderOk(w, r)
+}
+
+// recordCountOk checks X-Weave-Records is the number of BSOs sent when
+// StrictRecordCounts is on. Requests without it are always ok
+func (s *SyncUserHandler) recordCountOk(w http.ResponseWriter, r *http.Request, sent int) bool {
+	if !s.config.StrictRecordCounts {
+		return true
+	}
+
+	declared, err := strconv.Atoi(r.Header.Get("X-Weave-Records"))
+	if err != nil || declared == sent {
+		return true
+	}
+
+	WeaveInvalidWBOError(w, r,
+		errors.Errorf("X-Weave-Records is %d but %d BSOs were sent", declared, sent))
+	return false
+}
+
+// enforceSortIndex removes BSOs without a sortindex from writes to
+// collections that require one and records them as failures
+func (s *SyncUserHandler) enforceSortIndex(collection string, bsos syncstorage.PostBSOInput, results *syncstorage.PostResults) syncstorage.PostBSOInput {
+	if !s.sortIndexRequired(collection) {
+		return bsos
+	}
+
+	filtered := bsos[:0]
+	for _, b := range bsos {
+		if b.SortIndex == nil {
+			results.AddFailure(b.Id, fmt.Sprintf("Missing sortindex for: %s", b.Id))
+			continue
+		}
+
+		filtered = append(filtered, b)
+	}
+
+	return filtered
+}
+
+// frozenKey is the KeyValues key of a user's frozen collections. It is a
+// JSON list, empty when the user does not have their own list
+const frozenKey = "FROZEN_COLLECTIONS"
+
+// frozenCollections returns the collections that can not be written. It
+// must be called with requestLock held
+func (s *SyncUserHandler) frozenCollections() (collections []string, own bool, err error) {
+	if !s.frozenLoaded {
+		value, err := s.db.GetKey(frozenKey)
+		if err != nil {
+			return nil, false, err
+		}
+
+		s.frozen = nil
+		if value != "" {
+			s.frozen = []string{}
+			if err := json.Unmarshal([]byte(value), &s.frozen); err != nil {
+				return nil, false, errors.Wrap(err, "Invalid "+frozenKey)
+			}
+		}
+		s.frozenLoaded = true
+	}
+
+	if s.frozen != nil {
+		return s.frozen, true, nil
+	}
+	return s.config.FrozenCollections, false, nil
+}
+
+// notFrozen responds 423 Locked to writes to frozen collections. Deleting
+// all the user's data is refused while any collection is frozen
+func (s *SyncUserHandler) notFrozen(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		frozen, _, err := s.frozenCollections()
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		collection, ok := mux.Vars(r)["collection"]
+		for _, name := range frozen {
+			if !ok || name == collection {
+				sendRequestProblem(w, r, http.StatusLocked,
+					errors.Errorf("Collection %s is frozen", name))
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+// longest Idempotency-Key header accepted
+const maxIdempotencyKeyBytes = 255
+
+// idempotentResponse is a successful POST response that is sent again,
+// without processing the request, when a client retries it with the same
+// Idempotency-Key
+type idempotentResponse struct {
+	key     string
+	request string // the method and URL the key was sent with
+	expires time.Time
+	code    int
+	header  http.Header
+	body    []byte
+}
+
+// idempotent replays the response of an earlier request with the same
+// Idempotency-Key header. Only successful responses are kept, at most
+// IdempotencyKeys for IdempotencyTTL seconds. They are kept in memory and
+// lost when the handler is closed
+func (s *SyncUserHandler) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || s.config.IdempotencyTTL <= 0 || s.config.IdempotencyKeys <= 0 {
+			h(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyBytes {
+			sendRequestProblem(w, r, http.StatusBadRequest,
+				errors.Errorf("Idempotency-Key longer than %d bytes", maxIdempotencyKeyBytes))
+			return
+		}
+
+		request := r.Method + " " + r.URL.RequestURI()
+		now := time.Now()
+
+		// forget expired responses
+		kept := s.idempotentResponses[:0]
+		for _, resp := range s.idempotentResponses {
+			if now.Before(resp.expires) {
+				kept = append(kept, resp)
+			}
+		}
+		s.idempotentResponses = kept
+
+		for _, resp := range s.idempotentResponses {
+			if resp.key != key {
+				continue
+			}
+
+			if resp.request != request {
+				sendRequestProblem(w, r, http.StatusUnprocessableEntity,
+					errors.New("Idempotency-Key was sent with a different request"))
+				return
+			}
+
+			for name, values := range resp.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.code)
+			w.Write(resp.body)
+			return
+		}
+
+		cw := newCacheResponseWriter(w)
+		h(cw, r)
+
+		if cw.code < 200 || cw.code > 299 {
+			return
+		}
+
+		header := make(http.Header)
+		for name, values := range w.Header() {
+			header[name] = append([]string(nil), values...)
+		}
+
+		s.idempotentResponses = append(s.idempotentResponses, &idempotentResponse{
+			key:     key,
+			request: request,
+			expires: now.Add(time.Duration(s.config.IdempotencyTTL) * time.Second),
+			code:    cw.code,
+			header:  header,
+			body:    cw.Bytes(),
+		})
+
+		// keep the newest
+		if over := len(s.idempotentResponses) - s.config.IdempotencyKeys; over > 0 {
+			s.idempotentResponses = s.idempotentResponses[over:]
+		}
+	}
+}
+
+// sendChanges tells the Changes sink about a write. Without bsoIds it is a
+// single change for the whole collection
+func (s *SyncUserHandler) sendChanges(op ChangeOp, collection string, modified int, bsoIds ...string) {
+	if s.config.Changes == nil {
+		return
+	}
+
+	if len(bsoIds) == 0 {
+		s.config.Changes.Send(Change{Uid: s.uid, Collection: collection, Op: op, Modified: modified})
+		return
+	}
+
+	for _, bId := range bsoIds {
+		s.config.Changes.Send(Change{Uid: s.uid, Collection: collection, BsoId: bId, Op: op, Modified: modified})
+	}
+}
+
+// sendPostResults writes the results of a POST with at most MaxPOSTResults
+// ids in each of its success and failed lists
+func (s *SyncUserHandler) sendPostResults(w http.ResponseWriter, r *http.Request, status int, p *PostResults) {
+	p.Limit(s.config.MaxPOSTResults)
+	JsonNewlineStatus(w, r, status, p)
+}
+
+// usageExcluded is true for collections left out of usage reporting
+// and the quota
+func (s *SyncUserHandler) usageExcluded(collection string) bool {
+	for _, name := range s.config.UsageExclude {
+		if name == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// usedBytes returns the payload bytes stored by the user, not counting
+// excluded collections
+func (s *SyncUserHandler) usedBytes() (int, error) {
+	if len(s.config.UsageExclude) == 0 {
+		used, _, err := s.db.InfoQuota()
+		return used, err
+	}
+
+	results, err := s.db.InfoCollectionUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	used := 0
+	for name, bytes := range results {
+		if !s.usageExcluded(name) {
+			used += bytes
+		}
+	}
+	return used, nil
+}
+
+// remainingQuota returns how many more payload bytes the user may store.
+// limited is false when there is no quota
+func (s *SyncUserHandler) remainingQuota() (remaining int, limited bool, err error) {
+	if s.config.MaxUserBytes <= 0 {
+		return 0, false, nil
+	}
+
+	used, err := s.usedBytes()
+	if err != nil {
+		return 0, true, err
+	}
+
+	remaining = s.config.MaxUserBytes - used
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return remaining, true, nil
+}
+
+// quotaOk checks the payloads about to be written fit in the remaining
+// quota. It sends the error response and returns false when they do not
+func (s *SyncUserHandler) quotaOk(w http.ResponseWriter, r *http.Request, collection string, bsos syncstorage.PostBSOInput) bool {
+	if s.usageExcluded(collection) {
+		return true
+	}
+
+	return s.fitsQuota(w, r, bsos)
+}
+
+// capPaging applies MaxPagingRecords to a page of limit records that starts
+// paged records in. The limit is cut so the page ends at the cap and capped
+// is set when it was. Pages starting at or past the cap get a 400 and ok
+// is false
+func (s *SyncUserHandler) capPaging(w http.ResponseWriter, r *http.Request, paged, limit int) (newLimit int, capped, ok bool) {
+	max := s.config.MaxPagingRecords
+	if max <= 0 || paged+limit < max {
+		return limit, false, true
+	}
+
+	if paged >= max {
+		w.Header().Set("X-Weave-Paging-Limit", strconv.Itoa(max))
+		WeaveInvalidWBOError(w, r, errors.Errorf("Paging past %d records is not allowed", max))
+		return 0, false, false
+	}
+
+	return max - paged, true, true
+}
+
+// fitsQuota is quotaOk for BSOs that all count towards the quota
+func (s *SyncUserHandler) fitsQuota(w http.ResponseWriter, r *http.Request, bsos syncstorage.PostBSOInput) bool {
+	remaining, limited, err := s.remainingQuota()
+	if err != nil {
+		InternalError(w, r, err)
+		return false
+	}
+
+	if !limited {
+		return true
+	}
+
+	size := 0
+	for _, b := range bsos {
+		if b.Payload != nil {
+			size += len(*b.Payload)
+		}
+	}
+
+	if size > remaining {
+		WeaveOverQuota(w, r, errors.Errorf("Quota exceeded, %d payload bytes > %d remaining", size, remaining))
+		return false
+	}
+
+	return true
+}
+
 const (
 	// why 257KB?
 	// - 256 KB for BSO payload max size
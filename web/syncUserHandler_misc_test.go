@@ -146,6 +146,17 @@ func TestRequestToPostBSOInput(t *testing.T) {
 			}
 		}
 	}
+
+	{ // test empty and whitespace only bodies
+		for _, ct := range []string{"application/json", "application/newlines"} {
+			for _, body := range []string{"", "\n   \n"} {
+				req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+				req.Header.Add("Content-Type", ct)
+				_, _, err := RequestToPostBSOInput(req, 5)
+				assert.Equal(ErrEmptyPOSTBody, err)
+			}
+		}
+	}
 }
 
 func BenchmarkReadNewlineJSON(b *testing.B) {
@@ -2,14 +2,21 @@ package web
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/stretchr/testify/assert"
 )
@@ -73,6 +80,257 @@ func TestSyncUserHandlerInfoCollections(t *testing.T) {
 
 }
 
+func TestSyncUserHandlerInfoCollectionsNewer(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := "123456"
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	for _, cName := range []string{"bookmarks", "history", "tabs"} {
+		cId, _ := db.GetCollectionId(cName)
+		db.TouchCollection(cId, 1000)
+	}
+	for cName, modified := range map[string]int{"history": 3000, "tabs": 4000} {
+		cId, _ := db.GetCollectionId(cName)
+		db.TouchCollection(cId, modified)
+	}
+
+	resp := request("GET", syncurl(uid, "info/collections?newer=2"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		results := make(map[string]float64)
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Equal(map[string]float64{"history": 3, "tabs": 4}, results)
+		}
+
+		// X-Last-Modified is still for all the collections
+		assert.Equal("4.00", resp.Header().Get("X-Last-Modified"))
+	}
+
+	// nothing changed since
+	resp = request("GET", syncurl(uid, "info/collections?newer=4"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("{}", resp.Body.String())
+
+	for _, bad := range []string{"abc", "-1"} {
+		resp = request("GET", syncurl(uid, "info/collections?newer="+bad), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, bad)
+	}
+}
+
+func TestSyncUserHandlerInfoCollectionCountsNewer(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := "123456"
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	payload := "x"
+	for cName, num := range map[string]int{"bookmarks": 1, "history": 2, "tabs": 3} {
+		cId, _ := db.GetCollectionId(cName)
+		for i := 0; i < num; i++ {
+			db.PutBSO(cId, strconv.Itoa(i), &payload, nil, nil)
+		}
+		db.TouchCollection(cId, 1000)
+	}
+	for cName, modified := range map[string]int{"history": 3000, "tabs": 4000} {
+		cId, _ := db.GetCollectionId(cName)
+		db.TouchCollection(cId, modified)
+	}
+
+	// tabs was emptied
+	cId, _ := db.GetCollectionId("tabs")
+	db.DeleteCollection(cId)
+
+	counts := func(url string) map[string]int {
+		resp := request("GET", syncurl(uid, url), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return nil
+		}
+		results := make(map[string]int)
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+		return results
+	}
+
+	assert.Equal(map[string]int{"bookmarks": 1, "history": 2}, counts("info/collection_counts"))
+	assert.Equal(map[string]int{"history": 2, "tabs": 0}, counts("info/collection_counts?newer=2"))
+	assert.Equal(map[string]int{"tabs": 0}, counts("info/collection_counts?newer=3.5"))
+	assert.Equal(map[string]int{}, counts("info/collection_counts?newer=4"))
+
+	for _, bad := range []string{"abc", "-1"} {
+		resp := request("GET", syncurl(uid, "info/collection_counts?newer="+bad), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, bad)
+	}
+}
+
+func TestSyncUserHandlerInfoCollectionUsageUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "b0", syncstorage.String(strings.Repeat("x", 1500)), nil, nil)
+
+	for _, url := range []string{"info/collection_usage", "info/collection_usage?unit=kb"} {
+		resp := request("GET", syncurl(uid, url), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code, url) {
+			assert.Equal(`{"bookmarks":1.46484375}`+"\n", resp.Body.String(), url)
+		}
+	}
+
+	resp := request("GET", syncurl(uid, "info/collection_usage?unit=bytes"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(`{"bookmarks":1500}`+"\n", resp.Body.String())
+	}
+
+	resp = request("GET", syncurl(uid, "info/collection_usage?unit=mb"), nil, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+}
+
+func TestSyncUserHandlerInfoQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "b0", syncstorage.String(strings.Repeat("x", 1500)), nil, nil)
+
+	// same KB as info/collection_usage, unlimited is null
+	resp := request("GET", syncurl(uid, "info/quota"), nil, NewSyncUserHandler(uid, db, nil))
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal("[1.46484375,null]\n", resp.Body.String())
+	}
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxUserBytes = 5 * 1024 * 1024
+	handler := NewSyncUserHandler(uid, db, config)
+	resp = request("GET", syncurl(uid, "info/quota"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal("[1.46484375,5120]\n", resp.Body.String())
+	}
+
+	header := make(http.Header)
+	header.Set("Accept", "text/html")
+	resp = requestheaders("GET", syncurl(uid, "info/quota"), nil, header, handler)
+	assert.Equal(http.StatusNotAcceptable, resp.Code)
+}
+
+func TestSyncUserHandlerCollectionVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := request("GET", syncurl(uid, "info/collection_versions"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal("{}\n", resp.Body.String())
+	}
+
+	resp = jsonrequest("PUT", syncurl(uid, "info/collection_versions/bookmarks"), strings.NewReader(`{"version":2}`), handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(`{"version":2}`, strings.TrimSpace(resp.Body.String()))
+	}
+
+	// collections that don't exist yet are created
+	resp = jsonrequest("PUT", syncurl(uid, "info/collection_versions/custom"), strings.NewReader(`{"version":1}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	version, err := db.GetCollectionVersion(cId)
+	assert.NoError(err)
+	assert.Equal(2, version)
+
+	resp = request("GET", syncurl(uid, "info/collection_versions"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var versions map[string]int
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &versions)) {
+			assert.Equal(map[string]int{"bookmarks": 2, "custom": 1}, versions)
+		}
+	}
+
+	for _, body := range []string{"", "{}", `{"version":-1}`, `{"version":"2"}`} {
+		resp = jsonrequest("PUT", syncurl(uid, "info/collection_versions/bookmarks"), strings.NewReader(body), handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, body)
+	}
+
+	// deleting the collection forgets its version
+	request("DELETE", syncurl(uid, "storage/bookmarks"), nil, handler)
+	resp = request("GET", syncurl(uid, "info/collection_versions"), nil, handler)
+	assert.Equal(`{"custom":1}`+"\n", resp.Body.String())
+}
+
+func TestSyncUserHandlerFrozen(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "b0", syncstorage.String("x"), nil, nil)
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.FrozenCollections = []string{"bookmarks"}
+	handler := NewSyncUserHandler(uid, db, config)
+
+	// reads work
+	resp := request("GET", syncurl(uid, "storage/bookmarks/b0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	resp = request("GET", syncurl(uid, "storage/bookmarks"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	writes := []struct{ method, url, body string }{
+		{"POST", "storage/bookmarks", `[{"id":"b1","payload":"x"}]`},
+		{"PUT", "storage/bookmarks/b0", `{"payload":"y"}`},
+		{"DELETE", "storage/bookmarks/b0", ""},
+		{"DELETE", "storage/bookmarks", ""},
+		{"DELETE", "storage", ""},
+	}
+
+	for _, write := range writes {
+		resp = jsonrequest(write.method, syncurl(uid, write.url), strings.NewReader(write.body), handler)
+		assert.Equal(http.StatusLocked, resp.Code, write.method+" "+write.url)
+	}
+
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("x", bso.Payload)
+	}
+
+	// other collections are not frozen
+	resp = jsonrequest("PUT", syncurl(uid, "storage/tabs/t0"), strings.NewReader(`{"payload":"x"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// the user's own list replaces the config
+	assert.NoError(handler.SetFrozen([]string{"tabs"}))
+	frozen, own, err := handler.Frozen()
+	assert.NoError(err)
+	assert.True(own)
+	assert.Equal([]string{"tabs"}, frozen)
+
+	resp = jsonrequest("PUT", syncurl(uid, "storage/tabs/t0"), strings.NewReader(`{"payload":"y"}`), handler)
+	assert.Equal(http.StatusLocked, resp.Code)
+	resp = jsonrequest("PUT", syncurl(uid, "storage/bookmarks/b0"), strings.NewReader(`{"payload":"y"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// it is kept in the DB
+	handler = NewSyncUserHandler(uid, db, config)
+	resp = jsonrequest("PUT", syncurl(uid, "storage/tabs/t0"), strings.NewReader(`{"payload":"y"}`), handler)
+	assert.Equal(http.StatusLocked, resp.Code)
+
+	assert.NoError(handler.SetFrozen(nil))
+	resp = jsonrequest("PUT", syncurl(uid, "storage/bookmarks/b0"), strings.NewReader(`{"payload":"z"}`), handler)
+	assert.Equal(http.StatusLocked, resp.Code)
+
+	assert.NoError(handler.SetFrozen([]string{}))
+	for _, write := range writes {
+		resp = jsonrequest(write.method, syncurl(uid, write.url), strings.NewReader(write.body), handler)
+		assert.Equal(http.StatusOK, resp.Code, write.method+" "+write.url)
+	}
+}
+
 func TestSyncUserHandlerInfoConfiguration(t *testing.T) {
 
 	assert := assert.New(t)
@@ -212,6 +470,25 @@ func TestSyncUserHandlerPOST(t *testing.T) {
 		assert.Equal(http.StatusOK, resp.Code)
 	}
 
+	{ // charset parameters are ignored for both formats
+		bodies := map[string]string{
+			"application/json; charset=utf-8":     `[{"id":"bsod", "payload": "charset"}]`,
+			"application/newlines; charset=utf-8": "{\"id\":\"bsoe\", \"payload\": \"charset\"}\n",
+		}
+
+		for ct, body := range bodies {
+			header := make(http.Header)
+			header.Add("Content-Type", ct)
+			resp := requestheaders("POST", url, bytes.NewBufferString(body), header, handler)
+			if assert.Equal(http.StatusOK, resp.Code, ct) {
+				var results PostResults
+				assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), ct)
+				assert.Len(results.Success, 1, ct)
+				assert.Len(results.Failed, 0, ct)
+			}
+		}
+	}
+
 	{ // test error when payload is too large
 		body := bytes.NewBufferString(`[
 			{"id":"bsoA", "payload": "1234567890"},
@@ -242,6 +519,245 @@ func TestSyncUserHandlerPOST(t *testing.T) {
 	}
 }
 
+// TestSyncUserHandlerPayloadTooLarge checks the PUT, PATCH and POST
+// paths use the same limit and reason for payloads that are too large
+func TestSyncUserHandlerPayloadTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxRecordPayloadBytes = 5
+	handler := NewSyncUserHandler(uid, db, config)
+
+	tooLarge := func(resp *httptest.ResponseRecorder) {
+		if !assert.Equal(http.StatusRequestEntityTooLarge, resp.Code) {
+			return
+		}
+		var e jsonerr
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &e)) {
+			assert.Equal(ErrPayloadTooLarge.Error(), e.Err)
+		}
+	}
+
+	body := bytes.NewBufferString(`{"payload": "12345"}`)
+	resp := requestheaders("PUT", syncurl(uid, "storage/bookmarks/b0"), body, header, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	body = bytes.NewBufferString(`{"payload": "123456"}`)
+	tooLarge(requestheaders("PUT", syncurl(uid, "storage/bookmarks/b1"), body, header, handler))
+
+	body = bytes.NewBufferString(`{"payload": "123456"}`)
+	tooLarge(requestheaders("PATCH", syncurl(uid, "storage/bookmarks/b0"), body, header, handler))
+
+	// a batch with any failures is not started so nothing is written
+	for url, success := range map[string][]string{
+		"storage/bookmarks":                        {"b3"},
+		"storage/bookmarks?batch=true&commit=true": {},
+	} {
+		body = bytes.NewBufferString(`[
+			{"id":"b2", "payload": "123456"},
+			{"id":"b3", "payload": "12345"}
+		]`)
+		resp = requestheaders("POST", syncurl(uid, url), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, url) {
+			continue
+		}
+
+		var results PostResults
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			continue
+		}
+		assert.Equal(success, results.Success, url)
+		assert.Equal([]string{ErrPayloadTooLarge.Error()}, results.Failed["b2"], url)
+	}
+}
+
+func TestSyncUserHandlerPOSTMaxResults(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxPOSTResults = 5
+	handler := NewSyncUserHandler(uid, db, config)
+
+	bsos := make([]string, 0, 40)
+	for i := 0; i < 20; i++ {
+		bsos = append(bsos,
+			fmt.Sprintf(`{"id":"ok%02d","payload":"x"}`, i),
+			fmt.Sprintf(`{"id":"bad%02d","sortindex":"nope"}`, i))
+	}
+	body := "[" + strings.Join(bsos, ",") + "]"
+
+	post := func(handler http.Handler) (results PostResults) {
+		resp := jsonrequest("POST", syncurl(uid, "storage/bookmarks"), strings.NewReader(body), handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+		}
+		return
+	}
+
+	results := post(handler)
+	assert.True(results.Truncated)
+	assert.Len(results.Success, 5)
+	if assert.Len(results.Failed, 5) {
+		// the same ids are reported every time
+		for i := 0; i < 5; i++ {
+			assert.NotNil(results.Failed[fmt.Sprintf("bad%02d", i)])
+		}
+	}
+
+	// everything was still written
+	cId, _ := db.GetCollectionId("bookmarks")
+	if bsos, err := db.GetBSOs(cId, nil, syncstorage.MaxTimestamp, 0, syncstorage.SORT_NONE, 100, 0); assert.NoError(err) {
+		assert.Len(bsos.BSOs, 20)
+	}
+
+	// unlimited by default
+	results = post(NewSyncUserHandler(uid, db, nil))
+	assert.False(results.Truncated)
+	assert.Len(results.Success, 20)
+	assert.Len(results.Failed, 20)
+}
+
+func TestSyncUserHandlerPOSTEmptyBody(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	url := syncurl(uid, "storage/bookmarks")
+
+	for _, ct := range []string{"application/json", "text/plain", "application/newlines"} {
+		for _, body := range []string{"", " \n\t\n  "} {
+			header := make(http.Header)
+			header.Set("Accept", "application/json")
+			header.Set("Content-Type", ct)
+
+			resp := requestheaders("POST", url, bytes.NewBufferString(body), header, handler)
+			assert.Equal(http.StatusBadRequest, resp.Code, "Content-Type: %s, body: %q", ct, body)
+			assert.Contains(resp.Body.String(), ErrEmptyPOSTBody.Error())
+		}
+	}
+
+	{ // an empty list is not an empty body
+		resp := jsonrequest("POST", url, bytes.NewBufferString("[]"), handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	{ // an empty body is ok when committing a batch
+		resp := jsonrequest("POST", url+"?batch=true", bytes.NewBufferString(`[{"id":"bso0", "payload":"x"}]`), handler)
+		if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+
+		resp = jsonrequest("POST", url+"?commit=1&batch="+results.Batch, bytes.NewBufferString(""), handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		// but not when appending to one
+		resp = jsonrequest("POST", url+"?batch=true", bytes.NewBufferString(""), handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+	}
+}
+
+// text/plain from old clients is parsed exactly like application/json
+func TestSyncUserHandlerPOSTTextPlain(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	url := syncurl(uid, "storage/bookmarks")
+
+	for _, ct := range []string{"application/json", "text/plain"} {
+		header := make(http.Header)
+		header.Set("Content-Type", ct)
+
+		resp := requestheaders("POST", url, bytes.NewBufferString(`[{"id":"a", "payload": "x"`), header, handler)
+		if assert.Equal(http.StatusBadRequest, resp.Code, ct) {
+			assert.Equal(WEAVE_INVALID_WBO, resp.Body.String(), ct)
+		}
+
+		body := `[{"id":"a", "payload": "x", "color": "red"}, {"id":"b", "payload": "x"}]`
+		resp = requestheaders("POST", url, bytes.NewBufferString(body), header, handler)
+		if assert.Equal(http.StatusOK, resp.Code, ct) {
+			var results PostResults
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), ct) {
+				assert.Equal([]string{"b"}, results.Success, ct)
+				assert.Len(results.Failed, 1, ct)
+			}
+		}
+	}
+}
+
+func TestSyncUserHandlerPOSTAutoBSOIds(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	url := syncurl(uid, "storage/bookmarks")
+	body := `[{"payload": "one"}, {"payload": "two"}, {"id": "bso0", "payload": "three"}]`
+
+	{ // off by default, id-less BSOs fail
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		handler := NewSyncUserHandler(uid, db, nil)
+
+		resp := jsonrequest("POST", url, bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+
+		assert.Equal([]string{"bso0"}, results.Success)
+		assert.Len(results.Failed, 1)
+	}
+
+	for _, batch := range []string{"", "?batch=true&commit=1"} {
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		config := NewDefaultSyncUserHandlerConfig()
+		config.AutoBSOIds = true
+		handler := NewSyncUserHandler(uid, db, config)
+
+		resp := jsonrequest("POST", url+batch, bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+
+		assert.Len(results.Failed, 0)
+		if !assert.Len(results.Success, 3) {
+			return
+		}
+
+		cId, _ := db.GetCollectionId("bookmarks")
+		payloads := make(map[string]bool)
+		for _, bId := range results.Success {
+			bso, err := db.GetBSO(cId, bId)
+			if assert.NoError(err, "Could not find generated id %s", bId) {
+				payloads[bso.Payload] = true
+			}
+		}
+
+		assert.True(payloads["one"] && payloads["two"] && payloads["three"])
+	}
+}
+
 // TestSyncUserHandlerPOSTBatch tests that a batch can be created, appended to and commited
 func TestSyncUserHandlerPOSTBatch(t *testing.T) {
 
@@ -380,17 +896,1286 @@ func TestSyncUserHandlerPOSTBatch(t *testing.T) {
 	}
 }
 
-func TestSyncUserHandlerPUT(t *testing.T) {
-	t.Parallel()
+func TestSyncUserHandlerBatchCommitUnmodifiedSince(t *testing.T) {
 	assert := assert.New(t)
 
-	uid := "123456"
-
+	uid := uniqueUID()
 	db, _ := syncstorage.NewDB(":memory:", nil)
 	handler := NewSyncUserHandler(uid, db, nil)
-	url := syncurl(uid, "storage/bookmarks/bso0")
-	header := make(http.Header)
-	header.Add("Content-Type", "application/json")
+
+	url := syncurl(uid, "storage/col")
+	post := func(query, unmodifiedSince, bId string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		if unmodifiedSince != "" {
+			header.Set("X-If-Unmodified-Since", unmodifiedSince)
+		}
+		body := bytes.NewBufferString(`[{"id":"` + bId + `", "payload": "x"}]`)
+		return requestheaders("POST", url+"?"+query, body, header, handler)
+	}
+
+	resp := post("", "", "bso0")
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	started := resp.Header().Get("X-Last-Modified")
+
+	resp = post("batch=true", started, "bso1")
+	if !assert.Equal(http.StatusAccepted, resp.Code) {
+		return
+	}
+	var results PostResults
+	assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+
+	// another device writes to the collection mid batch
+	resp = post("", "", "other")
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	changed := resp.Header().Get("X-Last-Modified")
+
+	resp = post("commit=true&batch="+results.Batch, started, "bso2")
+	assert.Equal(http.StatusPreconditionFailed, resp.Code)
+	assert.Equal(changed, resp.Header().Get("X-Last-Modified"))
+
+	var ids []string
+	resp = request("GET", url, nil, handler)
+	assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids))
+	assert.NotContains(ids, "bso1", "the batch is not committed")
+
+	// the batch is kept so the client can retry once it has merged
+	resp = post("commit=true&batch="+results.Batch, changed, "bso2")
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = request("GET", url, nil, handler)
+	assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids))
+	assert.Contains(ids, "bso1")
+	assert.Contains(ids, "bso2")
+}
+
+func TestSyncUserHandlerWritesUnmodifiedSince(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.CreateCollection("col")
+	modified, _ := db.PutBSO(cId, "bso0", syncstorage.String("x"), nil, nil)
+	ts := syncstorage.ModifiedToString(modified)
+	stale := syncstorage.ModifiedToString(modified - 10)
+
+	write := func(method, path, since string) *httptest.ResponseRecorder {
+		var body io.Reader
+		header := make(http.Header)
+		header.Set("X-If-Unmodified-Since", since)
+		if method == "PUT" {
+			header.Set("Content-Type", "application/json")
+			body = bytes.NewBufferString(`{"payload": "y"}`)
+		} else if method == "POST" {
+			header.Set("Content-Type", "application/json")
+			body = bytes.NewBufferString(`[{"id": "bso1", "payload": "y"}]`)
+		}
+		return requestheaders(method, syncurl(uid, path), body, header, handler)
+	}
+
+	// nothing is written when the resource changed after the timestamp
+	for _, w := range [][2]string{
+		{"POST", "storage/col"},
+		{"PUT", "storage/col/bso0"},
+		{"DELETE", "storage/col/bso0"},
+		{"DELETE", "storage/col"},
+	} {
+		resp := write(w[0], w[1], stale)
+		if assert.Equal(http.StatusPreconditionFailed, resp.Code, w[0]+" "+w[1]) {
+			assert.Equal(ts, resp.Header().Get("X-Last-Modified"), w[0]+" "+w[1])
+		}
+	}
+
+	bso, err := db.GetBSO(cId, "bso0")
+	if assert.NoError(err) {
+		assert.Equal("x", bso.Payload)
+		assert.Equal(modified, bso.Modified)
+	}
+	_, err = db.GetBSO(cId, "bso1")
+	assert.Equal(syncstorage.ErrNotFound, err)
+
+	// the current timestamp passes
+	resp := write("PUT", "storage/col/bso0", ts)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// missing collections and BSOs were never modified so any timestamp passes
+	for _, w := range [][2]string{
+		{"POST", "storage/new0"},
+		{"PUT", "storage/new1/bso0"},
+		{"PUT", "storage/col/new"},
+		{"DELETE", "storage/missing"},
+	} {
+		resp := write(w[0], w[1], "yesterday")
+		assert.Equal(http.StatusBadRequest, resp.Code, w[0]+" "+w[1])
+
+		resp = write(w[0], w[1], "0.00")
+		assert.Equal(http.StatusOK, resp.Code, w[0]+" "+w[1])
+	}
+}
+
+func TestSyncUserHandlerStrictRecordCounts(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.StrictRecordCounts = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	url := syncurl(uid, "storage/col")
+	post := func(query, records, total string, bIds ...string) *httptest.ResponseRecorder {
+		var bsos []string
+		for _, bId := range bIds {
+			bsos = append(bsos, `{"id":"`+bId+`", "payload": "x"}`)
+		}
+
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		if records != "" {
+			header.Set("X-Weave-Records", records)
+		}
+		if total != "" {
+			header.Set("X-Weave-Total-Records", total)
+		}
+
+		body := bytes.NewBufferString("[" + strings.Join(bsos, ",") + "]")
+		return requestheaders("POST", url+"?"+query, body, header, handler)
+	}
+
+	batchId := func(resp *httptest.ResponseRecorder) string {
+		var results PostResults
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+		return results.Batch
+	}
+
+	resp := post("batch=true", "3", "", "bso0", "bso1")
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Equal(WEAVE_INVALID_WBO, resp.Body.String())
+
+	resp = post("batch=true", "2", "", "bso0", "bso1")
+	if !assert.Equal(http.StatusAccepted, resp.Code) {
+		return
+	}
+	batch := batchId(resp)
+
+	// the commit says the batch has more BSOs than it does
+	resp = post("commit=true&batch="+batch, "1", "4", "bso2")
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Equal(WEAVE_INVALID_WBO, resp.Body.String())
+
+	// nothing was committed and the batch is gone
+	resp = request("GET", url, nil, handler)
+	assert.JSONEq("[]", resp.Body.String())
+	resp = post("commit=true&batch="+batch, "", "", "bso2")
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	resp = post("batch=true", "2", "", "bso0", "bso1")
+	if assert.Equal(http.StatusAccepted, resp.Code) {
+		resp = post("commit=true&batch="+batchId(resp), "1", "3", "bso2")
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	// POSTs without a batch are checked too
+	resp = post("", "1", "", "bso5", "bso6")
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Equal(WEAVE_INVALID_WBO, resp.Body.String())
+	cId, _ := db.GetCollectionId("col")
+	_, err := db.GetBSO(cId, "bso5")
+	assert.Equal(syncstorage.ErrNotFound, err)
+
+	resp = post("", "2", "", "bso5", "bso6")
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// counts are not checked by default
+	handler = NewSyncUserHandler(uid, db, nil)
+	resp = post("batch=true", "3", "", "bso3")
+	if assert.Equal(http.StatusAccepted, resp.Code) {
+		resp = post("commit=true&batch="+batchId(resp), "", "5", "bso4")
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+	resp = post("", "5", "", "bso7")
+	assert.Equal(http.StatusOK, resp.Code)
+}
+
+func TestSyncUserHandlerMaxPagingRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxPagingRecords = 25
+	handler := NewSyncUserHandler(uid, db, config)
+
+	cId, _ := db.GetCollectionId("history")
+	for i := 0; i < 40; i++ {
+		db.PutBSO(cId, fmt.Sprintf("h%02d", i), syncstorage.String("x"), nil, nil)
+	}
+
+	// page through until there is no next offset
+	var (
+		ids    []string
+		offset string
+		resp   *httptest.ResponseRecorder
+	)
+	for pages := 0; pages < 10; pages++ {
+		url := "storage/history?limit=10&sort=index"
+		if offset != "" {
+			url += "&offset=" + offset
+		}
+
+		resp = request("GET", syncurl(uid, url), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+
+		var page []string
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &page)) {
+			return
+		}
+		ids = append(ids, page...)
+
+		if offset = resp.Header().Get("X-Weave-Next-Offset"); offset == "" {
+			break
+		}
+	}
+
+	assert.Len(ids, 25)
+	assert.Equal("25", resp.Header().Get("X-Weave-Paging-Limit"))
+	assert.Equal("40", resp.Header().Get("X-Weave-Records"))
+
+	// a page straddling the limit is cut short at it
+	resp = request("GET", syncurl(uid, "storage/history?limit=10&offset=20"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var page []string
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &page))
+		assert.Len(page, 5)
+		assert.Equal("25", resp.Header().Get("X-Weave-Paging-Limit"))
+		assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+	}
+
+	// offsets at or past the limit are rejected without a query
+	for _, offset := range []string{"25", "30", "1000000"} {
+		resp = request("GET", syncurl(uid, "storage/history?limit=10&offset="+offset), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, offset)
+		assert.Equal(WEAVE_INVALID_WBO, resp.Body.String(), offset)
+		assert.Equal("25", resp.Header().Get("X-Weave-Paging-Limit"), offset)
+	}
+
+	// a collection that ends at the limit is not marked
+	config.MaxPagingRecords = 40
+	resp = request("GET", syncurl(uid, "storage/history?limit=20&offset=20"), nil, handler)
+	assert.Equal("", resp.Header().Get("X-Weave-Paging-Limit"))
+	assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+}
+
+func TestSyncUserHandlerLimitClamped(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxBSOGetLimit = 10
+	handler := NewSyncUserHandler(uid, db, config)
+
+	cId, _ := db.GetCollectionId("history")
+	for i := 0; i < 25; i++ {
+		db.PutBSO(cId, fmt.Sprintf("h%02d", i), syncstorage.String("x"), nil, nil)
+	}
+
+	// asking for more than the max pages through the rest
+	var (
+		ids    []string
+		offset string
+		pages  int
+	)
+	for ; pages < 10; pages++ {
+		url := "storage/history?limit=100&sort=index"
+		if offset != "" {
+			url += "&offset=" + offset
+		}
+
+		resp := request("GET", syncurl(uid, url), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		assert.Equal("10", resp.Header().Get("X-Weave-Limit-Clamped"))
+
+		var page []string
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &page)) {
+			return
+		}
+		ids = append(ids, page...)
+
+		if offset = resp.Header().Get("X-Weave-Next-Offset"); offset == "" {
+			break
+		}
+	}
+
+	assert.Equal(2, pages)
+	assert.Len(ids, 25)
+
+	// limits within the max and the default are not marked
+	for _, url := range []string{"storage/history?limit=5", "storage/history"} {
+		resp := request("GET", syncurl(uid, url), nil, handler)
+		assert.Equal("", resp.Header().Get("X-Weave-Limit-Clamped"), url)
+		assert.NotEqual("", resp.Header().Get("X-Weave-Next-Offset"), url)
+	}
+}
+
+func TestSyncUserHandlerKeysetPaging(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", &syncstorage.Config{TombstoneTTL: 60000})
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxPagingRecords = 15
+	handler := NewSyncUserHandler(uid, db, config)
+
+	cId, _ := db.GetCollectionId("history")
+	for i := 0; i < 27; i++ {
+		db.PutBSO(cId, fmt.Sprintf("h%02d", i), syncstorage.String("x"), nil, nil)
+	}
+
+	resp := request("DELETE", syncurl(uid, "storage/history?ids=h25,h26"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	var (
+		ids     []string
+		deleted int
+		cursor  string
+		pages   int
+	)
+	for ; pages < 10; pages++ {
+		resp = request("GET", syncurl(uid, "storage/history?limit=10&sort=oldest&include_deleted=1&after="+cursor), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+		assert.Equal("25", resp.Header().Get("X-Weave-Records"))
+
+		var page []map[string]interface{}
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &page)) {
+			return
+		}
+		for _, record := range page {
+			if record["deleted"] == true {
+				deleted++
+			} else {
+				ids = append(ids, record["id"].(string))
+			}
+		}
+
+		if cursor = resp.Header().Get("X-Weave-Next-Cursor"); cursor == "" {
+			break
+		}
+	}
+
+	// tombstones are only on the first page and paging stops at
+	// MaxPagingRecords
+	assert.Equal(1, pages)
+	assert.Equal(2, deleted)
+	assert.Len(ids, 15)
+	assert.Equal("h00", ids[0])
+	assert.Equal("h14", ids[14])
+	assert.Equal("15", resp.Header().Get("X-Weave-Paging-Limit"))
+
+	for _, query := range []string{
+		"after=&sort=index",
+		"after=&sort=newest&offset=10",
+		"after=nope&sort=newest",
+	} {
+		resp := request("GET", syncurl(uid, "storage/history?"+query), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, query)
+	}
+}
+
+func TestSyncUserHandlerMultiCollectionGET(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MultiCollectionGET = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	collections := []string{"bookmarks", "history", "mycoll"}
+	for _, cName := range collections {
+		body := bytes.NewBufferString(`[
+			{"id":"bso0", "payload": "` + cName + `0"},
+			{"id":"bso1", "payload": "` + cName + `1"}
+		]`)
+		resp := requestheaders("POST", syncurl(uid, "storage/"+cName), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+	}
+
+	resp := request("GET", syncurl(uid, "storage?full=1&collections=bookmarks,history,mycoll,nope"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	assert.Equal("6", resp.Header().Get("X-Weave-Records"))
+
+	var multi map[string][]map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &multi); !assert.NoError(err) {
+		return
+	}
+
+	assert.Len(multi["nope"], 0)
+	for _, cName := range collections {
+		resp := request("GET", syncurl(uid, "storage/"+cName+"?full=1"), nil, handler)
+		var single []map[string]interface{}
+		if err := json.Unmarshal(resp.Body.Bytes(), &single); !assert.NoError(err) {
+			return
+		}
+
+		assert.Len(single, 2)
+		assert.Equal(single, multi[cName])
+	}
+
+	{ // paging is per collection
+		resp := request("GET", syncurl(uid, "storage?collections=bookmarks&offset=1"), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+	}
+
+	{ // opt in
+		handler := NewSyncUserHandler(uid, db, nil)
+		resp := request("GET", syncurl(uid, "storage?collections=bookmarks"), nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestSyncUserHandlerMultiCollectionPOST(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MultiCollectionPOST = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	type results struct {
+		Modified float64
+		Success  []string
+		Failed   map[string][]string
+	}
+
+	body := bytes.NewBufferString(`{
+		"bookmarks": [{"id":"bso0", "payload": "b0"}, {"id":"bso1", "payload": "b1"}],
+		"history":   [{"id":"bso0", "payload": "h0"}, {"id":"bso1", "payload": 1}],
+		"mycoll":    [{"id":"bso0", "payload": "m0"}]
+	}`)
+	resp := requestheaders("POST", syncurl(uid, "storage"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var posted map[string]results
+	if err := json.Unmarshal(resp.Body.Bytes(), &posted); !assert.NoError(err) {
+		return
+	}
+	lastModified := resp.Header().Get("X-Last-Modified")
+
+	assert.Equal([]string{"bso0", "bso1"}, posted["bookmarks"].Success)
+	assert.Equal([]string{"bso0"}, posted["history"].Success)
+	assert.Contains(posted["history"].Failed, "bso1")
+	assert.Equal([]string{"bso0"}, posted["mycoll"].Success)
+
+	// the collections have the modified times in the results and
+	// X-Last-Modified is the newest of them
+	resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+	var info map[string]float64
+	if err := json.Unmarshal(resp.Body.Bytes(), &info); !assert.NoError(err) {
+		return
+	}
+
+	newest := 0.0
+	for _, cName := range []string{"bookmarks", "history", "mycoll"} {
+		assert.Equal(info[cName], posted[cName].Modified, cName)
+		if info[cName] > newest {
+			newest = info[cName]
+		}
+
+		resp := request("GET", syncurl(uid, "storage/"+cName+"/bso0"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+	assert.Equal(fmt.Sprintf("%.2f", newest), lastModified)
+
+	{ // X-If-Unmodified-Since checks all the collections
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		header.Set("X-If-Unmodified-Since", "1.00")
+		body := bytes.NewBufferString(`{"bookmarks": [{"id":"bso2", "payload": "x"}]}`)
+		resp := requestheaders("POST", syncurl(uid, "storage"), body, header, handler)
+		assert.Equal(http.StatusPreconditionFailed, resp.Code)
+	}
+
+	{ // nothing is written when a collection is invalid
+		body := bytes.NewBufferString(`{
+			"bookmarks": [{"id":"bso3", "payload": "x"}],
+			"bad name":  [{"id":"bso0", "payload": "x"}]
+		}`)
+		resp := requestheaders("POST", syncurl(uid, "storage"), body, header, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+
+		cId, _ := db.GetCollectionId("bookmarks")
+		_, err := db.GetBSO(cId, "bso3")
+		assert.Equal(syncstorage.ErrNotFound, err)
+	}
+
+	{ // opt in
+		handler := NewSyncUserHandler(uid, db, nil)
+		body := bytes.NewBufferString(`{"bookmarks": [{"id":"bso2", "payload": "x"}]}`)
+		resp := requestheaders("POST", syncurl(uid, "storage"), body, header, handler)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestSyncUserHandlerIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.IdempotencyTTL = 60
+	config.IdempotencyKeys = 2
+
+	sink := &recordingSink{}
+	config.Changes = sink
+	handler := NewSyncUserHandler(uid, db, config)
+
+	post := func(key, path string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		header.Set("Idempotency-Key", key)
+		body := bytes.NewBufferString(`[{"id":"bso0", "payload": "x"}]`)
+		return requestheaders("POST", syncurl(uid, path), body, header, handler)
+	}
+
+	first := post("key0", "storage/bookmarks")
+	if !assert.Equal(http.StatusOK, first.Code) {
+		return
+	}
+	assert.Len(sink.changes, 1)
+
+	retry := post("key0", "storage/bookmarks")
+	if assert.Equal(http.StatusOK, retry.Code) {
+		assert.Equal(first.Body.String(), retry.Body.String())
+		assert.Equal(first.Header().Get("X-Last-Modified"), retry.Header().Get("X-Last-Modified"))
+		assert.Equal("true", retry.Header().Get("Idempotent-Replayed"))
+	}
+
+	// not written again
+	assert.Len(sink.changes, 1)
+	cId, _ := db.GetCollectionId("bookmarks")
+	modified, _ := db.GetCollectionModified(cId)
+	assert.Equal(first.Header().Get("X-Last-Modified"), syncstorage.ModifiedToString(modified))
+
+	// the key belongs to the first request
+	assert.Equal(http.StatusUnprocessableEntity, post("key0", "storage/history").Code)
+
+	// other keys and requests without one are processed
+	assert.Equal(http.StatusOK, post("key1", "storage/bookmarks").Code)
+	assert.Len(sink.changes, 2)
+	assert.Equal(http.StatusOK, post("", "storage/bookmarks").Code)
+	assert.Len(sink.changes, 3)
+
+	// only IdempotencyKeys responses are kept
+	assert.Equal(http.StatusOK, post("key2", "storage/bookmarks").Code)
+	assert.Len(sink.changes, 4)
+	resp := post("key0", "storage/bookmarks")
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Header().Get("Idempotent-Replayed"))
+	assert.Len(sink.changes, 5)
+}
+
+func TestSyncUserHandlerMissingCollectionNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	{ // an empty list by default
+		handler := NewSyncUserHandler(uid, db, nil)
+		for _, cName := range []string{"nope", "bookmarks"} {
+			resp := request("GET", syncurl(uid, "storage/"+cName), nil, handler)
+			if assert.Equal(http.StatusOK, resp.Code, cName) {
+				assert.JSONEq("[]", resp.Body.String(), cName)
+			}
+		}
+	}
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MissingCollectionNotFound = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	// unknown collections and ones that were never written
+	for _, cName := range []string{"nope", "bookmarks"} {
+		resp := request("GET", syncurl(uid, "storage/"+cName), nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code, cName)
+	}
+
+	body := bytes.NewBufferString(`[{"id":"bso0", "payload": "x"}]`)
+	resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// synced but empty
+	resp = request("DELETE", syncurl(uid, "storage/bookmarks"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.JSONEq("[]", resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerDefaultSort(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	// write delays guarantee each gets a newer modified timestamp
+	writer := NewSyncUserHandler(uid, db, nil)
+	for _, bId := range []string{"bso0", "bso1", "bso2"} {
+		body := bytes.NewBufferString(`{"payload": "x"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/col/"+bId), body, header, writer)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+	}
+
+	get := func(handler http.Handler, path string) (ids []string) {
+		resp := request("GET", syncurl(uid, path), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids))
+		}
+		return
+	}
+
+	assert.Equal([]string{"bso2", "bso1", "bso0"}, get(writer, "storage/col"))
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.DefaultSort = syncstorage.SORT_OLDEST
+	handler := NewSyncUserHandler(uid, db, config)
+
+	assert.Equal([]string{"bso0", "bso1", "bso2"}, get(handler, "storage/col"))
+	assert.Equal([]string{"bso2", "bso1", "bso0"}, get(handler, "storage/col?sort=newest"))
+}
+
+func TestSyncUserHandlerDefaultAccept(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	writer := NewSyncUserHandler(uid, db, nil)
+	for _, bId := range []string{"bso0", "bso1"} {
+		body := bytes.NewBufferString(`{"payload": "x"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/col/"+bId), body, header, writer)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+	}
+
+	get := func(handler http.Handler) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", syncurl(uid, "storage/col?sort=oldest"), nil)
+		return sendrequest(req, handler)
+	}
+
+	// json out of the box
+	resp := get(writer)
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+	assert.Equal("[\"bso0\",\"bso1\"]", strings.TrimSpace(resp.Body.String()))
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.DefaultAccept = "application/newlines"
+	handler := NewSyncUserHandler(uid, db, config)
+
+	resp = get(handler)
+	assert.Equal("application/newlines", resp.Header().Get("Content-Type"))
+	assert.Equal("\"bso0\"\n\"bso1\"\n", resp.Body.String())
+
+	// an Accept header is still used
+	header = make(http.Header)
+	header.Set("Accept", "application/json")
+	resp = requestheaders("GET", syncurl(uid, "storage/col"), nil, header, handler)
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+}
+
+func TestSyncUserHandlerCollectionGETIfModifiedSince(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	modified, _ := db.PutBSO(cId, "bso0", syncstorage.String("x"), nil, nil)
+	ts := syncstorage.ModifiedToString(modified)
+
+	get := func(collection, since string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("X-If-Modified-Since", since)
+		return requestheaders("GET", syncurl(uid, "storage/"+collection), nil, header, handler)
+	}
+
+	resp := get("bookmarks", ts)
+	assert.Equal(http.StatusNotModified, resp.Code)
+	assert.Equal(ts, resp.Header().Get("X-Last-Modified"))
+
+	resp = get("bookmarks", syncstorage.ModifiedToString(modified-10))
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal(ts, resp.Header().Get("X-Last-Modified"))
+		assert.Equal(`["bso0"]`, strings.TrimSpace(resp.Body.String()))
+	}
+
+	resp = get("bookmarks", "yesterday")
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	// missing collections are still an empty list
+	resp = get("nope", ts)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		assert.Equal("[]", resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerWildcardAccept(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	// wildcards get JSON
+	for _, accept := range []string{"*/*", "application/*", "text/html, */*;q=0.8"} {
+		header := make(http.Header)
+		header.Set("Accept", accept)
+		resp := requestheaders("GET", syncurl(uid, "info/collections"), nil, header, handler)
+		if assert.Equal(http.StatusOK, resp.Code, accept) {
+			assert.Equal("application/json", resp.Header().Get("Content-Type"), accept)
+		}
+	}
+
+	header := make(http.Header)
+	header.Set("Accept", "text/html")
+	resp := requestheaders("GET", syncurl(uid, "info/collections"), nil, header, handler)
+	assert.Equal(http.StatusNotAcceptable, resp.Code)
+}
+
+func TestSyncUserHandlerGeneration(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	steps := []struct {
+		method, path, body string
+		generation         string
+	}{
+		{"GET", "info/collections", "", "0"},
+		{"PUT", "storage/col/bso0", `{"payload": "x"}`, "1"},
+		{"GET", "info/collections", "", "1"},
+		{"GET", "storage/col/bso0", "", "1"},
+		{"GET", "storage/col/missing", "", "1"},
+		{"POST", "storage/col", `[{"id": "bso1", "payload": "x"}]`, "2"},
+		{"PUT", "storage/other/bso0", `{"payload": "x"}`, "3"},
+		{"DELETE", "storage/col?ids=bso1", "", "4"},
+		{"DELETE", "storage/other", "", "5"},
+		{"GET", "storage/col", "", "5"},
+		{"DELETE", "storage", "", "6"},
+		{"GET", "info/collections", "", "6"},
+	}
+
+	for _, step := range steps {
+		var body io.Reader
+		if step.body != "" {
+			body = bytes.NewBufferString(step.body)
+		}
+		resp := requestheaders(step.method, syncurl(uid, step.path), body, header, handler)
+		assert.Equal(step.generation, resp.Header().Get("X-Weave-Generation"), step.method+" "+step.path)
+	}
+}
+
+func TestSyncUserHandlerPreviousModified(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.PreviousModifiedHeader = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	url := syncurl(uid, "storage/col/bso0")
+	put := func(payload, unmodifiedSince string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		if unmodifiedSince != "" {
+			header.Set("X-If-Unmodified-Since", unmodifiedSince)
+		}
+		return requestheaders("PUT", url, bytes.NewBufferString(`{"payload": "`+payload+`"}`), header, handler)
+	}
+
+	// nothing to overwrite
+	resp := put("first", "")
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	assert.Equal("", resp.Header().Get("X-Weave-Previous-Modified"))
+	first := resp.Header().Get("X-Last-Modified")
+
+	// another client writes without seeing the first
+	resp = put("second", "")
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(first, resp.Header().Get("X-Weave-Previous-Modified"))
+	second := resp.Header().Get("X-Last-Modified")
+
+	// the precondition stops a client overwriting a write it has not seen
+	resp = put("third", first)
+	assert.Equal(http.StatusPreconditionFailed, resp.Code)
+	assert.Equal(second, resp.Header().Get("X-Last-Modified"))
+
+	resp = request("GET", url, nil, handler)
+	assert.Contains(resp.Body.String(), `"payload":"second"`)
+
+	resp = put("third", second)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(second, resp.Header().Get("X-Weave-Previous-Modified"))
+
+	// off by default
+	resp = requestheaders("PUT", url, bytes.NewBufferString(`{"payload": "x"}`),
+		http.Header{"Content-Type": {"application/json"}}, NewSyncUserHandler(uid, db, nil))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Header().Get("X-Weave-Previous-Modified"))
+}
+
+func TestSyncUserHandlerCompoundSort(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	// written oldest to newest
+	for _, put := range []struct{ bId, body string }{
+		{"bso0", `{"payload": "x", "sortindex": 1}`},
+		{"bso1", `{"payload": "x", "sortindex": 2}`},
+		{"bso2", `{"payload": "x", "sortindex": 1}`},
+		{"bso3", `{"payload": "x", "sortindex": 2}`},
+	} {
+		resp := requestheaders("PUT", syncurl(uid, "storage/col/"+put.bId), bytes.NewBufferString(put.body), header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+	}
+
+	for sort, expected := range map[string][]string{
+		"index,newest": {"bso3", "bso1", "bso2", "bso0"},
+		"index,oldest": {"bso1", "bso3", "bso0", "bso2"},
+		"newest,index": {"bso3", "bso2", "bso1", "bso0"},
+		"oldest":       {"bso0", "bso1", "bso2", "bso3"},
+	} {
+		resp := request("GET", syncurl(uid, "storage/col?sort="+sort), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code, sort) {
+			var ids []string
+			assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids))
+			assert.Equal(expected, ids, sort)
+		}
+	}
+
+	for _, sort := range []string{"newest,oldest", "index,index", "index,", "index,bad"} {
+		resp := request("GET", syncurl(uid, "storage/col?sort="+sort), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, sort)
+	}
+}
+
+func TestSyncUserHandlerWeaveBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	// multi-byte characters count as more than one byte
+	payloads := []string{"a", "bb", "ccc", "éé"}
+	body := bytes.NewBufferString(`[
+		{"id":"bso0", "payload": "a"},
+		{"id":"bso1", "payload": "bb"},
+		{"id":"bso2", "payload": "ccc"},
+		{"id":"bso3", "payload": "éé"}
+	]`)
+	resp := requestheaders("POST", syncurl(uid, "storage/col"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	total := 0
+	for _, p := range payloads {
+		total += len(p)
+	}
+
+	resp = request("GET", syncurl(uid, "storage/col?full=1"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	var bsos []struct{ Payload string }
+	if err := json.Unmarshal(resp.Body.Bytes(), &bsos); !assert.NoError(err) {
+		return
+	}
+
+	bodyBytes := 0
+	for _, b := range bsos {
+		bodyBytes += len(b.Payload)
+	}
+	assert.Equal(total, bodyBytes)
+	assert.Equal(strconv.Itoa(total), resp.Header().Get("X-Weave-Bytes"))
+
+	// counts all matching records, not just the page
+	resp = request("GET", syncurl(uid, "storage/col?full=1&limit=1"), nil, handler)
+	assert.Equal(strconv.Itoa(total), resp.Header().Get("X-Weave-Bytes"))
+
+	// only for full GETs
+	resp = request("GET", syncurl(uid, "storage/col"), nil, handler)
+	assert.Equal("", resp.Header().Get("X-Weave-Bytes"))
+}
+
+func TestSyncUserHandlerMinTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	setup := func(reject bool) (string, *syncstorage.DB, *SyncUserHandler) {
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		config := NewDefaultSyncUserHandlerConfig()
+		config.MinTTLs = map[string]int{"tabs": 3600}
+		config.MinTTLReject = reject
+		return uid, db, NewSyncUserHandler(uid, db, config)
+	}
+
+	// ttl returns the TTL a BSO was stored with in seconds
+	ttl := func(db *syncstorage.DB, cName, bId string) int {
+		cId, _ := db.GetCollectionId(cName)
+		bso, err := db.GetBSO(cId, bId)
+		if !assert.NoError(err) {
+			return 0
+		}
+		return (bso.TTL - bso.Modified) / 1000
+	}
+
+	{ // clamp up
+		uid, db, handler := setup(false)
+
+		body := bytes.NewBufferString(`[
+			{"id":"short", "payload": "x", "ttl": 60},
+			{"id":"long", "payload": "x", "ttl": 7200}
+		]`)
+		resp := requestheaders("POST", syncurl(uid, "storage/tabs"), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		assert.Equal(3600, ttl(db, "tabs", "short"))
+		assert.Equal(7200, ttl(db, "tabs", "long"))
+
+		body = bytes.NewBufferString(`{"payload": "x", "ttl": 60}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/tabs/put"), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		assert.Equal(3600, ttl(db, "tabs", "put"))
+
+		// other collections are not affected
+		body = bytes.NewBufferString(`{"payload": "x", "ttl": 60}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/forms/put"), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		assert.Equal(60, ttl(db, "forms", "put"))
+	}
+
+	{ // reject
+		uid, db, handler := setup(true)
+
+		body := bytes.NewBufferString(`[
+			{"id":"short", "payload": "x", "ttl": 60},
+			{"id":"long", "payload": "x", "ttl": 7200},
+			{"id":"none", "payload": "x"}
+		]`)
+		resp := requestheaders("POST", syncurl(uid, "storage/tabs"), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+		assert.Equal([]string{"long", "none"}, results.Success)
+		assert.Contains(results.Failed, "short")
+
+		body = bytes.NewBufferString(`{"payload": "x", "ttl": 60}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/tabs/put"), body, header, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+
+		cId, _ := db.GetCollectionId("tabs")
+		_, err := db.GetBSO(cId, "put")
+		assert.Equal(syncstorage.ErrNotFound, err)
+	}
+}
+
+func TestSyncUserHandlerCollectionLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxRecordPayloadBytes = 10
+	config.CollectionLimits = map[string]CollectionLimits{
+		"history": {MaxRecordPayloadBytes: 5, MaxPOSTRecords: 1, MaxBSOGetLimit: 1, DefaultTTL: 60, MaxTTL: 120},
+		"crypto":  {MaxRecordPayloadBytes: 20},
+	}
+	handler := NewSyncUserHandler(uid, db, config)
+
+	ttl := func(cName, bId string) int {
+		cId, _ := db.GetCollectionId(cName)
+		bso, err := db.GetBSO(cId, bId)
+		if !assert.NoError(err) {
+			return 0
+		}
+		return (bso.TTL - bso.Modified) / 1000
+	}
+
+	{ // the payload limit of a collection overrides the global one
+		body := bytes.NewBufferString(`{"payload": "1234567"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/history/b0"), body, header, handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+
+		body = bytes.NewBufferString(`{"payload": "123456789012345"}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/crypto/b0"), body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		// other collections use the global limit
+		body = bytes.NewBufferString(`{"payload": "1234567"}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/bookmarks/b0"), body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		body = bytes.NewBufferString(`{"payload": "123456789012345"}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/bookmarks/b1"), body, header, handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // default and max TTL
+		body := bytes.NewBufferString(`{"payload": "x"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/history/b1"), body, header, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			assert.Equal(60, ttl("history", "b1"))
+		}
+
+		body = bytes.NewBufferString(`{"payload": "x", "ttl": 3600}`)
+		resp = requestheaders("PUT", syncurl(uid, "storage/history/b2"), body, header, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			assert.Equal(120, ttl("history", "b2"))
+		}
+
+		body = bytes.NewBufferString(`[{"id":"b3", "payload": "x", "ttl": 3600}]`)
+		resp = requestheaders("POST", syncurl(uid, "storage/history"), body, header, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			assert.Equal(120, ttl("history", "b3"))
+		}
+	}
+
+	{ // records per POST and GET
+		body := bytes.NewBufferString(`[{"id":"b4", "payload": "x"}, {"id":"b5", "payload": "x"}]`)
+		resp := requestheaders("POST", syncurl(uid, "storage/history"), body, header, handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+
+		resp = request("GET", syncurl(uid, "storage/history"), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			var ids []string
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids)) {
+				assert.Len(ids, 1)
+			}
+			assert.NotEqual("", resp.Header().Get("X-Weave-Next-Offset"))
+		}
+	}
+}
+
+func TestSyncUserHandlerRequireSortIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.RequireSortIndex = []string{"bookmarks"}
+	handler := NewSyncUserHandler(uid, db, config)
+
+	body := `[{"id":"with", "payload": "x", "sortindex": 1}, {"id":"without", "payload": "x"}]`
+
+	// like other invalid BSOs a batch is not started when there are any
+	for url, success := range map[string][]string{
+		"storage/bookmarks":                        {"with"},
+		"storage/bookmarks?batch=true&commit=true": {},
+	} {
+		resp := jsonrequest("POST", syncurl(uid, url), strings.NewReader(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, url) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+		assert.Equal(success, results.Success, url)
+		assert.Contains(results.Failed, "without", url)
+	}
+
+	resp := jsonrequest("PUT", syncurl(uid, "storage/bookmarks/put"), strings.NewReader(`{"payload": "x"}`), handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Contains(resp.Body.String(), "sortindex is required")
+
+	resp = jsonrequest("PUT", syncurl(uid, "storage/bookmarks/put"), strings.NewReader(`{"payload": "x", "sortindex": 0}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// other collections are not affected
+	resp = jsonrequest("PUT", syncurl(uid, "storage/forms/put"), strings.NewReader(`{"payload": "x"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	_, err := db.GetBSO(cId, "without")
+	assert.Equal(syncstorage.ErrNotFound, err)
+}
+
+func TestSyncUserHandlerStorageChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	// returns the X-Last-Modified of the write
+	put := func(cName, bId string) string {
+		body := bytes.NewBufferString(`{"payload": "x"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/"+cName+"/"+bId), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			t.FailNow()
+		}
+		return resp.Header().Get("X-Last-Modified")
+	}
+
+	put("bookmarks", "old")
+	t1 := put("history", "t1")
+	put("bookmarks", "b0")
+	put("mycoll", "b1")
+	put("history", "b2")
+	t2 := put("bookmarks", "t2")
+	put("history", "new")
+
+	get := func(query string) (results map[string][]string) {
+		resp := request("GET", syncurl(uid, "storage?"+query), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results))
+		}
+		return
+	}
+
+	assert.Equal(map[string][]string{
+		"bookmarks": []string{"b0", "t2"},
+		"mycoll":    []string{"b1"},
+		"history":   []string{"b2"},
+	}, get("changed_since="+t1+"&changed_until="+t2))
+
+	// until defaults to now
+	assert.Equal(map[string][]string{
+		"history": []string{"new"},
+	}, get("changed_since="+t2))
+
+	// paged with limit and offset
+	resp := request("GET", syncurl(uid, "storage?limit=2&changed_since="+t1), nil, handler)
+	assert.Equal("2", resp.Header().Get("X-Weave-Next-Offset"))
+	assert.Equal(map[string][]string{
+		"history":   []string{"b2"},
+		"bookmarks": []string{"t2"},
+	}, get("limit=2&offset=2&changed_since="+t1))
+
+	resp = request("GET", syncurl(uid, "storage?limit=10&offset=4&changed_since="+t1), nil, handler)
+	assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+
+	for _, query := range []string{"changed_since=nope", "limit=0&changed_since=" + t1, "offset=-1&changed_since=" + t1} {
+		resp = request("GET", syncurl(uid, "storage?"+query), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, query)
+	}
+
+	// MaxPagingRecords bounds offsets too
+	handler.config.MaxPagingRecords = 3
+	resp = request("GET", syncurl(uid, "storage?limit=2&offset=2&changed_since="+t1), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("3", resp.Header().Get("X-Weave-Paging-Limit"))
+	assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+
+	resp = request("GET", syncurl(uid, "storage?limit=2&offset=3&changed_since="+t1), nil, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Equal(WEAVE_INVALID_WBO, resp.Body.String())
+}
+
+func TestSyncUserHandlerPUT(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	uid := "123456"
+
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	url := syncurl(uid, "storage/bookmarks/bso0")
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
 
 	{ // test basic create / update flow
 		body := bytes.NewBufferString(`{"payload": "1234"}`)
@@ -432,6 +2217,529 @@ func TestSyncUserHandlerPUT(t *testing.T) {
 
 }
 
+func TestSyncUserHandlerCollectionIdCache(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	put := func() {
+		body := bytes.NewBufferString(`{"payload": "1234"}`)
+		resp := requestheaders("PUT", syncurl(uid, "storage/mycoll/bso0"), body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	put()
+	cId, err := db.GetCollectionId("mycoll")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(cId, handler.cids["mycoll"])
+
+	resp := request("GET", syncurl(uid, "storage/mycoll/bso0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	{ // deleting the collection invalidates it
+		resp := request("DELETE", syncurl(uid, "storage/mycoll"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		_, ok := handler.cids["mycoll"]
+		assert.False(ok)
+
+		put()
+		cId, _ := db.GetCollectionId("mycoll")
+		assert.Equal(cId, handler.cids["mycoll"])
+	}
+
+	{ // so does deleting everything
+		resp := request("DELETE", syncurl(uid, "storage"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Len(handler.cids, 0)
+	}
+}
+
+func TestSyncUserHandlerPATCH(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.RequireSortIndex = []string{"bookmarks"}
+	handler := NewSyncUserHandler(uid, db, config)
+	url := syncurl(uid, "storage/bookmarks/b0")
+
+	resp := jsonrequest("PUT", url, strings.NewReader(`{"payload":"x","sortindex":1,"ttl":3600}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	created := resp.Header().Get("X-Last-Modified")
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	before, _ := db.GetBSO(cId, "b0")
+
+	// only the sortindex changes
+	resp = jsonrequest("PATCH", url, strings.NewReader(`{"sortindex":5}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	modified := resp.Header().Get("X-Last-Modified")
+	assert.NotEqual(created, modified)
+
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("x", bso.Payload)
+		assert.Equal(5, bso.SortIndex)
+		assert.Equal(before.TTL, bso.TTL)
+		assert.Equal(modified, syncstorage.ModifiedToString(bso.Modified))
+	}
+
+	// PATCH never creates
+	resp = jsonrequest("PATCH", syncurl(uid, "storage/bookmarks/nope"), strings.NewReader(`{"sortindex":5}`), handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+	_, err = db.GetBSO(cId, "nope")
+	assert.Equal(syncstorage.ErrNotFound, err)
+
+	resp = jsonrequest("PATCH", url, strings.NewReader(`{}`), handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+}
+
+func TestSyncUserHandlerPUTIfNoneMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	url := syncurl(uid, "storage/bookmarks/bso0")
+
+	put := func(payload string, createOnly bool) int {
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		if createOnly {
+			header.Set("If-None-Match", "*")
+		}
+
+		body := bytes.NewBufferString(`{"payload": "` + payload + `"}`)
+		return requestheaders("PUT", url, body, header, handler).Code
+	}
+
+	payload := func() string {
+		cId, _ := db.GetCollectionId("bookmarks")
+		bso, err := db.GetBSO(cId, "bso0")
+		if !assert.NoError(err) {
+			return ""
+		}
+		return bso.Payload
+	}
+
+	// create new
+	assert.Equal(http.StatusOK, put("1", true))
+	assert.Equal("1", payload())
+
+	// create existing
+	assert.Equal(http.StatusPreconditionFailed, put("2", true))
+	assert.Equal("1", payload())
+
+	// no header is a normal upsert
+	assert.Equal(http.StatusOK, put("3", false))
+	assert.Equal("3", payload())
+}
+
+func TestSyncUserHandlerPayloadHashMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "payloadhash")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	uid := uniqueUID()
+	dbFile := filepath.Join(dir, "test.db")
+	db, err := syncstorage.NewDB(dbFile, &syncstorage.Config{PayloadHash: true})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	metrics := &recordingMetrics{}
+	config := NewDefaultSyncUserHandlerConfig()
+	config.Metrics = metrics
+	handler := NewSyncUserHandler(uid, db, config)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	if _, err := db.PutBSO(cId, "bso0", syncstorage.String("original"), nil, nil); !assert.NoError(err) {
+		return
+	}
+
+	resp := request("GET", syncurl(uid, "storage/bookmarks/bso0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// corrupt the payload behind the DB's back
+	raw, err := sql.Open("sqlite3", dbFile)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = raw.Exec("UPDATE BSO SET Payload='corrupted'")
+	raw.Close()
+	if !assert.NoError(err) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks/bso0"), nil, handler)
+	assert.Equal(http.StatusInternalServerError, resp.Code)
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks?full=1"), nil, handler)
+	assert.Equal(http.StatusInternalServerError, resp.Code)
+
+	assert.Equal([]string{
+		"storage.quarantine|reason:payload_hash",
+		"storage.quarantine|reason:payload_hash",
+	}, metrics.counts)
+}
+
+func TestSyncUserHandlerBSOGone(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", &syncstorage.Config{TombstoneTTL: 100})
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	body := bytes.NewBufferString(`{"payload": "x"}`)
+	resp := requestheaders("PUT", syncurl(uid, "storage/bookmarks/bso0"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage/bookmarks/bso0"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	// never existed
+	resp = request("GET", syncurl(uid, "storage/bookmarks/nope"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// recently deleted
+	resp = request("GET", syncurl(uid, "storage/bookmarks/bso0"), nil, handler)
+	assert.Equal(http.StatusGone, resp.Code)
+
+	// long gone
+	time.Sleep(110 * time.Millisecond)
+	resp = request("GET", syncurl(uid, "storage/bookmarks/bso0"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+}
+
+func TestSyncUserHandlerIncludeDeleted(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", &syncstorage.Config{TombstoneTTL: 60000})
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "bso0", syncstorage.String("x"), nil, nil)
+	modified, _ := db.PutBSO(cId, "bso1", syncstorage.String("x"), nil, nil)
+
+	// a client synced up to here
+	since := syncstorage.ModifiedToString(modified)
+	time.Sleep(10 * time.Millisecond)
+
+	resp := request("DELETE", syncurl(uid, "storage/bookmarks?ids=bso0"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	deleted, _ := db.GetCollectionModified(cId)
+
+	// deletes are invisible without include_deleted
+	resp = request("GET", syncurl(uid, "storage/bookmarks?newer="+since), nil, handler)
+	assert.Equal("[]\n", resp.Body.String())
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks?include_deleted=1&newer="+since), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(`[{"id":"bso0","modified":`+syncstorage.ModifiedToString(deleted)+`,"deleted":true}]`+"\n",
+		resp.Body.String())
+
+	// live BSOs are objects too so they can be told apart
+	resp = request("GET", syncurl(uid, "storage/bookmarks?include_deleted=1"), nil, handler)
+	assert.Equal(`[{"id":"bso0","modified":`+syncstorage.ModifiedToString(deleted)+`,"deleted":true},{"id":"bso1"}]`+"\n",
+		resp.Body.String())
+
+	// deleting the collection is seen by clients checking if it changed
+	time.Sleep(10 * time.Millisecond)
+	db.PutBSO(cId, "bso2", syncstorage.String("x"), nil, nil)
+	before, _ := db.GetCollectionModified(cId)
+	time.Sleep(10 * time.Millisecond)
+	resp = request("DELETE", syncurl(uid, "storage/bookmarks"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+	deleted, _ = db.GetCollectionModified(cId)
+	assert.Equal(`{"modified":`+syncstorage.ModifiedToString(deleted)+`}`, resp.Body.String())
+
+	header := make(http.Header)
+	header.Set("X-If-Modified-Since", syncstorage.ModifiedToString(before))
+	resp = requestheaders("GET", syncurl(uid, "storage/bookmarks?include_deleted=1&newer="+syncstorage.ModifiedToString(before)), nil, header, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Contains(resp.Body.String(), `{"id":"bso2","modified":`+syncstorage.ModifiedToString(deleted)+`,"deleted":true}`)
+	db.PutBSO(cId, "bso1", syncstorage.String("x"), nil, nil)
+
+	// deleting everything leaves a tombstone for every BSO
+	time.Sleep(10 * time.Millisecond)
+	resp = request("DELETE", syncurl(uid, "storage"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks?include_deleted=1&newer="+syncstorage.ModifiedToString(deleted)), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Regexp(`^\[\{"id":"bso1","modified":[0-9.]+,"deleted":true\}\]\n$`, resp.Body.String())
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks/bso1"), nil, handler)
+	assert.Equal(http.StatusGone, resp.Code)
+}
+
+func TestSyncUserHandlerAPIVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	apiRoutes["2.0"] = func(s *SyncUserHandler, r *mux.Router, prefix string) {
+		r.HandleFunc(prefix+"/hello", func(w http.ResponseWriter, r *http.Request) {
+			OKResponse(w, "v2")
+		}).Methods("GET")
+	}
+	defer delete(apiRoutes, "2.0")
+
+	assert.Equal([]string{"1.5", "2.0"}, apiVersions())
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := request("GET", "http://test/2.0/"+uid+"/hello", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("v2", resp.Body.String())
+
+	resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// the 1.5 routes are not available under 2.0
+	resp = request("GET", "http://test/2.0/"+uid+"/info/collections", nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+}
+
+func TestSyncUserHandlerQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxUserBytes = 100
+	handler := NewSyncUserHandler(uid, db, config)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "used", syncstorage.String(strings.Repeat("x", 60)), nil, nil)
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+
+	tooBig := `[{"id":"bso0", "payload":"` + strings.Repeat("x", 50) + `"}]`
+
+	{ // early, rejected from the Content-Length without reading the body
+		body := bytes.NewBufferString(tooBig)
+		resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+		assert.Equal(len(tooBig), body.Len(), "body should not be read")
+	}
+
+	{ // late, no Content-Length so the parsed payloads are checked
+		body := bytes.NewBufferString(tooBig)
+		resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), ioutil.NopCloser(body), header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+		assert.Equal(0, body.Len())
+	}
+
+	{ // late, batches are checked too
+		body := ioutil.NopCloser(bytes.NewBufferString(tooBig))
+		resp := requestheaders("POST", syncurl(uid, "storage/bookmarks?batch=true"), body, header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+	}
+
+	{ // single BSO writes
+		bso := `{"payload":"` + strings.Repeat("x", 50) + `"}`
+		resp := requestheaders("PUT", syncurl(uid, "storage/bookmarks/bso0"), bytes.NewBufferString(bso), header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+
+		resp = requestheaders("PATCH", syncurl(uid, "storage/bookmarks/used"), bytes.NewBufferString(bso), header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	}
+
+	{ // batches built from appends that each fit are checked as a whole on commit
+		post := func(url, id string) *httptest.ResponseRecorder {
+			body := ioutil.NopCloser(bytes.NewBufferString(`[{"id":"` + id + `", "payload":"` + strings.Repeat("x", 20) + `"}]`))
+			return requestheaders("POST", url, body, header, handler)
+		}
+
+		resp := post(syncurl(uid, "storage/bookmarks?batch=true"), "a0")
+		if !assert.Equal(http.StatusAccepted, resp.Code) {
+			return
+		}
+		var results PostResults
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			return
+		}
+
+		resp = post(syncurl(uid, "storage/bookmarks?batch="+results.Batch), "a1")
+		assert.Equal(http.StatusAccepted, resp.Code)
+
+		resp = post(syncurl(uid, "storage/bookmarks?commit=true&batch="+results.Batch), "a2")
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+
+		_, err := db.GetBSO(cId, "a0")
+		assert.Equal(syncstorage.ErrNotFound, err)
+	}
+
+	{ // fits in the remaining quota
+		body := bytes.NewBufferString(`[{"id":"bso0", "payload":"` + strings.Repeat("x", 10) + `"}]`)
+		resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+}
+
+func TestSyncUserHandlerUsageExclude(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxUserBytes = 2048
+	config.UsageExclude = []string{"history"}
+	handler := NewSyncUserHandler(uid, db, config)
+
+	bId, _ := db.GetCollectionId("bookmarks")
+	hId, _ := db.GetCollectionId("history")
+	db.PutBSO(bId, "b0", syncstorage.String(strings.Repeat("x", 1024)), nil, nil)
+	db.PutBSO(hId, "h0", syncstorage.String(strings.Repeat("x", 4096)), nil, nil)
+
+	{ // excluded collection is not reported
+		resp := request("GET", syncurl(uid, "info/collection_usage"), nil, handler)
+		if assert.Equal(http.StatusOK, resp.Code) {
+			results := make(map[string]float64)
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+				assert.Equal(map[string]float64{"bookmarks": 1}, results)
+			}
+		}
+
+		resp = request("GET", syncurl(uid, "info/quota"), nil, handler)
+		assert.Equal("[1,2]\n", resp.Body.String())
+	}
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+	body := `[{"id":"bso1", "payload":"` + strings.Repeat("x", 512) + `"}]`
+
+	{ // the history bytes would put the user over quota if they counted
+		resp := requestheaders("POST", syncurl(uid, "storage/bookmarks"), bytes.NewBufferString(body), header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	{ // writes to the excluded collection are not limited
+		big := `[{"id":"h1", "payload":"` + strings.Repeat("x", 4096) + `"}]`
+		resp := requestheaders("POST", syncurl(uid, "storage/history"), bytes.NewBufferString(big), header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+}
+
+func TestSyncUserHandlerJSONErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	for url, code := range map[string]int{
+		syncurl(uid, "storage/bookmarks?limit=nope"): http.StatusBadRequest,
+		syncurl(uid, "not/a/route"):                  http.StatusNotFound,
+	} {
+		resp := request("GET", url, nil, handler)
+		assert.Equal(code, resp.Code, url)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"), url)
+
+		var body struct{ Err string }
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &body), url) {
+			assert.NotEmpty(body.Err, url)
+		}
+	}
+}
+
+func TestSyncUserHandlerBSONotFoundJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	db.PutBSO(cId, "bso0", syncstorage.String("x"), nil, nil)
+
+	for path, message := range map[string]string{
+		"storage/bookmarks/nope": "BSO Not Found: Not Found",
+		"storage/nocoll/bso0":    "Collection Not Found: Not Found",
+	} {
+		resp := request("GET", syncurl(uid, path), nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code, path)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"), path)
+
+		var body struct{ Err string }
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &body), path) {
+			assert.Equal(message, body.Err, path)
+		}
+	}
+}
+
+func TestSyncUserHandlerTrailingSlash(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+
+	for _, strict := range []bool{false, true} {
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		config := NewDefaultSyncUserHandlerConfig()
+		config.StrictSlash = strict
+		handler := NewSyncUserHandler(uid, db, config)
+
+		for _, path := range []string{"storage/bookmarks", "storage/bookmarks/"} {
+			expected := http.StatusOK
+			if strict && strings.HasSuffix(path, "/") {
+				expected = http.StatusNotFound
+			}
+
+			body := bytes.NewBufferString(`[{"id":"bso0", "payload":"x"}]`)
+			resp := requestheaders("POST", syncurl(uid, path), body, header, handler)
+			assert.Equal(expected, resp.Code, "POST %s strict:%v", path, strict)
+
+			resp = request("GET", syncurl(uid, path), nil, handler)
+			assert.Equal(expected, resp.Code, "GET %s strict:%v", path, strict)
+			if expected == http.StatusOK {
+				assert.Equal(`["bso0"]`+"\n", resp.Body.String())
+			}
+		}
+	}
+}
+
 func TestSyncUserHandlerTidyUp(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// TLSVersions maps the accepted TLS_MIN_VERSION values to tls versions
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// forward secret AEAD ciphers only. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// is required by HTTP/2
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// NewTLSConfig loads a certificate and key and returns a tls.Config for
+// http.Server that negotiates HTTP/2 with clients that support it
+func NewTLSConfig(certFile, keyFile, minVersion string) (*tls.Config, error) {
+	version, ok := TLSVersions[minVersion]
+	if !ok {
+		return nil, errors.Errorf("Unsupported TLS version %q", minVersion)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not load TLS certificate")
+	}
+
+	return &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               version,
+		CipherSuites:             tlsCipherSuites,
+		PreferServerCipherSuites: true,
+
+		// http.Server sets up HTTP/2 when h2 is offered
+		NextProtos: []string{"h2", "http/1.1"},
+	}, nil
+}
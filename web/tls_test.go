@@ -0,0 +1,115 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert creates a self signed certificate and key for 127.0.0.1
+func writeTestCert(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "tls")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := writeTestCert(dir)
+	if !assert.NoError(err) {
+		return
+	}
+
+	{ // bad settings
+		_, err := NewTLSConfig(certFile, keyFile, "0.9")
+		assert.Error(err)
+		_, err = NewTLSConfig(filepath.Join(dir, "nope.pem"), keyFile, "1.2")
+		assert.Error(err)
+	}
+
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, "1.2")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(tlsConfig.Certificates, 1)
+	assert.Equal(uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	// serve it the way httpdown does
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	server := &http.Server{Handler: EchoHandler, TLSConfig: tlsConfig}
+	go server.Serve(tls.NewListener(l, tlsConfig))
+	defer l.Close()
+
+	{ // HTTP/2 is negotiated
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+		if assert.NoError(err) {
+			assert.Equal("h2", conn.ConnectionState().NegotiatedProtocol)
+			conn.Close()
+		}
+	}
+
+	{ // older versions are refused
+		_, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS11,
+		})
+		assert.Error(err)
+	}
+}
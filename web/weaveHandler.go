@@ -41,6 +41,15 @@ func WeaveSizeLimitExceeded(w http.ResponseWriter, r *http.Request, reason error
 	w.Write([]byte(WEAVE_SIZE_LIMIT_EXCEEDED))
 }
 
+func WeaveOverQuota(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(WEAVE_OVER_QUOTA))
+}
+
 // WeaveHandler is a convenient and messy place to capture
 // sync 1.5, and legacy weave specific functionality.
 // TODO will have to implement http.Hijack()